@@ -1,14 +1,20 @@
 package builder
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/dorzheh/deployer/builder/image"
 	"github.com/dorzheh/deployer/deployer"
 	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/progress"
 	ssh "github.com/dorzheh/infra/comm/common"
 	"github.com/dorzheh/infra/comm/sshfs"
 )
@@ -33,20 +39,32 @@ func (b *ImageBuilder) Id() string {
 	return "RemoteImageBuilder"
 }
 
-func (b *ImageBuilder) Run() (deployer.Artifact, error) {
+func (b *ImageBuilder) Run(ctx context.Context) (a deployer.Artifact, err error) {
+	started := time.Now()
+	// the storage configuration used, the path is modified by the image processing
+	storageConfig := *b.ImageConfig
+	// the image is layered on the cached base image (if any)
+	base, err := b.cachedBase(ctx)
+	if err != nil {
+		return nil, utils.FormatError(err)
+	}
 	if err := os.MkdirAll(b.RootfsMp, 0755); err != nil {
 		return nil, utils.FormatError(err)
 	}
 
 	defer os.RemoveAll(b.RootfsMp)
 
-	// create new image artifact
-	img, err := image.New(b.ImageConfig, b.RootfsMp, b.Utils, b.SshfsConfig)
+	img, err := b.newImage(ctx, base)
 	if err != nil {
 		return nil, utils.FormatError(err)
 	}
-	// interrupt handler
-	img.ReleaseOnInterrupt()
+	// remove half-created image on failure
+	defer func() {
+		if err != nil {
+			img.Discard()
+		}
+	}()
+	// the image is released even though the context is cancelled
 	defer func() {
 		img.Cleanup()
 	}()
@@ -56,21 +74,40 @@ func (b *ImageBuilder) Run() (deployer.Artifact, error) {
 		return nil, utils.FormatError(err)
 	}
 	// customize rootfs
+	if b.Filler != nil && !b.Upgrade && base == "" {
+		if err := ctx.Err(); err != nil {
+			return nil, utils.FormatError(err)
+		}
+		if err := customizeRootfs(ctx, b.Filler, b.RootfsMp, 20, 40); err != nil {
+			return nil, utils.FormatError(err)
+		}
+	}
+	if !b.Upgrade && base == "" {
+		if err := img.WriteSystemFiles(); err != nil {
+			return nil, utils.FormatError(err)
+		}
+	}
 	if b.Filler != nil {
-		if err := b.Filler.CustomizeRootfs(b.RootfsMp); err != nil {
+		if err := ctx.Err(); err != nil {
 			return nil, utils.FormatError(err)
 		}
 		// install application.
+		progress.Report(ctx, progress.StageInstallApp, 40)
 		if err := b.Filler.InstallApp(b.RootfsMp); err != nil {
 			return nil, utils.FormatError(err)
 		}
 	}
-	if b.ImageConfig.Bootable {
+	if b.ImageConfig.Bootable && !b.Upgrade && base == "" {
+		progress.Report(ctx, progress.StageBootloader, 70)
 		if err := img.MakeBootable(); err != nil {
 			return nil, utils.FormatError(err)
 		}
 	}
-	if b.Filler != nil {
+	if b.Filler != nil && !b.Upgrade {
+		if err := ctx.Err(); err != nil {
+			return nil, utils.FormatError(err)
+		}
+		progress.Report(ctx, progress.StageHooks, 80)
 		if err := b.Filler.RunHooks(b.RootfsMp); err != nil {
 			return nil, utils.FormatError(err)
 		}
@@ -81,10 +118,128 @@ func (b *ImageBuilder) Run() (deployer.Artifact, error) {
 	if err := img.Convert(); err != nil {
 		return nil, utils.FormatError(err)
 	}
-	return &deployer.CommonArtifact{
+	artifact := &deployer.CommonArtifact{
 		Name: filepath.Base(b.ImageConfig.Path),
 		Path: b.ImageConfig.Path,
 		Type: deployer.ImageArtifact,
+	}
+	if b.SshfsConfig != nil {
+		artifact.SshConfig = b.SshfsConfig.Common
+	}
+	if artifact.Metadata, err = b.metadata(artifact, &storageConfig, started); err != nil {
+		return nil, utils.FormatError(err)
+	}
+	return artifact, nil
+}
+
+// metadata returns digest, size and the build details of the image.
+// The image is signed if the signing key is provided
+func (b *ImageBuilder) metadata(a *deployer.CommonArtifact, storageConfig *image.Disk, started time.Time) (*deployer.ArtifactMetadata, error) {
+	digest, size, err := deployer.ArtifactDigest(a.Path, a.SshConfig)
+	if err != nil {
+		return nil, err
+	}
+	m := &deployer.ArtifactMetadata{
+		SHA256:        hex.EncodeToString(digest),
+		Size:          size,
+		Format:        string(b.ImageConfig.Type),
+		StorageConfig: storageConfig,
+		Started:       started,
+	}
+	if b.SigningKey != "" {
+		if m.Signature, err = deployer.SignArtifact(a.Path, a.SshConfig, b.SigningKey, digest); err != nil {
+			return nil, err
+		}
+	}
+	m.Finished = time.Now()
+	return m, nil
+}
+
+// imageProcessor is implemented by the image backends
+type imageProcessor interface {
+	Parse() error
+	WriteSystemFiles() error
+	MakeBootable() error
+	Cleanup() error
+	Convert() error
+	Discard() error
+}
+
+// newImage creates new image artifact, opens the existing one
+// or creates an overlay of the base image (if any)
+// by the backend chosen by the disk configuration
+func (b *ImageBuilder) newImage(ctx context.Context, base string) (imageProcessor, error) {
+	if base != "" {
+		return image.NewOverlay(ctx, b.ImageConfig, base, b.RootfsMp, b.Utils)
+	}
+	if b.ImageConfig.Backend == image.BackendRootless {
+		if err := b.verifyRootless(); err != nil {
+			return nil, err
+		}
+		return image.NewRootless(ctx, b.ImageConfig, b.RootfsMp)
+	}
+	if b.Upgrade && b.Grow {
+		return image.Grow(ctx, b.ImageConfig, b.RootfsMp, b.Utils, b.SshfsConfig)
+	}
+	if b.Upgrade {
+		return image.Open(ctx, b.ImageConfig, b.RootfsMp, b.Utils, b.SshfsConfig)
+	}
+	return image.New(ctx, b.ImageConfig, b.RootfsMp, b.Utils, b.SshfsConfig)
+}
+
+// verifyRootless verifies the builder is able to use the rootless backend
+func (b *ImageBuilder) verifyRootless() error {
+	if b.SshfsConfig != nil {
+		return errors.New("rootless backend builds local images only")
+	}
+	if b.Upgrade {
+		return errors.New("rootless backend doesn't support upgrade")
+	}
+	return nil
+}
+
+// Plan writes the disk layout and the commands the builder would run
+func (b *ImageBuilder) Plan(w io.Writer) (deployer.Artifact, error) {
+	if b.SshfsConfig != nil {
+		fmt.Fprintf(w, "remote host: %s\n", b.SshfsConfig.Common.Host)
+	}
+	var path, base string
+	var err error
+	if filler, ok := b.cacheableFiller(); ok {
+		if base, err = b.planBase(w, filler); err != nil {
+			return nil, utils.FormatError(err)
+		}
+	}
+	switch {
+	case base != "":
+		path, err = image.PlanOverlay(w, b.ImageConfig, base, b.RootfsMp)
+	case b.ImageConfig.Backend == image.BackendRootless:
+		if err = b.verifyRootless(); err == nil {
+			path, err = image.PlanRootless(w, b.ImageConfig, b.RootfsMp)
+		}
+	case b.Upgrade && b.Grow:
+		path, err = image.PlanGrow(w, b.ImageConfig, b.RootfsMp, b.Utils)
+	case b.Upgrade:
+		path, err = image.PlanOpen(w, b.ImageConfig, b.RootfsMp, b.Utils)
+	default:
+		path, err = image.Plan(w, b.ImageConfig, b.RootfsMp, b.Utils)
+	}
+	if err != nil {
+		return nil, utils.FormatError(err)
+	}
+	if b.Upgrade || base != "" {
+		if b.Filler != nil {
+			fmt.Fprintf(w, "install application at %s (%T)\n", b.RootfsMp, b.Filler)
+		}
+	} else {
+		planFiller(w, b.Filler, b.RootfsMp)
+	}
+	return &deployer.PlannedArtifact{
+		CommonArtifact: deployer.CommonArtifact{
+			Name: filepath.Base(path),
+			Path: path,
+			Type: deployer.ImageArtifact,
+		},
 	}, nil
 }
 
@@ -102,34 +257,58 @@ func (b *MetadataBuilder) Id() string {
 	return "MetadataBuilder"
 }
 
-func (b *MetadataBuilder) Run() (deployer.Artifact, error) {
-	// in case no source template exists apparently we should use the default metadata
-	_, err := os.Stat(b.Source)
+func (b *MetadataBuilder) Run(ctx context.Context) (deployer.Artifact, error) {
+	data, err := b.render()
 	if err != nil {
-		b.Source = b.Dest
+		return nil, utils.FormatError(err)
 	}
 
-	f, err := ioutil.ReadFile(b.Source)
-	if err != nil {
+	progress.Report(ctx, progress.StageMetadata, 0)
+	run := utils.RunFuncWithContext(ctx, b.SshConfig)
+	if _, err := run(fmt.Sprintf("echo \"%s\" > %s", data, b.Dest)); err != nil {
 		return nil, utils.FormatError(err)
 	}
+	return &deployer.CommonArtifact{
+		Name:      filepath.Base(b.Dest),
+		Path:      b.Dest,
+		Type:      deployer.MetadataArtifact,
+		SshConfig: b.SshConfig,
+	}, nil
+}
 
-	data, err := utils.ProcessTemplate(string(f), b.UserData)
+// Plan writes the rendered metadata
+func (b *MetadataBuilder) Plan(w io.Writer) (deployer.Artifact, error) {
+	data, err := b.render()
 	if err != nil {
 		return nil, utils.FormatError(err)
 	}
-
-	run := utils.RunFunc(b.SshConfig)
-	if _, err := run(fmt.Sprintf("echo \"%s\" > %s", data, b.Dest)); err != nil {
+	if _, err := fmt.Fprintf(w, "metadata: %s\n%s\n", b.Dest, data); err != nil {
 		return nil, utils.FormatError(err)
 	}
-	return &deployer.CommonArtifact{
-		Name: filepath.Base(b.Dest),
-		Path: b.Dest,
-		Type: deployer.MetadataArtifact,
+	return &deployer.PlannedArtifact{
+		CommonArtifact: deployer.CommonArtifact{
+			Name: filepath.Base(b.Dest),
+			Path: b.Dest,
+			Type: deployer.MetadataArtifact,
+		},
+		Data: string(data),
 	}, nil
 }
 
+// render processes the metadata template
+func (b *MetadataBuilder) render() ([]byte, error) {
+	// in case no source template exists apparently we should use the default metadata
+	if _, err := os.Stat(b.Source); err != nil {
+		b.Source = b.Dest
+	}
+
+	f, err := ioutil.ReadFile(b.Source)
+	if err != nil {
+		return nil, utils.FormatError(err)
+	}
+	return utils.ProcessTemplate(string(f), b.UserData)
+}
+
 // InstanceBuilder represents properties related to a local instance builder
 // The common usage of InstanceBuiler: running deployer on a cloud instance
 type InstanceBuilder struct {
@@ -140,11 +319,16 @@ func (b *InstanceBuilder) Id() string {
 	return "InstanceBuilder"
 }
 
-func (b *InstanceBuilder) Run() (a deployer.Artifact, err error) {
-	if err = b.Filler.CustomizeRootfs("/"); err != nil {
+func (b *InstanceBuilder) Run(ctx context.Context) (a deployer.Artifact, err error) {
+	if err = customizeRootfs(ctx, b.Filler, "/", 0, 50); err != nil {
+		err = utils.FormatError(err)
+		return
+	}
+	if err = ctx.Err(); err != nil {
 		err = utils.FormatError(err)
 		return
 	}
+	progress.Report(ctx, progress.StageInstallApp, 50)
 	if err = b.Filler.InstallApp("/"); err != nil {
 		err = utils.FormatError(err)
 		return
@@ -152,6 +336,12 @@ func (b *InstanceBuilder) Run() (a deployer.Artifact, err error) {
 	return
 }
 
+// Plan writes the actions the builder would take
+func (b *InstanceBuilder) Plan(w io.Writer) (deployer.Artifact, error) {
+	planFiller(w, b.Filler, "/")
+	return nil, nil
+}
+
 // DirBuilder is intended for building directory backed appliances(LXC,OpenVZ and so forth)
 type DirBuilder struct {
 	// deployer.DirBuilderData represents common data
@@ -169,14 +359,19 @@ func (b *DirBuilder) Id() string {
 	return "RemoteDirBuilder"
 }
 
-func (b *DirBuilder) Run() (a deployer.Artifact, err error) {
+func (b *DirBuilder) Run(ctx context.Context) (a deployer.Artifact, err error) {
 	// customize rootfs
 	if b.Filler != nil {
-		if err = b.Filler.CustomizeRootfs(b.RootfsPath); err != nil {
+		if err = customizeRootfs(ctx, b.Filler, b.RootfsPath, 0, 50); err != nil {
+			err = utils.FormatError(err)
+			return
+		}
+		if err = ctx.Err(); err != nil {
 			err = utils.FormatError(err)
 			return
 		}
 		// install application
+		progress.Report(ctx, progress.StageInstallApp, 50)
 		if err = b.Filler.InstallApp(b.RootfsPath); err != nil {
 			err = utils.FormatError(err)
 			return
@@ -184,3 +379,37 @@ func (b *DirBuilder) Run() (a deployer.Artifact, err error) {
 	}
 	return
 }
+
+// Plan writes the actions the builder would take
+func (b *DirBuilder) Plan(w io.Writer) (deployer.Artifact, error) {
+	if b.SshfsConfig != nil {
+		fmt.Fprintf(w, "remote host: %s\n", b.SshfsConfig.Common.Host)
+	}
+	planFiller(w, b.Filler, b.RootfsPath)
+	return nil, nil
+}
+
+// customizeRootfs customizes the rootfs reporting StageFillRootfs
+// between the given percentages in case the filler reports the progress
+// (see deployer.ProgressFiller)
+func customizeRootfs(ctx context.Context, filler deployer.RootfsFiller, rootfs string, from, to int) error {
+	progress.Report(ctx, progress.StageFillRootfs, from)
+	f, ok := filler.(deployer.ProgressFiller)
+	if !ok {
+		return filler.CustomizeRootfs(rootfs)
+	}
+	last := 0
+	return f.CustomizeRootfsProgress(rootfs, func(part int) {
+		if part > last {
+			last = part
+			progress.Report(ctx, progress.StageFillRootfs, progress.Scale(from, to, part))
+		}
+	})
+}
+
+// planFiller describes the rootfs customization
+func planFiller(w io.Writer, filler deployer.RootfsFiller, rootfs string) {
+	if filler != nil {
+		fmt.Fprintf(w, "customize rootfs and install application at %s (%T)\n", rootfs, filler)
+	}
+}
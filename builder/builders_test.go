@@ -0,0 +1,264 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dorzheh/deployer/builder/image"
+	"github.com/dorzheh/deployer/deployer"
+	"github.com/dorzheh/deployer/utils/progress"
+)
+
+func TestImageBuilderPlan(t *testing.T) {
+	disk := &image.Disk{
+		Path:            "/var/lib/libvirt/images/test.qcow2",
+		Type:            image.StorageTypeQCOW2,
+		SizeMb:          1024,
+		Bootable:        true,
+		BootLoader:      image.BootLoaderGrub,
+		ActivePartition: 1,
+		Partitions: []*image.Partition{
+			{Sequence: 1, Type: 83, SizeMb: 800, Label: "SLASH", MountPoint: "/", FileSystem: "ext4"},
+			{Sequence: 2, Type: 82, SizeMb: -1, SizePercents: -2, Label: "SWAP", MountPoint: "SWAP", FileSystem: "swap"},
+		},
+	}
+	b := &ImageBuilder{
+		ImageBuilderData: &deployer.ImageBuilderData{ImageConfig: disk, RootfsMp: "/tmp/rootfs"},
+		Utils:            &image.Utils{Kpartx: "kpartx"},
+	}
+
+	buf := new(bytes.Buffer)
+	a, err := b.Plan(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.GetPath() != disk.Path || a.GetType() != deployer.ImageArtifact {
+		t.Fatalf("unexpected artifact %s", a)
+	}
+	if disk.Path != "/var/lib/libvirt/images/test.qcow2" {
+		t.Fatalf("the disk configuration is modified: %s", disk.Path)
+	}
+	for _, cmd := range []string{
+		"dd if=/dev/zero of=/var/lib/libvirt/images/test.raw count=1 bs=1 seek=1024M",
+		"# write msdos partition table to /var/lib/libvirt/images/test.raw",
+		"#   partition 1: sectors 2048-1640447, type 0x83, active",
+		"#   partition 2: sectors 1640448-2097151, type 0x82",
+		"mkfs -t ext4 -L SLASH  /dev/loopNp1",
+		"mount /dev/loopNp1 /tmp/rootfs",
+		"mkswap -L SWAP /dev/loopNp2",
+		"# add to /etc/fstab: LABEL=SLASH / ext4 defaults 0 1",
+		"# add to /etc/fstab: LABEL=SWAP none swap sw 0 0",
+		"qemu-img convert -f raw -O qcow2 /var/lib/libvirt/images/test.raw /var/lib/libvirt/images/test.qcow2",
+	} {
+		if !strings.Contains(buf.String(), cmd+"\n") {
+			t.Fatalf("command %q not found in the plan:\n%s", cmd, buf.String())
+		}
+	}
+
+	// user-supplied fdisk script is still honoured
+	disk.FdiskCmd = `n\np\n1\n\n+800M\nn\np\n2\n\n\nt\n2\n82\na\n1\nw\n`
+	buf.Reset()
+	if _, err := b.Plan(buf); err != nil {
+		t.Fatal(err)
+	}
+	cmd := `echo -e  "n\np\n1\n\n+800M\nn\np\n2\n\n\nt\n2\n82\na\n1\nw\n"|fdisk /dev/loopN`
+	if !strings.Contains(buf.String(), cmd+"\n") || strings.Contains(buf.String(), "partition table") {
+		t.Fatalf("unexpected plan:\n%s", buf.String())
+	}
+}
+
+func TestImageBuilderPlanGPT(t *testing.T) {
+	disk := &image.Disk{
+		Path:       "/var/lib/libvirt/images/test.raw",
+		Type:       image.StorageTypeRAW,
+		SizeMb:     4096,
+		PartTable:  image.PartTableGPT,
+		Bootable:   true,
+		BootLoader: image.BootLoaderGrubEfi,
+		Partitions: []*image.Partition{
+			{Sequence: 1, TypeGUID: image.GUIDEfiSystem, Name: "EFI System", SizeMb: 256, Label: "ESP", MountPoint: "/boot/efi", FileSystem: "vfat"},
+			{Sequence: 2, Type: 82, SizeMb: 512, Label: "SWAP", MountPoint: "SWAP", FileSystem: "swap"},
+			{Sequence: 3, Name: "root", SizeMb: -1, SizePercents: -2, Label: "SLASH", MountPoint: "/", FileSystem: "ext4"},
+		},
+	}
+	b := &ImageBuilder{
+		ImageBuilderData: &deployer.ImageBuilderData{ImageConfig: disk, RootfsMp: "/tmp/rootfs"},
+		Utils:            &image.Utils{Kpartx: "kpartx"},
+	}
+
+	buf := new(bytes.Buffer)
+	a, err := b.Plan(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.GetPath() != disk.Path {
+		t.Fatalf("unexpected artifact %s", a)
+	}
+	for _, cmd := range []string{
+		"dd if=/dev/zero of=/var/lib/libvirt/images/test.raw count=1 bs=1 seek=4096M",
+		"# write gpt partition table to /var/lib/libvirt/images/test.raw",
+		"#   partition 1: sectors 2048-526335, type C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+		"#   partition 2: sectors 526336-1574911, type 0657FD6D-A4AB-43C4-84E5-0933C84B4F4F",
+		"#   partition 3: sectors 1574912-8388574, type 0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+		"mkfs -t ext4 -L SLASH  /dev/loopNp3",
+		"mount /dev/loopNp3 /tmp/rootfs",
+		"mkfs -t vfat -n ESP  /dev/loopNp1",
+		"mount /dev/loopNp1 /tmp/rootfs/boot/efi",
+		"mkswap -L SWAP /dev/loopNp2",
+		"grub-install --target=x86_64-efi --efi-directory=/boot/efi --removable --no-nvram",
+	} {
+		if !strings.Contains(buf.String(), cmd) {
+			t.Fatalf("command %q not found in the plan:\n%s", cmd, buf.String())
+		}
+	}
+
+	// UEFI boot requires the EFI system partition
+	disk.Partitions = disk.Partitions[1:]
+	if _, err := b.Plan(new(bytes.Buffer)); err == nil {
+		t.Fatal("expected error for missing EFI system partition")
+	}
+}
+
+func TestImageBuilderPlanFormats(t *testing.T) {
+	tests := []struct {
+		storageType image.StorageType
+		path        string
+		convert     string
+	}{
+		{image.StorageTypeVHD, "/images/test.vhd", "qemu-img convert -f raw -O vpc -o subformat=fixed,force_size /images/test.raw /images/test.vhd"},
+		{image.StorageTypeVHDX, "/images/test.vhdx", "qemu-img convert -f raw -O vhdx /images/test.raw /images/test.vhdx"},
+		{image.StorageTypeQCOW2Compressed, "/images/test.qcow2", "qemu-img convert -f raw -O qcow2 -c -o cluster_size=2M /images/test.raw /images/test.qcow2"},
+	}
+	for _, test := range tests {
+		disk := &image.Disk{Path: test.path, Type: test.storageType, SizeMb: 1024, ClusterSize: "2M"}
+		b := &ImageBuilder{
+			ImageBuilderData: &deployer.ImageBuilderData{ImageConfig: disk, RootfsMp: "/tmp/rootfs"},
+			Utils:            &image.Utils{Kpartx: "kpartx"},
+		}
+		buf := new(bytes.Buffer)
+		a, err := b.Plan(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.GetPath() != test.path || !strings.Contains(buf.String(), test.convert+"\n") {
+			t.Fatalf("%s: unexpected plan of %s:\n%s", test.storageType, a.GetPath(), buf.String())
+		}
+	}
+}
+
+func TestImageBuilderPlanRootless(t *testing.T) {
+	disk := &image.Disk{
+		Path:    "/images/test.qcow2",
+		Type:    image.StorageTypeQCOW2,
+		SizeMb:  1024,
+		Backend: image.BackendRootless,
+		Partitions: []*image.Partition{
+			{Type: 83, SizeMb: 800, Label: "SLASH", MountPoint: "/", FileSystem: "ext4"},
+			{Type: 83, SizeMb: -1, SizePercents: -2, Label: "DATA", MountPoint: "/data", FileSystem: "ext4"},
+		},
+	}
+	b := &ImageBuilder{
+		ImageBuilderData: &deployer.ImageBuilderData{ImageConfig: disk, RootfsMp: "/tmp/rootfs"},
+	}
+
+	buf := new(bytes.Buffer)
+	a, err := b.Plan(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.GetPath() != disk.Path {
+		t.Fatalf("unexpected artifact %s", a)
+	}
+	plan := buf.String()
+	data := strings.Index(plan, "mke2fs -q -F -t ext4 -L DATA -d /tmp/rootfs/data  /images/test.raw.p2")
+	slash := strings.Index(plan, "mke2fs -q -F -t ext4 -L SLASH -d /tmp/rootfs  /images/test.raw.p1")
+	if data < 0 || slash < data {
+		t.Fatalf("nested file system is expected to be created first:\n%s", plan)
+	}
+	if !strings.Contains(plan, "dd if=/images/test.raw.p2 of=/images/test.raw bs=1M seek=801 conv=notrunc,sparse") {
+		t.Fatalf("unexpected partition offset:\n%s", plan)
+	}
+	if strings.Contains(plan, "losetup") || strings.Contains(plan, "kpartx") {
+		t.Fatalf("loop devices are not expected:\n%s", plan)
+	}
+
+	b.Upgrade = true
+	if _, err := b.Plan(new(bytes.Buffer)); err == nil {
+		t.Fatal("expected error for upgrade by the rootless backend")
+	}
+}
+
+func TestMetadataBuilderPlan(t *testing.T) {
+	f, err := ioutil.TempFile("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("<domain><name>{{.Name}}</name></domain>")
+	f.Close()
+
+	b := &MetadataBuilder{
+		MetadataBuilderData: &deployer.MetadataBuilderData{
+			Source:   f.Name(),
+			Dest:     "/tmp/nonexistent/test.xml",
+			UserData: struct{ Name string }{"test"},
+		},
+	}
+	buf := new(bytes.Buffer)
+	a, err := b.Plan(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	planned, ok := a.(*deployer.PlannedArtifact)
+	if !ok {
+		t.Fatalf("expected *deployer.PlannedArtifact, got %T", a)
+	}
+	if planned.Data != "<domain><name>test</name></domain>" {
+		t.Fatalf("unexpected metadata %s", planned.Data)
+	}
+	if !strings.Contains(buf.String(), planned.Data) {
+		t.Fatalf("the rendered metadata not found in the plan:\n%s", buf.String())
+	}
+}
+
+// progressFiller reports the given parts of the rootfs customization
+type progressFiller struct {
+	cacheFiller
+	parts []int
+}
+
+func (f *progressFiller) CustomizeRootfsProgress(rootfs string, report func(int)) error {
+	for _, part := range f.parts {
+		report(part)
+	}
+	return nil
+}
+
+func TestCustomizeRootfsProgress(t *testing.T) {
+	for _, test := range []struct {
+		filler   deployer.RootfsFiller
+		expected []int
+	}{
+		{&cacheFiller{}, []int{20}},
+		// the progress never goes back
+		{&progressFiller{parts: []int{50, 25, 100}}, []int{20, 30, 40}},
+	} {
+		events := make(chan *progress.Event, 10)
+		if err := customizeRootfs(progress.WithEvents(context.Background(), events), test.filler, "/tmp/rootfs", 20, 40); err != nil {
+			t.Fatal(err)
+		}
+		close(events)
+		var percents []int
+		for e := range events {
+			percents = append(percents, e.Percent)
+		}
+		if !reflect.DeepEqual(percents, test.expected) {
+			t.Fatalf("%T: unexpected progress %v", test.filler, percents)
+		}
+	}
+}
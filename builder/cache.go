@@ -0,0 +1,266 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dorzheh/deployer/builder/image"
+	"github.com/dorzheh/deployer/deployer"
+	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/progress"
+)
+
+// cacheableFiller returns the filler if the base image is cached.
+// Only local images built by the loop backend are cached.
+// The images having LUKS partitions are never cached:
+// the appliances would share the master key
+// and the temporary key is gone once the base image is built
+func (b *ImageBuilder) cacheableFiller() (deployer.CacheableFiller, bool) {
+	if b.CacheDir == "" || b.Upgrade || b.SshfsConfig != nil || b.ImageConfig.Backend == image.BackendRootless || encrypted(b.ImageConfig) {
+		return nil, false
+	}
+	f, ok := b.Filler.(deployer.CacheableFiller)
+	return f, ok
+}
+
+// encrypted returns true if any partition of the disk is LUKS encrypted
+func encrypted(config *image.Disk) bool {
+	for _, part := range config.Partitions {
+		if part.LUKS != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// basePath returns path to the cached base image
+func (b *ImageBuilder) basePath(filler deployer.CacheableFiller) (string, error) {
+	key, err := cacheKey(b.ImageConfig, filler)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(b.CacheDir, key+".qcow2"), nil
+}
+
+// cachedBase returns path to the base image the image is built on
+// or an empty string if the base image isn't cached.
+// The base image is built on a cache miss
+func (b *ImageBuilder) cachedBase(ctx context.Context) (string, error) {
+	filler, ok := b.cacheableFiller()
+	if !ok {
+		return "", nil
+	}
+	path, err := b.basePath(filler)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(b.CacheDir, 0755); err != nil {
+		return "", err
+	}
+	// the base image is built once by the concurrent builders
+	unlock, err := lockBase(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := b.buildBase(ctx, filler, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// lockBase takes the exclusive lock on the base image.
+// Waits for the lock until the context is done.
+// Returns a function releasing the lock
+func lockBase(ctx context.Context, path string) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, utils.FormatError(err)
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return func() { f.Close() }, nil
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			f.Close()
+			return nil, utils.FormatError(err)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// tempBasePath returns the temporary path the base image is built at
+func tempBasePath(path, suffix string) string {
+	return strings.TrimSuffix(path, ".qcow2") + ".tmp" + suffix + ".qcow2"
+}
+
+// buildBase builds the base image: partitions, file systems,
+// customized rootfs and the bootloader.
+// The image is built under a unique temporary name so that an interrupted
+// build never leaves a corrupted base image in the cache
+func (b *ImageBuilder) buildBase(ctx context.Context, filler deployer.CacheableFiller, path string) (err error) {
+	// the empty file reserves the temporary name
+	tmp, err := ioutil.TempFile(filepath.Dir(path), strings.TrimSuffix(filepath.Base(path), ".qcow2")+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	config := baseConfig(b.ImageConfig)
+	config.Path = tmp.Name() + ".qcow2"
+	if err := os.MkdirAll(b.RootfsMp, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(b.RootfsMp)
+
+	img, err := image.New(ctx, config, b.RootfsMp, b.Utils, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			img.Discard()
+		}
+	}()
+	defer func() {
+		img.Cleanup()
+	}()
+
+	if err := img.Parse(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := customizeRootfs(ctx, filler, b.RootfsMp, 20, 30); err != nil {
+		return err
+	}
+	if err := img.WriteSystemFiles(); err != nil {
+		return err
+	}
+	if config.Bootable {
+		progress.Report(ctx, progress.StageBootloader, 30)
+		if err := img.MakeBootable(); err != nil {
+			return err
+		}
+	}
+	if err := img.Cleanup(); err != nil {
+		return err
+	}
+	if err := img.Convert(); err != nil {
+		return err
+	}
+	return os.Rename(config.Path, path)
+}
+
+// planBase writes the commands building the base image on a cache miss.
+// Returns path to the base image
+func (b *ImageBuilder) planBase(w io.Writer, filler deployer.CacheableFiller) (string, error) {
+	path, err := b.basePath(filler)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		fmt.Fprintf(w, "base image: %s (cached)\n", path)
+		return path, nil
+	}
+	fmt.Fprintf(w, "base image: %s (not cached)\n", path)
+	config := baseConfig(b.ImageConfig)
+	config.Path = tempBasePath(path, "XXXXXX")
+	if _, err := image.Plan(w, config, b.RootfsMp, b.Utils); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(w, "customize rootfs at %s (%T)\n", b.RootfsMp, filler)
+	fmt.Fprintf(w, "mv %s %s\n", config.Path, path)
+	return path, nil
+}
+
+// baseConfig returns the disk configuration of the base image
+func baseConfig(config *image.Disk) *image.Disk {
+	c := *config
+	c.Type = image.StorageTypeQCOW2
+	c.ClusterSize = ""
+	return &c
+}
+
+// cacheKey returns the content address of the base image.
+// The key covers the storage configuration, the filler
+// and the content of the inputs and the data the rootfs customization
+// depends on. Path and format of the image don't affect the base image
+func cacheKey(config *image.Disk, filler deployer.CacheableFiller) (string, error) {
+	c := baseConfig(config)
+	c.Path = ""
+	c.Description = ""
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", utils.FormatError(err)
+	}
+	fillerData, err := json.Marshal(filler.CacheData())
+	if err != nil {
+		return "", utils.FormatError(err)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%T\n%s\n", data, filler, fillerData)
+	for _, input := range filler.CacheInputs() {
+		if err := hashInput(h, input); err != nil {
+			return "", utils.FormatError(err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashInput hashes names, modes and content of the file
+// or the directory tree. A missing input is hashed as such
+func hashInput(h hash.Hash, input string) error {
+	if _, err := os.Lstat(input); os.IsNotExist(err) {
+		fmt.Fprintf(h, "%s: missing\n", input)
+		return nil
+	}
+	return filepath.Walk(input, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s: %v\n", path, fi.Mode())
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "-> %s\n", target)
+		case fi.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
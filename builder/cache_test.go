@@ -0,0 +1,201 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dorzheh/deployer/builder/image"
+	"github.com/dorzheh/deployer/deployer"
+)
+
+// cacheFiller is a cacheable filler doing nothing
+type cacheFiller struct {
+	inputs []string
+	data   interface{}
+}
+
+func (f *cacheFiller) CustomizeRootfs(string) error { return nil }
+func (f *cacheFiller) InstallApp(string) error      { return nil }
+func (f *cacheFiller) RunHooks(string) error        { return nil }
+func (f *cacheFiller) CacheInputs() []string        { return f.inputs }
+func (f *cacheFiller) CacheData() interface{}       { return f.data }
+
+func cacheDisk() *image.Disk {
+	return &image.Disk{
+		Path:   "/var/lib/libvirt/images/test.qcow2",
+		Type:   image.StorageTypeQCOW2,
+		SizeMb: 1024,
+		Partitions: []*image.Partition{
+			{Sequence: 1, Type: 83, SizeMb: 800, Label: "SLASH", MountPoint: "/", FileSystem: "ext4"},
+			{Sequence: 2, Type: 82, SizeMb: -1, SizePercents: -2, Label: "SWAP", MountPoint: "SWAP", FileSystem: "swap"},
+		},
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "rootfs.squashfs")
+	if err := ioutil.WriteFile(archive, []byte("rootfs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configDir := filepath.Join(dir, "config")
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(configDir, "files.xml"), []byte("<files/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	filler := &cacheFiller{inputs: []string{archive, configDir, filepath.Join(dir, "missing")}}
+
+	key, err := cacheKey(cacheDisk(), filler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// path and format of the image don't affect the base image
+	disk := cacheDisk()
+	disk.Path = "/tmp/other.vmdk"
+	disk.Type = image.StorageTypeVMDK
+	if k, err := cacheKey(disk, filler); err != nil || k != key {
+		t.Fatalf("unexpected key %s [%v]", k, err)
+	}
+
+	disk.Partitions[0].FileSystem = "ext3"
+	if k, _ := cacheKey(disk, filler); k == key {
+		t.Fatal("the key doesn't depend on the storage configuration")
+	}
+	if err := ioutil.WriteFile(filepath.Join(configDir, "files.xml"), []byte("<files></files>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := cacheKey(cacheDisk(), filler); k == key {
+		t.Fatal("the key doesn't depend on the customization XMLs")
+	}
+
+	key, _ = cacheKey(cacheDisk(), filler)
+	filler.data = map[string]string{"name": "va1"}
+	k1, err := cacheKey(cacheDisk(), filler)
+	if err != nil || k1 == key {
+		t.Fatalf("the key doesn't depend on the data [%v]", err)
+	}
+	filler.data = map[string]string{"name": "va2"}
+	if k2, _ := cacheKey(cacheDisk(), filler); k2 == k1 {
+		t.Fatal("the appliances rendered with different data share the key")
+	}
+}
+
+func TestImageBuilderPlanCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk := cacheDisk()
+	b := &ImageBuilder{
+		ImageBuilderData: &deployer.ImageBuilderData{
+			ImageConfig: disk,
+			RootfsMp:    "/tmp/rootfs",
+			Filler:      &cacheFiller{},
+			CacheDir:    dir,
+		},
+		Utils: &image.Utils{Kpartx: "kpartx"},
+	}
+	key, err := cacheKey(disk, b.Filler.(deployer.CacheableFiller))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, key+".qcow2")
+
+	buf := new(bytes.Buffer)
+	if _, err := b.Plan(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{
+		"base image: " + base + " (not cached)",
+		"qemu-img convert -f raw -O qcow2 " + filepath.Join(dir, key+".tmpXXXXXX.raw") + " " + filepath.Join(dir, key+".tmpXXXXXX.qcow2"),
+		"mv " + filepath.Join(dir, key+".tmpXXXXXX.qcow2") + " " + base,
+		"qemu-img create -f qcow2 -F qcow2 -b " + base + " /var/lib/libvirt/images/test.overlay.qcow2",
+	} {
+		if !strings.Contains(buf.String(), cmd+"\n") {
+			t.Fatalf("command %q not found in the plan:\n%s", cmd, buf.String())
+		}
+	}
+
+	if err := ioutil.WriteFile(base, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	a, err := b.Plan(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.GetPath() != disk.Path {
+		t.Fatalf("unexpected artifact %s", a.GetPath())
+	}
+	for _, cmd := range []string{
+		"base image: " + base + " (cached)",
+		"qemu-nbd --connect=/dev/nbdN -f qcow2 /var/lib/libvirt/images/test.overlay.qcow2",
+		"mount /dev/nbdNp1 /tmp/rootfs",
+		"qemu-img convert -f qcow2 -O qcow2 /var/lib/libvirt/images/test.overlay.qcow2 /var/lib/libvirt/images/test.qcow2",
+		"install application at /tmp/rootfs (*builder.cacheFiller)",
+	} {
+		if !strings.Contains(buf.String(), cmd+"\n") {
+			t.Fatalf("command %q not found in the plan:\n%s", cmd, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "mkfs") {
+		t.Fatalf("the cached base image is rebuilt:\n%s", buf.String())
+	}
+}
+
+func TestLUKSNotCached(t *testing.T) {
+	b := &ImageBuilder{
+		ImageBuilderData: &deployer.ImageBuilderData{
+			ImageConfig: cacheDisk(),
+			Filler:      &cacheFiller{},
+			CacheDir:    "/var/cache/deployer",
+		},
+	}
+	if _, ok := b.cacheableFiller(); !ok {
+		t.Fatal("the base image is expected to be cached")
+	}
+	b.ImageConfig.Partitions[0].LUKS = &image.LUKS{Name: "slash", HostKeyFile: "/root/slash.key"}
+	if _, ok := b.cacheableFiller(); ok {
+		t.Fatal("the base image having LUKS partition is cached")
+	}
+}
+
+func TestLockBase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "key.qcow2")
+
+	unlock, err := lockBase(context.Background(), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the concurrent builder waits for the lock
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if _, err := lockBase(ctx, base); err != context.DeadlineExceeded {
+		t.Fatalf("the lock is taken, unexpected error %v", err)
+	}
+	unlock()
+	unlock, err = lockBase(context.Background(), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
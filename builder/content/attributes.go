@@ -0,0 +1,145 @@
+// Responsible for the metadata of the injected items
+
+package content
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// selinuxXattr keeps the SELinux context of the file
+const selinuxXattr = "security.selinux"
+
+// FileMode represents the permissions configured by the octal number (0755, 4755)
+type FileMode uint32
+
+// UnmarshalText parses the octal number
+func (m *FileMode) UnmarshalText(text []byte) error {
+	str := strings.TrimSpace(string(text))
+	if str == "" {
+		*m = 0
+		return nil
+	}
+	mode, err := strconv.ParseUint(str, 8, 32)
+	if err != nil || mode > 07777 {
+		return fmt.Errorf("invalid permissions %q", str)
+	}
+	*m = FileMode(mode)
+	return nil
+}
+
+// osMode converts the permissions to os.FileMode
+func (m FileMode) osMode() os.FileMode {
+	mode := os.FileMode(m) & os.ModePerm
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// Xattr represents the extended attribute of the item
+type Xattr struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// setAttributes sets the owner, the permissions and the extended
+// attributes of the item
+func setAttributes(path string, item InjectItem) error {
+	if err := os.Lchown(path, item.UID, item.GID); err != nil {
+		return err
+	}
+	// chown clears setuid and setgid, therefore chmod follows
+	if item.Type != ITEM_TYPE_LINK && item.Permissions != 0 {
+		if err := os.Chmod(path, item.Permissions.osMode()); err != nil {
+			return err
+		}
+	}
+	for _, x := range item.itemXattrs() {
+		if err := lsetxattr(path, x.Name, []byte(x.Value)); err != nil {
+			return fmt.Errorf("setting %s of %s: %v", x.Name, path, err)
+		}
+	}
+	return nil
+}
+
+// itemXattrs returns the extended attributes including the SELinux context
+func (item InjectItem) itemXattrs() []Xattr {
+	if item.SELinuxContext == "" {
+		return item.Xattrs
+	}
+	return append(item.Xattrs[:len(item.Xattrs):len(item.Xattrs)], Xattr{selinuxXattr, item.SELinuxContext})
+}
+
+// verifyItems reports the injected items which final metadata
+// differs from the configuration
+func verifyItems(items []InjectItem, pathToSlash string) error {
+	var diffs []string
+	for _, item := range items {
+		if item.Action == ACTION_REMOVE {
+			continue
+		}
+		name := filepath.Join(item.Location, item.Name)
+		for _, diff := range verifyItem(filepath.Join(pathToSlash, name), item) {
+			diffs = append(diffs, name+": "+diff)
+		}
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("injected items differ from the configuration: %s", strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+func verifyItem(path string, item InjectItem) []string {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	switch item.Type {
+	case ITEM_TYPE_FILE:
+		if !info.Mode().IsRegular() {
+			return []string{"not a regular file"}
+		}
+	case ITEM_TYPE_DIR:
+		if !info.IsDir() {
+			return []string{"not a directory"}
+		}
+	case ITEM_TYPE_LINK:
+		if info.Mode()&os.ModeSymlink == 0 {
+			return []string{"not a symlink"}
+		}
+	}
+
+	var diffs []string
+	if item.Type == ITEM_TYPE_LINK {
+		if target, err := os.Readlink(path); err != nil || target != item.BkpName {
+			diffs = append(diffs, fmt.Sprintf("link to %q, expected %q", target, item.BkpName))
+		}
+	} else if item.Permissions != 0 {
+		mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if mode != item.Permissions.osMode() {
+			diffs = append(diffs, fmt.Sprintf("permissions %v, expected %v", mode, item.Permissions.osMode()))
+		}
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && (int(st.Uid) != item.UID || int(st.Gid) != item.GID) {
+		diffs = append(diffs, fmt.Sprintf("owner %d:%d, expected %d:%d", st.Uid, st.Gid, item.UID, item.GID))
+	}
+	for _, x := range item.itemXattrs() {
+		value, err := lgetxattr(path, x.Name)
+		// the SELinux context is usually NUL terminated
+		if err != nil || strings.TrimRight(string(value), "\x00") != x.Value {
+			diffs = append(diffs, fmt.Sprintf("%s %q, expected %q", x.Name, value, x.Value))
+		}
+	}
+	return diffs
+}
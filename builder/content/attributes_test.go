@@ -0,0 +1,134 @@
+package content
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestFileMode(t *testing.T) {
+	for text, expected := range map[string]os.FileMode{
+		"0600": 0600,
+		"755":  0755,
+		"4755": 0755 | os.ModeSetuid,
+		"1777": 0777 | os.ModeSticky,
+		"":     0,
+	} {
+		var m FileMode
+		if err := m.UnmarshalText([]byte(text)); err != nil || m.osMode() != expected {
+			t.Fatalf("%q: unexpected mode %v [%v]", text, m.osMode(), err)
+		}
+	}
+	for _, text := range []string{"0999", "rwx", "77777"} {
+		var m FileMode
+		if err := m.UnmarshalText([]byte(text)); err == nil {
+			t.Fatalf("%q: expected error", text)
+		}
+	}
+}
+
+func TestInjectAttributes(t *testing.T) {
+	slash := fakeRootfs(t, map[string]string{"usr/lib/app/app.conf": "app\n"})
+	defer os.RemoveAll(slash)
+	configDir := fakeRootfs(t, map[string]string{
+		"inject_items.xml": `<items>
+	<selinux_relabel>true</selinux_relabel>
+	<item>
+		<name>secret</name>
+		<action>upload</action>
+		<type>file</type>
+		<location>/etc</location>
+		<permissions>0600</permissions>
+		<owner_id>1000</owner_id>
+		<group_id>1000</group_id>
+		<xattr name="user.origin">deployer</xattr>
+	</item>
+	<item>
+		<name>helper</name>
+		<action>create</action>
+		<type>file</type>
+		<location>/usr/bin</location>
+		<permissions>4755</permissions>
+		<owner_id>1000</owner_id>
+		<group_id>1000</group_id>
+	</item>
+	<item>
+		<name>data</name>
+		<action>create</action>
+		<type>directory</type>
+		<location>/var/lib</location>
+		<permissions>0750</permissions>
+		<owner_id>1000</owner_id>
+		<group_id>1000</group_id>
+	</item>
+	<item>
+		<name>app.conf</name>
+		<bkp_name>../usr/lib/app/app.conf</bkp_name>
+		<action>create</action>
+		<type>link</type>
+		<location>/etc</location>
+	</item>
+</items>`,
+		"items/secret": "secret\n",
+	})
+	defer os.RemoveAll(configDir)
+
+	if err := Customize(slash, configDir); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]os.FileMode{
+		"etc/secret":     0600,
+		"usr/bin/helper": 0755 | os.ModeSetuid,
+		"var/lib/data":   0750 | os.ModeDir,
+	} {
+		info, err := os.Lstat(filepath.Join(slash, path))
+		if err != nil || info.Mode() != expected || info.Sys().(*syscall.Stat_t).Uid != 1000 {
+			t.Fatalf("%s: unexpected metadata %v [%v]", path, info.Mode(), err)
+		}
+	}
+	// the parent directories keep the owner
+	if info, _ := os.Stat(filepath.Join(slash, "etc")); info.Sys().(*syscall.Stat_t).Uid != 0 {
+		t.Fatal("parent directory is chowned")
+	}
+	if value, err := lgetxattr(filepath.Join(slash, "etc/secret"), "user.origin"); err != nil || string(value) != "deployer" {
+		t.Fatalf("unexpected xattr %q [%v]", value, err)
+	}
+	if _, err := os.Stat(filepath.Join(slash, ".autorelabel")); err != nil {
+		t.Fatal("relabel marker isn't created")
+	}
+
+	// the link target must exist inside the rootfs
+	os.Remove(filepath.Join(slash, "usr/lib/app/app.conf"))
+	if err := Customize(slash, configDir); err == nil {
+		t.Fatal("link target not found, expected error")
+	}
+}
+
+func TestVerifyItems(t *testing.T) {
+	slash := fakeRootfs(t, map[string]string{"etc/secret": "secret\n"})
+	defer os.RemoveAll(slash)
+	item := InjectItem{Name: "secret", Action: ACTION_UPLOAD, Type: ITEM_TYPE_FILE, Location: "/etc",
+		Permissions: 0600, Xattrs: []Xattr{{"user.origin", "deployer"}}}
+	if err := verifyItems([]InjectItem{item}, slash); err == nil ||
+		!strings.Contains(err.Error(), "etc/secret: permissions -rw-r--r--, expected -rw-------") ||
+		!strings.Contains(err.Error(), "user.origin") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := setAttributes(filepath.Join(slash, "etc/secret"), item); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyItems([]InjectItem{item}, slash); err != nil {
+		t.Fatal(err)
+	}
+	item.Type = ITEM_TYPE_DIR
+	if err := verifyItems([]InjectItem{item}, slash); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	item = InjectItem{SELinuxContext: "system_u:object_r:etc_t:s0"}
+	if x := item.itemXattrs(); len(x) != 1 || x[0].Name != "security.selinux" {
+		t.Fatalf("unexpected xattrs %v", x)
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strings"
 
 	"github.com/dorzheh/deployer/utils"
 	"github.com/dorzheh/infra/utils/ioutils"
@@ -21,31 +23,55 @@ const SWAP_LABEL = "SWAP"
 const SLASH = "/"
 
 const (
-	ACTION_CREATE  = "create"
-	ACTION_UPLOAD  = "upload"
-	ACTION_REMOVE  = "remove"
-	ACTION_START   = "start"
-	ACTION_STOP    = "stop"
-	ACTION_RESTART = "restart"
-	ACTION_RELOAD  = "reload"
-	ACTION_APPEND  = "append"
-	ACTION_REPLACE = "replace"
-	ACTION_INSTALL = "install"
+	ACTION_CREATE        = "create"
+	ACTION_UPLOAD        = "upload"
+	ACTION_REMOVE        = "remove"
+	ACTION_START         = "start"
+	ACTION_STOP          = "stop"
+	ACTION_RESTART       = "restart"
+	ACTION_RELOAD        = "reload"
+	ACTION_APPEND        = "append"
+	ACTION_REPLACE       = "replace"
+	ACTION_INSTALL       = "install"
+	ACTION_TEMPLATE      = "template"
+	ACTION_ENSURE_LINE   = "ensure_line"
+	ACTION_ENSURE_ABSENT = "ensure_absent"
+	ACTION_BLOCK         = "block"
+	ACTION_SET           = "set"
+	ACTION_UNSET         = "unset"
 )
 
 const (
-	SVC_STATUS_ON  = "on"
-	SVC_STATUS_OFF = "off"
+	FORMAT_INI       = "ini"
+	FORMAT_SYSCONFIG = "sysconfig"
+	FORMAT_YAML      = "yaml"
+	FORMAT_JSON      = "json"
+)
+
+const (
+	SVC_STATUS_ON   = "on"
+	SVC_STATUS_OFF  = "off"
+	SVC_STATUS_MASK = "mask"
 )
 
 const (
 	SVC_TYPE_SYSV    = "sysv"
 	SVC_TYPE_UPSTART = "upstart"
+	SVC_TYPE_SYSTEMD = "systemd"
 )
 
 const (
 	PKG_TYPE_RPM = "rpm"
 	PKG_TYPE_DEB = "deb"
+	PKG_TYPE_APK = "apk"
+)
+
+const (
+	PKG_MANAGER_YUM    = "yum"
+	PKG_MANAGER_DNF    = "dnf"
+	PKG_MANAGER_ZYPPER = "zypper"
+	PKG_MANAGER_APT    = "apt-get"
+	PKG_MANAGER_APK    = "apk"
 )
 
 const (
@@ -67,20 +93,29 @@ const (
 
 // Represents Item to inject
 type InjectItem struct {
-	Name        string      `xml:"name"`
-	BkpName     string      `xml:"bkp_name"`
-	Action      string      `xml:"action"`
-	Type        string      `xml:"type"`
-	Location    string      `xml:"location"`
-	Permissions os.FileMode `xml:"permissions"`
-	UID         int         `xml:"owner_id"`
-	GID         int         `xml:"group_id"`
+	Name        string   `xml:"name"`
+	BkpName     string   `xml:"bkp_name"`
+	Action      string   `xml:"action"`
+	Type        string   `xml:"type"`
+	Location    string   `xml:"location"`
+	Permissions FileMode `xml:"permissions"`
+	UID         int      `xml:"owner_id"`
+	GID         int      `xml:"group_id"`
+
+	// extended attributes (optional)
+	Xattrs []Xattr `xml:"xattr"`
+
+	// SELinux context (optional), system_u:object_r:etc_t:s0
+	SELinuxContext string `xml:"selinux_context"`
 }
 
 // Represents a slice of Items for injection
 type InjectItems struct {
 	XMLName  xml.Name     `xml:"items"`
 	InjItems []InjectItem `xml:"item"`
+
+	// the rootfs is relabeled on the first boot
+	SELinuxRelabel bool `xml:"selinux_relabel"`
 }
 
 // Represents services
@@ -96,6 +131,9 @@ type Service struct {
 type Services struct {
 	XMLName xml.Name  `xml:"services"`
 	Srvcs   []Service `xml:"service"`
+
+	// systemd target the rootfs boots to (optional)
+	DefaultTarget string `xml:"default_target"`
 }
 
 // Represents packages
@@ -104,6 +142,15 @@ type Package struct {
 	Type   string `xml:"type"`
 	Action string `xml:"action"`
 	Chroot bool   `xml:"chroot"`
+
+	// package manager (optional, yum for rpm, apt-get for deb)
+	Manager string `xml:"manager"`
+
+	// local package file to install (optional)
+	File string `xml:"file"`
+
+	// local repository the package is installed from (optional)
+	Repo string `xml:"repo"`
 }
 
 // Represents a slice of packages
@@ -119,6 +166,19 @@ type FileContent struct {
 	Action     string `xml:"action"`
 	OldPattern string `xml:"old_pattern"`
 	NewPattern string `xml:"new_pattern"`
+
+	// the file is created if missing
+	Create bool `xml:"create"`
+
+	// names the managed block (block action)
+	Marker string `xml:"marker"`
+
+	// the key to set or unset in the file of the format
+	// (set and unset actions)
+	Format  string `xml:"format"`
+	Section string `xml:"section"`
+	Key     string `xml:"key"`
+	Value   string `xml:"value"`
 }
 
 // Represents a slice of files to modify
@@ -130,6 +190,14 @@ type FilesContent struct {
 // ImageCustomize treating image customization according to XML config files
 // Returns error or nil
 func Customize(pathToSlash, pathToConfigDir string) error {
+	return CustomizeWithData(pathToSlash, pathToConfigDir, nil, nil)
+}
+
+// CustomizeWithData treating image customization according to XML config files.
+// The items injected by ACTION_TEMPLATE are rendered with the data.
+// The unified diffs of the edited files are written to diff unless nil
+// Returns error or nil
+func CustomizeWithData(pathToSlash, pathToConfigDir string, data *TemplateData, diff io.Writer) error {
 	//install/deinstall appropriate packages
 	pathToXml := pathToConfigDir + "/packages.xml"
 	if _, err := os.Stat(pathToXml); err == nil {
@@ -140,7 +208,7 @@ func Customize(pathToSlash, pathToConfigDir string) error {
 	// inject appropriate stuff
 	pathToXml = pathToConfigDir + "/inject_items.xml"
 	if _, err := os.Stat(pathToXml); err == nil {
-		if err := injectManip(pathToXml, pathToSlash); err != nil {
+		if err := injectManip(pathToXml, pathToSlash, data); err != nil {
 			return utils.FormatError(err)
 		}
 	}
@@ -154,7 +222,7 @@ func Customize(pathToSlash, pathToConfigDir string) error {
 	// file content modification
 	pathToXml = pathToConfigDir + "/files_content.xml"
 	if _, err := os.Stat(pathToXml); err == nil {
-		if err := filesContentManip(pathToXml, pathToSlash); err != nil {
+		if err := filesContentManip(pathToXml, pathToSlash, diff); err != nil {
 			return utils.FormatError(err)
 		}
 	}
@@ -162,10 +230,15 @@ func Customize(pathToSlash, pathToConfigDir string) error {
 }
 
 // packageManip is intended for installing or removind appropriate
-// packages to the offline appliance
-// TODO: currently supported while deploying on a 3d party appliance.
-// Make it to support manipulation
-// over chroot
+// packages either on the host or into the offline appliance over chroot.
+// Over chroot /dev, /proc and /sys are bind mounted into the rootfs
+// while the packages are treated and unmounted once done.
+// The local package file (see Package.File) is installed by rpm, dpkg
+// or apk (with --root over chroot), the package manager (yum, dnf, zypper,
+// apt-get or apk) is used otherwise, optionally restricted to the local
+// repository (see Package.Repo).
+// The relative paths are relative to the "packages" directory next
+// to the XML file
 // Example:
 //<packages>
 //	<package>
@@ -174,8 +247,23 @@ func Customize(pathToSlash, pathToConfigDir string) error {
 //	   <action>install</action>
 //	   <chroot>false</chroot>
 //	</package>
+//	<package>
+//     <name>myapp</name>
+//     <type>rpm</type>
+//     <file>myapp-1.0-1.x86_64.rpm</file>
+//	   <action>install</action>
+//	   <chroot>true</chroot>
+//	</package>
+//	<package>
+//     <name>mytool</name>
+//     <type>rpm</type>
+//     <manager>dnf</manager>
+//     <repo>repo</repo>
+//	   <action>install</action>
+//	   <chroot>true</chroot>
+//	</package>
 //</packages>
-func packageManip(pathToXml, pathToSlash string) error {
+func packageManip(pathToXml, pathToSlash string) (err error) {
 	// read the XML file to a buffer
 	dataBuf, err := ioutil.ReadFile(pathToXml)
 	if err != nil {
@@ -186,48 +274,67 @@ func packageManip(pathToXml, pathToSlash string) error {
 	if err := xml.Unmarshal(dataBuf, &pkgsStruct); err != nil {
 		return utils.FormatError(err)
 	}
-	var pkgCmd string
+	pathToPackages := filepath.Join(filepath.Dir(pathToXml), "packages")
+	var chroot *chrootEnv
+	defer func() {
+		if chroot != nil {
+			if e := chroot.release(); e != nil && err == nil {
+				err = utils.FormatError(e)
+			}
+		}
+	}()
 	// iterate over the slice and treat each entry (package)
 	for _, val := range pkgsStruct.Pkgs {
-		switch val.Type {
-		case PKG_TYPE_RPM:
-			pkgCmd = "yum"
-		case PKG_TYPE_DEB:
-			pkgCmd = "apt-get"
-		default:
-			return utils.FormatError(errors.New("unsupported package format"))
-		}
-		var action string
-		switch val.Action {
-		case ACTION_INSTALL:
-			action = ACTION_INSTALL
-		case ACTION_REMOVE:
-			action = ACTION_REMOVE
-		default:
-			return utils.FormatError(errors.New("unsupported package manip action"))
-		}
+		file, repo, root := localPath(pathToPackages, val.File), localPath(pathToPackages, val.Repo), ""
 		if val.Chroot {
-			if err := exec.Command("chroot", pathToSlash,
-				pkgCmd, "-y", action, val.Name).Run(); err != nil {
-				return utils.FormatError(fmt.Errorf("chroot %s %s -y %s %s", pathToSlash, pkgCmd, action, val.Name))
+			if chroot == nil {
+				if chroot, err = newChrootEnv(pathToSlash); err != nil {
+					return utils.FormatError(err)
+				}
 			}
-		} else {
-			if err := exec.Command(pkgCmd, "-y", action, val.Name).Run(); err != nil {
-				return utils.FormatError(fmt.Errorf("%s -y %s %s", pkgCmd, action, val.Name))
+			if repo != "" {
+				if repo, err = chroot.bindRepo(repo); err != nil {
+					return utils.FormatError(err)
+				}
 			}
+			root = pathToSlash
+		}
+		cmd, err := packageCmd(val, root, file, repo)
+		if err != nil {
+			return utils.FormatError(err)
+		}
+		// the package files are installed from the host
+		if val.Chroot && file == "" {
+			cmd = append([]string{"chroot", pathToSlash}, cmd...)
+		}
+		if out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+			return utils.FormatError(fmt.Errorf("%s: %s [%v]", strings.Join(cmd, " "), out, err))
 		}
 	}
 	return nil
 }
 
+// localPath returns the path relative to the dir unless absolute or empty
+func localPath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
 // injectStuff modifies a RAW image "on-the-fly"
 // by injecting appropriate stuff to the mounted vHDD
 // 1) it receives src and dst directories paths
 // 2) it looks for a file inject.config inside the src directory
 // 3) in case the file found parses it and inject appropriate stuff
 //    according to the file.
+// The items get exactly the permissions (unless omitted), the owner
+// and the extended attributes configured. The permissions of a link
+// are ignored, the link target (bkp_name) must exist inside the rootfs.
+// Once injected, the items are verified against the configuration.
 // Example:
 //<inject_items>
+//	<selinux_relabel>true</selinux_relabel>
 //	<inject_item>
 //      <name>file1</name>
 //	 	<bkp_name>file1.bkp</bkp_name>
@@ -238,8 +345,19 @@ func packageManip(pathToXml, pathToSlash string) error {
 //  	<owner_id>0</owner_id>
 //		<group_id>0</group_id>
 //	</inject_item>
+//	<inject_item>
+//      <name>hostname</name>
+//	  	<action>template</action>
+//      <type>file</type>
+// 		<location>/etc</location>
+//		<permissions>0644</permissions>
+//		<xattr name="user.origin">deployer</xattr>
+//		<selinux_context>system_u:object_r:hostname_etc_t:s0</selinux_context>
+//	</inject_item>
 //</inject_items
-func injectManip(pathToXml, pathToSlash string) error {
+// The "template" action renders the item with text/template,
+// for example "{{.Name}}" (see TemplateData)
+func injectManip(pathToXml, pathToSlash string, data *TemplateData) error {
 	dataBuf, err := ioutil.ReadFile(pathToXml)
 	if err != nil {
 		return utils.FormatError(err)
@@ -270,11 +388,8 @@ func injectManip(pathToXml, pathToSlash string) error {
 		case ACTION_UPLOAD, ACTION_CREATE:
 			switch val.Type {
 			case ITEM_TYPE_FILE:
-				if err := ioutils.CreateDirRecursively(targetLocationPath, 0755,
-					val.UID, val.GID, false); err != nil {
-					if err != os.ErrExist {
-						return utils.FormatError(err)
-					}
+				if err := os.MkdirAll(targetLocationPath, 0755); err != nil {
+					return utils.FormatError(err)
 				}
 				if val.Action == ACTION_UPLOAD {
 					if val.BkpName != "" {
@@ -295,16 +410,9 @@ func injectManip(pathToXml, pathToSlash string) error {
 					}
 					fd.Close()
 				}
-				// FIXME:
-				// we shuld use val.Permissions for setting permissions ,example
-				// if err := CopyFile(srcFilePath, dstFilePath,
-				//	val.Permissions, val.UID, val.GID); err != nil {
-				//	return err
-				//}
-				// Currently , it copies permission flags from the source
 			case ITEM_TYPE_DIR:
 				if err := ioutils.CreateDirRecursively(filepath.Join(targetLocationPath, val.Name),
-					val.Permissions, val.UID, val.GID, false); err != nil {
+					0755, val.UID, val.GID, false); err != nil {
 					return utils.FormatError(err)
 				}
 				if val.Action == ACTION_UPLOAD {
@@ -320,14 +428,18 @@ func injectManip(pathToXml, pathToSlash string) error {
 					}
 				}
 			case ITEM_TYPE_LINK:
-				if _, err := os.Stat(val.BkpName); err != nil {
+				// the target is resolved inside the rootfs
+				target := val.BkpName
+				if !filepath.IsAbs(target) {
+					target = filepath.Join(val.Location, target)
+				}
+				if _, err := os.Lstat(filepath.Join(pathToSlash, target)); err != nil {
 					return utils.FormatError(err)
 				}
 				if err := ioutils.RemoveIfExists(false, dstPath); err != nil {
 					return utils.FormatError(err)
 				}
-				if err := ioutils.CreateDirRecursively(targetLocationPath,
-					val.Permissions, val.UID, val.GID, false); err != nil {
+				if err := os.MkdirAll(targetLocationPath, 0755); err != nil {
 					return utils.FormatError(err)
 				}
 				if err := os.Symlink(val.BkpName, dstPath); err != nil {
@@ -336,18 +448,52 @@ func injectManip(pathToXml, pathToSlash string) error {
 			default:
 				return utils.FormatError(errors.New("injectManip: configuration error - unexpected element type"))
 			}
+		case ACTION_TEMPLATE:
+			if val.Type != ITEM_TYPE_FILE {
+				return utils.FormatError(errors.New("injectManip: configuration error - only a file can be rendered"))
+			}
+			if err := os.MkdirAll(targetLocationPath, 0755); err != nil {
+				return utils.FormatError(err)
+			}
+			if val.BkpName != "" {
+				if _, err := os.Stat(dstPath); err == nil {
+					if err := os.Rename(dstPath, dstBkpPath); err != nil {
+						return utils.FormatError(err)
+					}
+				}
+			}
+			if err := renderItem(srcPath, dstPath, data); err != nil {
+				return utils.FormatError(err)
+			}
 		default:
 			return utils.FormatError(errors.New("injectManip: configuration error - unexpected action"))
 		}
+		if val.Action != ACTION_REMOVE {
+			if err := setAttributes(dstPath, val); err != nil {
+				return utils.FormatError(err)
+			}
+		}
+	}
+	if itemsStruct.SELinuxRelabel {
+		if err := ioutil.WriteFile(filepath.Join(pathToSlash, ".autorelabel"), nil, 0644); err != nil {
+			return utils.FormatError(err)
+		}
+	}
+	if err := verifyItems(itemsStruct.InjItems, pathToSlash); err != nil {
+		return utils.FormatError(err)
 	}
 	return nil
 }
 
 // serviceManip allows services manipulation either over chroot
 // (in case we need modify service state on an off-line image) or
-// without chrooting (in case we are deploying upon a running system)
+// without chrooting (in case we are deploying upon a running system).
+// The systemd units are managed on the rootfs directly (see systemdManip),
+// the unit files and the drop-ins are installed from the "units" directory
+// next to the XML file (units/foo.service, units/foo.service.d/*.conf)
 // Example:
 //<services>
+//	<default_target>multi-user.target</default_target>
 //	<service>
 //     <name>iptables</name>
 //     <type>sysv</type>
@@ -368,6 +514,11 @@ func injectManip(pathToXml, pathToSlash string) error {
 //	   <action>reload</action>
 //	   <chroot>false</chroot>
 //	</service>
+//	<service>
+//     <name>firewalld.service</name>
+//     <type>systemd</type>
+//     <status>mask</status>
+//	</service>
 //</services>
 func serviceManip(pathToXml, pathToSlash string) error {
 	dataBuf, err := ioutil.ReadFile(pathToXml)
@@ -450,13 +601,38 @@ func serviceManip(pathToXml, pathToSlash string) error {
 			default:
 				return utils.FormatError(errors.New(`ServiceManip : upstart :configuration error - unsupported action`))
 			}
+
+		case SVC_TYPE_SYSTEMD:
+			if err := systemdManip(val, pathToSlash, filepath.Join(filepath.Dir(pathToXml), "units")); err != nil {
+				return utils.FormatError(err)
+			}
+		}
+	}
+	if servicesStruct.DefaultTarget != "" {
+		if err := setDefaultTarget(pathToSlash, servicesStruct.DefaultTarget); err != nil {
+			return utils.FormatError(err)
 		}
 	}
 	return nil
 }
 
 // filesContentManip manipulates with the content of the files
-// according to appropriate XML configuration file
+// according to appropriate XML configuration file.
+// The changes are idempotent: the file is rewritten only if its content
+// changes, the unified diff of the change is written to diff unless nil.
+// The missing file is an error unless create is set
+// (nothing is removed from the missing file though).
+// Actions:
+//   append        - appends new_pattern unless the content matches it
+//   replace       - replaces old_pattern by new_pattern in every line
+//   ensure_line   - replaces the last line matching old_pattern (if any)
+//                   by new_pattern, appends new_pattern unless present
+//   ensure_absent - removes the lines equal to new_pattern or matching old_pattern
+//   block         - replaces the block between the marker lines by new_pattern,
+//                   appends it unless present, removes it if new_pattern is empty
+//                   (the begin marker not followed by the end marker is an error)
+//   set, unset    - sets or removes the key in the ini (of the section),
+//                   sysconfig, yaml or json (the nested keys are separated by ".") file
 // Example:
 //<files>
 //	<file>
@@ -473,8 +649,28 @@ func serviceManip(pathToXml, pathToSlash string) error {
 //		<old_pattern></old_pattern>
 //		<new_pattern>test:x:111:111::/root:/bin/bash</new_pattern>
 //	</file>
+//	<file>
+//		<path>/etc/ssh/sshd_config</path>
+//		<action>ensure_line</action>
+//		<old_pattern>^#?PermitRootLogin</old_pattern>
+//		<new_pattern>PermitRootLogin no</new_pattern>
+//	</file>
+//	<file>
+//		<path>/etc/hosts</path>
+//		<action>block</action>
+//		<marker>myproduct</marker>
+//		<new_pattern>10.0.0.1 controller</new_pattern>
+//	</file>
+//	<file>
+//		<path>/etc/myapp/config.yaml</path>
+//		<action>set</action>
+//		<format>yaml</format>
+//		<key>server.port</key>
+//		<value>8080</value>
+//		<create>true</create>
+//	</file>
 //</files>
-func filesContentManip(pathToXml, pathToSlash string) error {
+func filesContentManip(pathToXml, pathToSlash string, diff io.Writer) error {
 	dataBuf, err := ioutil.ReadFile(pathToXml)
 	if err != nil {
 		return utils.FormatError(err)
@@ -484,46 +680,9 @@ func filesContentManip(pathToXml, pathToSlash string) error {
 		return utils.FormatError(err)
 	}
 	for _, val := range fileContentStruct.FContent {
-		targetPath := filepath.Join(pathToSlash, val.Path)
-		if err != nil {
-			return utils.FormatError(err)
-		}
-		finfo, err := os.Stat(targetPath)
-		if err != nil {
-			continue
-		}
-		if val.NewPattern == "" {
-			return utils.FormatError(errors.New("configuration error - NewPattern is empty"))
-		}
-		if val.BkpName != "" {
-			bkpFilePath := filepath.Join(pathToSlash, val.BkpName)
-			if err := ioutils.CopyFile(targetPath, bkpFilePath, 0, -1, -1, false); err != nil {
-				return utils.FormatError(err)
-			}
-		}
-		fd, err := os.OpenFile(targetPath, os.O_RDWR|os.O_APPEND, finfo.Mode())
-		if err != nil {
+		if err := editFile(pathToSlash, val, diff); err != nil {
 			return utils.FormatError(err)
 		}
-		defer fd.Close()
-
-		switch val.Action {
-		// if we need to append to the file
-		case ACTION_APPEND:
-			if err := ioutils.AppendToFd(fd, val.NewPattern+"\n", val.NewPattern); err != nil {
-				return utils.FormatError(err)
-			}
-		// if we need to replace a pattern
-		case ACTION_REPLACE:
-			if val.OldPattern == "" {
-				return utils.FormatError(errors.New("configuration error - replace action is set but OldPattern is empty"))
-			}
-			if err := ioutils.FindAndReplaceFd(fd, val.OldPattern, val.NewPattern); err != nil {
-				return utils.FormatError(err)
-			}
-		default:
-			return utils.FormatError(errors.New(`FilesContentManip:configuration error - unsupported action`))
-		}
 	}
 	return nil
 }
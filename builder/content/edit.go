@@ -0,0 +1,638 @@
+// Responsible for editing the content of the files
+
+package content
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/dorzheh/infra/utils/ioutils"
+)
+
+// defaultMarker names the managed block unless the marker is configured
+const defaultMarker = "DEPLOYER MANAGED BLOCK"
+
+// editFile applies the change to the file inside the rootfs.
+// The file is rewritten only if its content changes.
+// A missing file is created if fc.Create is set, nothing is removed
+// from a missing file, it is an error otherwise.
+// The unified diff of the change is written to diff unless nil
+func editFile(pathToSlash string, fc FileContent, diff io.Writer) error {
+	targetPath := filepath.Join(pathToSlash, fc.Path)
+	old, err := ioutil.ReadFile(targetPath)
+	exists := err == nil
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if removes(fc) {
+			return nil
+		}
+		if !fc.Create {
+			return fmt.Errorf("%s not found", fc.Path)
+		}
+	}
+	content, err := editContent(string(old), fc)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fc.Path, err)
+	}
+	if exists && content == string(old) {
+		return nil
+	}
+	if exists && fc.BkpName != "" {
+		if err := ioutils.CopyFile(targetPath, filepath.Join(pathToSlash, fc.BkpName), 0, -1, -1, false); err != nil {
+			return err
+		}
+	}
+	if err := writeFile(targetPath, []byte(content), exists); err != nil {
+		return err
+	}
+	if diff != nil {
+		oldName := "a" + filepath.Join("/", fc.Path)
+		if !exists {
+			oldName = "/dev/null"
+		}
+		io.WriteString(diff, unifiedDiff(oldName, "b"+filepath.Join("/", fc.Path), splitLines(string(old)), splitLines(content)))
+	}
+	return nil
+}
+
+// removes reports whether the change only removes the content
+func removes(fc FileContent) bool {
+	switch fc.Action {
+	case ACTION_ENSURE_ABSENT, ACTION_UNSET:
+		return true
+	case ACTION_BLOCK:
+		return fc.NewPattern == ""
+	}
+	return false
+}
+
+// writeFile replaces the file atomically keeping its mode and owner
+func writeFile(path string, data []byte, exists bool) error {
+	mode, uid, gid := os.FileMode(0644), 0, 0
+	if exists {
+		finfo, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		mode = finfo.Mode().Perm()
+		if st, ok := finfo.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+	} else if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	fd, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Chmod(mode)
+	}
+	if err == nil {
+		err = fd.Chown(uid, gid)
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(fd.Name(), path)
+}
+
+// editContent returns the content changed according to the action
+func editContent(content string, fc FileContent) (string, error) {
+	lines := splitLines(content)
+	switch fc.Action {
+	case ACTION_APPEND:
+		if fc.NewPattern == "" {
+			return "", errors.New("configuration error - NewPattern is empty")
+		}
+		found, err := regexp.MatchString(fc.NewPattern, content)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			lines = append(lines, fc.NewPattern)
+		}
+	case ACTION_REPLACE:
+		if fc.OldPattern == "" {
+			return "", errors.New("configuration error - replace action is set but OldPattern is empty")
+		}
+		expr, err := regexp.Compile(fc.OldPattern)
+		if err != nil {
+			return "", err
+		}
+		for index, line := range lines {
+			lines[index] = expr.ReplaceAllString(line, fc.NewPattern)
+		}
+	case ACTION_ENSURE_LINE:
+		if fc.NewPattern == "" {
+			return "", errors.New("configuration error - NewPattern is empty")
+		}
+		var err error
+		if lines, err = ensureLine(lines, fc.OldPattern, fc.NewPattern); err != nil {
+			return "", err
+		}
+	case ACTION_ENSURE_ABSENT:
+		var err error
+		if lines, err = ensureAbsent(lines, fc.OldPattern, fc.NewPattern); err != nil {
+			return "", err
+		}
+	case ACTION_BLOCK:
+		marker := fc.Marker
+		if marker == "" {
+			marker = defaultMarker
+		}
+		var err error
+		if lines, err = ensureBlock(lines, marker, fc.NewPattern); err != nil {
+			return "", err
+		}
+	case ACTION_SET, ACTION_UNSET:
+		if fc.Key == "" {
+			return "", errors.New("configuration error - key is empty")
+		}
+		unset := fc.Action == ACTION_UNSET
+		switch fc.Format {
+		case FORMAT_INI:
+			lines = setKeyLine(lines, fc.Section, fc.Key, fc.Key+" = "+fc.Value, unset)
+		case FORMAT_SYSCONFIG:
+			lines = setKeyLine(lines, "", fc.Key, fc.Key+"="+shellQuote(fc.Value), unset)
+		case FORMAT_YAML:
+			var err error
+			if lines, err = setYAMLKey(lines, strings.Split(fc.Key, "."), fc.Value, unset); err != nil {
+				return "", err
+			}
+		case FORMAT_JSON:
+			return setJSONKey(content, strings.Split(fc.Key, "."), fc.Value, unset)
+		default:
+			return "", errors.New("configuration error - unsupported format " + fc.Format)
+		}
+	default:
+		return "", errors.New(`FilesContentManip:configuration error - unsupported action`)
+	}
+	return joinLines(lines), nil
+}
+
+// splitLines splits the content to the lines without the line breaks
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+func joinLines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// ensureLine replaces the last line matching the pattern (if any) by the line.
+// The line is appended unless present
+func ensureLine(lines []string, pattern, line string) ([]string, error) {
+	if pattern != "" {
+		expr, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for index := len(lines) - 1; index >= 0; index-- {
+			if expr.MatchString(lines[index]) {
+				lines[index] = line
+				return lines, nil
+			}
+		}
+	}
+	for _, l := range lines {
+		if l == line {
+			return lines, nil
+		}
+	}
+	return append(lines, line), nil
+}
+
+// ensureAbsent removes the lines equal to the line or matching the pattern
+func ensureAbsent(lines []string, pattern, line string) ([]string, error) {
+	if pattern == "" && line == "" {
+		return nil, errors.New("configuration error - both OldPattern and NewPattern are empty")
+	}
+	var expr *regexp.Regexp
+	if pattern != "" {
+		var err error
+		if expr, err = regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+	}
+	var kept []string
+	for _, l := range lines {
+		if (line != "" && l == line) || (expr != nil && expr.MatchString(l)) {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	return kept, nil
+}
+
+// ensureBlock replaces the content between the marker lines by the block.
+// The block is appended unless present, removed if empty.
+// The begin marker not followed by the end marker is an error
+func ensureBlock(lines []string, marker, block string) ([]string, error) {
+	begin, end := "# BEGIN "+marker, "# END "+marker
+	var blockLines []string
+	if block != "" {
+		blockLines = append(append([]string{begin}, splitLines(strings.Trim(block, "\n"))...), end)
+	}
+	for start, l := range lines {
+		if l != begin {
+			continue
+		}
+		for stop := start + 1; stop < len(lines) && lines[stop] != begin; stop++ {
+			if lines[stop] == end {
+				return append(append(append([]string{}, lines[:start]...), blockLines...), lines[stop+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("line %d: %q is not terminated by %q", start+1, begin, end)
+	}
+	return append(lines, blockLines...), nil
+}
+
+// setKeyLine sets the key of the section (INI) to the line or removes
+// the key if unset. The empty section stands for the lines preceding
+// the first section (sysconfig)
+func setKeyLine(lines []string, section, key, line string, unset bool) []string {
+	keyExpr := regexp.MustCompile(`^\s*(export\s+)?` + regexp.QuoteMeta(key) + `\s*=`)
+	sectionExpr := regexp.MustCompile(`^\s*\[([^\]]*)\]`)
+
+	current, found, last := "", section == "", -1
+	var result []string
+	done := false
+	for _, l := range lines {
+		if m := sectionExpr.FindStringSubmatch(l); m != nil {
+			current = strings.TrimSpace(m[1])
+			if current == section {
+				found = true
+			}
+		}
+		if current == section && keyExpr.MatchString(l) {
+			if unset || done {
+				continue
+			}
+			l, done = line, true
+		}
+		result = append(result, l)
+		if current == section && strings.TrimSpace(l) != "" {
+			last = len(result) - 1
+		}
+	}
+	if unset || done {
+		return result
+	}
+	if !found {
+		if len(result) > 0 && strings.TrimSpace(result[len(result)-1]) != "" {
+			result = append(result, "")
+		}
+		return append(result, "["+section+"]", line)
+	}
+	// the key is added after the last line of the section
+	return append(result[:last+1], append([]string{line}, result[last+1:]...)...)
+}
+
+// shellQuote quotes the value of the shell variable if necessary
+func shellQuote(value string) string {
+	if regexp.MustCompile(`^[A-Za-z0-9_./:,@%+=-]*$`).MatchString(value) {
+		return value
+	}
+	return `"` + regexp.MustCompile("([\\\\\"$`])").ReplaceAllString(value, `\$1`) + `"`
+}
+
+var yamlKeyExpr = regexp.MustCompile(`^(\s*)("[^"]*"|'[^']*'|[^\s#'"-][^:#]*?)\s*:(\s+|$)(.*)$`)
+
+// yamlKey returns the key and the value of the mapping line
+func yamlKey(line string) (string, string, bool) {
+	m := yamlKeyExpr.FindStringSubmatch(line)
+	if m == nil {
+		return "", "", false
+	}
+	return strings.Trim(m[2], `"'`), m[4], true
+}
+
+func yamlIndent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func blankYAML(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || trimmed[0] == '#' || trimmed == "---"
+}
+
+// yamlBlockEnd returns the index following the lines nested
+// in the key of the line at index (indented deeper)
+func yamlBlockEnd(lines []string, index, indent int) int {
+	end := index + 1
+	for end < len(lines) && (strings.TrimSpace(lines[end]) == "" || yamlIndent(lines[end]) > indent) {
+		end++
+	}
+	for end > index+1 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	return end
+}
+
+// yamlChildIndent returns the indentation of the first line nested
+// in the range of lines, -1 if none
+func yamlChildIndent(lines []string, indent int) int {
+	for _, l := range lines {
+		if !blankYAML(l) && yamlIndent(l) > indent {
+			return yamlIndent(l)
+		}
+	}
+	return -1
+}
+
+// setYAMLKey sets the key (the path of the nested mappings) to the value
+// or removes the key if unset. The value is written as is.
+// Only the block mappings are supported
+func setYAMLKey(lines []string, path []string, value string, unset bool) ([]string, error) {
+	// the lines of the longest existing prefix of the path
+	// and the indentation of its last key
+	start, end, indent, depth := 0, len(lines), -1, 0
+	for depth < len(path) {
+		childIndent := yamlChildIndent(lines[start:end], indent)
+		matched := -1
+		for index := start; index < end && childIndent >= 0; index++ {
+			if blankYAML(lines[index]) || yamlIndent(lines[index]) != childIndent {
+				continue
+			}
+			if key, _, ok := yamlKey(lines[index]); ok && key == path[depth] {
+				matched = index
+				break
+			}
+		}
+		if matched < 0 {
+			break
+		}
+		indent, start, end = childIndent, matched, yamlBlockEnd(lines, matched, childIndent)
+		depth++
+		if depth < len(path) {
+			start++
+		}
+	}
+
+	if depth == len(path) {
+		if unset {
+			return append(lines[:start], lines[end:]...), nil
+		}
+		line := lines[start][:indent] + path[len(path)-1] + ": " + value
+		return append(append(append([]string{}, lines[:start]...), line), lines[end:]...), nil
+	}
+	if unset {
+		return lines, nil
+	}
+	if depth > 0 {
+		if _, v, _ := yamlKey(lines[start-1]); strings.TrimSpace(v) != "" && !strings.HasPrefix(strings.TrimSpace(v), "#") {
+			return nil, fmt.Errorf("%s is not a mapping", strings.Join(path[:depth], "."))
+		}
+	}
+
+	// the missing keys are added after the lines of the existing prefix
+	childIndent := yamlChildIndent(lines[start:end], indent)
+	if childIndent < 0 {
+		childIndent = indent + 2
+		if indent < 0 {
+			childIndent = 0
+		}
+	}
+	var added []string
+	for i, key := range path[depth:] {
+		prefix := strings.Repeat(" ", childIndent+i*2)
+		if depth+i == len(path)-1 {
+			added = append(added, prefix+key+": "+value)
+		} else {
+			added = append(added, prefix+key+":")
+		}
+	}
+	if depth == 0 {
+		// trailing blank lines of the document are kept at the end
+		for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+			end--
+		}
+	}
+	return append(append(append([]string{}, lines[:end]...), added...), lines[end:]...), nil
+}
+
+// jsonObject keeps the order of the keys of the JSON object
+type jsonObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newJSONObject() *jsonObject {
+	return &jsonObject{values: make(map[string]interface{})}
+}
+
+func (o *jsonObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *jsonObject) unset(key string) {
+	if _, ok := o.values[key]; !ok {
+		return
+	}
+	delete(o.values, key)
+	for index, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:index], o.keys[index+1:]...)
+			break
+		}
+	}
+}
+
+// setJSONKey sets the key (the path of the nested objects) to the value
+// or removes the key if unset. The value is parsed as JSON
+// and taken as a string if invalid. The order of the keys is kept,
+// the content is indented by two spaces once changed
+func setJSONKey(content string, path []string, value string, unset bool) (string, error) {
+	root := interface{}(newJSONObject())
+	if strings.TrimSpace(content) != "" {
+		var err error
+		if root, err = decodeJSON(content); err != nil {
+			return "", err
+		}
+	}
+	before, err := encodeJSON(root)
+	if err != nil {
+		return "", err
+	}
+
+	obj, ok := root.(*jsonObject)
+	if !ok {
+		return "", errors.New("JSON object expected")
+	}
+	for _, key := range path[:len(path)-1] {
+		child, exists := obj.values[key]
+		if !exists {
+			if unset {
+				return content, nil
+			}
+			child = newJSONObject()
+			obj.set(key, child)
+		}
+		if obj, ok = child.(*jsonObject); !ok {
+			return "", fmt.Errorf("%s is not a JSON object", key)
+		}
+	}
+	key := path[len(path)-1]
+	if unset {
+		obj.unset(key)
+	} else {
+		v, err := decodeJSON(value)
+		if err != nil {
+			v = value
+		}
+		obj.set(key, v)
+	}
+
+	after, err := encodeJSON(root)
+	if err != nil {
+		return "", err
+	}
+	// the original formatting is kept unless the content changes
+	if after == before && strings.TrimSpace(content) != "" {
+		return content, nil
+	}
+	return after, nil
+}
+
+// decodeJSON decodes the JSON keeping the order of the object keys
+func decodeJSON(data string) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON: unexpected data after the value")
+	}
+	return v, nil
+}
+
+func decodeJSONValue(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		obj := newJSONObject()
+		for dec.More() {
+			keyToken, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(keyToken.(string), v)
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		list := []interface{}{}
+		for dec.More() {
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		_, err := dec.Token()
+		return list, err
+	}
+	return token, nil
+}
+
+// encodeJSON encodes the value indented by two spaces
+func encodeJSON(v interface{}) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := encodeJSONValue(buf, v, ""); err != nil {
+		return "", err
+	}
+	buf.WriteString("\n")
+	return buf.String(), nil
+}
+
+func encodeJSONValue(buf *bytes.Buffer, v interface{}, indent string) error {
+	switch value := v.(type) {
+	case *jsonObject:
+		if len(value.keys) == 0 {
+			buf.WriteString("{}")
+			return nil
+		}
+		buf.WriteString("{\n")
+		for index, key := range value.keys {
+			if err := encodeJSONScalar(buf, indent+"  ", key); err != nil {
+				return err
+			}
+			buf.WriteString(": ")
+			if err := encodeJSONValue(buf, value.values[key], indent+"  "); err != nil {
+				return err
+			}
+			if index < len(value.keys)-1 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(indent + "}")
+	case []interface{}:
+		if len(value) == 0 {
+			buf.WriteString("[]")
+			return nil
+		}
+		buf.WriteString("[\n")
+		for index, item := range value {
+			buf.WriteString(indent + "  ")
+			if err := encodeJSONValue(buf, item, indent+"  "); err != nil {
+				return err
+			}
+			if index < len(value)-1 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(indent + "]")
+	default:
+		return encodeJSONScalar(buf, "", value)
+	}
+	return nil
+}
+
+func encodeJSONScalar(buf *bytes.Buffer, prefix string, v interface{}) error {
+	data := new(bytes.Buffer)
+	enc := json.NewEncoder(data)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	buf.WriteString(prefix)
+	buf.Write(bytes.TrimSuffix(data.Bytes(), []byte("\n")))
+	return nil
+}
@@ -0,0 +1,191 @@
+package content
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// checkEdit verifies the change results in the expected content
+// and is idempotent
+func checkEdit(t *testing.T, content string, fc FileContent, expected string) {
+	edited, err := editContent(content, fc)
+	if err != nil {
+		t.Fatalf("%s %s: %v", fc.Action, fc.Key, err)
+	}
+	if edited != expected {
+		t.Fatalf("%s %s: unexpected content\n%s\nexpected\n%s", fc.Action, fc.Key, edited, expected)
+	}
+	if again, err := editContent(edited, fc); err != nil || again != edited {
+		t.Fatalf("%s %s: not idempotent\n%s [%v]", fc.Action, fc.Key, again, err)
+	}
+}
+
+func TestEditLines(t *testing.T) {
+	sshd := "Port 22\n#PermitRootLogin yes\nUsePAM yes"
+	checkEdit(t, sshd, FileContent{Action: ACTION_ENSURE_LINE, OldPattern: "^#?PermitRootLogin", NewPattern: "PermitRootLogin no"},
+		"Port 22\nPermitRootLogin no\nUsePAM yes\n")
+	checkEdit(t, sshd, FileContent{Action: ACTION_ENSURE_LINE, NewPattern: "X11Forwarding no"},
+		"Port 22\n#PermitRootLogin yes\nUsePAM yes\nX11Forwarding no\n")
+	checkEdit(t, sshd, FileContent{Action: ACTION_ENSURE_ABSENT, OldPattern: "^#"},
+		"Port 22\nUsePAM yes\n")
+	checkEdit(t, sshd, FileContent{Action: ACTION_APPEND, NewPattern: "UseDNS no"},
+		"Port 22\n#PermitRootLogin yes\nUsePAM yes\nUseDNS no\n")
+	checkEdit(t, "SELINUX=enforcing\n", FileContent{Action: ACTION_REPLACE, OldPattern: `SELINUX=\S+`, NewPattern: "SELINUX=disabled"},
+		"SELINUX=disabled\n")
+
+	hosts := "127.0.0.1 localhost\n"
+	block := FileContent{Action: ACTION_BLOCK, Marker: "myproduct", NewPattern: "\n10.0.0.1 controller\n10.0.0.2 compute\n"}
+	checkEdit(t, hosts, block,
+		"127.0.0.1 localhost\n# BEGIN myproduct\n10.0.0.1 controller\n10.0.0.2 compute\n# END myproduct\n")
+	block.NewPattern = "10.0.0.3 storage"
+	checkEdit(t, "# BEGIN myproduct\n10.0.0.1 controller\n# END myproduct\n::1 localhost\n", block,
+		"# BEGIN myproduct\n10.0.0.3 storage\n# END myproduct\n::1 localhost\n")
+	block.NewPattern = ""
+	checkEdit(t, "# BEGIN myproduct\n10.0.0.1 controller\n# END myproduct\n::1 localhost\n", block, "::1 localhost\n")
+	// the unterminated block never swallows the following lines
+	for _, content := range []string{
+		"# BEGIN myproduct\n10.0.0.1 controller\n::1 localhost\n",
+		"# BEGIN myproduct\n::1 localhost\n# BEGIN myproduct\n10.0.0.1 controller\n# END myproduct\n",
+	} {
+		if _, err := editContent(content, block); err == nil {
+			t.Fatalf("unterminated block, expected error\n%s", content)
+		}
+	}
+}
+
+func TestEditKeys(t *testing.T) {
+	ini := "; global\nverbose = 1\n\n[main]\ngpgcheck=1\n\n[updates]\nenabled = 1\n"
+	checkEdit(t, ini, FileContent{Action: ACTION_SET, Format: FORMAT_INI, Section: "main", Key: "gpgcheck", Value: "0"},
+		"; global\nverbose = 1\n\n[main]\ngpgcheck = 0\n\n[updates]\nenabled = 1\n")
+	checkEdit(t, ini, FileContent{Action: ACTION_SET, Format: FORMAT_INI, Section: "main", Key: "keepcache", Value: "1"},
+		"; global\nverbose = 1\n\n[main]\ngpgcheck=1\nkeepcache = 1\n\n[updates]\nenabled = 1\n")
+	checkEdit(t, ini, FileContent{Action: ACTION_SET, Format: FORMAT_INI, Section: "extras", Key: "enabled", Value: "0"},
+		ini+"\n[extras]\nenabled = 0\n")
+	checkEdit(t, ini, FileContent{Action: ACTION_SET, Format: FORMAT_INI, Key: "debug", Value: "0"},
+		"; global\nverbose = 1\ndebug = 0\n\n[main]\ngpgcheck=1\n\n[updates]\nenabled = 1\n")
+	checkEdit(t, ini, FileContent{Action: ACTION_UNSET, Format: FORMAT_INI, Section: "updates", Key: "enabled"},
+		"; global\nverbose = 1\n\n[main]\ngpgcheck=1\n\n[updates]\n")
+
+	sysconfig := "BOOTPROTO=dhcp\nONBOOT=no\n"
+	checkEdit(t, sysconfig, FileContent{Action: ACTION_SET, Format: FORMAT_SYSCONFIG, Key: "ONBOOT", Value: "yes"},
+		"BOOTPROTO=dhcp\nONBOOT=yes\n")
+	checkEdit(t, sysconfig, FileContent{Action: ACTION_SET, Format: FORMAT_SYSCONFIG, Key: "OPTS", Value: `a "b" $c`},
+		sysconfig+`OPTS="a \"b\" \$c"`+"\n")
+
+	yaml := "# config\nserver:\n  host: localhost\n  tls:\n    enabled: false\n\nlogging:\n  level: info\n"
+	checkEdit(t, yaml, FileContent{Action: ACTION_SET, Format: FORMAT_YAML, Key: "server.tls.enabled", Value: "true"},
+		"# config\nserver:\n  host: localhost\n  tls:\n    enabled: true\n\nlogging:\n  level: info\n")
+	checkEdit(t, yaml, FileContent{Action: ACTION_SET, Format: FORMAT_YAML, Key: "server.port", Value: "8080"},
+		"# config\nserver:\n  host: localhost\n  tls:\n    enabled: false\n  port: 8080\n\nlogging:\n  level: info\n")
+	checkEdit(t, yaml, FileContent{Action: ACTION_SET, Format: FORMAT_YAML, Key: "metrics.prometheus.port", Value: "9090"},
+		yaml+"metrics:\n  prometheus:\n    port: 9090\n")
+	checkEdit(t, yaml, FileContent{Action: ACTION_UNSET, Format: FORMAT_YAML, Key: "server.tls"},
+		"# config\nserver:\n  host: localhost\n\nlogging:\n  level: info\n")
+	if _, err := editContent(yaml, FileContent{Action: ACTION_SET, Format: FORMAT_YAML, Key: "logging.level.file", Value: "x"}); err == nil {
+		t.Fatal("scalar value, expected error")
+	}
+
+	json := `{"name": "myapp", "server": {"port": 80}, "tags": ["a&b"]}`
+	checkEdit(t, json, FileContent{Action: ACTION_SET, Format: FORMAT_JSON, Key: "server.port", Value: "8080"},
+		"{\n  \"name\": \"myapp\",\n  \"server\": {\n    \"port\": 8080\n  },\n  \"tags\": [\n    \"a&b\"\n  ]\n}\n")
+	checkEdit(t, json, FileContent{Action: ACTION_SET, Format: FORMAT_JSON, Key: "server.host", Value: "localhost"},
+		"{\n  \"name\": \"myapp\",\n  \"server\": {\n    \"port\": 80,\n    \"host\": \"localhost\"\n  },\n  \"tags\": [\n    \"a&b\"\n  ]\n}\n")
+	checkEdit(t, json, FileContent{Action: ACTION_UNSET, Format: FORMAT_JSON, Key: "server"},
+		"{\n  \"name\": \"myapp\",\n  \"tags\": [\n    \"a&b\"\n  ]\n}\n")
+	// the formatting is kept unless the content changes
+	checkEdit(t, json, FileContent{Action: ACTION_SET, Format: FORMAT_JSON, Key: "server.port", Value: "80"}, json)
+	checkEdit(t, "", FileContent{Action: ACTION_SET, Format: FORMAT_JSON, Key: "debug", Value: "true"}, "{\n  \"debug\": true\n}\n")
+	if _, err := editContent(json, FileContent{Action: ACTION_SET, Format: FORMAT_JSON, Key: "name.first", Value: "x"}); err == nil {
+		t.Fatal("not an object, expected error")
+	}
+}
+
+func TestFilesContentManip(t *testing.T) {
+	slash := fakeRootfs(t, map[string]string{"etc/sysconfig/network": "NETWORKING=no\n"})
+	defer os.RemoveAll(slash)
+	configDir := fakeRootfs(t, map[string]string{
+		"files_content.xml": `<files>
+	<file>
+		<path>/etc/sysconfig/network</path>
+		<bkp_name>/etc/sysconfig/network.bkp</bkp_name>
+		<action>set</action>
+		<format>sysconfig</format>
+		<key>NETWORKING</key>
+		<value>yes</value>
+	</file>
+	<file>
+		<path>/etc/myapp/config.json</path>
+		<action>set</action>
+		<format>json</format>
+		<key>debug</key>
+		<value>true</value>
+		<create>true</create>
+	</file>
+	<file>
+		<path>/etc/missing.conf</path>
+		<action>ensure_absent</action>
+		<new_pattern>debug</new_pattern>
+	</file>
+</files>`,
+	})
+	defer os.RemoveAll(configDir)
+
+	log := new(bytes.Buffer)
+	if err := CustomizeWithData(slash, configDir, nil, log); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		"etc/sysconfig/network":     "NETWORKING=yes\n",
+		"etc/sysconfig/network.bkp": "NETWORKING=no\n",
+		"etc/myapp/config.json":     "{\n  \"debug\": true\n}\n",
+	} {
+		if data, err := ioutil.ReadFile(filepath.Join(slash, path)); err != nil || string(data) != expected {
+			t.Fatalf("%s: unexpected content %q [%v]", path, data, err)
+		}
+	}
+	for _, diff := range []string{
+		"--- a/etc/sysconfig/network\n+++ b/etc/sysconfig/network\n@@ -1,1 +1,1 @@\n-NETWORKING=no\n+NETWORKING=yes\n",
+		"--- /dev/null\n+++ b/etc/myapp/config.json\n@@ -0,0 +1,3 @@\n+{\n+  \"debug\": true\n+}\n",
+	} {
+		if !strings.Contains(log.String(), diff) {
+			t.Fatalf("diff not found in the log:\n%s", log.String())
+		}
+	}
+
+	// unchanged files aren't reported
+	log.Reset()
+	if err := CustomizeWithData(slash, configDir, nil, log); err != nil || log.Len() != 0 {
+		t.Fatalf("unexpected diff %s [%v]", log.String(), err)
+	}
+
+	ioutil.WriteFile(filepath.Join(configDir, "files_content.xml"), []byte(`<files>
+	<file>
+		<path>/etc/missing.conf</path>
+		<action>append</action>
+		<new_pattern>debug</new_pattern>
+	</file>
+</files>`), 0644)
+	if err := Customize(slash, configDir); err == nil {
+		t.Fatal("missing file, expected error")
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	var a, b []string
+	for i := 1; i <= 20; i++ {
+		a = append(a, string(rune('a'+i)))
+	}
+	b = append(b, a...)
+	b[1] = "changed"
+	b = append(b[:15], append([]string{"added"}, b[15:]...)...)
+	expected := "--- a/f\n+++ b/f\n" +
+		"@@ -1,5 +1,5 @@\n b\n-c\n+changed\n d\n e\n f\n" +
+		"@@ -13,6 +13,7 @@\n n\n o\n p\n+added\n q\n r\n s\n"
+	if diff := unifiedDiff("a/f", "b/f", a, b); diff != expected {
+		t.Fatalf("unexpected diff\n%s\nexpected\n%s", diff, expected)
+	}
+}
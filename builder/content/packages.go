@@ -0,0 +1,179 @@
+// Responsible for installing the packages either on the host
+// or into the rootfs (over chroot)
+
+package content
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// chrootMounts are bind mounted into the rootfs while
+// the packages are treated over chroot
+var chrootMounts = []string{"/dev", "/proc", "/sys"}
+
+// pkgManagers maps the package format to the package managers
+// supporting it, the first one is the default
+var pkgManagers = map[string][]string{
+	PKG_TYPE_RPM: {PKG_MANAGER_YUM, PKG_MANAGER_DNF, PKG_MANAGER_ZYPPER},
+	PKG_TYPE_DEB: {PKG_MANAGER_APT},
+	PKG_TYPE_APK: {PKG_MANAGER_APK},
+}
+
+// chrootEnv represents the rootfs prepared for treating the packages
+type chrootEnv struct {
+	slash string
+
+	// the mount points in the order they are mounted
+	mounts []string
+
+	// temporary directories created inside the rootfs
+	dirs []string
+}
+
+// newChrootEnv bind mounts chrootMounts into the rootfs
+func newChrootEnv(pathToSlash string) (*chrootEnv, error) {
+	c := &chrootEnv{slash: pathToSlash}
+	for _, dir := range chrootMounts {
+		if err := c.bind(dir, filepath.Join(pathToSlash, dir)); err != nil {
+			c.release()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *chrootEnv) bind(src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	if out, err := exec.Command("mount", "--bind", src, dst).CombinedOutput(); err != nil {
+		return fmt.Errorf("mount --bind %s %s: %s [%v]", src, dst, out, err)
+	}
+	c.mounts = append(c.mounts, dst)
+	return nil
+}
+
+// bindRepo makes the local repository available inside the rootfs.
+// Returns the path to the repository inside the rootfs
+func (c *chrootEnv) bindRepo(repo string) (string, error) {
+	dir, err := ioutil.TempDir(filepath.Join(c.slash, "tmp"), "deployer-repo")
+	if err != nil {
+		return "", err
+	}
+	c.dirs = append(c.dirs, dir)
+	if err := c.bind(repo, dir); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(dir, filepath.Clean(c.slash)), nil
+}
+
+// release unmounts everything mounted in the reverse order and removes
+// the temporary directories. Every mount point is attempted,
+// the first failure is reported
+func (c *chrootEnv) release() error {
+	var firstErr error
+	for index := len(c.mounts) - 1; index >= 0; index-- {
+		if out, err := exec.Command("umount", "-l", c.mounts[index]).CombinedOutput(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("umount -l %s: %s [%v]", c.mounts[index], out, err)
+		}
+	}
+	c.mounts = nil
+	// the directories are expected to be empty once unmounted
+	for _, dir := range c.dirs {
+		if err := os.Remove(dir); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.dirs = nil
+	return firstErr
+}
+
+// packageCmd returns the command treating the package.
+// The local package file (if any) is installed by rpm, dpkg or apk
+// into the root directory (unless empty), the package manager
+// is used otherwise. The package manager uses the local repository
+// only, if the repo is set
+func packageCmd(pkg Package, root, file, repo string) ([]string, error) {
+	managers, ok := pkgManagers[pkg.Type]
+	if !ok {
+		return nil, errors.New("unsupported package format " + pkg.Type)
+	}
+	manager := managers[0]
+	if pkg.Manager != "" {
+		manager = ""
+		for _, m := range managers {
+			if m == pkg.Manager {
+				manager = m
+			}
+		}
+		if manager == "" {
+			return nil, fmt.Errorf("package manager %s doesn't support %s packages", pkg.Manager, pkg.Type)
+		}
+	}
+	if pkg.Action != ACTION_INSTALL && pkg.Action != ACTION_REMOVE {
+		return nil, errors.New("unsupported package manip action " + pkg.Action)
+	}
+
+	if file != "" {
+		if pkg.Action != ACTION_INSTALL {
+			return nil, fmt.Errorf("package file %s can only be installed", file)
+		}
+		var cmd []string
+		switch pkg.Type {
+		case PKG_TYPE_RPM:
+			cmd = []string{"rpm", "-U", "--replacepkgs"}
+		case PKG_TYPE_DEB:
+			cmd = []string{"dpkg", "-i"}
+		case PKG_TYPE_APK:
+			cmd = []string{"apk", "add", "--allow-untrusted"}
+		}
+		if root != "" {
+			cmd = append([]string{cmd[0], "--root", root}, cmd[1:]...)
+		}
+		return append(cmd, file), nil
+	}
+
+	switch manager {
+	case PKG_MANAGER_YUM, PKG_MANAGER_DNF:
+		cmd := []string{manager, "-y"}
+		if repo != "" {
+			cmd = append(cmd, "--disablerepo=*", "--repofrompath=deployer,"+repo, "--enablerepo=deployer", "--nogpgcheck")
+		}
+		return append(cmd, pkg.Action, pkg.Name), nil
+	case PKG_MANAGER_ZYPPER:
+		cmd := []string{manager, "--non-interactive"}
+		if repo != "" {
+			cmd = append(cmd, "--no-gpg-checks", "--plus-repo", repo)
+		}
+		return append(cmd, pkg.Action, pkg.Name), nil
+	case PKG_MANAGER_APT:
+		if repo == "" {
+			return []string{manager, "-y", pkg.Action, pkg.Name}, nil
+		}
+		// the package lists of the repository are kept apart.
+		// The source and the package are passed as the script arguments
+		// so that they are never interpreted by the shell
+		opts := `-o Dir::Etc::SourceList="$list" -o Dir::Etc::SourceParts=- -o APT::Get::List-Cleanup=0`
+		script := fmt.Sprintf(`list=$(mktemp) || exit 1; printf '%%s\n' "$1" > "$list" && `+
+			`apt-get %s update && apt-get %s -y %s -- "$2"; rc=$?; rm -f "$list"; exit $rc`,
+			opts, opts, pkg.Action)
+		source := "deb [trusted=yes] file:" + (&url.URL{Path: repo}).EscapedPath() + " ./"
+		return []string{"sh", "-c", script, "sh", source, pkg.Name}, nil
+	}
+	// apk
+	cmd := []string{manager, "add"}
+	if pkg.Action == ACTION_REMOVE {
+		cmd[1] = "del"
+	}
+	if repo != "" {
+		cmd = append(cmd, "--repository", repo, "--allow-untrusted")
+	}
+	return append(cmd, pkg.Name), nil
+}
@@ -0,0 +1,76 @@
+package content
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPackageCmd(t *testing.T) {
+	for _, test := range []struct {
+		pkg              Package
+		root, file, repo string
+		expected         []string
+	}{
+		{Package{Name: "tunctl", Type: PKG_TYPE_RPM, Action: ACTION_INSTALL}, "", "", "",
+			[]string{"yum", "-y", "install", "tunctl"}},
+		{Package{Name: "myapp", Type: PKG_TYPE_RPM, Action: ACTION_INSTALL}, "/mnt", "/cfg/packages/myapp.rpm", "",
+			[]string{"rpm", "--root", "/mnt", "-U", "--replacepkgs", "/cfg/packages/myapp.rpm"}},
+		{Package{Name: "myapp", Type: PKG_TYPE_DEB, Action: ACTION_INSTALL}, "/mnt", "/cfg/packages/myapp.deb", "",
+			[]string{"dpkg", "--root", "/mnt", "-i", "/cfg/packages/myapp.deb"}},
+		{Package{Name: "myapp", Type: PKG_TYPE_APK, Action: ACTION_INSTALL}, "", "/cfg/packages/myapp.apk", "",
+			[]string{"apk", "add", "--allow-untrusted", "/cfg/packages/myapp.apk"}},
+		{Package{Name: "mytool", Type: PKG_TYPE_RPM, Manager: PKG_MANAGER_DNF, Action: ACTION_INSTALL}, "/mnt", "", "/tmp/repo",
+			[]string{"dnf", "-y", "--disablerepo=*", "--repofrompath=deployer,/tmp/repo", "--enablerepo=deployer", "--nogpgcheck", "install", "mytool"}},
+		{Package{Name: "mytool", Type: PKG_TYPE_RPM, Manager: PKG_MANAGER_ZYPPER, Action: ACTION_REMOVE}, "", "", "",
+			[]string{"zypper", "--non-interactive", "remove", "mytool"}},
+		{Package{Name: "mytool", Type: PKG_TYPE_APK, Action: ACTION_REMOVE}, "", "", "",
+			[]string{"apk", "del", "mytool"}},
+		{Package{Name: "mytool", Type: PKG_TYPE_APK, Action: ACTION_INSTALL}, "", "", "/tmp/repo",
+			[]string{"apk", "add", "--repository", "/tmp/repo", "--allow-untrusted", "mytool"}},
+		{Package{Name: "mytool", Type: PKG_TYPE_DEB, Action: ACTION_REMOVE}, "", "", "",
+			[]string{"apt-get", "-y", "remove", "mytool"}},
+	} {
+		cmd, err := packageCmd(test.pkg, test.root, test.file, test.repo)
+		if err != nil || !reflect.DeepEqual(cmd, test.expected) {
+			t.Fatalf("unexpected command %q [%v]", cmd, err)
+		}
+	}
+
+	// the repository and the package are never part of the script
+	for repo, source := range map[string]string{
+		"/tmp/repo":           "deb [trusted=yes] file:/tmp/repo ./",
+		"/tmp/my repo;reboot": "deb [trusted=yes] file:/tmp/my%20repo;reboot ./",
+	} {
+		cmd, err := packageCmd(Package{Name: "mytool", Type: PKG_TYPE_DEB, Action: ACTION_INSTALL}, "", "", repo)
+		if err != nil || len(cmd) != 6 || cmd[0] != "sh" || !strings.Contains(cmd[2], `-y install -- "$2"`) ||
+			strings.Contains(cmd[2], "repo") || !reflect.DeepEqual(cmd[3:], []string{"sh", source, "mytool"}) {
+			t.Fatalf("unexpected command %q [%v]", cmd, err)
+		}
+	}
+
+	for _, pkg := range []Package{
+		{Name: "mytool", Type: PKG_TYPE_DEB, Manager: PKG_MANAGER_DNF, Action: ACTION_INSTALL},
+		{Name: "mytool", Type: "tgz", Action: ACTION_INSTALL},
+		{Name: "mytool", Type: PKG_TYPE_RPM, Action: ACTION_UPLOAD},
+	} {
+		if _, err := packageCmd(pkg, "", "", ""); err == nil {
+			t.Fatalf("%+v: expected error", pkg)
+		}
+	}
+	if _, err := packageCmd(Package{Name: "myapp", Type: PKG_TYPE_RPM, Action: ACTION_REMOVE}, "", "myapp.rpm", ""); err == nil {
+		t.Fatal("package file removal, expected error")
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	if path := localPath("/cfg/packages", "repo"); path != "/cfg/packages/repo" {
+		t.Fatalf("unexpected path %s", path)
+	}
+	if path := localPath("/cfg/packages", "/srv/repo"); path != "/srv/repo" {
+		t.Fatalf("unexpected path %s", path)
+	}
+	if path := localPath("/cfg/packages", ""); path != "" {
+		t.Fatalf("unexpected path %s", path)
+	}
+}
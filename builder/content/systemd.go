@@ -0,0 +1,341 @@
+// Responsible for managing systemd units on the mounted rootfs
+
+package content
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/infra/utils/ioutils"
+)
+
+// systemdConfDir is the directory the units are enabled, masked
+// and installed in
+const systemdConfDir = "/etc/systemd/system"
+
+// systemdUnitPaths is the units search path on the offline rootfs
+// in the order of precedence
+var systemdUnitPaths = []string{
+	systemdConfDir,
+	"/usr/local/lib/systemd/system",
+	"/usr/lib/systemd/system",
+	"/lib/systemd/system",
+}
+
+// unitInstall represents the [Install] section of a unit file
+type unitInstall struct {
+	WantedBy        []string
+	RequiredBy      []string
+	Alias           []string
+	Also            []string
+	DefaultInstance string
+}
+
+// systemdManip treats the systemd service on the mounted rootfs
+// without the running systemd: installs the unit file and the drop-ins
+// found in pathToUnits, enables, disables or masks the unit by managing
+// the symlinks the same way systemctl does.
+// The status "on" unmasks the unit before enabling it.
+// The actions are applied by systemctl on the running system
+// and therefore not supported over chroot
+func systemdManip(svc Service, pathToSlash, pathToUnits string) error {
+	if err := installUnit(pathToSlash, pathToUnits, svc.Name); err != nil {
+		return utils.FormatError(err)
+	}
+	switch svc.Status {
+	case SVC_STATUS_ON:
+		if err := unmaskUnit(pathToSlash, svc.Name); err != nil {
+			return utils.FormatError(err)
+		}
+		if err := enableUnit(pathToSlash, svc.Name, map[string]bool{}); err != nil {
+			return utils.FormatError(err)
+		}
+	case SVC_STATUS_OFF:
+		if err := disableUnit(pathToSlash, svc.Name, map[string]bool{}); err != nil {
+			return utils.FormatError(err)
+		}
+	case SVC_STATUS_MASK:
+		if err := maskUnit(pathToSlash, svc.Name); err != nil {
+			return utils.FormatError(err)
+		}
+	case "":
+	default:
+		return utils.FormatError(errors.New(`ServiceManip :systemd:status configuration error - unsupported service status ` + svc.Status))
+	}
+	switch svc.Action {
+	case ACTION_STOP, ACTION_START, ACTION_RESTART, ACTION_RELOAD:
+		if svc.Chroot {
+			return utils.FormatError(fmt.Errorf("ServiceManip :systemd:action: %s %s is not supported over chroot", svc.Action, svc.Name))
+		}
+		if out, err := exec.Command("systemctl", svc.Action, svc.Name).CombinedOutput(); err != nil {
+			return utils.FormatError(fmt.Errorf("systemctl %s %s: %s", svc.Action, svc.Name, out))
+		}
+	case "":
+	default:
+		return utils.FormatError(errors.New(`ServiceManip :systemd:action: configuration error - unsupported action ` + svc.Action))
+	}
+	return nil
+}
+
+// installUnit copies the unit file and the drop-ins (name.d/*.conf)
+// found in pathToUnits to systemdConfDir of the rootfs
+func installUnit(pathToSlash, pathToUnits, name string) error {
+	confDir := filepath.Join(pathToSlash, systemdConfDir)
+	src := filepath.Join(pathToUnits, name)
+	if _, err := os.Stat(src); err == nil {
+		if err := os.MkdirAll(confDir, 0755); err != nil {
+			return utils.FormatError(err)
+		}
+		if err := ioutils.CopyFile(src, filepath.Join(confDir, name), 0644, 0, 0, false); err != nil {
+			return utils.FormatError(err)
+		}
+	}
+	dropIns, err := filepath.Glob(filepath.Join(pathToUnits, name+".d", "*.conf"))
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	for _, dropIn := range dropIns {
+		dir := filepath.Join(confDir, name+".d")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return utils.FormatError(err)
+		}
+		if err := ioutils.CopyFile(dropIn, filepath.Join(dir, filepath.Base(dropIn)), 0644, 0, 0, false); err != nil {
+			return utils.FormatError(err)
+		}
+	}
+	return nil
+}
+
+// enableUnit creates the symlinks according to the [Install] section
+// of the unit and enables the units mentioned by Also=.
+// visited prevents enabling the same unit twice
+func enableUnit(pathToSlash, name string, visited map[string]bool) error {
+	if visited[name] {
+		return nil
+	}
+	visited[name] = true
+	unitPath, install, err := readUnit(pathToSlash, name)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	linkName := name
+	if prefix, instance, suffix := splitUnitName(name); prefix != "" && instance == "" {
+		// template is enabled by its default instance only
+		linkName = ""
+		if install.DefaultInstance != "" {
+			linkName = prefix + "@" + install.DefaultInstance + suffix
+		}
+	}
+	confDir := filepath.Join(pathToSlash, systemdConfDir)
+	if linkName != "" {
+		for _, target := range install.WantedBy {
+			if err := symlinkUnit(unitPath, filepath.Join(confDir, target+".wants", linkName)); err != nil {
+				return utils.FormatError(err)
+			}
+		}
+		for _, target := range install.RequiredBy {
+			if err := symlinkUnit(unitPath, filepath.Join(confDir, target+".requires", linkName)); err != nil {
+				return utils.FormatError(err)
+			}
+		}
+	}
+	for _, alias := range install.Alias {
+		if err := symlinkUnit(unitPath, filepath.Join(confDir, alias)); err != nil {
+			return utils.FormatError(err)
+		}
+	}
+	for _, also := range install.Also {
+		if err := enableUnit(pathToSlash, also, visited); err != nil {
+			return utils.FormatError(err)
+		}
+	}
+	return nil
+}
+
+// disableUnit removes the symlinks created by enableUnit: the aliases
+// and the links of the unit (of all the instances of the template)
+// in the .wants and .requires directories
+func disableUnit(pathToSlash, name string, visited map[string]bool) error {
+	if visited[name] {
+		return nil
+	}
+	visited[name] = true
+	unitPath, install, err := readUnit(pathToSlash, name)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	confDir := filepath.Join(pathToSlash, systemdConfDir)
+	prefix, instance, suffix := splitUnitName(name)
+	err = filepath.Walk(confDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		if !strings.HasSuffix(dir, ".wants") && !strings.HasSuffix(dir, ".requires") {
+			return nil
+		}
+		base := filepath.Base(path)
+		if base == name || (prefix != "" && instance == "" && strings.HasPrefix(base, prefix+"@") && strings.HasSuffix(base, suffix)) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return utils.FormatError(err)
+	}
+	for _, alias := range install.Alias {
+		path := filepath.Join(confDir, alias)
+		if target, err := os.Readlink(path); err == nil && target == unitPath {
+			if err := os.Remove(path); err != nil {
+				return utils.FormatError(err)
+			}
+		}
+	}
+	for _, also := range install.Also {
+		if err := disableUnit(pathToSlash, also, visited); err != nil {
+			return utils.FormatError(err)
+		}
+	}
+	return nil
+}
+
+// maskUnit links the unit to /dev/null
+func maskUnit(pathToSlash, name string) error {
+	path := filepath.Join(pathToSlash, systemdConfDir, name)
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return utils.FormatError(fmt.Errorf("cannot mask %s: unit file %s exists", name, path))
+	}
+	if err := symlinkUnit("/dev/null", path); err != nil {
+		return utils.FormatError(err)
+	}
+	return nil
+}
+
+// unmaskUnit removes the link of the masked unit
+func unmaskUnit(pathToSlash, name string) error {
+	path := filepath.Join(pathToSlash, systemdConfDir, name)
+	if target, err := os.Readlink(path); err == nil && target == "/dev/null" {
+		if err := os.Remove(path); err != nil {
+			return utils.FormatError(err)
+		}
+	}
+	return nil
+}
+
+// setDefaultTarget links default.target to the target unit
+func setDefaultTarget(pathToSlash, target string) error {
+	unitPath, err := findUnit(pathToSlash, target)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	if err := symlinkUnit(unitPath, filepath.Join(pathToSlash, systemdConfDir, "default.target")); err != nil {
+		return utils.FormatError(err)
+	}
+	return nil
+}
+
+// symlinkUnit replaces the link (if any) by the link to the unit
+func symlinkUnit(unitPath, link string) error {
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(link); err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("%s exists and is not a symlink", link)
+		}
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(unitPath, link)
+}
+
+// findUnit returns the path to the unit file (the template of the instance)
+// relative to the rootfs
+func findUnit(pathToSlash, name string) (string, error) {
+	names := []string{name}
+	if prefix, instance, suffix := splitUnitName(name); instance != "" {
+		names = append(names, prefix+"@"+suffix)
+	}
+	for _, n := range names {
+		for _, dir := range systemdUnitPaths {
+			unitPath := filepath.Join(dir, n)
+			if info, err := os.Lstat(filepath.Join(pathToSlash, unitPath)); err == nil && info.Mode().IsRegular() {
+				return unitPath, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unit %s not found", name)
+}
+
+// readUnit finds the unit and parses its [Install] section
+func readUnit(pathToSlash, name string) (string, *unitInstall, error) {
+	unitPath, err := findUnit(pathToSlash, name)
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := os.Open(filepath.Join(pathToSlash, unitPath))
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	install := new(unitInstall)
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			section = line
+			continue
+		}
+		if section != "[Install]" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		values := strings.Fields(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "WantedBy":
+			install.WantedBy = append(install.WantedBy, values...)
+		case "RequiredBy":
+			install.RequiredBy = append(install.RequiredBy, values...)
+		case "Alias":
+			install.Alias = append(install.Alias, values...)
+		case "Also":
+			install.Also = append(install.Also, values...)
+		case "DefaultInstance":
+			install.DefaultInstance = strings.TrimSpace(kv[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+	return unitPath, install, nil
+}
+
+// splitUnitName splits the name of the template or the instance
+// (getty@tty1.service) to the prefix, the instance and the suffix.
+// The prefix is empty unless it is the template or the instance
+func splitUnitName(name string) (prefix, instance, suffix string) {
+	at := strings.Index(name, "@")
+	dot := strings.LastIndex(name, ".")
+	if at < 0 || dot < at {
+		return "", "", ""
+	}
+	return name[:at], name[at+1 : dot], name[dot:]
+}
@@ -0,0 +1,157 @@
+package content
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeRootfs creates the rootfs tree with the units provided
+func fakeRootfs(t *testing.T, units map[string]string) string {
+	slash, err := ioutil.TempDir("", "rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range units {
+		path := filepath.Join(slash, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return slash
+}
+
+func checkLink(t *testing.T, slash, link, target string) {
+	if got, err := os.Readlink(filepath.Join(slash, link)); err != nil || got != target {
+		t.Fatalf("%s: expected link to %s, got %q [%v]", link, target, got, err)
+	}
+}
+
+func checkNoLink(t *testing.T, slash, link string) {
+	if _, err := os.Lstat(filepath.Join(slash, link)); !os.IsNotExist(err) {
+		t.Fatalf("%s is not removed", link)
+	}
+}
+
+var testUnits = map[string]string{
+	"usr/lib/systemd/system/foo.service":      "[Unit]\nDescription=foo\n\n[Install]\nWantedBy=multi-user.target\nAlias=bar.service\nAlso=foo.socket\n",
+	"usr/lib/systemd/system/foo.socket":       "[Install]\n# comment\nWantedBy=sockets.target\n",
+	"usr/lib/systemd/system/getty@.service":   "[Install]\nWantedBy=getty.target\nDefaultInstance=tty1\n",
+	"usr/lib/systemd/system/db.service":       "[Install]\nRequiredBy=multi-user.target\n",
+	"lib/systemd/system/multi-user.target":    "[Unit]\nDescription=Multi-User System\n",
+	"usr/lib/systemd/system/graphical.target": "[Unit]\nDescription=Graphical Interface\n",
+}
+
+func TestEnableDisableUnit(t *testing.T) {
+	slash := fakeRootfs(t, testUnits)
+	defer os.RemoveAll(slash)
+
+	for _, name := range []string{"foo.service", "getty@.service", "getty@tty2.service", "db.service"} {
+		if err := enableUnit(slash, name, map[string]bool{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkLink(t, slash, "etc/systemd/system/multi-user.target.wants/foo.service", "/usr/lib/systemd/system/foo.service")
+	checkLink(t, slash, "etc/systemd/system/bar.service", "/usr/lib/systemd/system/foo.service")
+	checkLink(t, slash, "etc/systemd/system/sockets.target.wants/foo.socket", "/usr/lib/systemd/system/foo.socket")
+	checkLink(t, slash, "etc/systemd/system/getty.target.wants/getty@tty1.service", "/usr/lib/systemd/system/getty@.service")
+	checkLink(t, slash, "etc/systemd/system/getty.target.wants/getty@tty2.service", "/usr/lib/systemd/system/getty@.service")
+	checkLink(t, slash, "etc/systemd/system/multi-user.target.requires/db.service", "/usr/lib/systemd/system/db.service")
+	checkNoLink(t, slash, "etc/systemd/system/getty.target.wants/getty@.service")
+
+	// enabling twice is harmless
+	if err := enableUnit(slash, "foo.service", map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := disableUnit(slash, "getty@tty2.service", map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+	checkNoLink(t, slash, "etc/systemd/system/getty.target.wants/getty@tty2.service")
+	checkLink(t, slash, "etc/systemd/system/getty.target.wants/getty@tty1.service", "/usr/lib/systemd/system/getty@.service")
+	if err := disableUnit(slash, "getty@.service", map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+	checkNoLink(t, slash, "etc/systemd/system/getty.target.wants/getty@tty1.service")
+
+	if err := disableUnit(slash, "foo.service", map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+	checkNoLink(t, slash, "etc/systemd/system/multi-user.target.wants/foo.service")
+	checkNoLink(t, slash, "etc/systemd/system/bar.service")
+	checkNoLink(t, slash, "etc/systemd/system/sockets.target.wants/foo.socket")
+	checkLink(t, slash, "etc/systemd/system/multi-user.target.requires/db.service", "/usr/lib/systemd/system/db.service")
+
+	if err := enableUnit(slash, "missing.service", map[string]bool{}); err == nil {
+		t.Fatal("unit not found, expected error")
+	}
+}
+
+func TestMaskUnit(t *testing.T) {
+	slash := fakeRootfs(t, testUnits)
+	defer os.RemoveAll(slash)
+
+	if err := maskUnit(slash, "foo.service"); err != nil {
+		t.Fatal(err)
+	}
+	checkLink(t, slash, "etc/systemd/system/foo.service", "/dev/null")
+	if err := unmaskUnit(slash, "foo.service"); err != nil {
+		t.Fatal(err)
+	}
+	checkNoLink(t, slash, "etc/systemd/system/foo.service")
+
+	installed := fakeRootfs(t, map[string]string{"etc/systemd/system/local.service": "[Install]\n"})
+	defer os.RemoveAll(installed)
+	if err := maskUnit(installed, "local.service"); err == nil {
+		t.Fatal("unit file exists, expected error")
+	}
+}
+
+func TestServiceManipSystemd(t *testing.T) {
+	slash := fakeRootfs(t, testUnits)
+	defer os.RemoveAll(slash)
+	configDir := fakeRootfs(t, map[string]string{
+		"services.xml": `<services>
+	<default_target>multi-user.target</default_target>
+	<service>
+		<name>app.service</name>
+		<type>systemd</type>
+		<status>on</status>
+	</service>
+	<service>
+		<name>foo.service</name>
+		<type>systemd</type>
+		<status>mask</status>
+	</service>
+</services>`,
+		"units/app.service":                  "[Service]\nExecStart=/opt/app\n\n[Install]\nWantedBy=multi-user.target\n",
+		"units/app.service.d/10-limits.conf": "[Service]\nLimitNOFILE=65536\n",
+	})
+	defer os.RemoveAll(configDir)
+
+	if err := serviceManip(filepath.Join(configDir, "services.xml"), slash); err != nil {
+		t.Fatal(err)
+	}
+	checkLink(t, slash, "etc/systemd/system/multi-user.target.wants/app.service", "/etc/systemd/system/app.service")
+	checkLink(t, slash, "etc/systemd/system/foo.service", "/dev/null")
+	checkLink(t, slash, "etc/systemd/system/default.target", "/lib/systemd/system/multi-user.target")
+	if data, err := ioutil.ReadFile(filepath.Join(slash, "etc/systemd/system/app.service.d/10-limits.conf")); err != nil || string(data) != "[Service]\nLimitNOFILE=65536\n" {
+		t.Fatalf("drop-in isn't installed: %q [%v]", data, err)
+	}
+}
+
+func TestSplitUnitName(t *testing.T) {
+	for name, expected := range map[string][3]string{
+		"getty@tty1.service": {"getty", "tty1", ".service"},
+		"getty@.service":     {"getty", "", ".service"},
+		"sshd.service":       {"", "", ""},
+	} {
+		if prefix, instance, suffix := splitUnitName(name); [3]string{prefix, instance, suffix} != expected {
+			t.Fatalf("%s: unexpected %q %q %q", name, prefix, instance, suffix)
+		}
+	}
+}
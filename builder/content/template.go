@@ -0,0 +1,102 @@
+// Responsible for rendering the injected items
+
+package content
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// TemplateData is the deployment data the items injected
+// by ACTION_TEMPLATE are rendered with
+type TemplateData struct {
+	// appliance name
+	Name string
+
+	CPUs  int
+	RamMb int
+
+	// the NICs of the chosen networks ordered by the guest PCI address
+	NICs []*TemplateNIC
+
+	// the guest NUMA layout
+	NUMAs []*TemplateNUMA
+
+	// directory the artifacts are exported to
+	ExportDir string
+
+	// custom data (the bundle and so forth)
+	Custom map[string]interface{}
+}
+
+// TemplateNIC represents the NIC of the guest
+type TemplateNIC struct {
+	// network the NIC is attached to
+	Network string
+
+	// guest PCI address (0000:00:05.0)
+	PCIAddr string
+
+	// the host NIC and its PCI address
+	HostNIC     string
+	HostPCIAddr string
+}
+
+// TemplateNUMA represents the guest NUMA cell
+type TemplateNUMA struct {
+	CellID   int
+	MemoryMb int
+
+	// the vCPUs of the cell and the host CPUs they are pinned to
+	CPUs   []int
+	CPUPin map[int][]int
+}
+
+// templateFuncs are available to the templates in addition
+// to the text/template builtins
+var templateFuncs = template.FuncMap{
+	// join joins the integers (CPU lists) by the separator
+	"join": func(ints []int, sep string) string {
+		strs := make([]string, len(ints))
+		for index, n := range ints {
+			strs[index] = strconv.Itoa(n)
+		}
+		return strings.Join(strs, sep)
+	},
+}
+
+// renderItem renders the template src to dst.
+// dst gets the permissions of src
+func renderItem(src, dst string, data *TemplateData) error {
+	if data == nil {
+		return fmt.Errorf("%s: no deployment data to render the template with", src)
+	}
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New(filepath.Base(src)).Funcs(templateFuncs).Option("missingkey=error").Parse(string(buf))
+	if err != nil {
+		return err
+	}
+	finfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	mode := finfo.Mode().Perm()
+	fd, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if err := tmpl.Execute(fd, data); err != nil {
+		return err
+	}
+	// the mode of the existing file is kept by OpenFile
+	return fd.Chmod(mode)
+}
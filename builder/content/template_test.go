@@ -0,0 +1,62 @@
+package content
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInjectTemplate(t *testing.T) {
+	slash := fakeRootfs(t, nil)
+	defer os.RemoveAll(slash)
+	configDir := fakeRootfs(t, map[string]string{
+		"inject_items.xml": `<items>
+	<item>
+		<name>hostname</name>
+		<action>template</action>
+		<type>file</type>
+		<location>/etc</location>
+		<permissions>0600</permissions>
+	</item>
+	<item>
+		<name>tuning.conf</name>
+		<action>template</action>
+		<type>file</type>
+		<location>/etc/myapp</location>
+	</item>
+</items>`,
+		"items/hostname":    "{{.Name}}\n",
+		"items/tuning.conf": "cpus={{.CPUs}}\n{{range .NICs}}{{.Network}}={{.PCIAddr}}\n{{end}}{{range .NUMAs}}node{{.CellID}}={{join .CPUs \",\"}}\n{{end}}",
+	})
+	defer os.RemoveAll(configDir)
+
+	data := &TemplateData{
+		Name:  "myvm",
+		CPUs:  2,
+		NICs:  []*TemplateNIC{{Network: "Management", PCIAddr: "0000:00:06.0"}},
+		NUMAs: []*TemplateNUMA{{CellID: 0, CPUs: []int{0, 1}}},
+	}
+	if err := CustomizeWithData(slash, configDir, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		"etc/hostname":          "myvm\n",
+		"etc/myapp/tuning.conf": "cpus=2\nManagement=0000:00:06.0\nnode0=0,1\n",
+	} {
+		if buf, err := ioutil.ReadFile(filepath.Join(slash, path)); err != nil || string(buf) != expected {
+			t.Fatalf("%s: unexpected content %q [%v]", path, buf, err)
+		}
+	}
+	if finfo, _ := os.Stat(filepath.Join(slash, "etc/hostname")); finfo.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected permissions %v", finfo.Mode())
+	}
+
+	if err := Customize(slash, configDir); err == nil {
+		t.Fatal("no deployment data, expected error")
+	}
+	ioutil.WriteFile(filepath.Join(configDir, "items/hostname"), []byte("{{.Hostname}}\n"), 0644)
+	if err := CustomizeWithData(slash, configDir, data, nil); err == nil {
+		t.Fatal("unknown field, expected error")
+	}
+}
@@ -31,6 +31,105 @@
 // 	 </disk>
 // </config>
 //</storage>`
+//
+// GPT layout booted by UEFI firmware (OVMF for example):
+//
+//	 <disk>
+//	  	<size_mb>5120</size_mb>
+//	  	<partition_table>gpt</partition_table>
+//    	<bootable>true</bootable>
+//    	<bootloader>grub-efi</bootloader>
+//  	 <partition>
+//	 	    <sequence>1</sequence>
+//	 	    <type_guid>C12A7328-F81F-11D2-BA4B-00A0C93EC93B</type_guid>
+//	 	    <name>EFI System</name>
+//	 	    <size_mb>256</size_mb>
+//   	    <label>ESP</label>
+//   	    <mount_point>/boot/efi</mount_point>
+//   	    <file_system>vfat</file_system>
+//	 	 </partition>
+//  	 <partition>
+//	 	    <sequence>2</sequence>
+//	 	    <name>root</name>
+//	 	    <size_mb>-1</size_mb>
+//	 	    <size_percents>-2</size_percents>
+//   	    <label>SLASH</label>
+//   	    <mount_point>/</mount_point>
+//   	    <file_system>ext4</file_system>
+//	 	 </partition>
+// 	 </disk>
+//
+// LUKS encrypted partition holding an LVM volume group
+// and btrfs subvolumes:
+//
+//  	 <partition>
+//	 	    <sequence>2</sequence>
+//	 	    <type>83</type>
+//	 	    <size_mb>2048</size_mb>
+//	 	    <luks>
+//	 	       <name>cryptdata</name>
+//	 	       <keyfile>/etc/luks/data.key</keyfile>
+//	 	       <host_keyfile>/root/keys/data.key</host_keyfile>
+//	 	    </luks>
+//	 	    <lvm>
+//	 	       <volume_group>vgdata</volume_group>
+//	 	       <logical_volume>
+//	 	          <name>log</name>
+//	 	          <size_mb>512</size_mb>
+//	 	          <label>LOG</label>
+//	 	          <mount_point>/var/log</mount_point>
+//	 	          <file_system>xfs</file_system>
+//	 	       </logical_volume>
+//	 	       <logical_volume>
+//	 	          <name>data</name>
+//	 	          <size_mb>-1</size_mb>
+//	 	          <size_percents>-2</size_percents>
+//	 	          <label>DATA</label>
+//	 	          <file_system>btrfs</file_system>
+//	 	          <subvolume>
+//	 	             <name>@srv</name>
+//	 	             <mount_point>/srv</mount_point>
+//	 	             <mount_options>compress=zstd</mount_options>
+//	 	          </subvolume>
+//	 	       </logical_volume>
+//	 	    </lvm>
+//	 	 </partition>
+//
+// An unencrypted LVM physical volume is of <type>142</type> (0x8e).
+//
+// The file systems are added to /etc/fstab of the image once the rootfs
+// is customized, the existing entries of the same mount points are replaced.
+// The disk sets <fstab>uuid</fstab> to identify the file systems by UUID
+// rather than by label or <fstab>none</fstab> to keep fstab intact.
+// The partitions and the logical volumes set <mount_options>, <dump>
+// and <pass> (fsck order) of the entries:
+//
+//  	 <partition>
+//	 	    <sequence>3</sequence>
+//	 	    <type>83</type>
+//	 	    <size_mb>512</size_mb>
+//   	    <label>DATA</label>
+//   	    <mount_point>/data</mount_point>
+//   	    <file_system>ext4</file_system>
+//   	    <mount_options>noatime,nodev</mount_options>
+//   	    <pass>0</pass>
+//	 	 </partition>
+//
+// An existing image is grown to <size_mb> by Grow, the last partition
+// and its file system are resized (ext3, ext4, xfs, btrfs and SWAP).
+// The disk sets <grow_partition> to allocate the space added
+// to a new partition rather than to the last one:
+//
+//	 	 <grow_partition>
+//	 	    <type>83</type>
+//   	    <label>DATA2</label>
+//   	    <mount_point>/data2</mount_point>
+//   	    <file_system>ext4</file_system>
+//	 	 </grow_partition>
+//
+// The image is built without root privileges and loop devices
+// from a staging directory if the disk sets <backend>rootless</backend>
+// (see NewRootless).
 
 package image
 
@@ -49,14 +148,78 @@ const (
 	StorageTypeRAW   StorageType = "raw"
 	StorageTypeQCOW2 StorageType = "qcow2"
 	StorageTypeVMDK  StorageType = "vmdk"
+
+	// qcow2 with compressed clusters
+	StorageTypeQCOW2Compressed StorageType = "qcow2c"
+
+	// fixed size VHD (Hyper-V and Azure)
+	StorageTypeVHD StorageType = "vhd"
+
+	// dynamically expanding VHDX (Hyper-V)
+	StorageTypeVHDX StorageType = "vhdx"
 )
 
+// Format returns the qemu-img format of the storage type
+func (t StorageType) Format() string {
+	switch t {
+	case StorageTypeQCOW2Compressed:
+		return string(StorageTypeQCOW2)
+	case StorageTypeVHD:
+		return "vpc"
+	}
+	return string(t)
+}
+
+// Extension returns the image file extension of the storage type
+func (t StorageType) Extension() string {
+	if t == StorageTypeQCOW2Compressed {
+		return string(StorageTypeQCOW2)
+	}
+	return string(t)
+}
+
 type BootLoaderType string
 
 const (
 	BootLoaderGrub     BootLoaderType = "grub"
 	BootLoaderGrub2    BootLoaderType = "grub2"
 	BootLoaderExtlinux BootLoaderType = "extlinux"
+
+	// UEFI boot loaders, installed to the EFI system partition
+	BootLoaderGrubEfi     BootLoaderType = "grub-efi"
+	BootLoaderSystemdBoot BootLoaderType = "systemd-boot"
+)
+
+type PartTableType string
+
+const (
+	PartTableMBR PartTableType = "msdos"
+	PartTableGPT PartTableType = "gpt"
+)
+
+type Backend string
+
+const (
+	// loop device, kpartx and real mounts (requires root)
+	BackendLoop Backend = "loop"
+
+	// file systems are created from a staging directory
+	// and written to the partition offsets (see NewRootless)
+	BackendRootless Backend = "rootless"
+)
+
+// FstabType defines how the file systems are identified
+// by the generated /etc/fstab
+type FstabType string
+
+const (
+	// LABEL=<label>, the default. The file systems having no label
+	// are identified by UUID
+	FstabLabel FstabType = "label"
+	FstabUUID  FstabType = "uuid"
+
+	// /etc/fstab is not generated
+	FstabNone FstabType = "none"
 )
 
 type ConfigIndex uint8
@@ -76,21 +239,92 @@ type Disk struct {
 	Bootable        bool           `xml:"bootable"`
 	BootLoader      BootLoaderType `xml:"bootloader"`
 	ActivePartition int            `xml:"active_part"`
+	PartTable       PartTableType  `xml:"partition_table"`
+	Backend         Backend        `xml:"backend"`
+	ClusterSize     string         `xml:"cluster_size"`
+	Fstab           FstabType      `xml:"fstab"`
 	FdiskCmd        string         `xml:"fdisk_cmd"`
 	Description     string         `xml:"description"`
 	Partitions      []*Partition   `xml:"partition"`
+
+	// the partition the space added by Grow is allocated to.
+	// The last partition is resized if not set
+	GrowPartition *Partition `xml:"grow_partition"`
 }
 
 type Partition struct {
 	Sequence       int    `xml:"sequence"`
 	Type           int    `xml:"type"`
+	TypeGUID       string `xml:"type_guid"`
+	Name           string `xml:"name"`
 	SizeMb         int    `xml:"size_mb"`
 	SizePercents   int    `xml:"size_percents"`
 	Label          string `xml:"label"`
 	MountPoint     string `xml:"mount_point"`
 	FileSystem     string `xml:"file_system"`
 	FileSystemArgs string `xml:"file_system_args"`
+	MountOptions   string `xml:"mount_options"`
+	Dump           int    `xml:"dump"`
+	Pass           *int   `xml:"pass"`
 	Description    string `xml:"description"`
+
+	// btrfs subvolumes of the partition file system
+	Subvolumes []*Subvolume `xml:"subvolume"`
+
+	// the partition is encrypted, the file system (or LVM)
+	// is created on the opened LUKS device
+	LUKS *LUKS `xml:"luks"`
+
+	// the partition is an LVM physical volume,
+	// the file systems are created on the logical volumes
+	LVM *LVM `xml:"lvm"`
+}
+
+// LUKS represents the encryption of a partition
+type LUKS struct {
+	// name of the opened device (/dev/mapper/<name>) and the crypttab entry
+	Name   string `xml:"name"`
+	Cipher string `xml:"cipher"`
+
+	// path to the keyfile inside the image. The keyfile isn't placed
+	// in the image if empty (the passphrase is prompted on boot)
+	KeyFile string `xml:"keyfile"`
+
+	// path to the keyfile on the host processing the image.
+	// The key is generated if the file doesn't exist.
+	// A temporary key is used if empty, in which case the image cannot be opened later
+	HostKeyFile string `xml:"host_keyfile"`
+}
+
+// LVM represents the volume group created on a partition.
+// Note that the volume group name must not be used on the host
+// processing the image
+type LVM struct {
+	VolumeGroup    string           `xml:"volume_group"`
+	LogicalVolumes []*LogicalVolume `xml:"logical_volume"`
+}
+
+// LogicalVolume represents a logical volume and its file system.
+// The size is calculated the same way the partition size is
+type LogicalVolume struct {
+	Name           string       `xml:"name"`
+	SizeMb         int          `xml:"size_mb"`
+	SizePercents   int          `xml:"size_percents"`
+	Label          string       `xml:"label"`
+	MountPoint     string       `xml:"mount_point"`
+	FileSystem     string       `xml:"file_system"`
+	FileSystemArgs string       `xml:"file_system_args"`
+	MountOptions   string       `xml:"mount_options"`
+	Dump           int          `xml:"dump"`
+	Pass           *int         `xml:"pass"`
+	Subvolumes     []*Subvolume `xml:"subvolume"`
+}
+
+// Subvolume represents a btrfs subvolume mounted by itself
+type Subvolume struct {
+	Name         string `xml:"name"`
+	MountPoint   string `xml:"mount_point"`
+	MountOptions string `xml:"mount_options"`
 }
 
 // ParseConfigFile is responsible for reading appropriate XML file
@@ -0,0 +1,103 @@
+package image
+
+import "fmt"
+
+// fsEntry represents a file system (or SWAP) listed by fstab
+type fsEntry struct {
+	// block device the file system is created on
+	device string
+
+	label      string
+	mountPoint string
+	fileSystem string
+	options    string
+	dump       int
+	pass       int
+}
+
+// line returns the fstab line of the file system identified by spec
+// (LABEL=<label> or UUID=<uuid>)
+func (e *fsEntry) line(spec string) string {
+	return fmt.Sprintf("%s %s %s %s %d %d", spec, e.mountPoint, e.fileSystem, e.options, e.dump, e.pass)
+}
+
+// fstabEntries returns the file systems of the disk configuration
+// listed by fstab. The device of the partition given by the index
+// in the disk configuration is provided by the caller
+func fstabEntries(config *Disk, device func(index int) string) []*fsEntry {
+	var entries []*fsEntry
+	for index, part := range config.Partitions {
+		dev := device(index)
+		if part.LUKS != nil {
+			dev = luksDevice(part.LUKS)
+		}
+		if part.LVM == nil {
+			entries = append(entries, fsEntries(part, part.Subvolumes, dev, part.Dump, part.Pass)...)
+			continue
+		}
+		for _, lv := range part.LVM.LogicalVolumes {
+			entries = append(entries, fsEntries(lv.partition(), lv.Subvolumes, lvDevice(part.LVM.VolumeGroup, lv), lv.Dump, lv.Pass)...)
+		}
+	}
+	return entries
+}
+
+// fsEntries returns the entries of the file system on the device:
+// SWAP, the file system itself and its subvolumes
+func fsEntries(part *Partition, subvolumes []*Subvolume, device string, dump int, pass *int) []*fsEntry {
+	if isSwap(part) {
+		return []*fsEntry{{device, part.Label, "none", "swap", "sw", 0, 0}}
+	}
+	var entries []*fsEntry
+	for _, v := range fsVolumes(part, subvolumes, device) {
+		options := v.options
+		if options == "" {
+			options = "defaults"
+		}
+		entries = append(entries, &fsEntry{device, part.Label, v.mountPoint, part.FileSystem,
+			options, dump, fsckPass(v.mountPoint, part.FileSystem, pass)})
+	}
+	return entries
+}
+
+// fsckPass returns the fsck pass of the file system.
+// Unless set explicitly the root file system is checked first,
+// the others afterwards. btrfs and xfs are not checked on boot
+func fsckPass(mountPoint, fs string, pass *int) int {
+	switch {
+	case pass != nil:
+		return *pass
+	case fs == "btrfs" || fs == "xfs":
+		return 0
+	case mountPoint == "/":
+		return 1
+	}
+	return 2
+}
+
+// fsSpec returns the fstab specification of the file system
+// unless it has to be looked up by UUID
+func fsSpec(config *Disk, e *fsEntry) (string, bool) {
+	if config.Fstab == FstabUUID || e.label == "" {
+		return "", false
+	}
+	return "LABEL=" + e.label, true
+}
+
+// planFstabLines returns the fstab lines WriteSystemFiles would add
+// given the devices of the partitions.
+// The UUIDs are unknown until the file systems are created
+func planFstabLines(config *Disk, device func(*Disk, int) string) []string {
+	if config.Fstab == FstabNone {
+		return nil
+	}
+	var lines []string
+	for _, e := range fstabEntries(config, func(index int) string { return device(config, index) }) {
+		spec, ok := fsSpec(config, e)
+		if !ok {
+			spec = "UUID=<" + e.device + ">"
+		}
+		lines = append(lines, e.line(spec))
+	}
+	return lines
+}
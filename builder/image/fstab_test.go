@@ -0,0 +1,79 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFstabEntries(t *testing.T) {
+	config := volumeDisk()
+	zero := 0
+	config.Partitions[1].LVM.LogicalVolumes[2].Pass = &zero
+	config.Partitions[1].LVM.LogicalVolumes[2].MountOptions = "noatime"
+	config.Partitions = append(config.Partitions, &Partition{Sequence: 3, Type: 83, SizeMb: 64,
+		MountPoint: "/boot", FileSystem: "ext2"})
+
+	var lines []string
+	for _, e := range fstabEntries(config, func(index int) string { return planMapper(config, index) }) {
+		spec, ok := fsSpec(config, e)
+		if !ok {
+			spec = "UUID=" + e.device
+		}
+		lines = append(lines, e.line(spec))
+	}
+	expected := []string{
+		"LABEL=SLASH / btrfs subvol=@ 0 0",
+		"LABEL=SLASH /home btrfs subvol=@home,compress=zstd 0 0",
+		"LABEL=LOG /var/log xfs defaults 0 0",
+		"LABEL=SWAP none swap sw 0 0",
+		"LABEL=DATA /srv ext4 noatime 0 0",
+		// the file systems having no label are identified by UUID
+		"UUID=/dev/loopNp3 /boot ext2 defaults 0 2",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("unexpected fstab %q", lines)
+	}
+
+	config.Fstab = FstabUUID
+	if _, ok := fsSpec(config, fstabEntries(config, func(int) string { return "" })[0]); ok {
+		t.Fatal("expected lookup by UUID")
+	}
+	config.Fstab = FstabNone
+	if lines := planFstabLines(config, planMapper); lines != nil {
+		t.Fatalf("unexpected fstab %q", lines)
+	}
+}
+
+func TestRootlessFstab(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer_fstab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fstab := filepath.Join(dir, "etc", "fstab")
+	if err := ioutil.WriteFile(fstab, []byte("/dev/sda1 / ext4 defaults 0 1\nproc /proc proc defaults 0 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := testDisk(PartTableMBR)
+	config.Partitions[0].Label, config.Partitions[0].MountPoint, config.Partitions[0].FileSystem = "SLASH", "/", "ext4"
+	config.Partitions[1].Label = "SWAP"
+	i := &stagedImage{config: config, staging: dir}
+	if err := i.WriteSystemFiles(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fstab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "proc /proc proc defaults 0 0\nLABEL=SLASH / ext4 defaults 0 1\nLABEL=SWAP none swap sw 0 0\n"
+	if string(data) != expected {
+		t.Fatalf("unexpected fstab %q", data)
+	}
+}
@@ -0,0 +1,92 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// GPT partition type GUIDs
+const (
+	GUIDLinuxFileSystem = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	GUIDLinuxSwap       = "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"
+	GUIDEfiSystem       = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	GUIDBiosBoot        = "21686148-6449-6E6F-744E-656564454649"
+	GUIDLinuxLVM        = "E6D6D379-F507-44C2-A23C-238F2A3DF928"
+)
+
+// MBR partition type of the EFI system partition
+const partTypeEfi = 0xef
+
+// MBR partition type of the LVM physical volume
+const partTypeLVM = 0x8e
+
+// typeGUID returns GPT partition type GUID.
+// Unless set explicitly the GUID is derived from the MBR partition type
+func typeGUID(part *Partition) string {
+	if part.TypeGUID != "" {
+		return strings.ToUpper(part.TypeGUID)
+	}
+	switch part.Type {
+	case partTypeSwap:
+		return GUIDLinuxSwap
+	case partTypeEfi:
+		return GUIDEfiSystem
+	case partTypeLVM:
+		return GUIDLinuxLVM
+	}
+	return GUIDLinuxFileSystem
+}
+
+// isSwap returns true if the partition is intended for SWAP
+func isSwap(part *Partition) bool {
+	return part.Type == partTypeSwap || strings.EqualFold(part.TypeGUID, GUIDLinuxSwap)
+}
+
+// espPartition returns the EFI system partition of the disk (if any)
+func espPartition(config *Disk) *Partition {
+	for _, part := range config.Partitions {
+		if typeGUID(part) == GUIDEfiSystem {
+			return part
+		}
+	}
+	return nil
+}
+
+// isEfiBootLoader returns true if the boot loader is booted by UEFI firmware
+func isEfiBootLoader(bootLoader BootLoaderType) bool {
+	return bootLoader == BootLoaderGrubEfi || bootLoader == BootLoaderSystemdBoot
+}
+
+// efiBootLoaderCmd returns the command installing UEFI boot loader
+// to the image mounted at rootfs.
+// The boot loader is installed to the removable media path (\EFI\BOOT\BOOTX64.EFI)
+// so that the firmware boots the disk without NVRAM entries.
+func efiBootLoaderCmd(config *Disk, rootfs string) (string, error) {
+	esp := espPartition(config)
+	if esp == nil {
+		return "", errors.New("EFI system partition not found")
+	}
+
+	var install string
+	switch config.BootLoader {
+	case BootLoaderGrubEfi:
+		args := "--target=x86_64-efi --efi-directory=" + esp.MountPoint + " --removable --no-nvram"
+		install = "if which grub-install >/dev/null 2>&1;then grub-install " + args +
+			" && grub-mkconfig -o /boot/grub/grub.cfg;else grub2-install " + args +
+			" && grub2-mkconfig -o /boot/grub2/grub.cfg;fi"
+	case BootLoaderSystemdBoot:
+		install = "bootctl --esp-path=" + esp.MountPoint + " --no-variables install" +
+			" && for k in \\$(ls /lib/modules);do kernel-install add \\$k /boot/vmlinuz-\\$k;done"
+	default:
+		return "", fmt.Errorf("%s is not UEFI boot loader", config.BootLoader)
+	}
+
+	cmd := "mount --bind /dev " + rootfs + "/dev;"
+	cmd += "mount --bind /sys " + rootfs + "/sys;"
+	cmd += "chroot " + rootfs + " /bin/sh -c "
+	cmd += "\"LC_ALL=C export PATH=/usr/local/bin:/usr/local/sbin:/usr/bin:/usr/sbin:/bin:/sbin;"
+	cmd += "mount -t proc none /proc;"
+	cmd += install + "\""
+	return cmd, nil
+}
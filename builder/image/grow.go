@@ -0,0 +1,464 @@
+// Grows an existing RAW image, its partition table and file systems
+
+package image
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/progress"
+	"github.com/dorzheh/infra/comm/sshfs"
+)
+
+// Grow opens the existing image described by the disk configuration
+// (see Open) in order to grow it to the configured size.
+// Parse grows the image and its partition table before mounting
+// the existing partitions. Unless the disk configuration sets the grow
+// partition, the last partition is resized along with its LUKS, LVM
+// (the last logical volume) and file system. Otherwise the space added
+// is allocated to the new partition, which is formatted, mounted
+// and added to /etc/fstab.
+// The image is neither grown nor shrunk if it isn't smaller than the configured size.
+// Returns a pointer to the structure and error/nil
+func Grow(ctx context.Context, config *Disk, rootfsMp string, bins *Utils, remoteConfig *sshfs.Config) (i *image, err error) {
+	if err = verifyGrow(config); err != nil {
+		err = utils.FormatError(err)
+		return
+	}
+	if i, err = Open(ctx, config, rootfsMp, bins, remoteConfig); err != nil {
+		return
+	}
+	i.grow = true
+	return
+}
+
+// PlanGrow writes the commands the processing of the existing image
+// grown to the configured size would run (see Grow).
+// Returns path to the image.
+func PlanGrow(w io.Writer, config *Disk, rootfsMp string, bins *Utils) (string, error) {
+	if err := verifyGrow(config); err != nil {
+		return "", err
+	}
+	return planOpen(w, config, rootfsMp, bins, true)
+}
+
+// verifyGrow verifies the image described by the disk configuration can be grown
+func verifyGrow(config *Disk) error {
+	if len(config.Partitions) == 0 {
+		return errors.New("the image without partitions cannot be grown")
+	}
+	if config.FdiskCmd != "" {
+		return errors.New("the image partitioned by fdisk script cannot be grown")
+	}
+	return nil
+}
+
+// growImage grows the RAW image and its partition table
+// unless the image is as large as the configured size
+func (i *image) growImage() error {
+	out, err := i.run("stat -c %s " + i.config.Path)
+	if err != nil {
+		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	}
+	size, err := strconv.ParseUint(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	total := diskSectors(i.config)
+	if size >= total*sectorSize {
+		return nil
+	}
+
+	progress.Report(i.ctx, progress.StageGrow, 5)
+	var r io.ReaderAt = &remoteReader{i.run, i.config.Path}
+	if i.client == nil {
+		f, err := os.Open(i.config.Path)
+		if err != nil {
+			return utils.FormatError(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	sectors, e, err := growTable(r, size/sectorSize, total, i.config.GrowPartition, rand.Reader)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	if out, err := i.run(growCmd(i.config.Path, i.config.SizeMb)); err != nil {
+		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	}
+	if err := i.writeSectors(sectors); err != nil {
+		return utils.FormatError(err)
+	}
+	i.grown = e
+	return nil
+}
+
+// growVolumes grows the volumes of the resized partition
+// or formats and mounts the partition added by growImage
+func (i *image) growVolumes() error {
+	mappers, err := i.getMappers(i.loopDevice.name)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	device, err := mapperByNumber(mappers, i.grown.number)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	if i.grown.part != nil {
+		return i.formatGrowPartition(device)
+	}
+
+	index := -1
+	for n, number := range partNumbers(i.config) {
+		if number == i.grown.number {
+			index = n
+		}
+	}
+	if index < 0 {
+		return utils.FormatError(fmt.Errorf("partition %d is not configured", i.grown.number))
+	}
+	part := i.config.Partitions[index]
+	keyfile := ""
+	if part.LUKS != nil {
+		keyfile = part.LUKS.HostKeyFile
+	}
+	cmds, err := growCmds(part, device, keyfile, i.slashpath)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	for _, cmd := range cmds {
+		if out, err := i.run(cmd); err != nil {
+			return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+		}
+	}
+	return nil
+}
+
+// formatGrowPartition creates LUKS, LVM and the file systems on the partition
+// added by growImage, mounts them and writes the system files
+// (see WriteSystemFiles)
+func (i *image) formatGrowPartition(device string) error {
+	part := i.grown.part
+	keyfile, err := i.newKeyfile(part)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	cmds, vols := formatCmds(part, device, keyfile, i.slashpath)
+	if err := i.journalVolumes(part); err != nil {
+		return utils.FormatError(err)
+	}
+	for _, cmd := range cmds {
+		if out, err := i.run(cmd); err != nil {
+			return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+		}
+	}
+	if err := i.mountVolumes(vols); err != nil {
+		return utils.FormatError(err)
+	}
+	var encrypted []*encryptedPartition
+	if part.LUKS != nil {
+		encrypted = append(encrypted, &encryptedPartition{part, device, keyfile})
+	}
+	return i.writeSystemFiles(growDisk(i.config), []string{device}, encrypted)
+}
+
+// growDisk returns the disk configuration holding the grow partition only
+func growDisk(config *Disk) *Disk {
+	return &Disk{Fstab: config.Fstab, Partitions: []*Partition{config.GrowPartition}}
+}
+
+// remoteReader reads the sectors of the image on the remote host by dd
+type remoteReader struct {
+	run  func(string) (string, error)
+	path string
+}
+
+func (r *remoteReader) ReadAt(p []byte, off int64) (int, error) {
+	cmd := fmt.Sprintf("dd if=%s bs=%d skip=%d count=%d 2>/dev/null|base64 -w0",
+		r.path, sectorSize, off/sectorSize, len(p)/sectorSize)
+	out, err := r.run(cmd)
+	if err != nil {
+		return 0, fmt.Errorf("%s [%v]", out, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(out))
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+// growTable returns the sectors of the partition table read from the image
+// and grown from the current to the total number of sectors.
+// The last partition is resized to the end of the disk unless part is set,
+// in which case part is added to the free space.
+// Returns the extent of the resized (or added) partition
+func growTable(r io.ReaderAt, current, total uint64, part *Partition, rand io.Reader) ([]*tableSectors, *extent, error) {
+	mbr := make([]byte, sectorSize)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, nil, err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, nil, errors.New("partition table not found")
+	}
+	if total <= current {
+		return nil, nil, fmt.Errorf("the disk of %d sectors cannot be grown to %d sectors", current, total)
+	}
+	if mbr[entryOffset(0)+4] == mbrTypeProtective {
+		return growGPT(r, mbr, total, part, rand)
+	}
+	return growMBR(r, mbr, total, part)
+}
+
+// growMBR grows the MBR partition table. The boot code and the disk
+// signature are kept. The last logical partition is resized along
+// with the extended partition
+func growMBR(r io.ReaderAt, mbr []byte, total uint64, part *Partition) ([]*tableSectors, *extent, error) {
+	if total > 0xffffffff {
+		return nil, nil, errors.New("MBR supports disks up to 2TB, please use GPT")
+	}
+	last, free := -1, -1
+	var end uint64
+	for index := 0; index < 4; index++ {
+		partType, start, size := readMbrEntry(mbr[entryOffset(index):])
+		if partType == 0 {
+			if free < 0 {
+				free = index
+			}
+			continue
+		}
+		if last < 0 || start+size > end {
+			last, end = index, start+size
+		}
+	}
+	if last < 0 {
+		return nil, nil, errors.New("no partitions found")
+	}
+	if end >= total {
+		return nil, nil, errors.New("no space left on the disk")
+	}
+	sectors := []*tableSectors{{0, mbr}}
+
+	if part != nil {
+		if free < 0 {
+			return nil, nil, errors.New("no free primary partition entry")
+		}
+		partType, err := mbrType(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		e := &extent{part: part, number: free + 1, start: alignUp(end)}
+		if e.start >= total {
+			return nil, nil, errors.New("no space left on the disk")
+		}
+		e.size = total - e.start
+		mbrEntry(mbr[entryOffset(free):], false, partType, e.start, e.size)
+		return sectors, e, nil
+	}
+
+	b := mbr[entryOffset(last):]
+	partType, start, _ := readMbrEntry(b)
+	if !isExtendedType(partType) {
+		e := &extent{number: last + 1, start: start, size: total - start}
+		mbrEntry(b, b[0] == 0x80, partType, e.start, e.size)
+		return sectors, e, nil
+	}
+
+	// walk the EBR chain up to the last logical partition
+	mbrEntry(b, false, partType, start, total-start)
+	ebr := make([]byte, sectorSize)
+	e := &extent{number: 5, ebr: start}
+	for {
+		if _, err := r.ReadAt(ebr, int64(e.ebr)*sectorSize); err != nil {
+			return nil, nil, err
+		}
+		nextType, next, _ := readMbrEntry(ebr[entryOffset(1):])
+		if !isExtendedType(nextType) {
+			break
+		}
+		if e.number == 255 || start+next <= e.ebr {
+			return nil, nil, errors.New("invalid extended partition")
+		}
+		e.ebr = start + next
+		e.number++
+	}
+	logicalType, offset, _ := readMbrEntry(ebr[entryOffset(0):])
+	e.start = e.ebr + offset
+	e.size = total - e.start
+	mbrEntry(ebr[entryOffset(0):], false, logicalType, offset, e.size)
+	return append(sectors, &tableSectors{e.ebr, ebr}), e, nil
+}
+
+// growGPT grows GPT, the backup GPT is moved to the end of the disk.
+// The protective MBR boot code and the GUIDs are kept
+func growGPT(r io.ReaderAt, pmbr []byte, total uint64, part *Partition, rand io.Reader) ([]*tableSectors, *extent, error) {
+	header := make([]byte, sectorSize)
+	if _, err := r.ReadAt(header, sectorSize); err != nil {
+		return nil, nil, err
+	}
+	if string(header[0:8]) != "EFI PART" {
+		return nil, nil, errors.New("GPT header not found")
+	}
+	if binary.LittleEndian.Uint64(header[72:80]) != 2 ||
+		binary.LittleEndian.Uint32(header[80:84]) != gptEntries ||
+		binary.LittleEndian.Uint32(header[84:88]) != gptEntrySize {
+		return nil, nil, fmt.Errorf("only GPT of %d entries following the header is supported", gptEntries)
+	}
+	entries := make([]byte, gptEntries*gptEntrySize)
+	if _, err := r.ReadAt(entries, 2*sectorSize); err != nil {
+		return nil, nil, err
+	}
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[88:92]) {
+		return nil, nil, errors.New("GPT entries are corrupted")
+	}
+
+	lastUsable := total - gptEntrySectors - 2
+	last, free := -1, -1
+	var end uint64
+	for index := 0; index < gptEntries; index++ {
+		b := entries[index*gptEntrySize:]
+		if isZeroGUID(b[0:16]) {
+			if free < 0 {
+				free = index
+			}
+			continue
+		}
+		if l := binary.LittleEndian.Uint64(b[40:48]); last < 0 || l > end {
+			last, end = index, l
+		}
+	}
+	if last < 0 {
+		return nil, nil, errors.New("no partitions found")
+	}
+	if end >= lastUsable {
+		return nil, nil, errors.New("no space left on the disk")
+	}
+
+	var e *extent
+	if part == nil {
+		b := entries[last*gptEntrySize:]
+		e = &extent{number: last + 1, start: binary.LittleEndian.Uint64(b[32:40])}
+	} else {
+		if free < 0 {
+			return nil, nil, errors.New("no free GPT entry")
+		}
+		e = &extent{part: part, number: free + 1, start: alignUp(end + 1)}
+		if e.start > lastUsable {
+			return nil, nil, errors.New("no space left on the disk")
+		}
+		b := entries[free*gptEntrySize:]
+		partType, err := parseGUID(typeGUID(part))
+		if err != nil {
+			return nil, nil, err
+		}
+		unique, err := randomGUID(rand)
+		if err != nil {
+			return nil, nil, err
+		}
+		partType.encode(b[0:16])
+		unique.encode(b[16:32])
+		binary.LittleEndian.PutUint64(b[32:40], e.start)
+		if err := putGptName(b, part.Name); err != nil {
+			return nil, nil, err
+		}
+	}
+	e.size = lastUsable - e.start + 1
+	binary.LittleEndian.PutUint64(entries[(e.number-1)*gptEntrySize+40:], lastUsable)
+
+	size := total - 1
+	if size > 0xffffffff {
+		size = 0xffffffff
+	}
+	mbrEntry(pmbr[entryOffset(0):], false, mbrTypeProtective, 1, size)
+	disk := decodeGUID(header[56:72])
+	backupEntries := total - gptEntrySectors - 1
+	return []*tableSectors{
+		{0, pmbr},
+		{1, gptHeader(1, total-1, 2, total, disk, entries)},
+		{2, entries},
+		{backupEntries, entries},
+		{total - 1, gptHeader(total-1, 1, backupEntries, total, disk, entries)},
+	}, e, nil
+}
+
+// readMbrEntry decodes the type, the first sector and the size
+// of the partition entry of the MBR or EBR
+func readMbrEntry(b []byte) (partType byte, start, size uint64) {
+	return b[4], uint64(binary.LittleEndian.Uint32(b[8:12])), uint64(binary.LittleEndian.Uint32(b[12:16]))
+}
+
+// isExtendedType reports whether the MBR partition type is one of the extended types
+func isExtendedType(partType byte) bool {
+	return partType == mbrTypeExtended || partType == 0x0f || partType == 0x85
+}
+
+func isZeroGUID(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// growCmds returns the commands growing LUKS, LVM and the file system
+// of the resized partition. The space added to LVM is allocated
+// to the last logical volume
+func growCmds(part *Partition, device, keyfile, rootfsMp string) ([]string, error) {
+	var cmds []string
+	if part.LUKS != nil {
+		cmds = append(cmds, fmt.Sprintf("cryptsetup resize --key-file %s %s", keyfile, part.LUKS.Name))
+		device = luksDevice(part.LUKS)
+	}
+	if part.LVM == nil {
+		cmd, err := growFsCmd(part, part.Subvolumes, device, rootfsMp)
+		return append(cmds, cmd), err
+	}
+	vg := part.LVM.VolumeGroup
+	lv := part.LVM.LogicalVolumes[len(part.LVM.LogicalVolumes)-1]
+	cmds = append(cmds, "pvresize "+device, fmt.Sprintf("lvextend -l +100%%FREE %s/%s", vg, lv.Name))
+	cmd, err := growFsCmd(lv.partition(), lv.Subvolumes, lvDevice(vg, lv), rootfsMp)
+	return append(cmds, cmd), err
+}
+
+// growFsCmd returns the command growing the file system on the device
+// to the size of the device. ext3 and ext4 are grown online,
+// xfs and btrfs are grown at the mount point. SWAP is recreated
+// keeping the label and UUID
+func growFsCmd(part *Partition, subvolumes []*Subvolume, device, rootfsMp string) (string, error) {
+	switch {
+	case isSwap(part):
+		return fmt.Sprintf("mkswap -L %s -U $(blkid -s UUID -o value %s) %s", part.Label, device, device), nil
+	case strings.HasPrefix(part.FileSystem, "ext"):
+		return "resize2fs " + device, nil
+	case part.FileSystem == "xfs" || part.FileSystem == "btrfs":
+		vols := fsVolumes(part, subvolumes, device)
+		if len(vols) == 0 {
+			return "", fmt.Errorf("%s on %s has no mount point to be grown at", part.FileSystem, device)
+		}
+		mountPoint := filepath.Join(rootfsMp, vols[0].mountPoint)
+		if part.FileSystem == "xfs" {
+			return "xfs_growfs " + mountPoint, nil
+		}
+		return "btrfs filesystem resize max " + mountPoint, nil
+	}
+	return "", fmt.Errorf("growing %s is not supported", part.FileSystem)
+}
+
+func growCmd(path string, sizeMb int) string {
+	return fmt.Sprintf("truncate -s %dM %s", sizeMb, path)
+}
@@ -0,0 +1,273 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dorzheh/deployer/utils"
+)
+
+// sparseDisk keeps the sectors written to the disk in memory
+type sparseDisk map[int64][]byte
+
+func (d sparseDisk) ReadAt(p []byte, off int64) (int, error) {
+	for n := 0; n < len(p); n += sectorSize {
+		sector, ok := d[(off+int64(n))/sectorSize]
+		if !ok {
+			sector = make([]byte, sectorSize)
+		}
+		copy(p[n:], sector)
+	}
+	return len(p), nil
+}
+
+func (d sparseDisk) WriteAt(p []byte, off int64) (int, error) {
+	for n := 0; n < len(p); n += sectorSize {
+		sector := make([]byte, sectorSize)
+		copy(sector, p[n:])
+		d[(off+int64(n))/sectorSize] = sector
+	}
+	return len(p), nil
+}
+
+func (d sparseDisk) write(sectors []*tableSectors) {
+	for _, s := range sectors {
+		d.WriteAt(s.data, int64(s.lba)*sectorSize)
+	}
+}
+
+// grownDisk returns the disk written according to the configuration
+// and the sectors of the table grown to 2GB
+func grownDisk(t *testing.T, config *Disk, part *Partition) (sparseDisk, *extent) {
+	disk := make(sparseDisk)
+	if err := WritePartTable(disk, config, new(counter)); err != nil {
+		t.Fatal(err)
+	}
+	// boot code is kept
+	disk[0][0] = 0xeb
+	sectors, e, err := growTable(disk, diskSectors(config), 2048*2048, part, new(counter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk.write(sectors)
+	if disk[0][0] != 0xeb {
+		t.Fatal("boot code is overwritten")
+	}
+	return disk, e
+}
+
+func TestGrowTableMBR(t *testing.T) {
+	total := uint64(2048 * 2048)
+	disk, e := grownDisk(t, testDisk(PartTableMBR), nil)
+	partType, start, size := readMbrEntry(disk[0][entryOffset(1):])
+	if e.number != 2 || partType != 0x82 || start != e.start || start+size != total {
+		t.Fatalf("unexpected partition %d: type %x, sectors %d-%d", e.number, partType, start, start+size-1)
+	}
+	if disk[0][entryOffset(0)] != 0x80 {
+		t.Fatal("active flag is cleared")
+	}
+
+	disk, e = grownDisk(t, testDisk(PartTableMBR), &Partition{Type: 83})
+	partType, start, size = readMbrEntry(disk[0][entryOffset(2):])
+	if e.number != 3 || partType != 0x83 || start != 1024*2048 || start+size != total {
+		t.Fatalf("unexpected partition %d: type %x, sectors %d-%d", e.number, partType, start, start+size-1)
+	}
+
+	// the last logical partition
+	logical := testDisk(PartTableMBR)
+	logical.Partitions = nil
+	for _, size := range []int{100, 100, 100, 100, 100} {
+		logical.Partitions = append(logical.Partitions, &Partition{Type: 83, SizeMb: size})
+	}
+	disk, e = grownDisk(t, logical, nil)
+	if _, start, size := readMbrEntry(disk[0][entryOffset(3):]); start+size != total {
+		t.Fatalf("extended partition isn't grown: sectors %d-%d", start, start+size-1)
+	}
+	if _, offset, size := readMbrEntry(disk[int64(e.ebr)][entryOffset(0):]); e.number != 6 || e.ebr+offset+size != total {
+		t.Fatalf("unexpected partition %d: sectors %d-%d", e.number, e.ebr+offset, e.ebr+offset+size-1)
+	}
+
+	if _, _, err := growTable(disk, 1, total, nil, new(counter)); err == nil {
+		t.Fatal("no space left, expected error")
+	}
+	if _, _, err := growTable(make(sparseDisk), 2048, total, nil, new(counter)); err == nil {
+		t.Fatal("no partition table, expected error")
+	}
+}
+
+func TestGrowTableGPT(t *testing.T) {
+	total := uint64(2048 * 2048)
+	config := testDisk(PartTableGPT)
+	original := make(sparseDisk)
+	WritePartTable(original, config, new(counter))
+
+	for _, part := range []*Partition{nil, {Type: 83, Name: "data"}} {
+		disk, e := grownDisk(t, testDisk(PartTableGPT), part)
+		for _, lba := range []int64{1, int64(total) - 1} {
+			header := disk[lba]
+			if string(header[0:8]) != "EFI PART" {
+				t.Fatalf("GPT header not found at %d", lba)
+			}
+			crc := binary.LittleEndian.Uint32(header[16:20])
+			binary.LittleEndian.PutUint32(header[16:20], 0)
+			if crc32.ChecksumIEEE(header[:92]) != crc {
+				t.Fatalf("invalid GPT header CRC at %d", lba)
+			}
+			binary.LittleEndian.PutUint32(header[16:20], crc)
+			if binary.LittleEndian.Uint64(header[48:56]) != total-gptEntrySectors-2 {
+				t.Fatalf("last usable sector isn't moved at %d", lba)
+			}
+			// the disk GUID is kept
+			if !bytes.Equal(header[56:72], original[1][56:72]) {
+				t.Fatalf("disk GUID is changed at %d", lba)
+			}
+		}
+		entries := make([]byte, gptEntries*gptEntrySize)
+		disk.ReadAt(entries, int64(total-gptEntrySectors-1)*sectorSize)
+		b := entries[(e.number-1)*gptEntrySize:]
+		if binary.LittleEndian.Uint64(b[32:40]) != e.start || binary.LittleEndian.Uint64(b[40:48]) != total-gptEntrySectors-2 {
+			t.Fatalf("unexpected partition %d", e.number)
+		}
+		if part == nil && (e.number != 2 || !bytes.Equal(b[16:32], original[2][gptEntrySize+16:gptEntrySize+32])) {
+			t.Fatalf("unexpected partition %d", e.number)
+		}
+		if part != nil && (e.number != 3 || e.start != 1024*2048 || b[56] != 'd') {
+			t.Fatalf("unexpected partition %d", e.number)
+		}
+	}
+}
+
+func TestGrowCmds(t *testing.T) {
+	config := volumeDisk()
+	cmds, err := growCmds(config.Partitions[1], "/dev/loop0p2", "/root/data.key", "/mnt")
+	expected := []string{
+		"cryptsetup resize --key-file /root/data.key cryptdata",
+		"pvresize /dev/mapper/cryptdata",
+		"lvextend -l +100%FREE vgdata/data",
+		"resize2fs /dev/vgdata/data",
+	}
+	if err != nil || !reflect.DeepEqual(cmds, expected) {
+		t.Fatalf("unexpected commands %q [%v]", cmds, err)
+	}
+	if cmds, err := growCmds(config.Partitions[0], "/dev/loop0p1", "", "/mnt"); err != nil || cmds[0] != "btrfs filesystem resize max /mnt" {
+		t.Fatalf("unexpected commands %q [%v]", cmds, err)
+	}
+	swap := &Partition{Type: partTypeSwap, Label: "SWAP", FileSystem: "swap"}
+	if cmds, _ := growCmds(swap, "/dev/loop0p2", "", "/mnt"); cmds[0] != "mkswap -L SWAP -U $(blkid -s UUID -o value /dev/loop0p2) /dev/loop0p2" {
+		t.Fatalf("unexpected commands %q", cmds)
+	}
+	if _, err := growCmds(&Partition{FileSystem: "vfat"}, "/dev/loop0p1", "", "/mnt"); err == nil {
+		t.Fatal("vfat cannot be grown, expected error")
+	}
+}
+
+func TestPlanGrow(t *testing.T) {
+	config := testDisk(PartTableMBR)
+	config.Path = "/tmp/test.qcow2"
+	config.Type = StorageTypeQCOW2
+	config.Partitions[0].FileSystem, config.Partitions[0].Label, config.Partitions[0].MountPoint = "ext4", "SLASH", "/"
+	config.Partitions[1].Label, config.Partitions[1].FileSystem = "SWAP", "swap"
+
+	buf := new(bytes.Buffer)
+	if _, err := PlanGrow(buf, config, "/tmp/rootfs", &Utils{Kpartx: "kpartx"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{
+		"qemu-img convert -f qcow2 -O raw /tmp/test.qcow2 /tmp/test.raw",
+		"truncate -s 1024M /tmp/test.raw",
+		"mkswap -L SWAP -U $(blkid -s UUID -o value /dev/loopNp2) /dev/loopNp2",
+		"qemu-img convert -f raw -O qcow2 /tmp/test.raw /tmp/test.qcow2.partial",
+		"mv -f /tmp/test.qcow2.partial /tmp/test.qcow2",
+	} {
+		if !strings.Contains(buf.String(), cmd+"\n") {
+			t.Fatalf("command %q not found in the plan:\n%s", cmd, buf.String())
+		}
+	}
+
+	config.GrowPartition = &Partition{Type: 83, Label: "DATA", MountPoint: "/data", FileSystem: "ext4"}
+	buf.Reset()
+	if _, err := PlanGrow(buf, config, "/tmp/rootfs", &Utils{Kpartx: "kpartx"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{
+		"# add partition 3 to /tmp/test.raw at the end of the disk",
+		"mkfs -t ext4 -L DATA  /dev/loopNp3",
+		"mount /dev/loopNp3 /tmp/rootfs/data",
+		"# add to /etc/fstab: LABEL=DATA /data ext4 defaults 0 2",
+	} {
+		if !strings.Contains(buf.String(), cmd+"\n") {
+			t.Fatalf("command %q not found in the plan:\n%s", cmd, buf.String())
+		}
+	}
+
+	config.FdiskCmd = `n\np\n1\n\n\nw\n`
+	if _, err := PlanGrow(buf, config, "/tmp/rootfs", &Utils{Kpartx: "kpartx"}); err == nil {
+		t.Fatal("fdisk partitioned image, expected error")
+	}
+}
+
+func TestConvertKeepsImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer_convert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.qcow2")
+	for _, p := range []string{path, filepath.Join(dir, "test.raw")} {
+		if err := ioutil.WriteFile(p, []byte(filepath.Base(p)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the image opened by Open fails to be converted back
+	local := utils.RunFunc(nil)
+	i := &image{config: &Disk{Path: filepath.Join(dir, "test.raw"), Type: StorageTypeQCOW2}, temporary: true, release: local}
+	i.run = func(cmd string) (string, error) {
+		if strings.HasPrefix(cmd, "qemu-img convert") {
+			local("echo partial > " + partialPath(path))
+			return "cancelled", errors.New("signal: killed")
+		}
+		return local(cmd)
+	}
+	if err := i.convert(); err == nil {
+		t.Fatal("conversion failed, expected error")
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "test.qcow2" {
+		t.Fatalf("the original image is lost: %q [%v]", data, err)
+	}
+	if _, err := os.Stat(partialPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("the partially converted image is kept [%v]", err)
+	}
+
+	// the original image is replaced once converted
+	i.run = func(cmd string) (string, error) {
+		if strings.HasPrefix(cmd, "qemu-img convert") {
+			return local("echo converted > " + partialPath(path))
+		}
+		return local(cmd)
+	}
+	if err := i.convert(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "converted\n" || i.config.Path != path {
+		t.Fatalf("unexpected image %s: %q [%v]", i.config.Path, data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test.raw")); !os.IsNotExist(err) {
+		t.Fatalf("the RAW copy is kept [%v]", err)
+	}
+	// a later failure doesn't remove the upgraded image
+	if err := i.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("the upgraded image is discarded [%v]", err)
+	}
+}
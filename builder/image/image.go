@@ -1,20 +1,24 @@
-// Responsible for creating , partitioning and customizing RAW image and writing MBR
+// Responsible for creating , partitioning and customizing RAW image and writing
+// either MBR or GPT partition table
 
 package image
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"sort"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/dorzheh/deployer/builder/content"
 	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/progress"
 	"github.com/dorzheh/infra/comm/sshfs"
 )
 
@@ -60,11 +64,66 @@ type image struct {
 	// this indicates whether image creation occurs locally or remotely
 	localmount string
 
+	// the image processing context
+	ctx context.Context
+
 	// executes commands locally or remotely
 	run func(string) (string, error)
 
+	// executes commands releasing the image.
+	// Unlike run it is not bound to the context
+	// so that the image is released even though the context is cancelled
+	release func(string) (string, error)
+
+	// executes commands streaming their output (the image conversion)
+	stream func(string, io.Reader, io.Writer) (string, error)
+
 	// sshfs client
 	client *sshfs.Client
+
+	// indicates whether the image has been created by New
+	created bool
+
+	// indicates whether the image is a temporary RAW copy made by Open
+	temporary bool
+
+	// path to the base image in case the image is a qcow2 overlay
+	// attached by qemu-nbd (see NewOverlay)
+	base string
+
+	// path the overlay is flattened to by Convert
+	dest string
+
+	// resources held on the host processing the image,
+	// released by Cleanup in the reverse order
+	journal *journal
+
+	// resources held locally while the image is processed
+	// on the remote host (the sshfs mount)
+	localJournal *journal
+
+	// LUKS partitions formatted by Parse (see WriteSystemFiles)
+	encrypted []*encryptedPartition
+
+	// devices of the partitions formatted by Parse
+	partDevices []string
+
+	// indicates whether Parse grows the image (see Grow)
+	grow bool
+
+	// the partition resized (or added) once the image is grown
+	grown *extent
+}
+
+// the structure represents a LUKS partition and its key
+type encryptedPartition struct {
+	part *Partition
+
+	// the partition device
+	device string
+
+	// path to the keyfile on the host processing the image
+	keyfile string
 }
 
 type Utils struct {
@@ -77,33 +136,121 @@ type Utils struct {
 // New gets a path to configuration directory
 // path to temporary directory where the vHDD image supposed to be mounted
 // and path to vHDD image.
+// The image is always created, an existing image is overwritten
+// (see Open and Grow for processing the existing one).
+// The image processing stops once the context is cancelled.
+// Returns a pointer to the structure and error/nil
+func New(ctx context.Context, config *Disk, rootfsMp string, bins *Utils, remoteConfig *sshfs.Config) (i *image, err error) {
+	if i, err = newImage(ctx, config, rootfsMp, bins, remoteConfig); err != nil {
+		return
+	}
+	defer i.abortOnError(&err)
+
+	// set temporary name
+	i.config.Path = rawPath(config)
+	progress.Report(ctx, progress.StageCreate, 0)
+	if err = i.create(); err != nil {
+		err = utils.FormatError(err)
+		return
+	}
+	i.created = true
+	if config.Partitions != nil {
+		i.needToFormat = true
+	}
+	return
+}
+
+// Open gets an existing image described by the disk configuration.
+// The image is neither partitioned nor formatted, Parse mounts
+// the existing partitions. An image of other than RAW format
+// is processed as a temporary RAW copy converted back by Convert,
+// the existing image is kept unless the conversion succeeds.
 // Returns a pointer to the structure and error/nil
-func New(config *Disk, rootfsMp string, bins *Utils, remoteConfig *sshfs.Config) (i *image, err error) {
+func Open(ctx context.Context, config *Disk, rootfsMp string, bins *Utils, remoteConfig *sshfs.Config) (i *image, err error) {
+	if i, err = newImage(ctx, config, rootfsMp, bins, remoteConfig); err != nil {
+		return
+	}
+	defer i.abortOnError(&err)
+
+	path := config.Path
+	if out, er := i.run("ls " + path); er != nil {
+		err = utils.FormatError(fmt.Errorf("image %s not found: %s [%v]", path, out, er))
+		return
+	}
+	i.config.Path = rawPath(config)
+	if i.config.Path != path {
+		if out, er := i.run(fmt.Sprintf("qemu-img convert -f %s -O raw %s %s", config.Type.Format(), path, i.config.Path)); er != nil {
+			i.release("rm -f " + i.config.Path)
+			err = utils.FormatError(fmt.Errorf("%s [%v]", out, er))
+			return
+		}
+		i.temporary = true
+	}
+	return
+}
+
+// newImage sets up the facilities shared by New and Open
+func newImage(ctx context.Context, config *Disk, rootfsMp string, bins *Utils, remoteConfig *sshfs.Config) (i *image, err error) {
 	i = new(image)
+	i.ctx = ctx
 	i.needToFormat = false
 	var qemuImgError string
 
 	if remoteConfig == nil {
-		i.run = utils.RunFunc(nil)
+		i.run = utils.RunFuncWithContext(ctx, nil)
+		i.release = utils.RunFunc(nil)
+		i.stream = utils.RunStreamFuncWithContext(ctx, nil)
+		if i.journal, err = newJournal(i.release, config.Path); err != nil {
+			err = utils.FormatError(err)
+			return
+		}
+		defer i.abortOnError(&err)
 		i.slashpath = rootfsMp
+		if err = i.journal.add(dirResource(i.slashpath)); err != nil {
+			err = utils.FormatError(err)
+			return
+		}
 		i.utils = bins
 		qemuImgError = "please install qemu-img"
 	} else {
-		i.run = utils.RunFunc(remoteConfig.Common)
+		i.run = utils.RunFuncWithContext(ctx, remoteConfig.Common)
+		i.release = utils.RunFunc(remoteConfig.Common)
+		i.stream = utils.RunStreamFuncWithContext(ctx, remoteConfig.Common)
 		i.client, err = sshfs.NewClient(remoteConfig)
 		if err != nil {
 			err = utils.FormatError(err)
 			return
 		}
+		if i.journal, err = newJournal(i.release, config.Path); err != nil {
+			err = utils.FormatError(err)
+			return
+		}
+		defer i.abortOnError(&err)
+		if i.localJournal, err = newJournal(utils.RunFunc(nil), config.Path); err != nil {
+			err = utils.FormatError(err)
+			return
+		}
 		i.localmount = rootfsMp
+		if err = i.localJournal.add(dirResource(i.localmount)); err != nil {
+			err = utils.FormatError(err)
+			return
+		}
 		if i.slashpath, err = i.run("mktemp -d --suffix _deployer_rootfs"); err != nil {
 			err = utils.FormatError(err)
 			return
 		}
+		if err = i.journal.add(dirResource(i.slashpath)); err != nil {
+			err = utils.FormatError(err)
+			return
+		}
 		if err = i.client.Attach(i.slashpath, i.localmount); err != nil {
 			err = utils.FormatError(err)
 			return
 		}
+		if err = i.localJournal.add(sshfsResource(i.localmount)); err != nil {
+			err = utils.FormatError(err)
+			return
+		}
 		if err = setUtilNewPaths(i, bins); err != nil {
 			err = utils.FormatError(err)
 			return
@@ -116,22 +263,18 @@ func New(config *Disk, rootfsMp string, bins *Utils, remoteConfig *sshfs.Config)
 			err = utils.FormatError(errors.New(qemuImgError))
 			return
 		}
-		// set temporary name
-		config.Path = strings.Replace(config.Path, "."+string(config.Type), "", -1)
 	}
-
-	i.config = config
-	i.config.Path = config.Path + ".raw"
-	if _, err = i.run("ls" + config.Path); err != nil {
-		if err = i.create(); err != nil {
-			err = utils.FormatError(err)
+	if err = validateVolumes(config); err != nil {
+		err = utils.FormatError(err)
+		return
+	}
+	for _, tool := range volumeTools(config) {
+		if _, err = i.run("which " + tool); err != nil {
+			err = utils.FormatError(fmt.Errorf("please install %s", tool))
 			return
 		}
-		if config.Partitions != nil {
-			i.needToFormat = true
-		}
 	}
-
+	i.config = config
 	i.loopDevice = new(loopDevice)
 	i.loopDevice.amountOfMappers = 0
 	return
@@ -145,13 +288,26 @@ func setUtilNewPaths(i *image, u *Utils) error {
 	i.utils = new(Utils)
 	i.utils.Kpartx = filepath.Join(dir, filepath.Base(u.Kpartx))
 	i.utils.dir = dir
-	return nil
+	return i.journal.add(dirResource(dir))
 }
 
 // Parse processes RAW image
 // Returns error/nil
 func (i *image) Parse() error {
 	var err error
+	// the partition table is written to the image before binding
+	// unless the user supplied fdisk script partitions the loop device
+	if i.needToFormat && i.config.FdiskCmd == "" {
+		progress.Report(i.ctx, progress.StagePartition, 5)
+		if err := i.writePartTable(); err != nil {
+			return utils.FormatError(err)
+		}
+	}
+	if i.grow {
+		if err := i.growImage(); err != nil {
+			return utils.FormatError(err)
+		}
+	}
 	if i.loopDevice.name, err = i.bind(i.config.Path); err != nil {
 		return utils.FormatError(err)
 	}
@@ -164,6 +320,11 @@ func (i *image) Parse() error {
 			return utils.FormatError(err)
 		}
 	}
+	if i.grown != nil {
+		if err := i.growVolumes(); err != nil {
+			return utils.FormatError(err)
+		}
+	}
 	return nil
 }
 
@@ -176,49 +337,66 @@ func (i *image) Customize(pathToConfigDir string) error {
 	return content.Customize(i.slashpath, pathToConfigDir)
 }
 
-// Release is trying to release the image correctly
-// by unmounting the mappers in reverse order
-// and the cleans up a temporary stuff
+// Cleanup releases the image in the reverse order the resources are acquired:
+// unmounts the volumes, closes LUKS and LVM, unbinds the mappers
+// and the loop device and removes the temporary stuff.
+// The resources failed to be released are kept in the journal
+// (see ReleaseStale), the first failure is reported.
 // Returns error or nil
 func (i *image) Cleanup() error {
-	if i.localmount != "" {
-		if err := i.client.Detach(i.localmount); err != nil {
-			return utils.FormatError(err)
-		}
-	}
-	// Release registered mount points
-	var index uint8 = i.loopDevice.amountOfMappers - 1
-	for i.loopDevice.amountOfMappers != 0 {
-		if i.loopDevice.mappers[index].mountPoint != "/" {
-			if out, err := i.run(fmt.Sprintf("umount -l %s", i.loopDevice.mappers[index].mountPoint)); err != nil {
-				return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
-			}
-			i.loopDevice.amountOfMappers--
-			index--
-		}
+	var err error
+	if i.localJournal != nil {
+		err = i.localJournal.release()
 	}
-	if out, err := i.run(fmt.Sprintf("umount -l %s", i.slashpath)); err != nil {
-		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	if e := i.journal.release(); e != nil && err == nil {
+		err = e
 	}
-	// unbind mappers and image
-	if out, err := i.run(i.utils.Kpartx + " -d " + i.loopDevice.name); err != nil {
-		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	i.mappers = nil
+	i.amountOfMappers = 0
+	if err != nil {
+		return utils.FormatError(err)
 	}
-	if out, err := i.run("losetup -d " + i.loopDevice.name); err != nil {
-		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	return nil
+}
+
+// abortOnError releases the resources acquired so far
+// in case the image cannot be processed
+func (i *image) abortOnError(err *error) {
+	if *err != nil {
+		i.Cleanup()
 	}
-	// remove mount point
-	if out, err := i.run("rm -rf " + i.slashpath); err != nil {
-		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+}
+
+// WriteSystemFiles places the LUKS keyfiles in the rootfs, adds
+// the LUKS partitions to /etc/crypttab and the file systems to /etc/fstab.
+// Intended to be called once the rootfs is customized
+func (i *image) WriteSystemFiles() error {
+	return i.writeSystemFiles(i.config, i.partDevices, i.encrypted)
+}
+
+// writeSystemFiles writes the system files of the disk configuration
+// given the devices of the formatted partitions
+func (i *image) writeSystemFiles(config *Disk, devices []string, encrypted []*encryptedPartition) error {
+	if err := i.writeFstab(config, devices); err != nil {
+		return utils.FormatError(err)
 	}
-	if i.localmount != "" {
-		// remove mount point
-		if out, err := i.run("rm -rf " + i.utils.dir); err != nil {
-			return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	var entries []string
+	for _, e := range encrypted {
+		uuid, err := i.run("cryptsetup luksUUID " + e.device)
+		if err != nil {
+			return utils.FormatError(err)
 		}
-		// remove mount point
-		if out, err := i.run("rm -rf " + i.localmount); err != nil {
-			return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+		if e.part.LUKS.KeyFile != "" {
+			dest := filepath.Join(i.slashpath, e.part.LUKS.KeyFile)
+			if out, err := i.run(fmt.Sprintf("install -D -m 0400 %s %s", e.keyfile, dest)); err != nil {
+				return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+			}
+		}
+		entries = append(entries, crypttabEntry(e.part.LUKS, uuid))
+	}
+	if len(entries) > 0 {
+		if err := i.mergeTable("/etc/crypttab", entries, 0); err != nil {
+			return utils.FormatError(err)
 		}
 	}
 	return nil
@@ -248,20 +426,26 @@ func (i *image) MakeBootable() error {
 		if err != nil {
 			return utils.FormatError(err)
 		}
-		defer i.run("losetup -d " + dummyLoopDevice)
+		defer i.release("losetup -d " + dummyLoopDevice)
 
 		dummyLoopDeviceMp, err := i.run("mktemp -d --suffix _deployer_dummy_loop")
 		if err != nil {
 			return utils.FormatError(err)
 		}
+		if err := i.journal.add(dirResource(dummyLoopDeviceMp)); err != nil {
+			return utils.FormatError(err)
+		}
 		if out, err := i.run("mount " + dummyLoopDevice + " " + dummyLoopDeviceMp); err != nil {
 			return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
 		}
+		if err := i.journalMounts(dummyLoopDeviceMp, dummyLoopDeviceMp+"/dev", dummyLoopDeviceMp+"/proc"); err != nil {
+			return utils.FormatError(err)
+		}
 		defer func() {
 			cmd := "umount -l " + dummyLoopDeviceMp + "/proc " + dummyLoopDeviceMp + "/dev;"
 			cmd += "umount -f " + dummyLoopDeviceMp
 			cmd += ";rm -rf " + dummyLoopDeviceMp
-			i.run(cmd)
+			i.release(cmd)
 		}()
 
 		cmd := fmt.Sprintf("mkdir -p %s/boot/grub; echo -e \"(hd0) %s\n(hd0,1) %s\" > %s/boot/grub/device.map;",
@@ -276,13 +460,31 @@ func (i *image) MakeBootable() error {
 			return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
 		}
 
+	case BootLoaderGrubEfi, BootLoaderSystemdBoot:
+		cmd, err := efiBootLoaderCmd(i.config, i.slashpath)
+		if err != nil {
+			return utils.FormatError(err)
+		}
+		if err := i.journalMounts(i.slashpath+"/dev", i.slashpath+"/sys", i.slashpath+"/proc"); err != nil {
+			return utils.FormatError(err)
+		}
+		defer func() {
+			i.release("umount -l " + i.slashpath + "/proc " + i.slashpath + "/sys " + i.slashpath + "/dev")
+		}()
+		if out, err := i.run(cmd); err != nil {
+			return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+		}
+
 	case BootLoaderExtlinux:
 		if _, err := i.run("chroot " + i.slashpath + " which extlinux"); err != nil {
 			return utils.FormatError(fmt.Errorf("%s [%v]", "Extlinux not found", err))
 		}
 
+		if err := i.journalMounts(i.slashpath+"/dev", i.slashpath+"/proc"); err != nil {
+			return utils.FormatError(err)
+		}
 		defer func() {
-			i.run("umount -l " + i.slashpath + "/proc " + i.slashpath + "/dev")
+			i.release("umount -l " + i.slashpath + "/proc " + i.slashpath + "/dev")
 		}()
 
 		var extlinuxMbrPath string
@@ -308,8 +510,25 @@ func (i *image) MakeBootable() error {
 	return nil
 }
 
+// Discard removes the image in case it has been created by New
+// or the temporary RAW copy made by Open. An image opened by Open
+// is kept once it has been converted back.
+// Intended for releasing a half-created image on failure
+// and must be called after Cleanup
+func (i *image) Discard() error {
+	if !i.created && !i.temporary {
+		return nil
+	}
+	if out, err := i.release("rm -f " + i.config.Path); err != nil {
+		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	}
+	return nil
+}
+
 func (i *image) Convert() error {
-	if i.config.Type != StorageTypeRAW {
+	// the overlay is always flattened
+	if i.config.Type != StorageTypeRAW || i.base != "" {
+		progress.Report(i.ctx, progress.StageConvert, convertFrom)
 		if err := i.convert(); err != nil {
 			return utils.FormatError(err)
 		}
@@ -317,24 +536,6 @@ func (i *image) Convert() error {
 	return nil
 }
 
-// ReleaseOnInterrupt is trying to release appropriate image
-// in case SIGHUP, SIGINT or SIGTERM signal received
-func (i *image) ReleaseOnInterrupt() {
-	//create a channel for interrupt handler
-	interrupt := make(chan os.Signal, 1)
-	// create an interrupt handler
-	signal.Notify(interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
-	// run a seperate goroutine.
-	go func() {
-		for {
-			select {
-			case <-interrupt:
-				i.Cleanup()
-			}
-		}
-	}()
-}
-
 // Exports amount of mappers
 func (i *image) AmountOfMappers() uint8 {
 	return i.amountOfMappers
@@ -342,49 +543,47 @@ func (i *image) AmountOfMappers() uint8 {
 
 /// Private stuff ///
 
-// partTable creates partition table on the RAW disk
+// partTableMakefs creates file systems on the partitions of the RAW disk
+// and mounts them. The partition table is created by the user-supplied
+// fdisk script (if any)
 func (i *image) partTableMakefs() error {
-	if i.config.FdiskCmd == "" {
-		i.generateFdiskCmd()
+	if i.config.FdiskCmd != "" {
+		progress.Report(i.ctx, progress.StagePartition, 5)
+		if out, err := i.run(partitionCmd(i.config.FdiskCmd, i.loopDevice.name)); err != nil {
+			return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+		}
 	}
-
-	i.run(fmt.Sprintf("echo -e  \"%s\"|%s %s", i.config.FdiskCmd, "fdisk", i.loopDevice.name))
 	mappers, err := i.getMappers(i.loopDevice.name)
 	if err != nil {
 		return utils.FormatError(err)
 	}
-	// first iteration - find root mount point and mount it
+	progress.Report(i.ctx, progress.StageMkfs, 10)
+	var volumes []*volume
 	for index, part := range i.config.Partitions {
-		if part.MountPoint == "/" {
-			cmd := fmt.Sprintf("mkfs -t %v -L %s %s %s", part.FileSystem,
-				part.Label, part.FileSystemArgs, mappers[index])
-			if out, err := i.run(cmd); err != nil {
-				return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
-			}
-			if out, err := i.run(fmt.Sprintf("mount %s %s", mappers[index], i.slashpath)); err != nil {
-				return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
-			}
+		mapper, err := i.mapper(mappers, index)
+		if err != nil {
+			return utils.FormatError(err)
 		}
-	}
-	// second iteration - treat everything else except / and SWAP
-	for index, part := range i.config.Partitions {
-		mapper := mappers[index]
-		if part.Type == 82 {
-			if out, err := i.run(fmt.Sprintf("mkswap -L %s %s", part.Label, mapper)); err != nil {
-				return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
-			}
-		} else if part.MountPoint != "/" {
-			cmd := fmt.Sprintf("mkfs -t %v -L %s %s %s", part.FileSystem,
-				part.Label, part.FileSystemArgs, mapper)
+		keyfile, err := i.newKeyfile(part)
+		if err != nil {
+			return utils.FormatError(err)
+		}
+		cmds, vols := formatCmds(part, mapper, keyfile, i.slashpath)
+		if err := i.journalVolumes(part); err != nil {
+			return utils.FormatError(err)
+		}
+		for _, cmd := range cmds {
 			if out, err := i.run(cmd); err != nil {
 				return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
 			}
-			if err := i.addMapper(mapper, part.MountPoint); err != nil {
-				return utils.FormatError(err)
-			}
 		}
+		if part.LUKS != nil {
+			i.encrypted = append(i.encrypted, &encryptedPartition{part, mapper, keyfile})
+		}
+		i.partDevices = append(i.partDevices, mapper)
+		volumes = append(volumes, vols...)
 	}
-	return nil
+	return i.mountVolumes(volumes)
 }
 
 const (
@@ -394,111 +593,101 @@ const (
 	allocateAll = -2
 )
 
-// generateFdiskCmd constructs a command to be used by fdisk utility
-// to create partition table on our disk
-func (i *image) generateFdiskCmd() {
-	// extended partiotion sequence number
-	extendedPart := 4
-	// first logical drive
-	logicalDrive := 5
-	// total amount of partitions
-	amountOfPartitions := len(i.config.Partitions)
-
-	// header of the command
-	i.config.FdiskCmd = `o\n`
-	for index, part := range i.config.Partitions {
-		// in case partition size in megabytes is set to -1
-		// caclulate partition size in percents
-		if part.SizeMb == calcInPercents {
-			if part.SizePercents == allocateAll {
-				part.SizeMb = allocateAll
-			} else {
-				part.SizeMb = i.config.SizeMb / 100 * part.SizePercents
-			}
-		}
-		switch {
-		// in case we are treating the last partition and need to allocate all the space left for it
-		case part.Sequence == amountOfPartitions && part.SizeMb == allocateAll:
-			if part.Sequence > extendedPart {
-				i.config.FdiskCmd += fmt.Sprintf(`n\nl\n%d\n\n\n`, logicalDrive)
-				logicalDrive++
-			} else if part.Sequence < extendedPart {
-				i.config.FdiskCmd += fmt.Sprintf(`n\np\n%d\n\n\n`, part.Sequence)
-			} else if part.Sequence == extendedPart {
-				i.config.FdiskCmd += `n\np\n\n\n`
-			}
-		// in case we are treating a primary partition
-		case part.Sequence < extendedPart:
-			i.config.FdiskCmd += fmt.Sprintf(`n\np\n%d\n\n+%dM\n`, part.Sequence, part.SizeMb)
-		// in case partition sequence is 4 - create extended partiton and treat the partition
-		// with sequence 4 as a logical drive
-		case part.Sequence == extendedPart:
-			i.config.FdiskCmd += fmt.Sprintf(`n\ne\n\n\n\n+%dM\n`, part.SizeMb)
-		// default behaviour
-		default:
-			i.config.FdiskCmd += fmt.Sprintf(`n\n\n+%dM\n`, part.SizeMb)
-		}
-		if index == 0 {
-			i.config.FdiskCmd += fmt.Sprintf(`t\n%d\n`, part.Type)
-		} else {
-			i.config.FdiskCmd += fmt.Sprintf(`t\n%d\n%d\n`, part.Sequence, part.Type)
-		}
+// partSizeMb returns partition size in megabytes.
+// In case partition size in megabytes is set to -1
+// the size is calculated in percents of the disk size
+func partSizeMb(config *Disk, part *Partition) int {
+	if part.SizeMb != calcInPercents {
+		return part.SizeMb
 	}
-
-	if i.config.Bootable {
-		i.config.FdiskCmd += fmt.Sprintf(`a\n%d\n`, i.config.ActivePartition)
+	if part.SizePercents == allocateAll {
+		return allocateAll
 	}
-
-	// write changes
-	i.config.FdiskCmd += `w`
+	return config.SizeMb / 100 * part.SizePercents
 }
 
-// addMappers registers appropriate mappers
+// addMappers opens LUKS, activates LVM of the existing partitions
+// and mounts the volumes
 func (i *image) addMappers() error {
 	mappers, err := i.getMappers(i.loopDevice.name)
 	if err != nil {
 		return utils.FormatError(err)
 	}
-	// first iteration - find root mount point and mount it
+	var volumes []*volume
 	for index, part := range i.config.Partitions {
-		if part.MountPoint == "/" {
-			if out, err := i.run(fmt.Sprintf("mount %s %s", mappers[index], i.slashpath)); err != nil {
+		mapper, err := i.mapper(mappers, index)
+		if err != nil {
+			return utils.FormatError(err)
+		}
+		keyfile := ""
+		if part.LUKS != nil {
+			if keyfile = part.LUKS.HostKeyFile; keyfile == "" {
+				return utils.FormatError(fmt.Errorf("partition %d: host keyfile is required to open LUKS", part.Sequence))
+			}
+		}
+		cmds, vols := openCmds(part, mapper, keyfile)
+		if err := i.journalVolumes(part); err != nil {
+			return utils.FormatError(err)
+		}
+		for _, cmd := range cmds {
+			if out, err := i.run(cmd); err != nil {
 				return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
 			}
 		}
+		volumes = append(volumes, vols...)
 	}
-	// second iteration - treat everything else except / and SWAP
-	for index, part := range i.config.Partitions {
-		// create SWAP and do not add to the mappers slice
-		if part.Type != 82 && part.MountPoint != "/" {
-			if err := i.addMapper(mappers[index], part.MountPoint); err != nil {
+	return i.mountVolumes(volumes)
+}
+
+// mountVolumes mounts the volumes, parent mount points first
+func (i *image) mountVolumes(volumes []*volume) error {
+	sorted := make([]*volume, len(volumes))
+	copy(sorted, volumes)
+	sort.Stable(byVolumeDepth(sorted))
+	for _, v := range sorted {
+		if v.mountPoint == "/" {
+			if out, err := i.run(v.mountCmd(i.slashpath)); err != nil {
+				return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+			}
+			if err := i.journal.add(mountResource(i.slashpath)); err != nil {
 				return utils.FormatError(err)
 			}
+			continue
+		}
+		if err := i.addMapper(v); err != nil {
+			return utils.FormatError(err)
 		}
 	}
 	return nil
 }
 
-// addMapper registers appropriate mapper and it's mount point
-func (i *image) addMapper(mapperDeviceName, path string) error {
-	mountPoint := filepath.Join(i.slashpath, path)
+// addMapper mounts the volume and registers appropriate mapper
+func (i *image) addMapper(v *volume) error {
+	mountPoint := filepath.Join(i.slashpath, v.mountPoint)
 	if out, err := i.run("mkdir -p " + mountPoint); err != nil {
 		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
 	}
-	// check if the volume is already mounted
-	mounted, err := isMounted(mapperDeviceName)
-	if err != nil {
-		return utils.FormatError(err)
+	// check if the volume is already mounted.
+	// The subvolumes of a btrfs file system share the device
+	mounted := false
+	if !strings.Contains(v.options, "subvol=") {
+		var err error
+		if mounted, err = isMounted(v.device); err != nil {
+			return utils.FormatError(err)
+		}
 	}
 	if !mounted {
-		if out, err := i.run(fmt.Sprintf("mount %s %s", mapperDeviceName, mountPoint)); err != nil {
+		if out, err := i.run(v.mountCmd(mountPoint)); err != nil {
 			return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
 		}
+		if err := i.journal.add(mountResource(mountPoint)); err != nil {
+			return utils.FormatError(err)
+		}
 	}
 	// add mapper
 	i.mappers = append(i.mappers,
 		&mapperDevice{
-			name:       mapperDeviceName,
+			name:       v.device,
 			mountPoint: mountPoint,
 		},
 	)
@@ -507,9 +696,71 @@ func (i *image) addMapper(mapperDeviceName, path string) error {
 	return nil
 }
 
+// newKeyfile returns path to the key the LUKS partition is formatted with.
+// The key is generated unless the host keyfile exists.
+// A temporary key is removed by Cleanup
+func (i *image) newKeyfile(part *Partition) (string, error) {
+	if part.LUKS == nil {
+		return "", nil
+	}
+	keyfile := part.LUKS.HostKeyFile
+	if keyfile == "" {
+		var err error
+		if keyfile, err = i.run("mktemp"); err != nil {
+			return "", utils.FormatError(err)
+		}
+		if err = i.journal.add(fileResource(keyfile)); err != nil {
+			return "", utils.FormatError(err)
+		}
+	}
+	if out, err := i.run(keyfileCmd(keyfile)); err != nil {
+		return "", utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	}
+	return keyfile, nil
+}
+
+// writeFstab adds the file systems of the partitions formatted on the devices
+// to /etc/fstab
+func (i *image) writeFstab(config *Disk, devices []string) error {
+	if config.Fstab == FstabNone || len(devices) == 0 {
+		return nil
+	}
+	var lines []string
+	for _, e := range fstabEntries(config, func(index int) string { return devices[index] }) {
+		spec, ok := fsSpec(config, e)
+		if !ok {
+			uuid, err := i.run("blkid -s UUID -o value " + e.device)
+			if err != nil {
+				return utils.FormatError(err)
+			}
+			spec = "UUID=" + uuid
+		}
+		lines = append(lines, e.line(spec))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return i.mergeTable("/etc/fstab", lines, 1)
+}
+
+// mergeTable merges the entries into the table (fstab, crypttab) in the rootfs
+// (see mergeTable)
+func (i *image) mergeTable(path string, entries []string, field int) error {
+	path = filepath.Join(i.slashpath, path)
+	table, err := i.run(fmt.Sprintf("mkdir -p %s && touch %s && cat %s", filepath.Dir(path), path, path))
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	data := base64.StdEncoding.EncodeToString([]byte(mergeTable(table, entries, field)))
+	if out, err := i.run(fmt.Sprintf("echo %s|base64 -d > %s", data, path)); err != nil {
+		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	}
+	return nil
+}
+
 // create is intended for creating RAW image
 func (i *image) create() error {
-	out, err := i.run(fmt.Sprintf("dd if=/dev/zero of=%s count=1 bs=1 seek=%vM", i.config.Path, i.config.SizeMb))
+	out, err := i.run(createCmd(i.config.Path, i.config.SizeMb))
 	if err != nil {
 		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
 	}
@@ -520,8 +771,11 @@ func (i *image) create() error {
 // and providing the stuff as a slice
 func (i *image) getMappers(loopDeviceName string) ([]string, error) {
 	var mappers []string
-	if _, err := i.run(i.utils.Kpartx + " -a " + loopDeviceName); err != nil {
-		return mappers, utils.FormatError(err)
+	// the partitions of the network block device are exposed by the kernel
+	if i.base == "" {
+		if _, err := i.run(i.utils.Kpartx + " -a " + loopDeviceName); err != nil {
+			return mappers, utils.FormatError(err)
+		}
 	}
 	// somehow on RHEL based systems refresh might take some time therefore
 	// no mappers are available until then
@@ -531,8 +785,7 @@ func (i *image) getMappers(loopDeviceName string) ([]string, error) {
 	}
 	time.Sleep(duration)
 
-	cmd := fmt.Sprintf("find /dev -name loop%sp[0-9]",
-		strings.TrimSpace(strings.SplitAfter(loopDeviceName, "/dev/loop")[1]))
+	cmd := fmt.Sprintf("find /dev -name '%sp[0-9]*'", filepath.Base(strings.TrimSpace(loopDeviceName)))
 	out, err := i.run(cmd)
 	if err != nil {
 		return mappers, utils.FormatError(fmt.Errorf("%s [%v]", out, err))
@@ -549,32 +802,222 @@ func (i *image) getMappers(loopDeviceName string) ([]string, error) {
 	return mappers, nil
 }
 
-// convert is responsible for converting RAW image to other format
+// mapper returns the mapper of the partition given by the index
+// in the disk configuration
+func (i *image) mapper(mappers []string, index int) (string, error) {
+	return mapperByNumber(mappers, partNumbers(i.config)[index])
+}
+
+// mapperByNumber returns the mapper of the partition given by the number
+func mapperByNumber(mappers []string, number int) (string, error) {
+	suffix := fmt.Sprintf("p%d", number)
+	for _, m := range mappers {
+		if strings.HasSuffix(m, suffix) {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("mapper of partition %s not found", suffix)
+}
+
+// writePartTable writes the partition table to the RAW image.
+// In remote mode the table sectors are written by dd
+func (i *image) writePartTable() error {
+	sectors, err := partTable(i.config, rand.Reader)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	return i.writeSectors(sectors)
+}
+
+// writeSectors writes the partition table sectors to the RAW image.
+// In remote mode the sectors are written by dd
+func (i *image) writeSectors(sectors []*tableSectors) error {
+	if i.client == nil {
+		f, err := os.OpenFile(i.config.Path, os.O_WRONLY, 0)
+		if err != nil {
+			return utils.FormatError(err)
+		}
+		defer f.Close()
+		for _, s := range sectors {
+			if _, err := f.WriteAt(s.data, int64(s.lba)*sectorSize); err != nil {
+				return utils.FormatError(err)
+			}
+		}
+		return nil
+	}
+	for _, s := range sectors {
+		cmd := fmt.Sprintf("echo %s|base64 -d|dd of=%s bs=%d seek=%d conv=notrunc",
+			base64.StdEncoding.EncodeToString(s.data), i.config.Path, sectorSize, s.lba)
+		if out, err := i.run(cmd); err != nil {
+			return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+		}
+	}
+	return nil
+}
+
+// convert is responsible for converting RAW image (or flattening the overlay)
+// to other format
 func (i *image) convert() error {
 	// set the new path - append extention
-	newPath := fmt.Sprintf("%s.%s", strings.TrimSuffix(i.config.Path, ".raw"), i.config.Type)
-	if out, err := i.run(fmt.Sprintf("qemu-img convert -f raw -O %s %s %s", i.config.Type, i.config.Path, newPath)); err != nil {
+	newPath := convertedPath(i.config.Path, i.config.Type)
+	if i.base != "" {
+		newPath = i.dest
+	}
+	// the existing image opened by Open is replaced
+	// only once the conversion succeeds
+	target := newPath
+	if i.temporary {
+		target = partialPath(newPath)
+	}
+	cmd := convertCmd(i.config, i.config.Path, target)
+	if i.base != "" {
+		cmd = convertFromCmd(i.config, string(StorageTypeQCOW2), i.config.Path, target)
+	}
+	if out, err := runConvert(i.ctx, i.run, i.stream, cmd); err != nil {
+		// remove partially converted image
+		i.release("rm -f " + target)
 		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
 	}
+	if target != newPath {
+		if out, err := i.run(replaceCmd(target, newPath)); err != nil {
+			i.release("rm -f " + target)
+			return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+		}
+	}
 	//remove temporary image
 	if out, err := i.run("rm -rf " + i.config.Path); err != nil {
 		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
 	}
 	// expose the new path
 	i.config.Path = newPath
+	// the existing image has been replaced and is not discarded anymore
+	i.temporary = false
 	return nil
 }
 
 func (i *image) bind(imagePath string) (loopDevice string, err error) {
+	if i.base != "" {
+		return i.nbdBind(imagePath)
+	}
 	loopDevice, err = i.run("losetup -f")
 	if err != nil {
 		err = utils.FormatError(err)
 		return
 	}
 	cmd := fmt.Sprintf("losetup %s %s", loopDevice, imagePath)
-	if out, er := i.run(cmd); err != nil {
+	if out, er := i.run(cmd); er != nil {
 		err = utils.FormatError(fmt.Errorf("%s [%v]", out, er))
 		return
 	}
+	// the mappers are removed before the loop device is released
+	if err = i.journal.add(loopResource(loopDevice, imagePath)); err != nil {
+		err = utils.FormatError(err)
+		return
+	}
+	if err = i.journal.add(mappersResource(i.utils.Kpartx, loopDevice, imagePath)); err != nil {
+		err = utils.FormatError(err)
+	}
 	return
 }
+
+// journalVolumes records LUKS and LVM of the partition before they are opened
+func (i *image) journalVolumes(part *Partition) error {
+	for _, r := range volumeResources(part) {
+		if err := i.journal.add(r); err != nil {
+			return utils.FormatError(err)
+		}
+	}
+	return nil
+}
+
+// journalMounts records the mount points before they are mounted
+func (i *image) journalMounts(mountPoints ...string) error {
+	for _, mountPoint := range mountPoints {
+		if err := i.journal.add(mountResource(mountPoint)); err != nil {
+			return utils.FormatError(err)
+		}
+	}
+	return nil
+}
+
+// commands shared by the image processing and the plan (see Plan)
+
+// partition type of a SWAP partition
+const partTypeSwap = 82
+
+// rawPath returns path to the RAW image processed before the conversion
+func rawPath(config *Disk) string {
+	return strings.TrimSuffix(config.Path, "."+config.Type.Extension()) + ".raw"
+}
+
+// convertedPath returns path to the image converted to the given format
+func convertedPath(rawPath string, storageType StorageType) string {
+	return fmt.Sprintf("%s.%s", strings.TrimSuffix(rawPath, ".raw"), storageType.Extension())
+}
+
+// partialPath returns path to the image converted before it replaces
+// the existing one
+func partialPath(path string) string {
+	return path + ".partial"
+}
+
+// replaceCmd returns the command replacing the existing image
+// by the converted one
+func replaceCmd(partialPath, path string) string {
+	return fmt.Sprintf("mv -f %s %s", partialPath, path)
+}
+
+func createCmd(path string, sizeMb int) string {
+	return fmt.Sprintf("dd if=/dev/zero of=%s count=1 bs=1 seek=%vM", path, sizeMb)
+}
+
+func partitionCmd(fdiskCmd, device string) string {
+	return fmt.Sprintf("echo -e  \"%s\"|%s %s", fdiskCmd, "fdisk", device)
+}
+
+// mkfsCmd returns the command creating either a file system or SWAP on the device
+func mkfsCmd(part *Partition, device string) string {
+	if isSwap(part) {
+		return fmt.Sprintf("mkswap -L %s %s", part.Label, device)
+	}
+	// FAT label is set by -n
+	if part.FileSystem == "vfat" {
+		return fmt.Sprintf("mkfs -t vfat -n %s %s %s", part.Label, part.FileSystemArgs, device)
+	}
+	// xfs and btrfs refuse to overwrite an existing signature
+	if part.FileSystem == "xfs" || part.FileSystem == "btrfs" {
+		return fmt.Sprintf("mkfs -t %v -f -L %s %s %s", part.FileSystem,
+			part.Label, part.FileSystemArgs, device)
+	}
+	return fmt.Sprintf("mkfs -t %v -L %s %s %s", part.FileSystem,
+		part.Label, part.FileSystemArgs, device)
+}
+
+func mountCmd(device, mountPoint string) string {
+	return fmt.Sprintf("mount %s %s", device, mountPoint)
+}
+
+func convertCmd(config *Disk, rawPath, newPath string) string {
+	return convertFromCmd(config, string(StorageTypeRAW), rawPath, newPath)
+}
+
+// convertFromCmd returns the command converting the image of the given format
+// to the format of the disk configuration
+func convertFromCmd(config *Disk, format, path, newPath string) string {
+	var opts []string
+	switch config.Type {
+	case StorageTypeQCOW2Compressed:
+		opts = append(opts, "-c")
+	case StorageTypeVHD:
+		// Azure requires fixed VHD of the exact size
+		opts = append(opts, "-o subformat=fixed,force_size")
+	}
+	if config.ClusterSize != "" && config.Type.Format() == string(StorageTypeQCOW2) {
+		opts = append(opts, "-o cluster_size="+config.ClusterSize)
+	}
+	cmd := fmt.Sprintf("qemu-img convert -f %s -O %s", format, config.Type.Format())
+	for _, o := range opts {
+		cmd += " " + o
+	}
+	return fmt.Sprintf("%s %s %s", cmd, path, newPath)
+}
@@ -1,6 +1,7 @@
 package image
 
 import (
+	"context"
 	"os"
 	"testing"
 
@@ -77,14 +78,11 @@ func TestLocalImage(t *testing.T) {
 
 	for _, disk := range config.Disks {
 		t.Logf("=> new disk description => %s", disk.Description)
-		img, err := New(disk, rootfsMp, u, nil)
+		img, err := New(context.Background(), disk, rootfsMp, u, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		// interrupt handler
-		img.ReleaseOnInterrupt()
-
 		defer func() {
 			t.Log("=> CleanupPre")
 			if err := img.CleanupPre(); err != nil {
@@ -136,11 +134,10 @@ func TestRemoteImage(t *testing.T) {
 
 	for _, disk := range config.Disks {
 		t.Logf("=> new disk description => %s", disk.Description)
-		img, err := New(disk, rootfsMp, u, sshfsConf)
+		img, err := New(context.Background(), disk, rootfsMp, u, sshfsConf)
 		if err != nil {
 			t.Fatal(err)
 		}
-		img.ReleaseOnInterrupt()
 
 		defer func() {
 			t.Log("=> CleanupPre")
@@ -0,0 +1,264 @@
+// Journals the resources held by the image processing
+
+package image
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/dorzheh/deployer/utils"
+)
+
+// JournalDir is the directory the journals are kept in
+// on the host processing the image
+var JournalDir = "/var/lib/deployer/journal"
+
+// resource represents a loop device, a mapper, a mount
+// or a temporary directory held by the image processing
+type resource struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+
+	// shell condition verifying the resource is still held.
+	// The resource is released unconditionally if empty
+	Check string `json:"check,omitempty"`
+
+	// command releasing the resource
+	Release string `json:"release"`
+}
+
+// command returns the command releasing the resource
+func (r *resource) command() string {
+	if r.Check == "" {
+		return r.Release
+	}
+	return fmt.Sprintf("if %s; then %s; fi", r.Check, r.Release)
+}
+
+// journal records the resources in the state file on the host
+// processing the image, so that they are released even though
+// the process is killed (see ReleaseStale)
+type journal struct {
+	// host and ID of the process holding the resources
+	Host string `json:"host"`
+	Pid  int    `json:"pid"`
+
+	// the image processed
+	Image string `json:"image"`
+
+	// the resources in the order they are acquired
+	Resources []*resource `json:"resources"`
+
+	// executes commands on the host processing the image
+	run func(string) (string, error)
+
+	// path to the state file
+	path string
+}
+
+// newJournal creates the state file of the image processing in JournalDir.
+// The commands are executed by run
+func newJournal(run func(string) (string, error), image string) (*journal, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, utils.FormatError(err)
+	}
+	j := &journal{Host: host, Pid: os.Getpid(), Image: image, run: run}
+	if j.path, err = run(fmt.Sprintf("mkdir -p %s && mktemp --suffix .json -p %s journal.XXXXXXXX", JournalDir, JournalDir)); err != nil {
+		return nil, utils.FormatError(err)
+	}
+	if err := j.save(); err != nil {
+		return nil, utils.FormatError(err)
+	}
+	return j, nil
+}
+
+// add records the resource once it is acquired
+func (j *journal) add(r *resource) error {
+	j.Resources = append(j.Resources, r)
+	return j.save()
+}
+
+// release releases the resources in the reverse order.
+// The resources failed to be released are kept in the journal,
+// the first failure is reported. The state file is removed once
+// all the resources are released
+func (j *journal) release() error {
+	var firstErr error
+	var held []*resource
+	for index := len(j.Resources) - 1; index >= 0; index-- {
+		r := j.Resources[index]
+		if out, err := j.run(r.command()); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("releasing %s %s: %s [%v]", r.Kind, r.Name, out, err)
+			}
+			held = append([]*resource{r}, held...)
+		}
+	}
+	j.Resources = held
+	if len(held) == 0 {
+		if err := j.remove(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	} else if err := j.save(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// save writes the state file atomically
+func (j *journal) save() error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	cmd := fmt.Sprintf("echo %s|base64 -d > %s.tmp && mv %s.tmp %s",
+		base64.StdEncoding.EncodeToString(data), j.path, j.path, j.path)
+	if out, err := j.run(cmd); err != nil {
+		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	}
+	return nil
+}
+
+func (j *journal) remove() error {
+	if out, err := j.run("rm -f " + j.path); err != nil {
+		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	}
+	return nil
+}
+
+// ReleaseStale releases the resources recorded by the journals in JournalDir
+// of the image processing which is not running anymore, for example killed.
+// The commands are executed by run either locally or on the remote host.
+// Since it cannot be verified whether a process of other host is running,
+// the journals of other hosts are released only if force is set.
+// A resource is released provided it is still held: the mount point
+// is mounted, the loop device is bound to the image and so forth.
+// In plan mode (plan is not nil) the commands are written instead.
+// Returns the number of the journals released
+func ReleaseStale(run func(string) (string, error), plan io.Writer, force bool) (int, error) {
+	out, err := run(fmt.Sprintf("ls %s 2>/dev/null || true", filepath.Join(JournalDir, "journal.*.json")))
+	if err != nil {
+		return 0, utils.FormatError(err)
+	}
+	var firstErr error
+	released := 0
+	for _, path := range strings.Fields(out) {
+		j, err := readJournal(run, path)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if !j.stale(force) {
+			continue
+		}
+		if plan != nil {
+			fmt.Fprintf(plan, "journal %s (image %s, process %d on %s)\n", path, j.Image, j.Pid, j.Host)
+			for index := len(j.Resources) - 1; index >= 0; index-- {
+				fmt.Fprintf(plan, "  %s\n", j.Resources[index].command())
+			}
+			fmt.Fprintf(plan, "  rm -f %s\n", path)
+			released++
+			continue
+		}
+		if err := j.release(); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		released++
+	}
+	if firstErr != nil {
+		return released, utils.FormatError(firstErr)
+	}
+	return released, nil
+}
+
+// readJournal reads the state file
+func readJournal(run func(string) (string, error), path string) (*journal, error) {
+	out, err := run("cat " + path)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{run: run, path: path}
+	if err := json.Unmarshal([]byte(out), j); err != nil {
+		return nil, fmt.Errorf("journal %s: %v", path, err)
+	}
+	return j, nil
+}
+
+// stale reports whether the process holding the resources is not running
+func (j *journal) stale(force bool) bool {
+	host, err := os.Hostname()
+	if err != nil || host != j.Host {
+		return force
+	}
+	if j.Pid == os.Getpid() {
+		return false
+	}
+	return syscall.Kill(j.Pid, 0) == syscall.ESRCH
+}
+
+// the resources and the commands releasing them provided they are still held
+
+func mountResource(mountPoint string) *resource {
+	return &resource{"mount", mountPoint, "mountpoint -q " + mountPoint, "umount -l " + mountPoint}
+}
+
+// sshfsResource represents the local mount of the rootfs processed on the remote host
+func sshfsResource(mountPoint string) *resource {
+	return &resource{"sshfs", mountPoint, "mountpoint -q " + mountPoint, "fusermount -u " + mountPoint}
+}
+
+// dirResource represents the temporary directory, which is never removed
+// while mounted
+func dirResource(dir string) *resource {
+	return &resource{"directory", dir, "[ -e " + dir + " ]", fmt.Sprintf("! mountpoint -q %s && rm -rf %s", dir, dir)}
+}
+
+func fileResource(path string) *resource {
+	return &resource{"file", path, "", "rm -f " + path}
+}
+
+func loopResource(device, image string) *resource {
+	return &resource{"loop", device, loopCheck(device, image), "losetup -d " + device}
+}
+
+// mappersResource represents the mappers created by kpartx
+func mappersResource(kpartx, device, image string) *resource {
+	return &resource{"mappers", device, loopCheck(device, image), kpartx + " -d " + device}
+}
+
+func nbdResource(device, image string) *resource {
+	check := fmt.Sprintf("pgrep -f -- '%s' >/dev/null", nbdConnectCmd(device, image))
+	return &resource{"nbd", device, check, "qemu-nbd --disconnect " + device}
+}
+
+// loopCheck returns the condition verifying the loop device is bound to the image
+func loopCheck(device, image string) string {
+	return fmt.Sprintf("[ \"$(losetup -n -O BACK-FILE %s 2>/dev/null)\" = %s ]", device, image)
+}
+
+// volumeResources returns LUKS and LVM of the partition in the order
+// they are opened
+func volumeResources(part *Partition) []*resource {
+	var resources []*resource
+	if part.LUKS != nil {
+		device := luksDevice(part.LUKS)
+		resources = append(resources, &resource{"LUKS", part.LUKS.Name, "[ -e " + device + " ]", "cryptsetup luksClose " + part.LUKS.Name})
+	}
+	if part.LVM != nil {
+		vg := part.LVM.VolumeGroup
+		resources = append(resources, &resource{"LVM", vg, "vgs " + vg + " >/dev/null 2>&1", "vgchange -an " + vg})
+	}
+	return resources
+}
@@ -0,0 +1,122 @@
+package image
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dorzheh/deployer/utils"
+)
+
+// testResource appends the name to the log once released
+func testResource(log, name string) *resource {
+	return &resource{"test", name, "", "echo " + name + " >> " + log}
+}
+
+func TestJournalRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	JournalDir = dir
+	log := filepath.Join(dir, "log")
+
+	j, err := newJournal(utils.RunFunc(nil), "/tmp/test.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"first", "second"} {
+		if err := j.add(testResource(log, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved, err := readJournal(utils.RunFunc(nil), j.path)
+	if err != nil || saved.Image != "/tmp/test.img" || len(saved.Resources) != 2 {
+		t.Fatalf("unexpected journal %+v [%v]", saved, err)
+	}
+
+	failed := &resource{"test", "failed", "", "false"}
+	j.Resources = append([]*resource{failed}, j.Resources...)
+	if err := j.release(); err == nil {
+		t.Fatal("resource failed to be released, expected error")
+	}
+	if data, _ := ioutil.ReadFile(log); string(data) != "second\nfirst\n" {
+		t.Fatalf("unexpected release order %q", data)
+	}
+	if saved, err := readJournal(utils.RunFunc(nil), j.path); err != nil || len(saved.Resources) != 1 {
+		t.Fatalf("failed resource isn't kept %+v [%v]", saved, err)
+	}
+
+	j.Resources = nil
+	if err := j.release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(j.path); !os.IsNotExist(err) {
+		t.Fatal("journal isn't removed")
+	}
+}
+
+func TestReleaseStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	JournalDir = dir
+	log := filepath.Join(dir, "log")
+	host, _ := os.Hostname()
+
+	journals := map[string]*journal{}
+	for name, j := range map[string]*journal{
+		"dead":    {Host: host, Pid: 1 << 22},
+		"running": {Host: host, Pid: os.Getpid()},
+		"other":   {Host: host + ".other", Pid: 1},
+	} {
+		created, err := newJournal(utils.RunFunc(nil), "/tmp/"+name+".img")
+		if err != nil {
+			t.Fatal(err)
+		}
+		created.Host, created.Pid = j.Host, j.Pid
+		if err := created.add(testResource(log, name)); err != nil {
+			t.Fatal(err)
+		}
+		journals[name] = created
+	}
+
+	plan := new(bytes.Buffer)
+	if released, err := ReleaseStale(utils.RunFunc(nil), plan, false); err != nil || released != 1 {
+		t.Fatalf("unexpected journals released %d [%v]", released, err)
+	}
+	if !strings.Contains(plan.String(), "  echo dead >> "+log+"\n") || strings.Contains(plan.String(), "running") {
+		t.Fatalf("unexpected plan:\n%s", plan.String())
+	}
+	if _, err := os.Stat(log); !os.IsNotExist(err) {
+		t.Fatal("resource released in plan mode")
+	}
+
+	if released, err := ReleaseStale(utils.RunFunc(nil), nil, false); err != nil || released != 1 {
+		t.Fatalf("unexpected journals released %d [%v]", released, err)
+	}
+	if data, _ := ioutil.ReadFile(log); string(data) != "dead\n" {
+		t.Fatalf("unexpected resources released %q", data)
+	}
+	if released, err := ReleaseStale(utils.RunFunc(nil), nil, true); err != nil || released != 1 {
+		t.Fatalf("unexpected journals released %d [%v]", released, err)
+	}
+	if _, err := os.Stat(journals["running"].path); err != nil {
+		t.Fatal("journal of the running process is released")
+	}
+}
+
+func TestResourceCommand(t *testing.T) {
+	if cmd := mountResource("/mnt").command(); cmd != "if mountpoint -q /mnt; then umount -l /mnt; fi" {
+		t.Fatalf("unexpected command %q", cmd)
+	}
+	if cmd := fileResource("/root/data.key").command(); cmd != "rm -f /root/data.key" {
+		t.Fatalf("unexpected command %q", cmd)
+	}
+}
@@ -0,0 +1,113 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dorzheh/deployer/utils"
+)
+
+// planNbdDevice stands for the network block device the overlay is attached to
+const planNbdDevice = "/dev/nbdN"
+
+// findNbdCmd prints the first network block device not in use
+const findNbdCmd = `for d in /sys/class/block/nbd*; do case ${d##*/} in *p*) continue;; esac; ` +
+	`[ "$(cat $d/size)" = 0 ] && echo /dev/${d##*/} && exit 0; done; exit 1`
+
+// NewOverlay creates a qcow2 overlay of the base image which is used
+// as a backing file. The base image is expected to be partitioned
+// and formatted according to the disk configuration, Parse attaches
+// the overlay by qemu-nbd and mounts the existing partitions.
+// Convert flattens the overlay to the image described by the disk configuration.
+// Only local images are supported.
+// Returns a pointer to the structure and error/nil
+func NewOverlay(ctx context.Context, config *Disk, base, rootfsMp string, bins *Utils) (i *image, err error) {
+	if i, err = newImage(ctx, config, rootfsMp, bins, nil); err != nil {
+		return
+	}
+	defer i.abortOnError(&err)
+	for _, tool := range []string{"qemu-img", "qemu-nbd"} {
+		if _, err = i.run("which " + tool); err != nil {
+			err = utils.FormatError(fmt.Errorf("please install %s", tool))
+			return
+		}
+	}
+	i.base = base
+	i.dest = config.Path
+	i.config.Path = overlayPath(config)
+	if out, er := i.run(overlayCmd(base, i.config.Path)); er != nil {
+		err = utils.FormatError(fmt.Errorf("%s [%v]", out, er))
+		return
+	}
+	i.created = true
+	return
+}
+
+// PlanOverlay writes the commands the processing of the overlay
+// of the base image would run (see NewOverlay).
+// Returns path to the image that would be created.
+func PlanOverlay(w io.Writer, config *Disk, base, rootfsMp string) (string, error) {
+	buf := new(bytes.Buffer)
+	path := overlayPath(config)
+
+	fmt.Fprintf(buf, "disk: %s (overlay of %s)\n", config.Description, base)
+	fmt.Fprintf(buf, "  commands:\n")
+	fmt.Fprintf(buf, "    %s\n", overlayCmd(base, path))
+	fmt.Fprintf(buf, "    %s\n", nbdConnectCmd(planNbdDevice, path))
+	volumes, err := planOpenCmds(buf, config, func(config *Disk, index int) string {
+		return nbdPartition(config, planNbdDevice, index)
+	})
+	if err != nil {
+		return "", err
+	}
+	planMounts(buf, volumes, rootfsMp)
+	fmt.Fprintf(buf, "    qemu-nbd --disconnect %s\n", planNbdDevice)
+	fmt.Fprintf(buf, "    %s\n", convertFromCmd(config, string(StorageTypeQCOW2), path, config.Path))
+	fmt.Fprintf(buf, "    rm -f %s\n", path)
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return "", err
+	}
+	return config.Path, nil
+}
+
+// nbdBind attaches the overlay to the first network block device not in use
+func (i *image) nbdBind(imagePath string) (string, error) {
+	if out, err := i.run("modprobe nbd max_part=16"); err != nil {
+		return "", utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	}
+	device, err := i.run(findNbdCmd)
+	if err != nil {
+		return "", utils.FormatError(errors.New("no network block device available"))
+	}
+	if out, err := i.run(nbdConnectCmd(device, imagePath)); err != nil {
+		return "", utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	}
+	if err := i.journal.add(nbdResource(device, imagePath)); err != nil {
+		return "", utils.FormatError(err)
+	}
+	return device, nil
+}
+
+// overlayPath returns path to the overlay processed before the conversion
+func overlayPath(config *Disk) string {
+	return strings.TrimSuffix(config.Path, "."+config.Type.Extension()) + ".overlay.qcow2"
+}
+
+func overlayCmd(base, overlay string) string {
+	return fmt.Sprintf("qemu-img create -f qcow2 -F qcow2 -b %s %s", base, overlay)
+}
+
+func nbdConnectCmd(device, overlay string) string {
+	return fmt.Sprintf("qemu-nbd --connect=%s -f qcow2 %s", device, overlay)
+}
+
+// nbdPartition returns the device of the partition given by the index
+// in the disk configuration
+func nbdPartition(config *Disk, device string, index int) string {
+	return fmt.Sprintf("%sp%d", device, partNumbers(config)[index])
+}
@@ -0,0 +1,392 @@
+// Writes MBR and GPT partition tables to RAW image
+
+package image
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// logical sector size of the image
+	sectorSize = 512
+
+	// partitions are aligned to 1MB
+	alignSectors = 2048
+
+	// MBR partition types
+	mbrTypeExtended   = 0x05
+	mbrTypeProtective = 0xee
+
+	// GPT partition entries
+	gptEntries      = 128
+	gptEntrySize    = 128
+	gptEntrySectors = gptEntries * gptEntrySize / sectorSize
+
+	// legacy BIOS bootable GPT attribute
+	gptAttrLegacyBoot = 1 << 2
+)
+
+// extent represents a partition placed on the disk
+type extent struct {
+	part *Partition
+
+	// partition number (the device suffix)
+	number int
+
+	// first sector and size in sectors
+	start uint64
+	size  uint64
+
+	// sector of the Extended Boot Record of a logical partition
+	ebr uint64
+}
+
+// tableSectors represents consecutive sectors written to the disk
+type tableSectors struct {
+	lba  uint64
+	data []byte
+}
+
+// WritePartTable writes the partition table described by the disk configuration
+// to the RAW image. Partitions are placed in the configuration order
+// and aligned to 1MB. GUIDs and MBR disk signature are read from rand.
+func WritePartTable(w io.WriterAt, config *Disk, rand io.Reader) error {
+	sectors, err := partTable(config, rand)
+	if err != nil {
+		return err
+	}
+	for _, s := range sectors {
+		if _, err := w.WriteAt(s.data, int64(s.lba)*sectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partTable returns the sectors of the partition table
+func partTable(config *Disk, rand io.Reader) ([]*tableSectors, error) {
+	extents, err := partLayout(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.PartTable == PartTableGPT {
+		return gptTable(config, extents, rand)
+	}
+	return mbrTable(config, extents, rand)
+}
+
+// diskSectors returns the disk size in sectors
+func diskSectors(config *Disk) uint64 {
+	return uint64(config.SizeMb) * (1024 * 1024 / sectorSize)
+}
+
+// alignUp rounds the sector up to the partition alignment
+func alignUp(lba uint64) uint64 {
+	return (lba + alignSectors - 1) / alignSectors * alignSectors
+}
+
+// partLayout places the partitions on the disk.
+// MBR disk with more than 4 partitions gets 3 primary partitions
+// followed by the extended partition holding logical partitions 5, 6 and so on.
+// Only the last partition is allowed to allocate the rest of the disk.
+func partLayout(config *Disk) ([]*extent, error) {
+	if len(config.Partitions) == 0 {
+		return nil, errors.New("no partitions configured")
+	}
+	total := diskSectors(config)
+	gpt := config.PartTable == PartTableGPT
+
+	// the last sector available for partitions
+	last := total - 1
+	if gpt {
+		if len(config.Partitions) > gptEntries {
+			return nil, fmt.Errorf("GPT supports up to %d partitions", gptEntries)
+		}
+		last = total - gptEntrySectors - 2
+	} else if total > 0xffffffff {
+		return nil, errors.New("MBR supports disks up to 2TB, please use GPT")
+	}
+
+	logical := !gpt && len(config.Partitions) > 4
+	var extents []*extent
+	next := uint64(alignSectors)
+	for index, part := range config.Partitions {
+		e := &extent{part: part, number: index + 1}
+		if logical && index >= 3 {
+			// the Extended Boot Record precedes the aligned logical partition
+			e.number = index + 2
+			e.ebr = next
+			next += alignSectors
+		}
+		e.start = next
+		if e.start > last {
+			return nil, fmt.Errorf("partition %d exceeds the disk size", e.number)
+		}
+
+		switch sizeMb := partSizeMb(config, part); {
+		case sizeMb == allocateAll:
+			if index != len(config.Partitions)-1 {
+				return nil, fmt.Errorf("partition %d: only the last partition may allocate the rest of the disk", e.number)
+			}
+			e.size = last - e.start + 1
+		case sizeMb > 0:
+			e.size = uint64(sizeMb) * (1024 * 1024 / sectorSize)
+			if e.start+e.size-1 > last {
+				return nil, fmt.Errorf("partition %d exceeds the disk size", e.number)
+			}
+		default:
+			return nil, fmt.Errorf("partition %d: invalid size %d MB", e.number, sizeMb)
+		}
+		next = alignUp(e.start + e.size)
+		extents = append(extents, e)
+	}
+	return extents, nil
+}
+
+// partNumbers returns the partition numbers in the configuration order.
+// The partitions created by user-supplied fdisk script are numbered
+// sequentially.
+func partNumbers(config *Disk) []int {
+	numbers := make([]int, len(config.Partitions))
+	extents, err := partLayout(config)
+	for index := range numbers {
+		if config.FdiskCmd != "" || err != nil {
+			numbers[index] = index + 1
+		} else {
+			numbers[index] = extents[index].number
+		}
+	}
+	return numbers
+}
+
+// mbrType returns the MBR partition type.
+// Partition type is configured the way fdisk accepts it, i.e. 83 stands for 0x83
+func mbrType(part *Partition) (byte, error) {
+	if part.Type == partTypeEfi || part.Type == partTypeLVM {
+		return byte(part.Type), nil
+	}
+	t, err := strconv.ParseUint(strconv.Itoa(part.Type), 16, 8)
+	if err != nil || t == 0 {
+		return 0, fmt.Errorf("invalid partition type %d", part.Type)
+	}
+	return byte(t), nil
+}
+
+// chs returns the CHS address of the sector.
+// Addresses beyond the CHS limits are set to the maximum
+func chs(lba uint64) [3]byte {
+	const heads, sectors = 255, 63
+	c := lba / (heads * sectors)
+	if c > 1023 {
+		return [3]byte{0xfe, 0xff, 0xff}
+	}
+	h := lba / sectors % heads
+	s := lba%sectors + 1
+	return [3]byte{byte(h), byte(s) | byte(c>>2&0xc0), byte(c)}
+}
+
+// mbrEntry encodes a partition entry of the MBR or EBR
+func mbrEntry(b []byte, active bool, partType byte, start, size uint64) {
+	if active {
+		b[0] = 0x80
+	}
+	first, last := chs(start), chs(start+size-1)
+	copy(b[1:4], first[:])
+	b[4] = partType
+	copy(b[5:8], last[:])
+	binary.LittleEndian.PutUint32(b[8:12], uint32(start))
+	binary.LittleEndian.PutUint32(b[12:16], uint32(size))
+}
+
+// bootSector returns the Master (or Extended) Boot Record with the signature set
+func bootSector() []byte {
+	b := make([]byte, sectorSize)
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+// entryOffset returns the offset of the partition entry in the boot record
+func entryOffset(index int) int {
+	return 446 + 16*index
+}
+
+// mbrTable returns the sectors of the MBR partition table
+func mbrTable(config *Disk, extents []*extent, rand io.Reader) ([]*tableSectors, error) {
+	mbr := bootSector()
+	if _, err := io.ReadFull(rand, mbr[440:444]); err != nil {
+		return nil, err
+	}
+	sectors := []*tableSectors{{0, mbr}}
+
+	activeFound := !config.Bootable || config.ActivePartition == 0
+	var logicals []*extent
+	for index, e := range extents {
+		if e.ebr != 0 {
+			logicals = append(logicals, e)
+			continue
+		}
+		partType, err := mbrType(e.part)
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %v", e.number, err)
+		}
+		active := config.Bootable && config.ActivePartition == e.number
+		activeFound = activeFound || active
+		mbrEntry(mbr[entryOffset(index):], active, partType, e.start, e.size)
+	}
+	if !activeFound {
+		return nil, fmt.Errorf("active partition %d is not a primary partition", config.ActivePartition)
+	}
+	if len(logicals) == 0 {
+		return sectors, nil
+	}
+
+	// the extended partition spans the logical partitions
+	extStart := logicals[0].ebr
+	lastLogical := logicals[len(logicals)-1]
+	mbrEntry(mbr[entryOffset(3):], false, mbrTypeExtended, extStart, lastLogical.start+lastLogical.size-extStart)
+
+	// EBR chain - each EBR describes the logical partition
+	// and points to the next EBR relative to the extended partition
+	for index, e := range logicals {
+		partType, err := mbrType(e.part)
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %v", e.number, err)
+		}
+		ebr := bootSector()
+		mbrEntry(ebr[entryOffset(0):], false, partType, e.start-e.ebr, e.size)
+		if index < len(logicals)-1 {
+			n := logicals[index+1]
+			mbrEntry(ebr[entryOffset(1):], false, mbrTypeExtended, n.ebr-extStart, n.start+n.size-n.ebr)
+		}
+		sectors = append(sectors, &tableSectors{e.ebr, ebr})
+	}
+	return sectors, nil
+}
+
+// guid represents GUID in the canonical (RFC 4122) byte order
+type guid [16]byte
+
+// parseGUID parses GUID string such as C12A7328-F81F-11D2-BA4B-00A0C93EC93B
+func parseGUID(s string) (g guid, err error) {
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != len(g) || strings.Count(s, "-") != 4 {
+		return g, fmt.Errorf("invalid GUID %s", s)
+	}
+	copy(g[:], b)
+	return g, nil
+}
+
+// randomGUID returns a version 4 GUID
+func randomGUID(rand io.Reader) (g guid, err error) {
+	if _, err = io.ReadFull(rand, g[:]); err != nil {
+		return
+	}
+	g[6] = g[6]&0x0f | 0x40
+	g[8] = g[8]&0x3f | 0x80
+	return
+}
+
+// encode stores GUID the way GPT does - the first three fields are little endian
+func (g guid) encode(b []byte) {
+	b[0], b[1], b[2], b[3] = g[3], g[2], g[1], g[0]
+	b[4], b[5] = g[5], g[4]
+	b[6], b[7] = g[7], g[6]
+	copy(b[8:16], g[8:])
+}
+
+// decodeGUID reads GUID stored the way GPT does (see encode)
+func decodeGUID(b []byte) (g guid) {
+	g[0], g[1], g[2], g[3] = b[3], b[2], b[1], b[0]
+	g[4], g[5] = b[5], b[4]
+	g[6], g[7] = b[7], b[6]
+	copy(g[8:], b[8:16])
+	return
+}
+
+// putGptName stores the partition name (UTF-16) in the GPT entry
+func putGptName(entry []byte, name string) error {
+	s := utf16.Encode([]rune(name))
+	if len(s) > 36 {
+		return fmt.Errorf("name %s is too long", name)
+	}
+	for i, c := range s {
+		binary.LittleEndian.PutUint16(entry[56+2*i:], c)
+	}
+	return nil
+}
+
+// gptHeader returns the GPT header sector
+func gptHeader(current, backup, entriesLBA, total uint64, disk guid, entries []byte) []byte {
+	b := make([]byte, sectorSize)
+	copy(b[0:8], "EFI PART")
+	binary.LittleEndian.PutUint32(b[8:12], 0x00010000)
+	binary.LittleEndian.PutUint32(b[12:16], 92)
+	binary.LittleEndian.PutUint64(b[24:32], current)
+	binary.LittleEndian.PutUint64(b[32:40], backup)
+	binary.LittleEndian.PutUint64(b[40:48], gptEntrySectors+2)
+	binary.LittleEndian.PutUint64(b[48:56], total-gptEntrySectors-2)
+	disk.encode(b[56:72])
+	binary.LittleEndian.PutUint64(b[72:80], entriesLBA)
+	binary.LittleEndian.PutUint32(b[80:84], gptEntries)
+	binary.LittleEndian.PutUint32(b[84:88], gptEntrySize)
+	binary.LittleEndian.PutUint32(b[88:92], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(b[16:20], crc32.ChecksumIEEE(b[:92]))
+	return b
+}
+
+// gptTable returns the sectors of the protective MBR, the primary
+// and the backup GPT
+func gptTable(config *Disk, extents []*extent, rand io.Reader) ([]*tableSectors, error) {
+	total := diskSectors(config)
+
+	pmbr := bootSector()
+	size := total - 1
+	if size > 0xffffffff {
+		size = 0xffffffff
+	}
+	mbrEntry(pmbr[entryOffset(0):], false, mbrTypeProtective, 1, size)
+
+	disk, err := randomGUID(rand)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]byte, gptEntries*gptEntrySize)
+	for _, e := range extents {
+		b := entries[(e.number-1)*gptEntrySize:]
+		partType, err := parseGUID(typeGUID(e.part))
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %v", e.number, err)
+		}
+		unique, err := randomGUID(rand)
+		if err != nil {
+			return nil, err
+		}
+		partType.encode(b[0:16])
+		unique.encode(b[16:32])
+		binary.LittleEndian.PutUint64(b[32:40], e.start)
+		binary.LittleEndian.PutUint64(b[40:48], e.start+e.size-1)
+		if config.Bootable && config.ActivePartition == e.number && !isEfiBootLoader(config.BootLoader) {
+			binary.LittleEndian.PutUint64(b[48:56], gptAttrLegacyBoot)
+		}
+		if err := putGptName(b, e.part.Name); err != nil {
+			return nil, fmt.Errorf("partition %d: %v", e.number, err)
+		}
+	}
+
+	backupEntries := total - gptEntrySectors - 1
+	return []*tableSectors{
+		{0, pmbr},
+		{1, gptHeader(1, total-1, 2, total, disk, entries)},
+		{2, entries},
+		{backupEntries, entries},
+		{total - 1, gptHeader(total-1, 1, backupEntries, total, disk, entries)},
+	}, nil
+}
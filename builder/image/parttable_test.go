@@ -0,0 +1,168 @@
+package image
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// counter is a deterministic source of GUIDs and disk signatures
+type counter byte
+
+func (c *counter) Read(p []byte) (int, error) {
+	for i := range p {
+		*c++
+		p[i] = byte(*c)
+	}
+	return len(p), nil
+}
+
+// dump returns hexdump of the table sectors.
+// Repeated lines are replaced by '*' the way hexdump does
+func dump(sectors []*tableSectors) string {
+	buf := new(bytes.Buffer)
+	for _, s := range sectors {
+		fmt.Fprintf(buf, "LBA %d\n", s.lba)
+		var prev []byte
+		skipped := false
+		for off := 0; off < len(s.data); off += 16 {
+			line := s.data[off : off+16]
+			if prev != nil && bytes.Equal(line, prev) && off+16 < len(s.data) {
+				if !skipped {
+					fmt.Fprintf(buf, "*\n")
+					skipped = true
+				}
+				continue
+			}
+			fmt.Fprintf(buf, "%08x  % x\n", off, line)
+			prev, skipped = line, false
+		}
+	}
+	return buf.String()
+}
+
+func testDisk(table PartTableType) *Disk {
+	return &Disk{
+		SizeMb:          1024,
+		PartTable:       table,
+		Bootable:        true,
+		ActivePartition: 1,
+		Partitions: []*Partition{
+			{Type: 83, SizeMb: 800, Name: "root"},
+			{Type: 82, SizeMb: -1, SizePercents: -2, Name: "swap"},
+		},
+	}
+}
+
+func TestPartTableGolden(t *testing.T) {
+	logical := testDisk(PartTableMBR)
+	logical.SizeMb = 2048
+	logical.Partitions = nil
+	for _, size := range []int{100, 200, 300, 400, 500} {
+		logical.Partitions = append(logical.Partitions, &Partition{Type: 83, SizeMb: size})
+	}
+	logical.Partitions = append(logical.Partitions, &Partition{Type: 82, SizeMb: -1, SizePercents: -2})
+
+	esp := testDisk(PartTableGPT)
+	esp.BootLoader = BootLoaderGrubEfi
+	esp.Partitions = append([]*Partition{{TypeGUID: GUIDEfiSystem, SizeMb: 100, Name: "EFI System"}}, esp.Partitions[0])
+	esp.Partitions[1].SizeMb = -1
+	esp.Partitions[1].SizePercents = -2
+
+	tests := []struct {
+		golden string
+		config *Disk
+	}{
+		{"mbr", testDisk(PartTableMBR)},
+		{"mbr_logical", logical},
+		{"gpt", testDisk(PartTableGPT)},
+		{"gpt_esp", esp},
+	}
+	for _, test := range tests {
+		sectors, err := partTable(test.config, new(counter))
+		if err != nil {
+			t.Fatalf("%s: %v", test.golden, err)
+		}
+		got := dump(sectors)
+		path := filepath.Join("testdata", test.golden+".golden")
+		if *update {
+			if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(expected) {
+			t.Errorf("%s: partition table differs from %s:\n%s", test.golden, path, got)
+		}
+	}
+}
+
+func TestWritePartTable(t *testing.T) {
+	f, err := ioutil.TempFile("", "deployer_parttable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	config := testDisk(PartTableGPT)
+	if err := WritePartTable(f, config, new(counter)); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(config.SizeMb)*1024*1024 {
+		t.Fatalf("unexpected image size %d", fi.Size())
+	}
+	header := make([]byte, 8)
+	if _, err := f.ReadAt(header, int64(diskSectors(config)-1)*sectorSize); err != nil {
+		t.Fatal(err)
+	}
+	if string(header) != "EFI PART" {
+		t.Fatalf("backup GPT header not found: %q", header)
+	}
+}
+
+func TestPartLayoutErrors(t *testing.T) {
+	tests := map[string]func(d *Disk){
+		"exceeds":       func(d *Disk) { d.Partitions[0].SizeMb = 2048 },
+		"allocate rest": func(d *Disk) { d.Partitions[0], d.Partitions[1] = d.Partitions[1], d.Partitions[0] },
+		"invalid size":  func(d *Disk) { d.Partitions[0].SizeMb = 0 },
+		"invalid type":  func(d *Disk) { d.Partitions[0].Type = 8 * 100 },
+		"active":        func(d *Disk) { d.ActivePartition = 3 },
+		"GUID":          func(d *Disk) { d.PartTable = PartTableGPT; d.Partitions[0].TypeGUID = "0FC63DAF" },
+		"name":          func(d *Disk) { d.PartTable = PartTableGPT; d.Partitions[0].Name = string(make([]byte, 37)) },
+	}
+	for name, modify := range tests {
+		config := testDisk(PartTableMBR)
+		modify(config)
+		if _, err := partTable(config, new(counter)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestPartNumbers(t *testing.T) {
+	config := testDisk(PartTableMBR)
+	for i := 0; i < 4; i++ {
+		config.Partitions = append(config.Partitions[:1], append([]*Partition{{Type: 83, SizeMb: 10}}, config.Partitions[1:]...)...)
+	}
+	if numbers := fmt.Sprint(partNumbers(config)); numbers != "[1 2 3 5 6 7]" {
+		t.Fatalf("unexpected partition numbers %s", numbers)
+	}
+	config.FdiskCmd = `n\np\n1\n\n\nw\n`
+	if numbers := fmt.Sprint(partNumbers(config)); numbers != "[1 2 3 4 5 6]" {
+		t.Fatalf("unexpected partition numbers %s", numbers)
+	}
+}
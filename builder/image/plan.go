@@ -0,0 +1,354 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// planLoopDevice stands for the loop device allocated during the image processing
+const planLoopDevice = "/dev/loopN"
+
+// Plan writes the disk layout and the commands the image processing would run
+// for the given disk configuration. Nothing is created or executed.
+// Returns path to the image that would be created.
+func Plan(w io.Writer, config *Disk, rootfsMp string, bins *Utils) (string, error) {
+	if err := validateVolumes(config); err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	path := rawPath(config)
+
+	fmt.Fprintf(buf, "disk: %s\n", config.Description)
+	fmt.Fprintf(buf, "  type: %s\n", config.Type)
+	fmt.Fprintf(buf, "  size: %d MB\n", config.SizeMb)
+	if config.PartTable != "" {
+		fmt.Fprintf(buf, "  partition table: %s\n", config.PartTable)
+	}
+	if config.Bootable {
+		if isEfiBootLoader(config.BootLoader) {
+			fmt.Fprintf(buf, "  bootloader: %s (UEFI)\n", config.BootLoader)
+		} else {
+			fmt.Fprintf(buf, "  bootloader: %s (active partition %d)\n", config.BootLoader, config.ActivePartition)
+		}
+	}
+	if len(config.Partitions) > 0 {
+		fmt.Fprintf(buf, "  partitions:\n")
+		for _, part := range config.Partitions {
+			size := strconv.Itoa(partSizeMb(config, part)) + " MB"
+			if partSizeMb(config, part) == allocateAll {
+				size = "rest of the disk"
+			}
+			partType := strconv.Itoa(part.Type)
+			if config.PartTable == PartTableGPT {
+				partType = typeGUID(part)
+			}
+			fmt.Fprintf(buf, "    %d: type %s, %s, %s, label %s, mount point %s\n", part.Sequence,
+				partType, size, part.FileSystem, part.Label, part.MountPoint)
+			if part.LUKS != nil {
+				fmt.Fprintf(buf, "       LUKS %s\n", part.LUKS.Name)
+			}
+			if part.LVM != nil {
+				for _, lv := range part.LVM.LogicalVolumes {
+					fmt.Fprintf(buf, "       LVM %s/%s: %s, %s, label %s, mount point %s\n", part.LVM.VolumeGroup,
+						lv.Name, lvSizeArg(lv), lv.FileSystem, lv.Label, lv.MountPoint)
+				}
+			}
+		}
+	}
+
+	fmt.Fprintf(buf, "  commands:\n")
+	fmt.Fprintf(buf, "    %s\n", createCmd(path, config.SizeMb))
+	if len(config.Partitions) > 0 && config.FdiskCmd == "" {
+		if err := planPartTable(buf, config, path); err != nil {
+			return "", err
+		}
+	}
+	fmt.Fprintf(buf, "    losetup %s %s\n", planLoopDevice, path)
+	if len(config.Partitions) > 0 {
+		if config.FdiskCmd != "" {
+			fmt.Fprintf(buf, "    %s\n", partitionCmd(config.FdiskCmd, planLoopDevice))
+		}
+		fmt.Fprintf(buf, "    %s -a %s\n", bins.Kpartx, planLoopDevice)
+		var volumes []*volume
+		for index, part := range config.Partitions {
+			keyfile := ""
+			if part.LUKS != nil {
+				if keyfile = part.LUKS.HostKeyFile; keyfile == "" {
+					keyfile = planKeyfile
+				}
+				fmt.Fprintf(buf, "    %s\n", keyfileCmd(keyfile))
+			}
+			cmds, vols := formatCmds(part, planMapper(config, index), keyfile, rootfsMp)
+			for _, cmd := range cmds {
+				fmt.Fprintf(buf, "    %s\n", cmd)
+			}
+			volumes = append(volumes, vols...)
+		}
+		planMounts(buf, volumes, rootfsMp)
+		planSystemFiles(buf, config, planMapper)
+	}
+	if config.Bootable {
+		if isEfiBootLoader(config.BootLoader) {
+			cmd, err := efiBootLoaderCmd(config, rootfsMp)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(buf, "    %s\n", cmd)
+		} else {
+			fmt.Fprintf(buf, "    # install %s to %s\n", config.BootLoader, planLoopDevice)
+		}
+	}
+	if config.Type != StorageTypeRAW {
+		newPath := convertedPath(path, config.Type)
+		fmt.Fprintf(buf, "    %s\n", convertCmd(config, path, newPath))
+		fmt.Fprintf(buf, "    rm -rf %s\n", path)
+		path = newPath
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// PlanOpen writes the commands the processing of the existing image
+// described by the disk configuration would run (see Open).
+// Returns path to the image.
+func PlanOpen(w io.Writer, config *Disk, rootfsMp string, bins *Utils) (string, error) {
+	return planOpen(w, config, rootfsMp, bins, false)
+}
+
+// planOpen writes the commands the processing of the existing image
+// would run, the image is grown if grow is set
+func planOpen(w io.Writer, config *Disk, rootfsMp string, bins *Utils, grow bool) (string, error) {
+	if err := validateVolumes(config); err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	path := rawPath(config)
+
+	fmt.Fprintf(buf, "disk: %s (existing)\n", config.Description)
+	if grow {
+		fmt.Fprintf(buf, "  size: %d MB (grown)\n", config.SizeMb)
+	}
+	fmt.Fprintf(buf, "  commands:\n")
+	if path != config.Path {
+		fmt.Fprintf(buf, "    qemu-img convert -f %s -O raw %s %s\n", config.Type.Format(), config.Path, path)
+	}
+	if grow {
+		fmt.Fprintf(buf, "    # unless the image is %d MB already\n", config.SizeMb)
+		fmt.Fprintf(buf, "    %s\n", growCmd(path, config.SizeMb))
+		if config.GrowPartition == nil {
+			fmt.Fprintf(buf, "    # resize the last partition of %s to the end of the disk\n", path)
+		} else {
+			fmt.Fprintf(buf, "    # add partition %d to %s at the end of the disk\n", planGrowNumber(config), path)
+		}
+	}
+	fmt.Fprintf(buf, "    losetup %s %s\n", planLoopDevice, path)
+	if len(config.Partitions) > 0 {
+		fmt.Fprintf(buf, "    %s -a %s\n", bins.Kpartx, planLoopDevice)
+		volumes, err := planOpenCmds(buf, config, planMapper)
+		if err != nil {
+			return "", err
+		}
+		planMounts(buf, volumes, rootfsMp)
+		if grow {
+			if err := planGrowVolumes(buf, config, rootfsMp); err != nil {
+				return "", err
+			}
+		}
+	}
+	if path != config.Path {
+		fmt.Fprintf(buf, "    %s\n", convertCmd(config, path, partialPath(config.Path)))
+		fmt.Fprintf(buf, "    %s\n", replaceCmd(partialPath(config.Path), config.Path))
+		fmt.Fprintf(buf, "    rm -rf %s\n", path)
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return "", err
+	}
+	return config.Path, nil
+}
+
+// PlanRootless writes the commands the rootless processing (see NewRootless)
+// of the disk configuration would run. Returns path to the image
+// that would be created.
+func PlanRootless(w io.Writer, config *Disk, stagingDir string) (string, error) {
+	buf := new(bytes.Buffer)
+	path := rawPath(config)
+
+	fmt.Fprintf(buf, "disk: %s (rootless)\n", config.Description)
+	fmt.Fprintf(buf, "  staging directory: %s\n", stagingDir)
+	fmt.Fprintf(buf, "  commands:\n")
+	fmt.Fprintf(buf, "    %s\n", createCmd(path, config.SizeMb))
+	if len(config.Partitions) > 0 {
+		if err := planPartTable(buf, config, path); err != nil {
+			return "", err
+		}
+		// the file systems are written to the image processed
+		// under the temporary name
+		c := *config
+		c.Path = path
+		cmds, err := stagedFsCmds(&c, stagingDir)
+		if err != nil {
+			return "", err
+		}
+		for _, line := range planFstabLines(config, planMapper) {
+			fmt.Fprintf(buf, "    # add to %s/etc/fstab: %s\n", stagingDir, line)
+		}
+		for _, cmd := range cmds {
+			fmt.Fprintf(buf, "    %s\n", cmd)
+		}
+	}
+	if config.Type != StorageTypeRAW {
+		newPath := convertedPath(path, config.Type)
+		fmt.Fprintf(buf, "    %s\n", convertCmd(config, path, newPath))
+		fmt.Fprintf(buf, "    rm -f %s\n", path)
+		path = newPath
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// planKeyfile stands for the temporary LUKS key
+const planKeyfile = "/tmp/tmp.XXXXXXXXXX"
+
+// planOpenCmds writes the commands opening LUKS and activating LVM
+// of the existing partitions. Returns the volumes to be mounted
+func planOpenCmds(w io.Writer, config *Disk, device func(*Disk, int) string) ([]*volume, error) {
+	var volumes []*volume
+	for index, part := range config.Partitions {
+		if part.LUKS != nil && part.LUKS.HostKeyFile == "" {
+			return nil, fmt.Errorf("partition %d: host keyfile is required to open LUKS", part.Sequence)
+		}
+		keyfile := ""
+		if part.LUKS != nil {
+			keyfile = part.LUKS.HostKeyFile
+		}
+		cmds, vols := openCmds(part, device(config, index), keyfile)
+		for _, cmd := range cmds {
+			fmt.Fprintf(w, "    %s\n", cmd)
+		}
+		volumes = append(volumes, vols...)
+	}
+	return volumes, nil
+}
+
+// planGrowVolumes writes the commands growing the volumes of the last partition
+// or formatting the grow partition (see growVolumes)
+func planGrowVolumes(w io.Writer, config *Disk, rootfsMp string) error {
+	if config.GrowPartition == nil {
+		index := len(config.Partitions) - 1
+		part := config.Partitions[index]
+		keyfile := ""
+		if part.LUKS != nil {
+			keyfile = part.LUKS.HostKeyFile
+		}
+		cmds, err := growCmds(part, planMapper(config, index), keyfile, rootfsMp)
+		if err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			fmt.Fprintf(w, "    %s\n", cmd)
+		}
+		return nil
+	}
+
+	part := config.GrowPartition
+	device := func(*Disk, int) string {
+		return fmt.Sprintf("%sp%d", planLoopDevice, planGrowNumber(config))
+	}
+	keyfile := ""
+	if part.LUKS != nil {
+		if keyfile = part.LUKS.HostKeyFile; keyfile == "" {
+			keyfile = planKeyfile
+		}
+		fmt.Fprintf(w, "    %s\n", keyfileCmd(keyfile))
+	}
+	cmds, vols := formatCmds(part, device(config, 0), keyfile, rootfsMp)
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, "    %s\n", cmd)
+	}
+	planMounts(w, vols, rootfsMp)
+	planSystemFiles(w, growDisk(config), device)
+	return nil
+}
+
+// planGrowNumber returns the number the grow partition would get
+// provided the partitions are numbered sequentially
+func planGrowNumber(config *Disk) int {
+	numbers := partNumbers(config)
+	return numbers[len(numbers)-1] + 1
+}
+
+// planMounts writes the commands mounting the volumes
+func planMounts(w io.Writer, volumes []*volume, rootfsMp string) {
+	sorted := make([]*volume, len(volumes))
+	copy(sorted, volumes)
+	sort.Stable(byVolumeDepth(sorted))
+	for _, v := range sorted {
+		mountPoint := filepath.Join(rootfsMp, v.mountPoint)
+		if v.mountPoint != "/" {
+			fmt.Fprintf(w, "    mkdir -p %s\n", mountPoint)
+		}
+		fmt.Fprintf(w, "    %s\n", v.mountCmd(mountPoint))
+	}
+}
+
+// planSystemFiles writes the system files WriteSystemFiles would write
+// given the devices of the partitions
+func planSystemFiles(w io.Writer, config *Disk, device func(*Disk, int) string) {
+	for _, line := range planFstabLines(config, device) {
+		fmt.Fprintf(w, "    # add to /etc/fstab: %s\n", line)
+	}
+	for _, part := range config.Partitions {
+		if part.LUKS == nil {
+			continue
+		}
+		if part.LUKS.KeyFile != "" {
+			fmt.Fprintf(w, "    # install LUKS key to %s\n", part.LUKS.KeyFile)
+		}
+		fmt.Fprintf(w, "    # add to /etc/crypttab: %s\n", crypttabEntry(part.LUKS, "<uuid>"))
+	}
+}
+
+// planPartTable writes the partition table layout WritePartTable would write
+func planPartTable(w io.Writer, config *Disk, path string) error {
+	extents, err := partLayout(config)
+	if err != nil {
+		return err
+	}
+	table := PartTableMBR
+	if config.PartTable == PartTableGPT {
+		table = PartTableGPT
+	}
+	fmt.Fprintf(w, "    # write %s partition table to %s\n", table, path)
+	for _, e := range extents {
+		partType := typeGUID(e.part)
+		if table == PartTableMBR {
+			t, err := mbrType(e.part)
+			if err != nil {
+				return fmt.Errorf("partition %d: %v", e.number, err)
+			}
+			partType = fmt.Sprintf("0x%02x", t)
+		}
+		fmt.Fprintf(w, "    #   partition %d: sectors %d-%d, type %s", e.number, e.start, e.start+e.size-1, partType)
+		if config.Bootable && config.ActivePartition == e.number && !isEfiBootLoader(config.BootLoader) {
+			fmt.Fprintf(w, ", active")
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return nil
+}
+
+// planMapper returns name of the mapper created for the partition
+func planMapper(config *Disk, index int) string {
+	return fmt.Sprintf("%sp%d", planLoopDevice, partNumbers(config)[index])
+}
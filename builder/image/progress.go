@@ -0,0 +1,61 @@
+// Responsible for reporting the progress of the image conversion
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dorzheh/deployer/utils/progress"
+)
+
+const (
+	// the conversion is reported between the percentages
+	convertFrom = 90
+	convertTo   = 99
+)
+
+// the progress printed by qemu-img convert -p, e.g. "    (42.17/100%)"
+var convertProgressRe = regexp.MustCompile(`\((\d+)(\.\d+)?/100%\)`)
+
+// convertProgress parses the output of qemu-img convert -p
+// and reports the progress of StageConvert
+type convertProgress struct {
+	ctx context.Context
+
+	// the incomplete line
+	buf []byte
+
+	// the last reported part of the conversion
+	part int
+}
+
+func (p *convertProgress) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	if m := convertProgressRe.FindAllSubmatch(p.buf, -1); m != nil {
+		if part, err := strconv.Atoi(string(m[len(m)-1][1])); err == nil && part > p.part {
+			p.part = part
+			progress.Report(p.ctx, progress.StageConvert, progress.Scale(convertFrom, convertTo, part))
+		}
+	}
+	// qemu-img rewrites the line by carriage return
+	if i := bytes.LastIndexAny(p.buf, "\r\n"); i >= 0 {
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// runConvert runs the conversion command reporting its progress.
+// The command is run by run in case its output can't be streamed
+func runConvert(ctx context.Context, run func(string) (string, error),
+	stream func(string, io.Reader, io.Writer) (string, error), cmd string) (string, error) {
+	if stream == nil {
+		return run(cmd)
+	}
+	cmd = strings.Replace(cmd, "qemu-img convert ", "qemu-img convert -p ", 1)
+	return stream(cmd, nil, &convertProgress{ctx: ctx})
+}
@@ -0,0 +1,30 @@
+package image
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dorzheh/deployer/utils/progress"
+)
+
+func TestConvertProgress(t *testing.T) {
+	events := make(chan *progress.Event, 10)
+	p := &convertProgress{ctx: progress.WithEvents(context.Background(), events)}
+	// the line is split between the writes
+	for _, out := range []string{"    (0.00/100%)\r    (42.17/1", "00%)\r    (42.50/100%)\r", "    (100.00/100%)\r\n"} {
+		if n, err := p.Write([]byte(out)); err != nil || n != len(out) {
+			t.Fatalf("unexpected write %d [%v]", n, err)
+		}
+	}
+	close(events)
+	var percents []int
+	for e := range events {
+		if e.Stage != progress.StageConvert {
+			t.Fatalf("unexpected stage %s", e.Stage)
+		}
+		percents = append(percents, e.Percent)
+	}
+	if len(percents) != 2 || percents[0] != 93 || percents[1] != convertTo {
+		t.Fatalf("unexpected progress %v", percents)
+	}
+}
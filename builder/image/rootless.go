@@ -0,0 +1,301 @@
+// Builds RAW image without loop devices, kpartx and mounts.
+// The file systems are created from a staging directory
+// and written directly to the partition offsets of the image
+
+package image
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/progress"
+)
+
+// the structure represents an image built from a staging directory
+type stagedImage struct {
+	// storage configuration file
+	config *Disk
+
+	// path to the staging directory representing the root file system
+	staging string
+
+	// the image processing context
+	ctx context.Context
+
+	// executes commands
+	run func(string) (string, error)
+
+	// executes commands releasing the image.
+	// Unlike run it is not bound to the context
+	release func(string) (string, error)
+
+	// executes commands streaming their output (the image conversion)
+	stream func(string, io.Reader, io.Writer) (string, error)
+
+	// indicates whether the file systems have been written to the image
+	built bool
+}
+
+// NewRootless gets the disk configuration and path to the staging directory
+// populated instead of the mounted image.
+// Neither root privileges nor loop devices are needed: the file systems
+// are created from the staging directory by Convert (mke2fs -d for ext2/3/4,
+// mkfs.vfat and mtools for vfat) and written to the partition offsets.
+// Note that the files are owned by the user populating the staging directory.
+// Returns a pointer to the structure and error/nil
+func NewRootless(ctx context.Context, config *Disk, stagingDir string) (*stagedImage, error) {
+	i := &stagedImage{
+		config:  config,
+		staging: stagingDir,
+		ctx:     ctx,
+		run:     utils.RunFuncWithContext(ctx, nil),
+		release: utils.RunFunc(nil),
+		stream:  utils.RunStreamFuncWithContext(ctx, nil),
+	}
+
+	if config.Fstab == FstabUUID {
+		return nil, utils.FormatError(errors.New("fstab by UUID is not supported by the rootless backend"))
+	}
+	var tools []string
+	if config.Type != StorageTypeRAW {
+		tools = append(tools, "qemu-img")
+	}
+	for _, part := range config.Partitions {
+		t, err := stagedFsTools(part)
+		if err != nil {
+			return nil, utils.FormatError(err)
+		}
+		tools = append(tools, t...)
+	}
+	for _, tool := range tools {
+		if _, err := i.run("which " + tool); err != nil {
+			return nil, utils.FormatError(fmt.Errorf("please install %s", tool))
+		}
+	}
+
+	progress.Report(ctx, progress.StageCreate, 0)
+	i.config.Path = rawPath(config)
+	if out, err := i.run(createCmd(i.config.Path, i.config.SizeMb)); err != nil {
+		return nil, utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	}
+	return i, nil
+}
+
+// Parse writes the partition table and creates the mount points
+// of the partitions in the staging directory
+func (i *stagedImage) Parse() error {
+	if len(i.config.Partitions) == 0 {
+		return nil
+	}
+	progress.Report(i.ctx, progress.StagePartition, 5)
+	f, err := os.OpenFile(i.config.Path, os.O_WRONLY, 0)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	defer f.Close()
+	if err := WritePartTable(f, i.config, rand.Reader); err != nil {
+		return utils.FormatError(err)
+	}
+	for _, part := range i.config.Partitions {
+		if !isSwap(part) {
+			if err := os.MkdirAll(filepath.Join(i.staging, part.MountPoint), 0755); err != nil {
+				return utils.FormatError(err)
+			}
+		}
+	}
+	return nil
+}
+
+// MakeBootable verifies the image is bootable.
+// Boot loaders cannot be installed without root privileges therefore
+// only UEFI boot from the removable media path (\EFI\BOOT\BOOTX64.EFI)
+// populated in the staging directory is supported
+func (i *stagedImage) MakeBootable() error {
+	if !isEfiBootLoader(i.config.BootLoader) {
+		return utils.FormatError(fmt.Errorf("%s is not supported by the rootless backend", i.config.BootLoader))
+	}
+	esp := espPartition(i.config)
+	if esp == nil {
+		return utils.FormatError(errors.New("EFI system partition not found"))
+	}
+	loader := filepath.Join(i.staging, esp.MountPoint, "EFI", "BOOT", "BOOTX64.EFI")
+	if _, err := os.Stat(loader); err != nil {
+		return utils.FormatError(err)
+	}
+	return nil
+}
+
+// WriteSystemFiles adds the file systems to /etc/fstab of the staging directory.
+// The file systems are identified by label since UUIDs are unknown
+// until the file systems are created
+func (i *stagedImage) WriteSystemFiles() error {
+	if i.config.Fstab == FstabNone {
+		return nil
+	}
+	var lines []string
+	for _, e := range fstabEntries(i.config, func(int) string { return "" }) {
+		spec, ok := fsSpec(i.config, e)
+		if !ok {
+			return utils.FormatError(fmt.Errorf("%s: the rootless backend identifies file systems by label", e.mountPoint))
+		}
+		lines = append(lines, e.line(spec))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	path := filepath.Join(i.staging, "etc", "fstab")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return utils.FormatError(err)
+	}
+	table, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return utils.FormatError(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(mergeTable(string(table), lines, 1)), 0644); err != nil {
+		return utils.FormatError(err)
+	}
+	return nil
+}
+
+// Cleanup has nothing to release since nothing is mounted.
+// The staging directory is removed by the caller
+func (i *stagedImage) Cleanup() error {
+	return nil
+}
+
+// Convert writes the file systems created from the staging directory
+// to the partitions and converts the image to the configured format
+func (i *stagedImage) Convert() error {
+	if !i.built {
+		progress.Report(i.ctx, progress.StageMkfs, 85)
+		cmds, err := stagedFsCmds(i.config, i.staging)
+		if err != nil {
+			return utils.FormatError(err)
+		}
+		for _, cmd := range cmds {
+			if out, err := i.run(cmd); err != nil {
+				return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+			}
+		}
+		i.built = true
+	}
+	if i.config.Type == StorageTypeRAW {
+		return nil
+	}
+
+	progress.Report(i.ctx, progress.StageConvert, convertFrom)
+	newPath := convertedPath(i.config.Path, i.config.Type)
+	if out, err := runConvert(i.ctx, i.run, i.stream, convertCmd(i.config, i.config.Path, newPath)); err != nil {
+		i.release("rm -f " + newPath)
+		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	}
+	if out, err := i.run("rm -f " + i.config.Path); err != nil {
+		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	}
+	i.config.Path = newPath
+	return nil
+}
+
+// Discard removes the half-created image
+func (i *stagedImage) Discard() error {
+	if out, err := i.release(fmt.Sprintf("rm -f %s %s.p*", i.config.Path, i.config.Path)); err != nil {
+		return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+	}
+	return nil
+}
+
+// stagedFsTools returns the utilities needed for creating file system
+// of the partition from a directory
+func stagedFsTools(part *Partition) ([]string, error) {
+	if hasVolumes(part) {
+		return nil, errors.New("LUKS, LVM and btrfs subvolumes are not supported by the rootless backend")
+	}
+	switch {
+	case isSwap(part):
+		return []string{"mkswap"}, nil
+	case part.FileSystem == "ext2" || part.FileSystem == "ext3" || part.FileSystem == "ext4":
+		return []string{"mke2fs"}, nil
+	case part.FileSystem == "vfat":
+		return []string{"mkfs.vfat", "mcopy"}, nil
+	}
+	return nil, fmt.Errorf("file system %s is not supported by the rootless backend", part.FileSystem)
+}
+
+// byDepth sorts the partitions so that nested mount points come first
+type byDepth []*extent
+
+func (e byDepth) Len() int      { return len(e) }
+func (e byDepth) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e byDepth) Less(i, j int) bool {
+	return mountDepth(e[i].part) > mountDepth(e[j].part)
+}
+
+// mountDepth returns the amount of path elements of the mount point
+func mountDepth(part *Partition) int {
+	if isSwap(part) || part.MountPoint == "/" {
+		return 0
+	}
+	return strings.Count(filepath.Clean(part.MountPoint), "/")
+}
+
+// stagedFsCmds returns the commands creating the file systems
+// from the staging directory and writing them to the partitions.
+// Nested mount points are processed first and emptied afterwards
+// so that their content doesn't get to the parent file system
+func stagedFsCmds(config *Disk, staging string) ([]string, error) {
+	extents, err := partLayout(config)
+	if err != nil {
+		return nil, err
+	}
+	sorted := make([]*extent, len(extents))
+	copy(sorted, extents)
+	sort.Stable(byDepth(sorted))
+
+	var cmds []string
+	for _, e := range sorted {
+		part := e.part
+		file := fmt.Sprintf("%s.p%d", config.Path, e.number)
+		dir := filepath.Join(staging, part.MountPoint)
+
+		cmd := fmt.Sprintf("truncate -s %d %s && ", e.size*sectorSize, file)
+		switch {
+		case isSwap(part):
+			cmd += fmt.Sprintf("mkswap %s%s", labelOpt("-L", part.Label), file)
+		case part.FileSystem == "vfat":
+			cmd += fmt.Sprintf("mkfs.vfat %s%s %s", labelOpt("-n", part.Label), part.FileSystemArgs, file)
+			cmd += fmt.Sprintf(" && find %s -mindepth 1 -maxdepth 1 -exec mcopy -s -i %s {} ::/ \\;", dir, file)
+		default:
+			if _, err := stagedFsTools(part); err != nil {
+				return nil, err
+			}
+			cmd += fmt.Sprintf("mke2fs -q -F -t %s %s-d %s %s %s", part.FileSystem, labelOpt("-L", part.Label),
+				dir, part.FileSystemArgs, file)
+		}
+		// partitions are aligned to 1MB
+		cmd += fmt.Sprintf(" && dd if=%s of=%s bs=1M seek=%d conv=notrunc,sparse && rm -f %s",
+			file, config.Path, e.start/alignSectors, file)
+		if mountDepth(part) > 0 {
+			cmd += fmt.Sprintf(" && find %s -mindepth 1 -delete", dir)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+// labelOpt returns the option setting the file system label
+// or an empty string for an unlabeled partition
+func labelOpt(opt, label string) string {
+	if label == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s %s ", opt, label)
+}
@@ -0,0 +1,129 @@
+package image
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// extractPartition copies the partition of the image to a separate file
+func extractPartition(t *testing.T, path string, e *extent) string {
+	src, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile("", "deployer_partition")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	r := io.NewSectionReader(src, int64(e.start)*sectorSize, int64(e.size)*sectorSize)
+	if _, err := io.Copy(dst, r); err != nil {
+		t.Fatal(err)
+	}
+	return dst.Name()
+}
+
+func TestRootlessImage(t *testing.T) {
+	for _, tool := range []string{"mke2fs", "mkswap", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+	dir, err := ioutil.TempDir("", "deployer_rootless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	staging := filepath.Join(dir, "rootfs")
+
+	config := &Disk{
+		Path:   filepath.Join(dir, "test.raw"),
+		Type:   StorageTypeRAW,
+		SizeMb: 64,
+		Partitions: []*Partition{
+			{Type: 83, SizeMb: 32, Label: "SLASH", MountPoint: "/", FileSystem: "ext4"},
+			{Type: 83, SizeMb: 16, Label: "VAR", MountPoint: "/var", FileSystem: "ext2"},
+			{Type: 82, SizeMb: -1, SizePercents: -2, Label: "SWAP", MountPoint: "SWAP"},
+		},
+	}
+	img, err := NewRootless(context.Background(), config, staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(staging, "hostname"), []byte("rootless\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(staging, "var", "log"), []byte("var\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Convert(); err != nil {
+		t.Fatal(err)
+	}
+
+	extents, err := partLayout(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slash := extractPartition(t, config.Path, extents[0])
+	defer os.Remove(slash)
+	out, err := exec.Command("debugfs", "-R", "cat /hostname", slash).Output()
+	if err != nil || string(out) != "rootless\n" {
+		t.Fatalf("unexpected /hostname %q [%v]", out, err)
+	}
+	// the content of the nested mount point belongs to its own partition
+	out, err = exec.Command("debugfs", "-R", "ls /var", slash).Output()
+	if err != nil || strings.Contains(string(out), "log") {
+		t.Fatalf("unexpected /var content %q [%v]", out, err)
+	}
+	varfs := extractPartition(t, config.Path, extents[1])
+	defer os.Remove(varfs)
+	out, err = exec.Command("debugfs", "-R", "cat /log", varfs).Output()
+	if err != nil || string(out) != "var\n" {
+		t.Fatalf("unexpected /var/log %q [%v]", out, err)
+	}
+}
+
+func TestRootlessUnsupported(t *testing.T) {
+	config := testDisk(PartTableMBR)
+	config.Partitions[0].FileSystem = "xfs"
+	if _, err := NewRootless(context.Background(), config, "/tmp/rootfs"); err == nil {
+		t.Fatal("expected error for unsupported file system")
+	}
+}
+
+func TestStagedFsCmdsUnlabeled(t *testing.T) {
+	config := &Disk{
+		Path:   "/images/test.raw",
+		SizeMb: 64,
+		Fstab:  FstabNone,
+		Partitions: []*Partition{
+			{Type: 83, SizeMb: 32, MountPoint: "/", FileSystem: "ext4"},
+			{Type: 83, SizeMb: 16, MountPoint: "/boot", FileSystem: "vfat"},
+			{Type: 82, SizeMb: -1, SizePercents: -2, MountPoint: "SWAP"},
+		},
+	}
+	cmds, err := stagedFsCmds(config, "/tmp/rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := strings.Join(cmds, "\n")
+	for _, cmd := range []string{
+		"mke2fs -q -F -t ext4 -d /tmp/rootfs  /images/test.raw.p1",
+		"mkfs.vfat  /images/test.raw.p2",
+		"mkswap /images/test.raw.p3",
+	} {
+		if !strings.Contains(plan, cmd) {
+			t.Fatalf("command %q not found:\n%s", cmd, plan)
+		}
+	}
+}
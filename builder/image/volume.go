@@ -0,0 +1,294 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// volume represents a file system mounted to the rootfs:
+// a partition, a logical volume or a btrfs subvolume
+type volume struct {
+	// device the file system is created on
+	device string
+
+	// mount point relative to the rootfs
+	mountPoint string
+
+	// mount options
+	options string
+}
+
+// mountCmd returns the command mounting the volume
+func (v *volume) mountCmd(mountPoint string) string {
+	if v.options == "" {
+		return mountCmd(v.device, mountPoint)
+	}
+	return fmt.Sprintf("mount -o %s %s %s", v.options, v.device, mountPoint)
+}
+
+// byVolumeDepth sorts the volumes so that a parent mount point
+// is mounted before the nested ones
+type byVolumeDepth []*volume
+
+func (v byVolumeDepth) Len() int      { return len(v) }
+func (v byVolumeDepth) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v byVolumeDepth) Less(i, j int) bool {
+	return volumeDepth(v[i]) < volumeDepth(v[j])
+}
+
+func volumeDepth(v *volume) int {
+	if v.mountPoint == "/" {
+		return 0
+	}
+	return strings.Count(filepath.Clean(v.mountPoint), "/")
+}
+
+// partition returns the partition the file system of the logical volume
+// is described by (see mkfsCmd)
+func (lv *LogicalVolume) partition() *Partition {
+	part := &Partition{
+		Label:          lv.Label,
+		MountPoint:     lv.MountPoint,
+		FileSystem:     lv.FileSystem,
+		FileSystemArgs: lv.FileSystemArgs,
+		MountOptions:   lv.MountOptions,
+	}
+	if lv.FileSystem == "swap" {
+		part.Type = partTypeSwap
+	}
+	return part
+}
+
+// hasVolumes reports whether the partition is encrypted,
+// holds LVM or btrfs subvolumes
+func hasVolumes(part *Partition) bool {
+	return part.LUKS != nil || part.LVM != nil || len(part.Subvolumes) > 0
+}
+
+// validateVolumes verifies LUKS, LVM and btrfs subvolumes of the disk configuration
+func validateVolumes(config *Disk) error {
+	for _, part := range diskPartitions(config) {
+		if part.LUKS != nil && part.LUKS.Name == "" {
+			return fmt.Errorf("partition %d: LUKS name is empty", part.Sequence)
+		}
+		if err := validateSubvolumes(part.FileSystem, part.Subvolumes); err != nil {
+			return fmt.Errorf("partition %d: %v", part.Sequence, err)
+		}
+		if part.LVM == nil {
+			continue
+		}
+		if isSwap(part) || len(part.Subvolumes) > 0 {
+			return fmt.Errorf("partition %d: LVM physical volume holds neither SWAP nor subvolumes", part.Sequence)
+		}
+		if part.LVM.VolumeGroup == "" || len(part.LVM.LogicalVolumes) == 0 {
+			return fmt.Errorf("partition %d: LVM volume group is empty", part.Sequence)
+		}
+		for index, lv := range part.LVM.LogicalVolumes {
+			if lv.Name == "" {
+				return fmt.Errorf("partition %d: logical volume name is empty", part.Sequence)
+			}
+			if lvSizeArg(lv) == "-l 100%FREE" && index != len(part.LVM.LogicalVolumes)-1 {
+				return fmt.Errorf("partition %d: only the last logical volume may allocate the free space", part.Sequence)
+			}
+			if err := validateSubvolumes(lv.FileSystem, lv.Subvolumes); err != nil {
+				return fmt.Errorf("logical volume %s: %v", lv.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateSubvolumes(fs string, subvolumes []*Subvolume) error {
+	if len(subvolumes) == 0 {
+		return nil
+	}
+	if fs != "btrfs" {
+		return fmt.Errorf("subvolumes are not supported by %s", fs)
+	}
+	for _, s := range subvolumes {
+		if s.Name == "" {
+			return errors.New("subvolume name is empty")
+		}
+	}
+	return nil
+}
+
+// diskPartitions returns the configured partitions and the grow partition (if any)
+func diskPartitions(config *Disk) []*Partition {
+	if config.GrowPartition == nil {
+		return config.Partitions
+	}
+	return append(config.Partitions[:len(config.Partitions):len(config.Partitions)], config.GrowPartition)
+}
+
+// volumeTools returns the tools required by LUKS, LVM and btrfs subvolumes
+func volumeTools(config *Disk) []string {
+	var luks, lvm, btrfs bool
+	for _, part := range diskPartitions(config) {
+		luks = luks || part.LUKS != nil
+		lvm = lvm || part.LVM != nil
+		btrfs = btrfs || len(part.Subvolumes) > 0
+		if part.LVM != nil {
+			for _, lv := range part.LVM.LogicalVolumes {
+				btrfs = btrfs || len(lv.Subvolumes) > 0
+			}
+		}
+	}
+	var tools []string
+	if luks {
+		tools = append(tools, "cryptsetup")
+	}
+	if lvm {
+		tools = append(tools, "lvcreate")
+	}
+	if btrfs {
+		tools = append(tools, "btrfs")
+	}
+	return tools
+}
+
+// formatCmds returns the commands creating LUKS, LVM and the file systems
+// on the partition device and the volumes to be mounted.
+// The btrfs file systems are mounted to tmpMp while the subvolumes are created
+func formatCmds(part *Partition, device, keyfile, tmpMp string) ([]string, []*volume) {
+	var cmds []string
+	if part.LUKS != nil {
+		cipher := ""
+		if part.LUKS.Cipher != "" {
+			cipher = " --cipher " + part.LUKS.Cipher
+		}
+		cmds = append(cmds,
+			fmt.Sprintf("cryptsetup -q luksFormat%s --key-file %s %s", cipher, keyfile, device),
+			luksOpenCmd(part.LUKS, device, keyfile))
+		device = luksDevice(part.LUKS)
+	}
+	if part.LVM == nil {
+		c, vols := fsCmds(part, part.Subvolumes, device, tmpMp)
+		return append(cmds, c...), vols
+	}
+
+	vg := part.LVM.VolumeGroup
+	cmds = append(cmds, "pvcreate -ff -y "+device, fmt.Sprintf("vgcreate %s %s", vg, device))
+	for _, lv := range part.LVM.LogicalVolumes {
+		cmds = append(cmds, fmt.Sprintf("lvcreate -y %s -n %s %s", lvSizeArg(lv), lv.Name, vg))
+	}
+	var vols []*volume
+	for _, lv := range part.LVM.LogicalVolumes {
+		c, v := fsCmds(lv.partition(), lv.Subvolumes, lvDevice(vg, lv), tmpMp)
+		cmds = append(cmds, c...)
+		vols = append(vols, v...)
+	}
+	return cmds, vols
+}
+
+// openCmds returns the commands opening LUKS and activating LVM
+// of the existing partition and the volumes to be mounted
+func openCmds(part *Partition, device, keyfile string) ([]string, []*volume) {
+	var cmds []string
+	if part.LUKS != nil {
+		cmds = append(cmds, luksOpenCmd(part.LUKS, device, keyfile))
+		device = luksDevice(part.LUKS)
+	}
+	if part.LVM == nil {
+		return cmds, fsVolumes(part, part.Subvolumes, device)
+	}
+	cmds = append(cmds, "vgchange -ay "+part.LVM.VolumeGroup)
+	var vols []*volume
+	for _, lv := range part.LVM.LogicalVolumes {
+		vols = append(vols, fsVolumes(lv.partition(), lv.Subvolumes, lvDevice(part.LVM.VolumeGroup, lv))...)
+	}
+	return cmds, vols
+}
+
+// fsCmds returns the commands creating the file system
+// and the btrfs subvolumes on the device
+func fsCmds(part *Partition, subvolumes []*Subvolume, device, tmpMp string) ([]string, []*volume) {
+	cmds := []string{mkfsCmd(part, device)}
+	if len(subvolumes) > 0 {
+		cmds = append(cmds, mountCmd(device, tmpMp))
+		for _, s := range subvolumes {
+			cmds = append(cmds, "btrfs subvolume create "+filepath.Join(tmpMp, s.Name))
+		}
+		cmds = append(cmds, "umount "+tmpMp)
+	}
+	return cmds, fsVolumes(part, subvolumes, device)
+}
+
+// fsVolumes returns the volumes of the file system on the device:
+// the subvolumes and the file system itself if the mount point is set
+func fsVolumes(part *Partition, subvolumes []*Subvolume, device string) []*volume {
+	if isSwap(part) {
+		return nil
+	}
+	var vols []*volume
+	if part.MountPoint != "" {
+		vols = append(vols, &volume{device, part.MountPoint, part.MountOptions})
+	}
+	for _, s := range subvolumes {
+		options := "subvol=" + s.Name
+		if s.MountOptions != "" {
+			options += "," + s.MountOptions
+		}
+		vols = append(vols, &volume{device, s.MountPoint, options})
+	}
+	return vols
+}
+
+func luksOpenCmd(luks *LUKS, device, keyfile string) string {
+	return fmt.Sprintf("cryptsetup luksOpen --key-file %s %s %s", keyfile, device, luks.Name)
+}
+
+func luksDevice(luks *LUKS) string {
+	return "/dev/mapper/" + luks.Name
+}
+
+func lvDevice(vg string, lv *LogicalVolume) string {
+	return fmt.Sprintf("/dev/%s/%s", vg, lv.Name)
+}
+
+// lvSizeArg returns the lvcreate size argument
+func lvSizeArg(lv *LogicalVolume) string {
+	switch {
+	case lv.SizeMb != calcInPercents:
+		return fmt.Sprintf("-L %dM", lv.SizeMb)
+	case lv.SizePercents == allocateAll:
+		return "-l 100%FREE"
+	}
+	return fmt.Sprintf("-l %d%%VG", lv.SizePercents)
+}
+
+// keyfileCmd returns the command generating the LUKS key unless the keyfile exists
+func keyfileCmd(keyfile string) string {
+	return fmt.Sprintf("[ -s %s ] || (umask 077 && dd if=/dev/urandom of=%s bs=512 count=4 2>/dev/null)", keyfile, keyfile)
+}
+
+// crypttabEntry returns the crypttab line of the LUKS partition
+func crypttabEntry(luks *LUKS, uuid string) string {
+	key := luks.KeyFile
+	if key == "" {
+		key = "none"
+	}
+	return fmt.Sprintf("%s UUID=%s %s luks", luks.Name, uuid, key)
+}
+
+// mergeTable replaces the lines of the table (fstab, crypttab)
+// having the same key field as the entries and appends the entries
+func mergeTable(table string, entries []string, field int) string {
+	keys := make(map[string]bool)
+	for _, e := range entries {
+		keys[strings.Fields(e)[field]] = true
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(table, "\n"), "\n") {
+		f := strings.Fields(line)
+		if len(f) > field && !strings.HasPrefix(f[0], "#") && keys[f[field]] {
+			continue
+		}
+		if line != "" || len(lines) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(append(lines, entries...), "\n") + "\n"
+}
@@ -0,0 +1,145 @@
+package image
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// volumeDisk returns the disk having LUKS encrypted LVM and btrfs subvolumes
+func volumeDisk() *Disk {
+	return &Disk{
+		Path:   "/tmp/test.raw",
+		Type:   StorageTypeRAW,
+		SizeMb: 4096,
+		Partitions: []*Partition{
+			{Sequence: 1, Type: 83, SizeMb: 1024, Label: "SLASH", FileSystem: "btrfs",
+				Subvolumes: []*Subvolume{
+					{Name: "@", MountPoint: "/"},
+					{Name: "@home", MountPoint: "/home", MountOptions: "compress=zstd"},
+				}},
+			{Sequence: 2, Type: partTypeLVM, SizeMb: -1, SizePercents: -2,
+				LUKS: &LUKS{Name: "cryptdata", KeyFile: "/etc/luks/data.key", HostKeyFile: "/root/data.key"},
+				LVM: &LVM{VolumeGroup: "vgdata", LogicalVolumes: []*LogicalVolume{
+					{Name: "log", SizeMb: 512, Label: "LOG", MountPoint: "/var/log", FileSystem: "xfs"},
+					{Name: "swap", SizeMb: 256, Label: "SWAP", FileSystem: "swap"},
+					{Name: "data", SizeMb: -1, SizePercents: -2, Label: "DATA", MountPoint: "/srv", FileSystem: "ext4"},
+				}}},
+		},
+	}
+}
+
+func TestFormatCmds(t *testing.T) {
+	config := volumeDisk()
+	cmds, vols := formatCmds(config.Partitions[0], "/dev/loop0p1", "", "/mnt")
+	expected := []string{
+		"mkfs -t btrfs -f -L SLASH  /dev/loop0p1",
+		"mount /dev/loop0p1 /mnt",
+		"btrfs subvolume create /mnt/@",
+		"btrfs subvolume create /mnt/@home",
+		"umount /mnt",
+	}
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Fatalf("unexpected commands %q", cmds)
+	}
+	if len(vols) != 2 || vols[1].mountCmd("/mnt/home") != "mount -o subvol=@home,compress=zstd /dev/loop0p1 /mnt/home" {
+		t.Fatalf("unexpected volumes %+v", vols)
+	}
+
+	cmds, vols = formatCmds(config.Partitions[1], "/dev/loop0p2", "/root/data.key", "/mnt")
+	expected = []string{
+		"cryptsetup -q luksFormat --key-file /root/data.key /dev/loop0p2",
+		"cryptsetup luksOpen --key-file /root/data.key /dev/loop0p2 cryptdata",
+		"pvcreate -ff -y /dev/mapper/cryptdata",
+		"vgcreate vgdata /dev/mapper/cryptdata",
+		"lvcreate -y -L 512M -n log vgdata",
+		"lvcreate -y -L 256M -n swap vgdata",
+		"lvcreate -y -l 100%FREE -n data vgdata",
+		"mkfs -t xfs -f -L LOG  /dev/vgdata/log",
+		"mkswap -L SWAP /dev/vgdata/swap",
+		"mkfs -t ext4 -L DATA  /dev/vgdata/data",
+	}
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Fatalf("unexpected commands %q", cmds)
+	}
+	if len(vols) != 2 || vols[0].device != "/dev/vgdata/log" || vols[1].mountPoint != "/srv" {
+		t.Fatalf("unexpected volumes %+v", vols)
+	}
+
+	cmds, _ = openCmds(config.Partitions[1], "/dev/nbd0p2", "/root/data.key")
+	expected = []string{
+		"cryptsetup luksOpen --key-file /root/data.key /dev/nbd0p2 cryptdata",
+		"vgchange -ay vgdata",
+	}
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Fatalf("unexpected commands %q", cmds)
+	}
+	// LVM is deactivated before LUKS is closed (the resources are released in reverse order)
+	resources := volumeResources(config.Partitions[1])
+	if len(resources) != 2 || resources[0].Release != "cryptsetup luksClose cryptdata" || resources[1].Release != "vgchange -an vgdata" {
+		t.Fatalf("unexpected resources %+v", resources)
+	}
+}
+
+func TestValidateVolumes(t *testing.T) {
+	if err := validateVolumes(volumeDisk()); err != nil {
+		t.Fatal(err)
+	}
+	for name, modify := range map[string]func(*Disk){
+		"LUKS name":         func(d *Disk) { d.Partitions[1].LUKS.Name = "" },
+		"volume group":      func(d *Disk) { d.Partitions[1].LVM.VolumeGroup = "" },
+		"free space":        func(d *Disk) { d.Partitions[1].LVM.LogicalVolumes[0].SizeMb = -1 },
+		"subvolumes of xfs": func(d *Disk) { d.Partitions[0].FileSystem = "xfs" },
+		"subvolume name":    func(d *Disk) { d.Partitions[0].Subvolumes[0].Name = "" },
+	} {
+		config := volumeDisk()
+		config.Partitions[1].LVM.LogicalVolumes[0].SizePercents = -2
+		modify(config)
+		if err := validateVolumes(config); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+	lvm := &Partition{Type: partTypeLVM}
+	if pt, err := mbrType(lvm); err != nil || pt != 0x8e || typeGUID(lvm) != GUIDLinuxLVM {
+		t.Fatalf("unexpected LVM partition type %x [%v]", pt, err)
+	}
+	if tools := volumeTools(volumeDisk()); !reflect.DeepEqual(tools, []string{"cryptsetup", "lvcreate", "btrfs"}) {
+		t.Fatalf("unexpected tools %q", tools)
+	}
+}
+
+func TestMergeTable(t *testing.T) {
+	table := "# <name> <device> <key> <options>\ncryptdata UUID=old none luks\nother UUID=1 none luks\n"
+	merged := mergeTable(table, []string{"cryptdata UUID=new /etc/luks/data.key luks"}, 0)
+	expected := "# <name> <device> <key> <options>\nother UUID=1 none luks\ncryptdata UUID=new /etc/luks/data.key luks\n"
+	if merged != expected {
+		t.Fatalf("unexpected table %q", merged)
+	}
+	if merged := mergeTable("", []string{"a b"}, 0); merged != "a b\n" {
+		t.Fatalf("unexpected table %q", merged)
+	}
+}
+
+func TestPlanVolumes(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if _, err := Plan(buf, volumeDisk(), "/tmp/rootfs", &Utils{Kpartx: "kpartx"}); err != nil {
+		t.Fatal(err)
+	}
+	plan := buf.String()
+	for _, cmd := range []string{
+		"LVM vgdata/log: -L 512M, xfs, label LOG, mount point /var/log",
+		keyfileCmd("/root/data.key"),
+		"cryptsetup luksOpen --key-file /root/data.key /dev/loopNp2 cryptdata",
+		"mount -o subvol=@ /dev/loopNp1 /tmp/rootfs",
+		"# add to /etc/crypttab: cryptdata UUID=<uuid> /etc/luks/data.key luks",
+	} {
+		if !strings.Contains(plan, cmd+"\n") {
+			t.Fatalf("command %q not found in the plan:\n%s", cmd, plan)
+		}
+	}
+	// the root subvolume is mounted before the nested mount points
+	if strings.Index(plan, "/tmp/rootfs\n") > strings.Index(plan, "/tmp/rootfs/var/log\n") {
+		t.Fatalf("unexpected mount order:\n%s", plan)
+	}
+}
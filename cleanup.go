@@ -0,0 +1,36 @@
+package deployer
+
+import (
+	"fmt"
+
+	"github.com/dorzheh/deployer/builder/image"
+	"github.com/dorzheh/deployer/deployer"
+	"github.com/dorzheh/deployer/utils"
+	ssh "github.com/dorzheh/infra/comm/common"
+)
+
+// Cleanup releases the loop devices, mappers, mounts and temporary
+// directories left behind by the image processing that didn't complete,
+// for example killed (see image.ReleaseStale).
+// The journals are read locally and on the remote host (see sshconf).
+// The journals of the processes of other hosts are released only if force is set.
+// In plan mode (see CommonData.Plan) the actions are only described.
+// Returns the number of the journals released.
+func Cleanup(c *deployer.CommonData, sshconf *ssh.Config, force bool) (int, error) {
+	released, err := image.ReleaseStale(utils.RunFunc(nil), c.Plan, force)
+	if err != nil {
+		return released, utils.FormatError(err)
+	}
+	if sshconf == nil {
+		return released, nil
+	}
+	if c.Plan != nil {
+		fmt.Fprintf(c.Plan, "remote host: %s\n", sshconf.Host)
+	}
+	n, err := image.ReleaseStale(utils.RunFunc(sshconf), c.Plan, force)
+	released += n
+	if err != nil {
+		return released, utils.FormatError(err)
+	}
+	return released, nil
+}
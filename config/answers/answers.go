@@ -0,0 +1,303 @@
+// Parses the answers file allowing to run the deployment flow unattended
+
+// Configuration example:
+//
+//<?xml version="1.0" encoding="UTF-8"?>
+//<answers>
+//   <environment>Libvirt(KVM)</environment>
+//   <remote_mode>true</remote_mode>
+//   <ssh>
+//      <host>192.168.1.10</host>
+//      <port>22</port>
+//      <user>root</user>
+//      <password>secret</password>
+//      <private_key_file></private_key_file>
+//      <!-- the password is asked on replay if not set (the recorded answers) -->
+//      <ask_password>false</ask_password>
+//   </ssh>
+//   <export_dir>/var/lib/libvirt/images</export_dir>
+//   <name>myproduct</name>
+//   <!-- either bundle name or custom configuration -->
+//   <bundle></bundle>
+//   <cpus>4</cpus>
+//   <ram_mb>8192</ram_mb>
+//   <storage_config_index>0</storage_config_index>
+//   <disks>
+//      <disk_mb>10240</disk_mb>
+//   </disks>
+//   <networks>
+//      <network name="Management">
+//          <nic>br0</nic>
+//      </network>
+//      <network name="Traffic" mode_selection="Passthrough">
+//          <nic pci="0000:03:00.0"></nic>
+//          <nic>eth3</nic>
+//      </network>
+//   </networks>
+//   <numa>
+//      <vcpu id="0" vnuma="0">0-3</vcpu>
+//      <vcpu id="1" vnuma="0">4</vcpu>
+//   </numa>
+//   <accept_warnings>true</accept_warnings>
+//</answers>
+
+package answers
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dorzheh/deployer/builder/image"
+	"github.com/dorzheh/deployer/utils"
+	sshconf "github.com/dorzheh/infra/comm/common"
+)
+
+// Answers represents predefined answers for the questions
+// asked by deployer during the user interaction.
+type Answers struct {
+	XMLName xml.Name `xml:"answers"`
+
+	// Environment name (as it appears in the environments menu)
+	Environment string `xml:"environment,omitempty"`
+
+	// Indicates whether the deployment occures remotely
+	RemoteMode bool `xml:"remote_mode"`
+
+	// Remote session configuration
+	Ssh *Ssh `xml:"ssh,omitempty"`
+
+	// Directory for storing appropriate artifacts
+	ExportDir string `xml:"export_dir,omitempty"`
+
+	// Virtual appliance name
+	Name string `xml:"name,omitempty"`
+
+	// Name of the bundle configuration.
+	// Custom configuration is used if the bundle is not set
+	Bundle string `xml:"bundle,omitempty"`
+
+	// Amount of vCPUs
+	CPUs int `xml:"cpus,omitempty"`
+
+	// Amount of RAM in Megabytes
+	RamMb int `xml:"ram_mb,omitempty"`
+
+	// Storage configuration index
+	StorageConfigIndex image.ConfigIndex `xml:"storage_config_index,omitempty"`
+
+	// Disks sizes in Megabytes
+	DisksMb []int `xml:"disks>disk_mb,omitempty"`
+
+	// Networks to host NICs mapping
+	Networks []*Network `xml:"networks>network,omitempty"`
+
+	// vCPU affinity
+	VCPUs []*VCPU `xml:"numa>vcpu,omitempty"`
+
+	// Indicates whether warnings (CPU overcommit, NUMA optimization failure and so forth)
+	// are accepted or treated as errors
+	AcceptWarnings bool `xml:"accept_warnings"`
+
+	// Warnings accepted during the deployment
+	Warnings []string `xml:"-"`
+}
+
+// Ssh represents remote session configuration
+type Ssh struct {
+	Host        string `xml:"host"`
+	Port        string `xml:"port,omitempty"`
+	User        string `xml:"user,omitempty"`
+	Password    string `xml:"password,omitempty"`
+	PrvtKeyFile string `xml:"private_key_file,omitempty"`
+
+	// Indicates whether the password missing in the answers is asked
+	// before the deployment. The password is never recorded,
+	// therefore the recorded session authenticated by password sets it
+	AskPassword bool `xml:"ask_password,omitempty"`
+}
+
+// Network represents host NICs selected for appropriate network
+type Network struct {
+	// Network name (see xmlinput package)
+	Name string `xml:"name,attr"`
+
+	// Connection modes group (see "ui_mode_selection" in xmlinput package)
+	ModeSelection string `xml:"mode_selection,attr,omitempty"`
+
+	// Host NICs
+	NICs []*NIC `xml:"nic"`
+}
+
+// NIC represents host NIC either by name or by PCI address
+type NIC struct {
+	Name    string `xml:",chardata"`
+	PCIAddr string `xml:"pci,attr,omitempty"`
+}
+
+// VCPU represents vCPU affinity
+type VCPU struct {
+	ID    int `xml:"id,attr"`
+	VNUMA int `xml:"vnuma,attr"`
+
+	// Host CPU(s) - either a single CPU, a range or a list (for example "0-3,8")
+	HostCPUs string `xml:",chardata"`
+}
+
+// ParseFile is responsible for reading appropriate XML file
+// and calling ParseBuf for further processing
+func ParseFile(xmlpath string) (*Answers, error) {
+	d, err := utils.ParseXMLFile(xmlpath, new(Answers))
+	if err != nil {
+		return nil, utils.FormatError(err)
+	}
+	if err := d.(*Answers).Verify(); err != nil {
+		return nil, utils.FormatError(err)
+	}
+	return d.(*Answers), nil
+}
+
+// ParseBuf is responsible for processing XML content
+func ParseBuf(data []byte) (*Answers, error) {
+	d, err := utils.ParseXMLBuff(data, new(Answers))
+	if err != nil {
+		return nil, utils.FormatError(err)
+	}
+	if err := d.(*Answers).Verify(); err != nil {
+		return nil, utils.FormatError(err)
+	}
+	return d.(*Answers), nil
+}
+
+// WriteFile writes the answers to appropriate XML file
+func (a *Answers) WriteFile(xmlpath string) error {
+	buf, err := xml.MarshalIndent(a, "", "   ")
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	buf = append([]byte(xml.Header), buf...)
+	if err := ioutil.WriteFile(xmlpath, append(buf, '\n'), 0600); err != nil {
+		return utils.FormatError(err)
+	}
+	return nil
+}
+
+// Verify validates the answers that do not depend on the host
+func (a *Answers) Verify() error {
+	if a.RemoteMode {
+		if a.Ssh == nil {
+			return errors.New("remote mode is set but ssh configuration is missing")
+		}
+		s := *a.Ssh
+		// the password is not known until asked
+		if s.AskPassword && s.Password == "" {
+			s.Password = "asked"
+		}
+		if _, err := s.Config(); err != nil {
+			return err
+		}
+	}
+	if a.CPUs < 0 {
+		return fmt.Errorf("illegal amount of vCPUs (%d)", a.CPUs)
+	}
+	if a.RamMb < 0 {
+		return fmt.Errorf("illegal amount of RAM (%dMB)", a.RamMb)
+	}
+	for _, d := range a.DisksMb {
+		if d <= 0 {
+			return fmt.Errorf("illegal disk size (%dMB)", d)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, n := range a.Networks {
+		if n.Name == "" {
+			return errors.New("network name is empty")
+		}
+		if seen[n.Name] {
+			return fmt.Errorf("network \"%s\" appears more than once", n.Name)
+		}
+		seen[n.Name] = true
+		for _, nic := range n.NICs {
+			if nic.Name == "" && nic.PCIAddr == "" {
+				return fmt.Errorf("network \"%s\": either NIC name or PCI address is required", n.Name)
+			}
+		}
+	}
+	for _, v := range a.VCPUs {
+		if v.ID < 0 || v.VNUMA < 0 {
+			return fmt.Errorf("illegal vCPU configuration (vCPU %d, vNUMA %d)", v.ID, v.VNUMA)
+		}
+		if v.HostCPUs == "" {
+			return fmt.Errorf("host CPU(s) for vCPU %d are not set", v.ID)
+		}
+	}
+	return nil
+}
+
+// Config converts the answers to the ssh configuration
+func (s *Ssh) Config() (*sshconf.Config, error) {
+	if net.ParseIP(s.Host) == nil {
+		return nil, fmt.Errorf("invalid IP \"%s\"", s.Host)
+	}
+
+	cfg := &sshconf.Config{
+		Host:        s.Host,
+		Port:        s.Port,
+		User:        s.User,
+		Password:    s.Password,
+		PrvtKeyFile: s.PrvtKeyFile,
+	}
+	if cfg.Port == "" {
+		cfg.Port = "22"
+	}
+	if cfg.User == "" {
+		cfg.User = "root"
+	}
+
+	port, err := strconv.Atoi(cfg.Port)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid SSH port \"%s\"", cfg.Port)
+	}
+	if cfg.Password == "" && cfg.PrvtKeyFile == "" {
+		return nil, errors.New("either password or private key file is required for SSH authentication")
+	}
+	return cfg, nil
+}
+
+// NetworkByName returns answers related to a given network
+func (a *Answers) NetworkByName(name string) *Network {
+	for _, n := range a.Networks {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// FormatHostCpus converts a slice of host CPUs to the string
+// representation (for example "0-3,8")
+func FormatHostCpus(cpus []int) string {
+	sorted := make([]int, len(cpus))
+	copy(sorted, cpus)
+	sort.Ints(sorted)
+
+	var ranges []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(sorted[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
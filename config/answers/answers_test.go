@@ -0,0 +1,168 @@
+package answers
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+var xmldata = []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<answers>
+   <environment>Libvirt(KVM)</environment>
+   <remote_mode>true</remote_mode>
+   <ssh>
+      <host>192.168.1.10</host>
+      <password>secret</password>
+   </ssh>
+   <export_dir>/var/lib/libvirt/images</export_dir>
+   <name>myproduct</name>
+   <cpus>4</cpus>
+   <ram_mb>8192</ram_mb>
+   <storage_config_index>1</storage_config_index>
+   <disks>
+      <disk_mb>10240</disk_mb>
+      <disk_mb>20480</disk_mb>
+   </disks>
+   <networks>
+      <network name="Management">
+          <nic>br0</nic>
+      </network>
+      <network name="Traffic" mode_selection="Passthrough">
+          <nic pci="0000:03:00.0"></nic>
+          <nic>eth3</nic>
+      </network>
+   </networks>
+   <numa>
+      <vcpu id="0" vnuma="0">0-3</vcpu>
+      <vcpu id="1" vnuma="1">4</vcpu>
+   </numa>
+   <accept_warnings>true</accept_warnings>
+</answers>`)
+
+func TestParseBuf(t *testing.T) {
+	a, err := ParseBuf(xmldata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Environment != "Libvirt(KVM)" {
+		t.Fatalf("expected environment Libvirt(KVM), got %s", a.Environment)
+	}
+	if !a.RemoteMode || a.Ssh == nil {
+		t.Fatal("expected remote mode with ssh configuration")
+	}
+	if a.CPUs != 4 || a.RamMb != 8192 || a.StorageConfigIndex != 1 {
+		t.Fatalf("unexpected guest configuration: cpus %d, ram %d, storage config index %d",
+			a.CPUs, a.RamMb, a.StorageConfigIndex)
+	}
+	if len(a.DisksMb) != 2 || a.DisksMb[1] != 20480 {
+		t.Fatalf("unexpected disks %v", a.DisksMb)
+	}
+	if !a.AcceptWarnings {
+		t.Fatal("expected warnings to be accepted")
+	}
+
+	net := a.NetworkByName("Traffic")
+	if net == nil {
+		t.Fatal("network Traffic not found")
+	}
+	if net.ModeSelection != "Passthrough" {
+		t.Fatalf("expected mode selection Passthrough, got %s", net.ModeSelection)
+	}
+	if len(net.NICs) != 2 {
+		t.Fatalf("expected 2 NICs, got %d", len(net.NICs))
+	}
+	if net.NICs[0].PCIAddr != "0000:03:00.0" || net.NICs[1].Name != "eth3" {
+		t.Fatalf("unexpected NICs %+v %+v", net.NICs[0], net.NICs[1])
+	}
+	if a.NetworkByName("Unknown") != nil {
+		t.Fatal("expected nil for unknown network")
+	}
+
+	if len(a.VCPUs) != 2 || a.VCPUs[1].VNUMA != 1 || a.VCPUs[1].HostCPUs != "4" {
+		t.Fatalf("unexpected vCPUs configuration")
+	}
+}
+
+func TestSshConfig(t *testing.T) {
+	s := &Ssh{Host: "10.0.0.1", Password: "secret"}
+	cfg, err := s.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != "22" || cfg.User != "root" {
+		t.Fatalf("expected default port and user, got %s and %s", cfg.Port, cfg.User)
+	}
+
+	for _, s := range []*Ssh{
+		{Host: "host", Password: "secret"},
+		{Host: "10.0.0.1", Port: "70000", Password: "secret"},
+		{Host: "10.0.0.1"},
+	} {
+		if _, err := s.Config(); err == nil {
+			t.Fatalf("expected error for %+v", s)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, a := range []*Answers{
+		{RemoteMode: true},
+		{CPUs: -1},
+		{DisksMb: []int{0}},
+		{Networks: []*Network{{Name: "a"}, {Name: "a"}}},
+		{Networks: []*Network{{Name: "a", NICs: []*NIC{{}}}}},
+		{VCPUs: []*VCPU{{ID: 0}}},
+	} {
+		if err := a.Verify(); err == nil {
+			t.Fatalf("expected error for %+v", a)
+		}
+	}
+
+	// the password is asked on replay
+	a := &Answers{RemoteMode: true, Ssh: &Ssh{Host: "10.0.0.1", AskPassword: true}}
+	if err := a.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Ssh.Config(); err == nil {
+		t.Fatal("the password is not asked yet, expected error")
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	a, err := ParseBuf(xmldata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "answers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err := a.WriteFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ParseFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("expected %+v, got %+v", a, b)
+	}
+}
+
+func TestFormatHostCpus(t *testing.T) {
+	for expected, cpus := range map[string][]int{
+		"":        nil,
+		"4":       {4},
+		"0-3":     {3, 1, 2, 0},
+		"0-3,8":   {0, 1, 2, 3, 8},
+		"1,3,5-6": {1, 3, 5, 6},
+	} {
+		if str := FormatHostCpus(cpus); str != expected {
+			t.Fatalf("expected \"%s\", got \"%s\"", expected, str)
+		}
+	}
+}
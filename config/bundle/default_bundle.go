@@ -9,7 +9,6 @@ import (
 	"github.com/dorzheh/deployer/config/xmlinput"
 	"github.com/dorzheh/deployer/deployer"
 	"github.com/dorzheh/deployer/ui"
-	gui "github.com/dorzheh/deployer/ui/dialog_ui"
 	"github.com/dorzheh/deployer/utils"
 )
 
@@ -68,6 +67,9 @@ func (b *DefaultBundle) Parse(d *deployer.CommonData, hidriver deployer.Hostinfo
 	if err != nil {
 		return nil, utils.FormatError(err)
 	}
+	if d.Answers != nil {
+		return answerBundleConfig(d, configs, installedCpus)
+	}
 	for {
 		c, err := uiBundleConfig(d.Ui, configs, b.AdvancedConfig)
 		if err != nil {
@@ -81,12 +83,7 @@ func (b *DefaultBundle) Parse(d *deployer.CommonData, hidriver deployer.Hostinfo
 				continue
 			}
 		}
-		m := make(map[string]interface{})
-		m["name"] = c.Name
-		m["cpus"] = c.CPUs
-		m["ram_mb"] = c.RAM
-		m["storage_config_index"] = c.StorageConfigIndex
-		return m, nil
+		return configToMap(c), nil
 	}
 	return nil, nil
 }
@@ -101,7 +98,36 @@ func (b *DefaultBundle) getConfigs(ramsizeMb int) []*Config {
 	return configs
 }
 
-func uiBundleConfig(ui *gui.DialogUi, configs []*Config, advancedConfig bool) (*Config, error) {
+// answerBundleConfig looks for the bundle configuration set in the answers file.
+// Custom configuration is used if the bundle is not set
+func answerBundleConfig(d *deployer.CommonData, configs []*Config, installedCpus int) (map[string]interface{}, error) {
+	if d.Answers.Bundle == "" {
+		return nil, nil
+	}
+	for _, c := range configs {
+		if c.Name != d.Answers.Bundle {
+			continue
+		}
+		if c.CPUs > installedCpus {
+			if err := ui.AnswerWarning(d.Answers, fmt.Sprintf("The host only has %d CPUs.Overcommitting vCPUs can reduce performance!", installedCpus)); err != nil {
+				return nil, err
+			}
+		}
+		return configToMap(c), nil
+	}
+	return nil, fmt.Errorf("bundle configuration \"%s\" is not eligible for the host", d.Answers.Bundle)
+}
+
+func configToMap(c *Config) map[string]interface{} {
+	m := make(map[string]interface{})
+	m["name"] = c.Name
+	m["cpus"] = c.CPUs
+	m["ram_mb"] = c.RAM
+	m["storage_config_index"] = c.StorageConfigIndex
+	return m
+}
+
+func uiBundleConfig(ui deployer.UI, configs []*Config, advancedConfig bool) (*Config, error) {
 	var temp []string
 	index := 0
 	for _, c := range configs {
@@ -22,6 +22,10 @@ func RegisterSteps(d *deployer.CommonData, storageConfigFile string) (*deployer.
 	controller.RegisterSteps(func() func() error {
 		return func() error {
 			var err error
+			if d.Answers != nil {
+				c.RemoteMode, err = gui.AnswerRemoteMode(d.Answers)
+				return err
+			}
 			c.RemoteMode, err = gui.UiRemoteMode(d.Ui)
 			return err
 		}
@@ -31,6 +35,10 @@ func RegisterSteps(d *deployer.CommonData, storageConfigFile string) (*deployer.
 		return func() error {
 			var err error
 			if c.RemoteMode {
+				if d.Answers != nil {
+					c.SshConfig, err = gui.AnswerSshConfig(d.Answers)
+					return err
+				}
 				c.SshConfig, err = gui.UiSshConfig(d.Ui)
 				return err
 			}
@@ -41,6 +49,10 @@ func RegisterSteps(d *deployer.CommonData, storageConfigFile string) (*deployer.
 	controller.RegisterSteps(func() func() error {
 		return func() error {
 			var err error
+			if d.Answers != nil {
+				c.ExportDir, err = gui.AnswerImagePath(d.Answers, d.DefaultExportDir, c.RemoteMode)
+				return err
+			}
 			c.ExportDir, err = gui.UiImagePath(d.Ui, d.DefaultExportDir, c.RemoteMode)
 			return err
 		}
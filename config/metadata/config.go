@@ -103,10 +103,29 @@ func RegisterSteps(d *deployer.CommonData, i *InputData, c *Config, metaconf dep
 	controller.RegisterSteps(func() func() error {
 		return func() error {
 			var err error
-			if c.Metadata.DomainName, err = gui.UiApplianceName(d.Ui, d.VaName, c.EnvDriver); err != nil {
-				return err
+			switch {
+			case d.Action != deployer.ActionInstall:
+				// the existing appliance is processed
+				if !c.EnvDriver.DomainExists(d.VaName) {
+					return fmt.Errorf("domain %s doesn't exist", d.VaName)
+				}
+				c.Metadata.DomainName = d.VaName
+			case d.Answers != nil:
+				if c.Metadata.DomainName, err = gui.AnswerApplianceName(d.Answers, d.VaName, c.EnvDriver); err != nil {
+					return err
+				}
+			default:
+				if c.Metadata.DomainName, err = gui.UiApplianceName(d.Ui, d.VaName, c.EnvDriver); err != nil {
+					return err
+				}
 			}
 			d.VaName = c.Metadata.DomainName
+			if d.Answers != nil {
+				if err = c.Hwdriver.Init(); err != nil {
+					return utils.FormatError(err)
+				}
+				return nil
+			}
 			if err = gui.UiGatherHWInfo(d.Ui, c.Hwdriver, c.RemoteMode); err != nil {
 				return utils.FormatError(err)
 			}
@@ -125,7 +144,12 @@ func RegisterSteps(d *deployer.CommonData, i *InputData, c *Config, metaconf dep
 				if err != nil {
 					return utils.FormatError(err)
 				}
-				if err = gui.UiNetworks(d.Ui, xid, nics, c.GuestConfig); err != nil {
+				if d.Answers != nil {
+					err = gui.AnswerNetworks(d.Answers, xid, nics, c.GuestConfig)
+				} else {
+					err = gui.UiNetworks(d.Ui, xid, nics, c.GuestConfig)
+				}
+				if err != nil {
 					return err
 				}
 				c.Metadata.Networks, err = metaconf.SetNetworkData(c.GuestConfig, i.TemplatesDir, nil)
@@ -160,7 +184,12 @@ func RegisterSteps(d *deployer.CommonData, i *InputData, c *Config, metaconf dep
 				if xid.CPU.Max == xmlinput.UnlimitedAlloc {
 					xid.CPU.Max = c.EnvDriver.MaxVCPUsPerGuest()
 				}
-				if err = gui.UiVmConfig(d.Ui, c.Hwdriver, xid, filepath.Join(c.ExportDir, d.VaName), c.StorageConfig, c.GuestConfig); err != nil {
+				if d.Answers != nil {
+					err = gui.AnswerVmConfig(d.Answers, c.Hwdriver, xid, filepath.Join(c.ExportDir, d.VaName), c.StorageConfig, c.GuestConfig)
+				} else {
+					err = gui.UiVmConfig(d.Ui, c.Hwdriver, xid, filepath.Join(c.ExportDir, d.VaName), c.StorageConfig, c.GuestConfig)
+				}
+				if err != nil {
 					return err
 				}
 			}
@@ -168,7 +197,11 @@ func RegisterSteps(d *deployer.CommonData, i *InputData, c *Config, metaconf dep
 			c.Metadata.CPUs = c.GuestConfig.CPUs
 			c.Metadata.RAM = c.GuestConfig.RamMb * 1024
 			if c.GuestConfig.Storage == nil {
-				if c.GuestConfig.Storage, err = config.StorageConfig(filepath.Join(c.ExportDir, d.VaName), 0, c.StorageConfig, nil); err != nil {
+				var index image.ConfigIndex
+				if d.Answers != nil {
+					index = d.Answers.StorageConfigIndex
+				}
+				if c.GuestConfig.Storage, err = config.StorageConfig(filepath.Join(c.ExportDir, d.VaName), index, c.StorageConfig, nil); err != nil {
 					return err
 				}
 			}
@@ -199,8 +232,8 @@ func RegisterSteps(d *deployer.CommonData, i *InputData, c *Config, metaconf dep
 						return utils.FormatError(err)
 					}
 					if !pinned {
-						if !gui.UiWarningOnOptimizationFailure(d.Ui, "Not all the virtual machines on the host are configured with CPU pinning.") {
-							os.Exit(0)
+						if err := warnOnOptimizationFailure(d, "Not all the virtual machines on the host are configured with CPU pinning."); err != nil {
+							return err
 						}
 					}
 				}
@@ -217,8 +250,8 @@ func RegisterSteps(d *deployer.CommonData, i *InputData, c *Config, metaconf dep
 					}
 					if c.GuestConfig.OptimizationFailureMsg != "" {
 						// file.WriteString("RegisterSteps() c.GuestConfig.OptimizationFailureMsg  " + c.GuestConfig.OptimizationFailureMsg + "\n")
-						if !gui.UiWarningOnOptimizationFailure(d.Ui, c.GuestConfig.OptimizationFailureMsg) {
-							os.Exit(0)
+						if err := warnOnOptimizationFailure(d, c.GuestConfig.OptimizationFailureMsg); err != nil {
+							return err
 						}
 					}
 				}
@@ -228,15 +261,19 @@ func RegisterSteps(d *deployer.CommonData, i *InputData, c *Config, metaconf dep
 				}
 			}
 
-			processNext, err := gui.UiNumaRamNotOK(d.Ui, c.Hwdriver, c.GuestConfig, c.GuestConfig.RamMb)
-
-			if processNext != true {
-
-				return errors.New(dialog_ui.DialogMoveBack)
-			}
-			if err != nil {
-				// file.WriteString("RegisterSteps() err != nil 1 \n")
-				return utils.FormatError(err)
+			if d.Answers != nil {
+				if err := gui.AnswerNumaRam(d.Answers, c.Hwdriver, c.GuestConfig, c.GuestConfig.RamMb); err != nil {
+					return err
+				}
+			} else {
+				processNext, err := gui.UiNumaRamNotOK(d.Ui, c.Hwdriver, c.GuestConfig, c.GuestConfig.RamMb)
+				if processNext != true {
+					return errors.New(dialog_ui.DialogMoveBack)
+				}
+				if err != nil {
+					// file.WriteString("RegisterSteps() err != nil 1 \n")
+					return utils.FormatError(err)
+				}
 			}
 			// file.WriteString("RegisterSteps() xid.UiEditNUMAConfig  \n")
 			if xid.UiEditNUMAConfig {
@@ -247,7 +284,12 @@ func RegisterSteps(d *deployer.CommonData, i *InputData, c *Config, metaconf dep
 					return utils.FormatError(err)
 				}
 				// inject return code if need reconfigure
-				isChanged, err := gui.UiNUMATopology(d.Ui, c.GuestConfig, c.EnvDriver, cpus)
+				var isChanged bool
+				if d.Answers != nil {
+					isChanged, err = gui.AnswerNUMATopology(d.Answers, c.GuestConfig, cpus)
+				} else {
+					isChanged, err = gui.UiNUMATopology(d.Ui, c.GuestConfig, c.EnvDriver, cpus)
+				}
 				if err != nil {
 					// file.WriteString("RegisterSteps() err !=nil gui.UiNUMATopology " + err.Error() + " \n")
 					return err
@@ -290,6 +332,20 @@ func RegisterSteps(d *deployer.CommonData, i *InputData, c *Config, metaconf dep
 		}
 	}())
 
+	// record the effective configuration
+	if d.RecordFile != "" {
+		controller.RegisterSteps(func() func() error {
+			return func() error {
+				a, err := recordAnswers(d, c, xid)
+				if err != nil {
+					return utils.FormatError(err)
+				}
+				d.Recorded = a
+				return controller.SkipStep
+			}
+		}())
+	}
+
 	// create default metadata
 	controller.RegisterSteps(func() func() error {
 		return func() error {
@@ -298,6 +354,13 @@ func RegisterSteps(d *deployer.CommonData, i *InputData, c *Config, metaconf dep
 			if err := ioutil.WriteFile(c.DestMetadataFile, metaconf.DefaultMetadata(), 0); err != nil {
 				return utils.FormatError(err)
 			}
+			path := c.DestMetadataFile
+			d.Rollback.Register("remove "+path, func() error {
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				return nil
+			})
 			return controller.SkipStep
 		}
 	}())
@@ -305,6 +368,19 @@ func RegisterSteps(d *deployer.CommonData, i *InputData, c *Config, metaconf dep
 	return nil
 }
 
+// warnOnOptimizationFailure shows the warning and terminates the flow
+// in case the user refuses to proceed.
+// In unattended mode the warning is treated as an error unless accepted in advance
+func warnOnOptimizationFailure(d *deployer.CommonData, warningStr string) error {
+	if d.Answers != nil {
+		return gui.AnswerWarning(d.Answers, warningStr)
+	}
+	if !gui.UiWarningOnOptimizationFailure(d.Ui, warningStr) {
+		os.Exit(0)
+	}
+	return nil
+}
+
 func ProcessNetworkTemplate(mode *xmlinput.Mode, defaultTemplate string, tmpltData interface{}, templatesDir string) (string, error) {
 	var customTemplate string
 
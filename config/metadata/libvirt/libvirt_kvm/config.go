@@ -331,7 +331,8 @@ func (m meta) SetStorageData(conf *guest.Config, templatesDir string, i interfac
 	for i, disk := range conf.Storage.Disks {
 		d := new(DiskData)
 		d.ImagePath = disk.Path
-		d.StorageType = disk.Type
+		// libvirt driver type is the qemu format
+		d.StorageType = image.StorageType(disk.Type.Format())
 		d.BlockDeviceSuffix = blockDevicesSuffix[i]
 		tempData, err := utils.ProcessTemplate(TmpltStorage, d)
 		if err != nil {
@@ -71,7 +71,7 @@ func (m meta) SetStorageData(conf *guest.Config, templatesDir string, i interfac
 	var e []string
 	for i, disk := range conf.Storage.Disks {
 		switch disk.Type {
-		case image.StorageTypeQCOW2:
+		case image.StorageTypeQCOW2, image.StorageTypeQCOW2Compressed:
 			e = append(e, "'tap:qcow2:"+disk.Path+",xvd"+blockDevicesSuffix[i]+",w'")
 		case image.StorageTypeRAW:
 			e = append(e, "'file:"+disk.Path+",xvd"+blockDevicesSuffix[i]+",w'")
@@ -0,0 +1,122 @@
+package metadata
+
+import (
+	"sort"
+
+	"github.com/dorzheh/deployer/config/answers"
+	"github.com/dorzheh/deployer/config/xmlinput"
+	"github.com/dorzheh/deployer/deployer"
+	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/host_hwfilter"
+	"github.com/dorzheh/deployer/utils/hwinfo/host"
+)
+
+// recordAnswers converts the effective configuration to the answers
+// allowing to reproduce the deployment (see answers package).
+// The ssh password is not recorded, it is asked on replay instead
+// (see answers.Ssh.AskPassword)
+func recordAnswers(d *deployer.CommonData, c *Config, xid *xmlinput.XMLInputData) (*answers.Answers, error) {
+	a := new(answers.Answers)
+	if d.Recorded != nil {
+		a.Environment = d.Recorded.Environment
+	}
+
+	a.RemoteMode = c.RemoteMode
+	if c.RemoteMode && c.SshConfig != nil {
+		a.Ssh = &answers.Ssh{
+			Host:        c.SshConfig.Host,
+			Port:        c.SshConfig.Port,
+			User:        c.SshConfig.User,
+			PrvtKeyFile: c.SshConfig.PrvtKeyFile,
+			AskPassword: c.SshConfig.PrvtKeyFile == "",
+		}
+	}
+	a.ExportDir = c.ExportDir
+	a.Name = d.VaName
+
+	if name, ok := c.Bundle["name"]; ok {
+		a.Bundle = name.(string)
+	} else {
+		if xid.CPU.Configure {
+			a.CPUs = c.GuestConfig.CPUs
+		}
+		if xid.RAM.Configure {
+			a.RamMb = c.GuestConfig.RamMb
+		}
+		if xid.Disks.Configure && c.GuestConfig.Storage != nil {
+			for _, disk := range c.GuestConfig.Storage.Disks {
+				a.DisksMb = append(a.DisksMb, disk.SizeMb)
+			}
+		}
+	}
+
+	for i, net := range c.GuestConfig.Networks {
+		anet := &answers.Network{Name: net.Name}
+		hnics := host.NewNICList()
+		for _, gnic := range c.GuestConfig.NICLists[i] {
+			anet.NICs = append(anet.NICs, &answers.NIC{
+				Name:    gnic.HostNIC.Name,
+				PCIAddr: gnic.HostNIC.PCIAddr,
+			})
+			hnics.Add(gnic.HostNIC)
+		}
+		modeSelection, err := recordModeSelection(net, hnics)
+		if err != nil {
+			return nil, utils.FormatError(err)
+		}
+		anet.ModeSelection = modeSelection
+		a.Networks = append(a.Networks, anet)
+	}
+
+	if xid.UiEditNUMAConfig {
+		for vnuma, n := range c.GuestConfig.NUMAs {
+			var vcpus []int
+			for vcpu, _ := range n.CPUPin {
+				vcpus = append(vcpus, vcpu)
+			}
+			sort.Ints(vcpus)
+			for _, vcpu := range vcpus {
+				a.VCPUs = append(a.VCPUs, &answers.VCPU{
+					ID:       vcpu,
+					VNUMA:    vnuma,
+					HostCPUs: answers.FormatHostCpus(n.CPUPin[vcpu]),
+				})
+			}
+		}
+	}
+	return a, nil
+}
+
+// recordModeSelection looks for the interface type ("ui_mode_selection" group)
+// all the host NICs selected for the network belong to
+func recordModeSelection(net *xmlinput.Network, hnics host.NICList) (string, error) {
+	if len(net.UiModeBinding) == 0 || len(hnics) == 0 {
+		return "", nil
+	}
+
+	groups := make(map[string][]xmlinput.ConnectionMode)
+	var appears []string
+	for _, mode := range net.UiModeBinding {
+		if _, ok := groups[mode.Appear]; !ok {
+			appears = append(appears, mode.Appear)
+		}
+		groups[mode.Appear] = append(groups[mode.Appear], mode.Type)
+	}
+	for _, appear := range appears {
+		list, err := host_hwfilter.NicsByType(hnics, groups[appear])
+		if err != nil {
+			return "", err
+		}
+		found := true
+		for _, hnic := range hnics {
+			if _, err := list.IndexByObj(hnic); err != nil {
+				found = false
+				break
+			}
+		}
+		if found {
+			return appear, nil
+		}
+	}
+	return "", nil
+}
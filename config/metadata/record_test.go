@@ -0,0 +1,98 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/dorzheh/deployer/builder/image"
+	"github.com/dorzheh/deployer/config/answers"
+	"github.com/dorzheh/deployer/config/xmlinput"
+	"github.com/dorzheh/deployer/deployer"
+	"github.com/dorzheh/deployer/utils/hwinfo/guest"
+	"github.com/dorzheh/deployer/utils/hwinfo/host"
+	sshconf "github.com/dorzheh/infra/comm/common"
+)
+
+func TestRecordAnswers(t *testing.T) {
+	d := &deployer.CommonData{
+		VaName:   "myvm",
+		Recorded: &answers.Answers{Environment: "Libvirt(KVM)"},
+	}
+
+	xid := new(xmlinput.XMLInputData)
+	xid.CPU.Configure = true
+	xid.RAM.Configure = true
+	xid.Disks.Configure = true
+	xid.UiEditNUMAConfig = true
+
+	traffic := &xmlinput.Network{
+		Name: "Traffic",
+		UiModeBinding: []*xmlinput.Appearance{
+			{Type: xmlinput.ConTypeBridged, Appear: "Bridged"},
+			{Type: xmlinput.ConTypeDirect, Appear: "Passthrough"},
+			{Type: xmlinput.ConTypePassthrough, Appear: "Passthrough"},
+		},
+	}
+	hnic := &host.NIC{Name: "eth3", PCIAddr: "0000:03:00.0", Type: host.NicTypePhys}
+	gnic := guest.NewNIC()
+	gnic.HostNIC = hnic
+
+	gconf := guest.NewConfig()
+	gconf.CPUs = 2
+	gconf.RamMb = 4096
+	gconf.Storage = &image.Config{Disks: []*image.Disk{{SizeMb: 10240}}}
+	gconf.Networks = append(gconf.Networks, traffic)
+	gconf.NICLists = append(gconf.NICLists, guest.NICList{gnic})
+	gconf.NUMAs = []*guest.NUMA{
+		{CPUPin: map[int][]int{1: {5}, 0: {0, 1, 2, 3}}},
+	}
+
+	c := &Config{
+		CommonConfig: &deployer.CommonConfig{
+			RemoteMode: true,
+			ExportDir:  "/var/lib/libvirt/images",
+			SshConfig:  &sshconf.Config{Host: "10.0.0.1", Port: "22", User: "root", Password: "secret"},
+		},
+		GuestConfig: gconf,
+	}
+
+	a, err := recordAnswers(d, c, xid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Environment != "Libvirt(KVM)" || a.Name != "myvm" || a.ExportDir != "/var/lib/libvirt/images" {
+		t.Fatalf("unexpected common configuration %+v", a)
+	}
+	if a.Ssh == nil || a.Ssh.Host != "10.0.0.1" || a.Ssh.Password != "" || !a.Ssh.AskPassword {
+		t.Fatalf("unexpected ssh configuration %+v", a.Ssh)
+	}
+	if err := a.Verify(); err != nil {
+		t.Fatalf("the recorded answers cannot be replayed: %v", err)
+	}
+	if a.CPUs != 2 || a.RamMb != 4096 || len(a.DisksMb) != 1 || a.DisksMb[0] != 10240 {
+		t.Fatalf("unexpected guest configuration %+v", a)
+	}
+
+	net := a.NetworkByName("Traffic")
+	if net == nil || len(net.NICs) != 1 {
+		t.Fatal("network Traffic is not recorded")
+	}
+	if net.ModeSelection != "Passthrough" {
+		t.Fatalf("expected mode selection Passthrough, got %s", net.ModeSelection)
+	}
+	if net.NICs[0].Name != "eth3" || net.NICs[0].PCIAddr != "0000:03:00.0" {
+		t.Fatalf("unexpected NIC %+v", net.NICs[0])
+	}
+
+	if len(a.VCPUs) != 2 || a.VCPUs[0].ID != 0 || a.VCPUs[0].HostCPUs != "0-3" || a.VCPUs[1].HostCPUs != "5" {
+		t.Fatalf("unexpected vCPUs configuration")
+	}
+
+	// bundle configuration
+	c.Bundle = map[string]interface{}{"name": "Test1"}
+	if a, err = recordAnswers(d, c, xid); err != nil {
+		t.Fatal(err)
+	}
+	if a.Bundle != "Test1" || a.CPUs != 0 || a.RamMb != 0 {
+		t.Fatalf("unexpected bundle configuration %+v", a)
+	}
+}
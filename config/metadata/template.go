@@ -0,0 +1,51 @@
+package metadata
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dorzheh/deployer/builder/content"
+	"github.com/dorzheh/deployer/utils/hwinfo/guest"
+)
+
+// TemplateData returns the deployment data the items injected
+// by the template action are rendered with (see content.TemplateData)
+func (c *Config) TemplateData() *content.TemplateData {
+	data := &content.TemplateData{Custom: c.Bundle}
+	if c.CommonConfig != nil {
+		data.ExportDir = c.ExportDir
+	}
+	if c.Metadata != nil {
+		data.Name = c.Metadata.DomainName
+	}
+	if c.GuestConfig == nil {
+		return data
+	}
+	data.CPUs, data.RamMb = c.GuestConfig.CPUs, c.GuestConfig.RamMb
+
+	nics := guest.NewNICList()
+	for _, list := range c.GuestConfig.NICLists {
+		nics.AppendList(list)
+	}
+	nics.SortByPCISlot()
+	for _, nic := range nics {
+		n := &content.TemplateNIC{Network: nic.Network}
+		if nic.PCIAddr != nil {
+			n.PCIAddr = fmt.Sprintf("%s:%s:%s.%s", nic.PCIAddr.Domain, nic.PCIAddr.Bus, nic.PCIAddr.Slot, nic.PCIAddr.Function)
+		}
+		if nic.HostNIC != nil {
+			n.HostNIC, n.HostPCIAddr = nic.HostNIC.Name, nic.HostNIC.PCIAddr
+		}
+		data.NICs = append(data.NICs, n)
+	}
+
+	for _, numa := range c.GuestConfig.NUMAs {
+		n := &content.TemplateNUMA{CellID: numa.CellID, MemoryMb: numa.MemoryMb, CPUPin: numa.CPUPin}
+		for vcpu := range numa.CPUPin {
+			n.CPUs = append(n.CPUs, vcpu)
+		}
+		sort.Ints(n.CPUs)
+		data.NUMAs = append(data.NUMAs, n)
+	}
+	return data
+}
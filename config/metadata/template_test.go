@@ -0,0 +1,43 @@
+package metadata
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dorzheh/deployer/deployer"
+	"github.com/dorzheh/deployer/utils/hwinfo/guest"
+	"github.com/dorzheh/deployer/utils/hwinfo/host"
+)
+
+func TestTemplateData(t *testing.T) {
+	gconf := guest.NewConfig()
+	gconf.CPUs, gconf.RamMb = 2, 4096
+	for _, n := range []struct{ network, slot, host string }{
+		{"Traffic", "07", "eth3"},
+		{"Management", "06", "br0"},
+	} {
+		gnic := guest.NewNIC()
+		gnic.Network = n.network
+		gnic.PCIAddr = &guest.PCI{Domain: "0000", Bus: "00", Slot: n.slot, Function: "0"}
+		gnic.HostNIC = &host.NIC{Name: n.host, PCIAddr: "0000:03:00.0"}
+		gconf.NICLists = append(gconf.NICLists, guest.NICList{gnic})
+	}
+	gconf.NUMAs = []*guest.NUMA{{CellID: 0, MemoryMb: 4096, CPUPin: map[int][]int{1: {3}, 0: {2}}}}
+
+	c := &Config{
+		CommonConfig: &deployer.CommonConfig{ExportDir: "/var/lib/libvirt/images"},
+		GuestConfig:  gconf,
+		Metadata:     &Metadata{DomainName: "myvm"},
+	}
+	data := c.TemplateData()
+	if data.Name != "myvm" || data.CPUs != 2 || data.RamMb != 4096 || data.ExportDir != "/var/lib/libvirt/images" {
+		t.Fatalf("unexpected data %+v", data)
+	}
+	if len(data.NICs) != 2 || data.NICs[0].Network != "Management" || data.NICs[0].PCIAddr != "0000:00:06.0" ||
+		data.NICs[1].HostNIC != "eth3" {
+		t.Fatalf("unexpected NICs %+v %+v", data.NICs[0], data.NICs[1])
+	}
+	if len(data.NUMAs) != 1 || !reflect.DeepEqual(data.NUMAs[0].CPUs, []int{0, 1}) {
+		t.Fatalf("unexpected NUMAs %+v", data.NUMAs)
+	}
+}
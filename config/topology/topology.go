@@ -0,0 +1,168 @@
+// Parses the topology file describing several cooperating appliances
+// deployed by a single run
+
+// Configuration example:
+//
+//<?xml version="1.0" encoding="UTF-8"?>
+//<topology>
+//   <!-- answers shared by all the appliances (see answers package) -->
+//   <answers>
+//      <environment>Libvirt(KVM)</environment>
+//      <export_dir>/var/lib/libvirt/images</export_dir>
+//      <accept_warnings>true</accept_warnings>
+//   </answers>
+//   <!-- the appliances are defined and started in the declared order -->
+//   <appliance role="controller">
+//      <name>controller</name>
+//      <bundle>Controller</bundle>
+//      <storage_config_index>0</storage_config_index>
+//      <networks>
+//         <network name="Management">
+//            <nic>br0</nic>
+//         </network>
+//      </networks>
+//   </appliance>
+//   <appliance role="worker">
+//      <name>worker-1</name>
+//      <bundle>Worker</bundle>
+//      <storage_config_index>1</storage_config_index>
+//      <networks>
+//         <network name="Management">
+//            <nic>br0</nic>
+//         </network>
+//      </networks>
+//   </appliance>
+//</topology>
+
+package topology
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"github.com/dorzheh/deployer/builder/image"
+	"github.com/dorzheh/deployer/config/answers"
+	"github.com/dorzheh/deployer/utils"
+)
+
+// Topology represents the appliances deployed together
+type Topology struct {
+	XMLName xml.Name `xml:"topology"`
+
+	// Answers shared by all the appliances
+	Common *answers.Answers `xml:"answers"`
+
+	// Appliances in the order they are defined and started
+	Appliances []*Appliance `xml:"appliance"`
+}
+
+// Appliance represents the answers specific to an appliance.
+// The answers that are not set are taken from the common answers.
+type Appliance struct {
+	// Appliance role (product specific, for example "controller" or "worker")
+	Role string `xml:"role,attr,omitempty"`
+
+	// Virtual appliance name
+	Name string `xml:"name"`
+
+	// Name of the bundle configuration
+	Bundle string `xml:"bundle,omitempty"`
+
+	// Amount of vCPUs
+	CPUs int `xml:"cpus,omitempty"`
+
+	// Amount of RAM in Megabytes
+	RamMb int `xml:"ram_mb,omitempty"`
+
+	// Storage configuration index
+	StorageConfigIndex *image.ConfigIndex `xml:"storage_config_index"`
+
+	// Disks sizes in Megabytes
+	DisksMb []int `xml:"disks>disk_mb,omitempty"`
+
+	// Networks to host NICs mapping
+	Networks []*answers.Network `xml:"networks>network,omitempty"`
+
+	// vCPU affinity
+	VCPUs []*answers.VCPU `xml:"numa>vcpu,omitempty"`
+}
+
+// ParseFile is responsible for reading appropriate XML file
+// and calling ParseBuf for further processing
+func ParseFile(xmlpath string) (*Topology, error) {
+	d, err := utils.ParseXMLFile(xmlpath, new(Topology))
+	if err != nil {
+		return nil, utils.FormatError(err)
+	}
+	if err := d.(*Topology).Verify(); err != nil {
+		return nil, utils.FormatError(err)
+	}
+	return d.(*Topology), nil
+}
+
+// ParseBuf is responsible for processing XML content
+func ParseBuf(data []byte) (*Topology, error) {
+	d, err := utils.ParseXMLBuff(data, new(Topology))
+	if err != nil {
+		return nil, utils.FormatError(err)
+	}
+	if err := d.(*Topology).Verify(); err != nil {
+		return nil, utils.FormatError(err)
+	}
+	return d.(*Topology), nil
+}
+
+// Verify validates the topology and the answers of every appliance
+func (t *Topology) Verify() error {
+	if len(t.Appliances) == 0 {
+		return errors.New("no appliance is configured")
+	}
+	seen := make(map[string]bool)
+	for _, a := range t.Appliances {
+		if a.Name == "" {
+			return errors.New("appliance name is empty")
+		}
+		if seen[a.Name] {
+			return fmt.Errorf("appliance \"%s\" appears more than once", a.Name)
+		}
+		seen[a.Name] = true
+		if err := t.Answers(a).Verify(); err != nil {
+			return fmt.Errorf("appliance \"%s\": %v", a.Name, err)
+		}
+	}
+	return nil
+}
+
+// Answers returns the answers for the appliance.
+// The appliance answers override the common ones.
+func (t *Topology) Answers(a *Appliance) *answers.Answers {
+	res := new(answers.Answers)
+	if t.Common != nil {
+		*res = *t.Common
+	}
+	res.Warnings = nil
+	res.Name = a.Name
+	if a.Bundle != "" {
+		res.Bundle = a.Bundle
+	}
+	if a.CPUs != 0 {
+		res.CPUs = a.CPUs
+	}
+	if a.RamMb != 0 {
+		res.RamMb = a.RamMb
+	}
+	if a.StorageConfigIndex != nil {
+		res.StorageConfigIndex = *a.StorageConfigIndex
+	}
+	if a.DisksMb != nil {
+		res.DisksMb = a.DisksMb
+	}
+	if a.Networks != nil {
+		res.Networks = a.Networks
+	}
+	if a.VCPUs != nil {
+		res.VCPUs = a.VCPUs
+	}
+	return res
+}
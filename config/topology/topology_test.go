@@ -0,0 +1,85 @@
+package topology
+
+import (
+	"testing"
+)
+
+var xmldata = []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<topology>
+   <answers>
+      <environment>Libvirt(KVM)</environment>
+      <export_dir>/var/lib/libvirt/images</export_dir>
+      <cpus>2</cpus>
+      <storage_config_index>1</storage_config_index>
+      <networks>
+         <network name="Management">
+            <nic>br0</nic>
+         </network>
+      </networks>
+   </answers>
+   <appliance role="controller">
+      <name>controller</name>
+      <bundle>Controller</bundle>
+      <storage_config_index>0</storage_config_index>
+   </appliance>
+   <appliance role="worker">
+      <name>worker-1</name>
+      <cpus>4</cpus>
+      <networks>
+         <network name="Traffic">
+            <nic>eth3</nic>
+         </network>
+      </networks>
+   </appliance>
+</topology>`)
+
+func TestParseBuf(t *testing.T) {
+	topo, err := ParseBuf(xmldata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topo.Appliances) != 2 {
+		t.Fatalf("expected 2 appliances, got %d", len(topo.Appliances))
+	}
+	if topo.Appliances[0].Role != "controller" || topo.Appliances[1].Name != "worker-1" {
+		t.Fatalf("unexpected appliances %+v %+v", topo.Appliances[0], topo.Appliances[1])
+	}
+
+	a := topo.Answers(topo.Appliances[0])
+	if a.Name != "controller" || a.Bundle != "Controller" || a.Environment != "Libvirt(KVM)" {
+		t.Fatalf("unexpected controller answers %+v", a)
+	}
+	// the index set explicitly overrides the common one even if zero
+	if a.StorageConfigIndex != 0 || a.CPUs != 2 {
+		t.Fatalf("unexpected controller configuration: storage config index %d, cpus %d", a.StorageConfigIndex, a.CPUs)
+	}
+	if len(a.Networks) != 1 || a.Networks[0].Name != "Management" {
+		t.Fatalf("unexpected controller networks %v", a.Networks)
+	}
+
+	a = topo.Answers(topo.Appliances[1])
+	if a.StorageConfigIndex != 1 || a.CPUs != 4 {
+		t.Fatalf("unexpected worker configuration: storage config index %d, cpus %d", a.StorageConfigIndex, a.CPUs)
+	}
+	if len(a.Networks) != 1 || a.Networks[0].Name != "Traffic" {
+		t.Fatalf("unexpected worker networks %v", a.Networks)
+	}
+	// the common answers are not modified
+	if topo.Common.Name != "" || topo.Common.CPUs != 2 {
+		t.Fatalf("common answers are modified %+v", topo.Common)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []string{
+		`<topology></topology>`,
+		`<topology><appliance><bundle>Controller</bundle></appliance></topology>`,
+		`<topology><appliance><name>a</name></appliance><appliance><name>a</name></appliance></topology>`,
+		`<topology><appliance><name>a</name><cpus>-1</cpus></appliance></topology>`,
+	}
+	for _, data := range tests {
+		if _, err := ParseBuf([]byte(data)); err == nil {
+			t.Errorf("expected error for %s", data)
+		}
+	}
+}
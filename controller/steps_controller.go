@@ -20,6 +20,12 @@ func RegisterSteps(fs ...func() error) {
 	}
 }
 
+// ResetSteps removes the registered steps so that
+// the flow of another appliance could be configured
+func ResetSteps() {
+	steps = make([]func() error, 0)
+}
+
 func RunSteps() error {
 	stepMoveBack := false
 	for i := 0; i < len(steps); {
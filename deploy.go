@@ -1,6 +1,12 @@
 package deployer
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/dorzheh/deployer/deployer"
 	"github.com/dorzheh/deployer/utils"
 )
@@ -10,17 +16,118 @@ import (
 // - CreateConfig creates appropriate configuration(user interaction against UI).
 // - CreateBuilders creates appropriate builders and passes them to the build process
 // - CreatePostProcessors creates appropriate post-processors and passes them for post-processing
+// The configuration is recorded to the answers file if requested (see CommonData.RecordFile).
+// In case of failure the actions compensating the completed stages are unwound
+// in reverse order (see CommonData.Rollback) and the rollback report
+// is appended to the error.
+// In plan mode (see CommonData.Plan) the builders and the post-processor
+// only describe what they would do.
 func Deploy(c *deployer.CommonData, f deployer.FlowCreator) error {
+	return DeployWithContext(context.Background(), c, f)
+}
+
+// DeployWithContext is similar to Deploy.
+// The build and the post-processing are cancelled once the context is cancelled
+// or SIGHUP, SIGINT or SIGTERM is received.
+func DeployWithContext(ctx context.Context, c *deployer.CommonData, f deployer.FlowCreator) (err error) {
+	if c.Rollback == nil {
+		c.Rollback = new(deployer.Rollback)
+	}
+	defer unwindOnError(c, &err)
+
 	if err := f.CreateConfig(c); err != nil {
 		return utils.FormatError(err)
 	}
+	if c.RecordFile != "" && c.Recorded != nil {
+		if err := c.Recorded.WriteFile(c.RecordFile); err != nil {
+			return utils.FormatError(err)
+		}
+	}
 
 	builders, err := f.CreateBuilders(c)
 	if err != nil {
 		return utils.FormatError(err)
 	}
+	if c.Plan != nil {
+		return plan(c, f, builders)
+	}
+
+	ctx, cancel := cancelOnInterrupt(ctx)
+	defer cancel()
+	ctx = deployer.WithRollback(ctx, c.Rollback)
+
+	artifacts, err := build(ctx, c, builders)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	if err := postProcess(ctx, c, f, artifacts); err != nil {
+		return utils.FormatError(err)
+	}
+	return nil
+}
+
+// unwindOnError unwinds the rollback actions in case the deployment failed
+// and appends the rollback report to the error.
+// Otherwise the actions are discarded unless in plan mode:
+// the plan leaves nothing behind (the temporary metadata and so forth).
+func unwindOnError(c *deployer.CommonData, err *error) {
+	if *err == nil {
+		if c.Plan != nil {
+			c.Rollback.Unwind()
+			return
+		}
+		c.Rollback.Discard()
+		return
+	}
+	if report := c.Rollback.Unwind(); report != "" {
+		*err = fmt.Errorf("%v\nRollback:\n%s", *err, report)
+	}
+}
+
+// build runs the builders and registers the created artifacts for rollback
+func build(ctx context.Context, c *deployer.CommonData, builders []deployer.Builder) ([]deployer.Artifact, error) {
+	artifacts, err := deployer.BuildProgress(ctx, c, builders)
+	for _, a := range artifacts {
+		c.Rollback.Register("remove "+a.GetPath(), a.Destroy)
+	}
+	if err != nil {
+		return artifacts, err
+	}
+	return artifacts, writeManifest(c, artifacts)
+}
 
-	artifacts, err := deployer.BuildProgress(c, builders)
+// writeManifest writes the manifest of the artifacts (if any carries metadata)
+// alongside the images and registers it for rollback
+func writeManifest(c *deployer.CommonData, artifacts []deployer.Artifact) error {
+	name := c.VaName
+	if name == "" {
+		name = "appliance"
+	}
+	m, err := deployer.WriteManifest(name, artifacts)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		c.Rollback.Register("remove "+m.Path, m.Destroy)
+	}
+	return nil
+}
+
+// postProcess runs the post-processor created by the flow (if any)
+func postProcess(ctx context.Context, c *deployer.CommonData, f deployer.FlowCreator, artifacts []deployer.Artifact) error {
+	post, err := f.CreatePostProcessor(c)
+	if err != nil {
+		return err
+	}
+	if post != nil {
+		return deployer.PostProcessProgress(ctx, c, post, artifacts)
+	}
+	return nil
+}
+
+// plan writes the deployment plan
+func plan(c *deployer.CommonData, f deployer.FlowCreator, builders []deployer.Builder) error {
+	artifacts, err := deployer.PlanBuild(c.Plan, builders)
 	if err != nil {
 		return utils.FormatError(err)
 	}
@@ -30,10 +137,26 @@ func Deploy(c *deployer.CommonData, f deployer.FlowCreator) error {
 		return utils.FormatError(err)
 	}
 	if post != nil {
-		err := deployer.PostProcessProgress(c, post, artifacts)
-		if err != nil {
+		if err := deployer.PlanPostProcess(c.Plan, post, artifacts); err != nil {
 			return utils.FormatError(err)
 		}
 	}
 	return nil
 }
+
+// cancelOnInterrupt returns a context cancelled
+// in case SIGHUP, SIGINT or SIGTERM signal received
+func cancelOnInterrupt(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(interrupt)
+	}()
+	return ctx, cancel
+}
@@ -13,6 +13,8 @@ type ArtifactType uint8
 const (
 	ImageArtifact ArtifactType = iota
 	MetadataArtifact
+	// the manifest describing the artifacts (see WriteManifest)
+	ManifestArtifact
 )
 
 // Artifact is the interface to a real artifact implementation.
@@ -27,6 +29,9 @@ type Artifact interface {
 	// Artifact type (either ImageArtifact or MetadataArtifact).
 	GetType() ArtifactType
 
+	// Integrity information and the build details (nil if unknown).
+	GetMetadata() *ArtifactMetadata
+
 	// Destroys the artifact.
 	Destroy() error
 
@@ -40,6 +45,7 @@ type CommonArtifact struct {
 	Path      string
 	Type      ArtifactType
 	SshConfig *ssh.Config
+	Metadata  *ArtifactMetadata
 }
 
 // GetName returns artifact's name.
@@ -57,12 +63,23 @@ func (a *CommonArtifact) GetType() ArtifactType {
 	return a.Type
 }
 
-// Destroy is responsible for removing appropriate artifact.
+// GetMetadata returns artifact's metadata.
+func (a *CommonArtifact) GetMetadata() *ArtifactMetadata {
+	return a.Metadata
+}
+
+// Destroy is responsible for removing appropriate artifact
+// and its detached signature (if any).
 func (a *CommonArtifact) Destroy() error {
 	run := utils.RunFunc(a.SshConfig)
 	if _, err := run("rm " + a.Path); err != nil {
 		return utils.FormatError(err)
 	}
+	if a.Metadata != nil && a.Metadata.Signature != "" {
+		if _, err := run("rm -f " + a.Metadata.Signature); err != nil {
+			return utils.FormatError(err)
+		}
+	}
 	return nil
 }
 
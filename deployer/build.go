@@ -1,70 +1,213 @@
 package deployer
 
 import (
+	"context"
+	"fmt"
 	"runtime"
-	"time"
+	"strings"
 
 	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/progress"
 )
 
 // BuildProgress is responsible for running appropriate builders
 // and representing a progress bar providing information about the build progress.
-func BuildProgress(c *CommonData, builders []Builder) (artifacts []Artifact, err error) {
-	if c.Ui == nil {
-		return Build(builders)
-	}
-	errChan := make(chan error)
-	defer close(errChan)
-	go func() {
-		artifacts, err = Build(builders)
-		errChan <- err
-	}()
-
-	progressBarTitle := "Building artifacts"
-	progressBarMsg := "\n" + c.VaName + " installation in progress.Please wait..."
-	if err = c.Ui.Progress(progressBarTitle, progressBarMsg, c.Ui.Pb.Sleep(), c.Ui.Pb.Step(), errChan); err != nil {
-		err = utils.FormatError(err)
-	}
+// The progress events are written to the event log as well (see CommonData.EventLog).
+func BuildProgress(ctx context.Context, c *CommonData, builders []Builder) (artifacts []Artifact, err error) {
+	err = trackProgress(ctx, c, "Building artifacts", len(builders), func(ctx context.Context) error {
+		var err error
+		artifacts, err = Build(ctx, builders, c.BuildConcurrency)
+		return err
+	})
 	return
 }
 
 // buildResult contains result of a build.
 type buildResult struct {
+	index    int
 	artifact Artifact
 	err      error
 }
 
-// Build iterates over a slice of builders and runs
-// each builder in a separated goroutine.
-// Returns a slice of artifacts.
-func Build(builders []Builder) ([]Artifact, error) {
-	dur, err := time.ParseDuration("1s")
+// Build runs the builders, each builder in a separated goroutine.
+// No more than limit builders run at a time (limit < 1 means runtime.NumCPU()).
+// A builder implementing DependentBuilder is started once its dependencies
+// complete successfully; the rest are started in the slice order.
+// Once a builder fails or the context is cancelled the rest of the builders
+// are cancelled and the pending ones are never started. Build doesn't return
+// until all the running builders are done so that the resources they hold are released.
+// Every builder reports its progress events under the builder ID
+// (see progress package).
+// Returns a slice of artifacts ordered as the builders creating them.
+// On failure the artifacts created by the builders succeeded are returned
+// along with the error so that they could be destroyed.
+func Build(ctx context.Context, builders []Builder, limit int) ([]Artifact, error) {
+	dependents, pending, err := buildDependencies(builders)
 	if err != nil {
 		return nil, utils.FormatError(err)
 	}
+	if limit < 1 {
+		limit = runtime.NumCPU()
+	}
 
-	runtime.GOMAXPROCS(runtime.NumCPU() - 1)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	var artifacts []Artifact
-	ch := make(chan *buildResult, len(builders))
+	// the source must be unique since several builders may share the ID
+	sources := make([]string, len(builders))
+	ids := make(map[string]int)
+	for i, b := range builders {
+		source := b.Id()
+		ids[source]++
+		if ids[source] > 1 {
+			source = fmt.Sprintf("%s-%d", source, ids[source])
+		}
+		sources[i] = source
+	}
 
-	for _, b := range builders {
-		time.Sleep(dur)
-		go func(b Builder) {
-			artifact, err := b.Run()
-			// Forwards created artifact to the channel.
-			ch <- &buildResult{artifact, err}
-		}(b)
+	// indexes of the builders ready to start, in the slice order
+	var ready []int
+	for i := range builders {
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
 	}
-	for i := 0; i < len(builders); i++ {
-		select {
-		case result := <-ch:
-			if result.err != nil {
-				//defer close(ch)
-				return nil, utils.FormatError(result.err)
+
+	ch := make(chan *buildResult, len(builders))
+	results := make([]Artifact, len(builders))
+	var failure error
+	running := 0
+	for {
+		for running < limit && len(ready) > 0 && ctx.Err() == nil {
+			i := ready[0]
+			ready = ready[1:]
+			running++
+			go func(i int, ctx context.Context) {
+				artifact, err := builders[i].Run(ctx)
+				if err != nil {
+					progress.ReportError(ctx, err)
+				} else {
+					progress.Report(ctx, progress.StageDone, 100)
+				}
+				// Forwards created artifact to the channel.
+				ch <- &buildResult{i, artifact, err}
+			}(i, progress.WithSource(ctx, sources[i]))
+		}
+		if running == 0 {
+			break
+		}
+
+		result := <-ch
+		running--
+		if result.err != nil {
+			if failure == nil {
+				failure = result.err
 			}
-			artifacts = append(artifacts, result.artifact)
+			// cancel the rest of the builders
+			cancel()
+			continue
 		}
+		results[result.index] = result.artifact
+		for _, d := range dependents[result.index] {
+			pending[d]--
+			if pending[d] == 0 {
+				ready = insertIndex(ready, d)
+			}
+		}
+	}
+
+	var artifacts []Artifact
+	for _, a := range results {
+		if a != nil {
+			artifacts = append(artifacts, a)
+		}
+	}
+	if failure != nil {
+		return artifacts, utils.FormatError(failure)
+	}
+	if err := ctx.Err(); err != nil {
+		return artifacts, utils.FormatError(err)
 	}
 	return artifacts, nil
 }
+
+// buildDependencies resolves the dependencies of the builders.
+// Returns indexes of the builders depending on every builder and
+// the number of dependencies of every builder.
+// An error is returned if a dependency isn't among the builders
+// or the dependencies are circular.
+func buildDependencies(builders []Builder) ([][]int, []int, error) {
+	index := make(map[Builder]int)
+	for i, b := range builders {
+		index[b] = i
+		// a dependency may refer to the decorated builder as well
+		if d, ok := b.(*dependentBuilder); ok {
+			index[d.Builder] = i
+		}
+	}
+
+	dependents := make([][]int, len(builders))
+	pending := make([]int, len(builders))
+	for i, b := range builders {
+		d, ok := b.(DependentBuilder)
+		if !ok {
+			continue
+		}
+		for _, dep := range d.DependsOn() {
+			j, ok := index[dep]
+			if !ok {
+				return nil, nil, fmt.Errorf("builder %s depends on builder %s that is not being built", b.Id(), dep.Id())
+			}
+			if j == i {
+				return nil, nil, fmt.Errorf("builder %s depends on itself", b.Id())
+			}
+			dependents[j] = append(dependents[j], i)
+			pending[i]++
+		}
+	}
+
+	// make sure every builder may be started
+	left := make([]int, len(pending))
+	copy(left, pending)
+	var queue []int
+	for i := range builders {
+		if left[i] == 0 {
+			queue = append(queue, i)
+		}
+	}
+	for done := 0; done < len(builders); done++ {
+		if len(queue) == 0 {
+			var ids []string
+			for i, n := range left {
+				if n > 0 {
+					ids = append(ids, builders[i].Id())
+				}
+			}
+			return nil, nil, fmt.Errorf("circular dependencies between builders %s", strings.Join(ids, ", "))
+		}
+		i := queue[0]
+		queue = queue[1:]
+		for _, d := range dependents[i] {
+			left[d]--
+			if left[d] == 0 {
+				queue = append(queue, d)
+			}
+		}
+	}
+	return dependents, pending, nil
+}
+
+// insertIndex inserts i into the sorted slice of indexes.
+func insertIndex(indexes []int, i int) []int {
+	pos := len(indexes)
+	for j, v := range indexes {
+		if v > i {
+			pos = j
+			break
+		}
+	}
+	indexes = append(indexes, 0)
+	copy(indexes[pos+1:], indexes[pos:])
+	indexes[pos] = i
+	return indexes
+}
@@ -0,0 +1,176 @@
+package deployer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type artifactBuilder struct {
+	name string
+}
+
+func (b *artifactBuilder) Id() string {
+	return "artifactBuilder"
+}
+
+func (b *artifactBuilder) Run(ctx context.Context) (Artifact, error) {
+	return &CommonArtifact{Name: b.name}, nil
+}
+
+type failingBuilder struct{}
+
+func (b *failingBuilder) Id() string {
+	return "failingBuilder"
+}
+
+func (b *failingBuilder) Run(ctx context.Context) (Artifact, error) {
+	return nil, errors.New("build failed")
+}
+
+type blockingBuilder struct {
+	released bool
+}
+
+func (b *blockingBuilder) Id() string {
+	return "blockingBuilder"
+}
+
+func (b *blockingBuilder) Run(ctx context.Context) (Artifact, error) {
+	defer func() {
+		b.released = true
+	}()
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// countingBuilder records the builders running concurrently
+// and the order the builders complete.
+type countingBuilder struct {
+	name    string
+	delay   time.Duration
+	counter *buildCounter
+}
+
+type buildCounter struct {
+	sync.Mutex
+	running int
+	max     int
+	done    []string
+}
+
+func (b *countingBuilder) Id() string {
+	return "countingBuilder"
+}
+
+func (b *countingBuilder) Run(ctx context.Context) (Artifact, error) {
+	c := b.counter
+	c.Lock()
+	c.running++
+	if c.running > c.max {
+		c.max = c.running
+	}
+	c.Unlock()
+
+	time.Sleep(b.delay)
+
+	c.Lock()
+	c.running--
+	c.done = append(c.done, b.name)
+	c.Unlock()
+	return &CommonArtifact{Name: b.name}, nil
+}
+
+func artifactNames(artifacts []Artifact) string {
+	var names []string
+	for _, a := range artifacts {
+		names = append(names, a.GetName())
+	}
+	return strings.Join(names, ",")
+}
+
+func TestBuildLimit(t *testing.T) {
+	c := new(buildCounter)
+	var builders []Builder
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		builders = append(builders, &countingBuilder{name, 10 * time.Millisecond, c})
+	}
+	artifacts, err := Build(context.Background(), builders, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.max != 2 {
+		t.Fatalf("expected 2 builders running at a time, got %d", c.max)
+	}
+	if names := artifactNames(artifacts); names != "a,b,c,d,e" {
+		t.Fatalf("unexpected artifacts order %s", names)
+	}
+}
+
+func TestBuildDependencies(t *testing.T) {
+	c := new(buildCounter)
+	root := &countingBuilder{"root", 20 * time.Millisecond, c}
+	data := &countingBuilder{"data", 0, c}
+	metadata := &countingBuilder{"metadata", 0, c}
+	builders := []Builder{After(metadata, root, data), After(data, root), root}
+	artifacts, err := Build(context.Background(), builders, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done := strings.Join(c.done, ","); done != "root,data,metadata" {
+		t.Fatalf("unexpected build order %s", done)
+	}
+	if names := artifactNames(artifacts); names != "metadata,data,root" {
+		t.Fatalf("unexpected artifacts order %s", names)
+	}
+}
+
+func TestBuildDependencyFailed(t *testing.T) {
+	c := new(buildCounter)
+	dependent := &countingBuilder{"dependent", 0, c}
+	failing := new(failingBuilder)
+	if _, err := Build(context.Background(), []Builder{After(dependent, failing), failing}, 0); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(c.done) != 0 {
+		t.Fatal("the dependent builder was started")
+	}
+}
+
+func TestBuildCircularDependencies(t *testing.T) {
+	c := new(buildCounter)
+	a := &countingBuilder{"a", 0, c}
+	b := &countingBuilder{"b", 0, c}
+	_, err := Build(context.Background(), []Builder{After(a, b), After(b, a)}, 0)
+	if err == nil || !strings.Contains(err.Error(), "circular") {
+		t.Fatalf("expected circular dependencies error, got %v", err)
+	}
+	if _, err := Build(context.Background(), []Builder{After(a, b)}, 0); err == nil {
+		t.Fatal("expected error for a dependency that is not being built")
+	}
+	if len(c.done) != 0 {
+		t.Fatal("builders were started")
+	}
+}
+
+func TestBuildCancelsSiblings(t *testing.T) {
+	sibling := new(blockingBuilder)
+	_, err := Build(context.Background(), []Builder{sibling, new(failingBuilder)}, 2)
+	if err == nil || !strings.Contains(err.Error(), "build failed") {
+		t.Fatalf("expected the builder failure, got %v", err)
+	}
+	if !sibling.released {
+		t.Fatal("Build returned before the sibling builder was released")
+	}
+}
+
+func TestBuildCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Build(ctx, []Builder{new(blockingBuilder)}, 0); err == nil {
+		t.Fatal("expected error")
+	}
+}
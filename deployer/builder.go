@@ -1,6 +1,10 @@
 package deployer
 
 import (
+	"context"
+	"fmt"
+	"io"
+
 	"github.com/dorzheh/deployer/builder/image"
 )
 
@@ -10,8 +14,10 @@ type Builder interface {
 	// Id of the build
 	Id() string
 
-	// Run the build
-	Run() (Artifact, error)
+	// Run the build.
+	// Once the context is cancelled the builder is expected
+	// to stop and release all the resources it holds.
+	Run(ctx context.Context) (Artifact, error)
 }
 
 // ImageBuilderData represents the common data
@@ -26,6 +32,24 @@ type ImageBuilderData struct {
 	// RootfsMp - path to the mount point where the image
 	// artifact will be mounted during customization.
 	RootfsMp string
+
+	// Upgrade - the image exists already, only the application
+	// is reinstalled (see RootfsFiller.InstallApp).
+	Upgrade bool
+
+	// Grow - the existing image is grown to the size of the image
+	// configuration before the application is reinstalled (see image.Grow).
+	// Ignored unless Upgrade is set.
+	Grow bool
+
+	// SigningKey - path to the local private key the image
+	// is signed by (see SignArtifact). The image isn't signed if empty.
+	SigningKey string
+
+	// CacheDir - path to the directory the base images are cached in
+	// (see CacheableFiller). The image is built from scratch if empty
+	// or the image has LUKS partitions.
+	CacheDir string
 }
 
 // MetadataBuilderData represents the common data
@@ -51,3 +75,39 @@ type DirBuilderData struct {
 	// RootfsPath - path to rootfs
 	RootfsPath string
 }
+
+// DependentBuilder is the interface implemented by builders
+// that have to wait for other builders, for example a metadata builder
+// referring to the final image paths.
+type DependentBuilder interface {
+	Builder
+
+	// DependsOn returns the builders that must complete successfully
+	// before the builder is started.
+	DependsOn() []Builder
+}
+
+// After returns a builder running b once all the deps are done.
+func After(b Builder, deps ...Builder) DependentBuilder {
+	return &dependentBuilder{b, deps}
+}
+
+// dependentBuilder decorates a builder with its dependencies.
+type dependentBuilder struct {
+	Builder
+	deps []Builder
+}
+
+func (b *dependentBuilder) DependsOn() []Builder {
+	return b.deps
+}
+
+// Plan forwards the plan to the decorated builder.
+func (b *dependentBuilder) Plan(w io.Writer) (Artifact, error) {
+	p, ok := b.Builder.(BuildPlanner)
+	if !ok {
+		fmt.Fprintln(w, "plan is not supported by the builder")
+		return nil, nil
+	}
+	return p.Plan(w)
+}
@@ -1,8 +1,10 @@
 package deployer
 
 import (
+	"io"
+
 	"github.com/dorzheh/deployer/builder/image"
-	ui "github.com/dorzheh/deployer/ui/dialog_ui"
+	"github.com/dorzheh/deployer/config/answers"
 	ssh "github.com/dorzheh/infra/comm/common"
 )
 
@@ -24,8 +26,60 @@ type CommonData struct {
 	// Arch represents archirecture we'r running on.
 	Arch string
 
-	// Ui represents appropriate dialog based user interface.
-	Ui *ui.DialogUi
+	// Ui represents appropriate user interface.
+	Ui UI
+
+	// Answers represents predefined answers replacing the user interaction.
+	// If set, the flow runs unattended and no dialog is shown.
+	Answers *answers.Answers
+
+	// RecordFile is a path to the answers file the effective configuration
+	// is written to once the configuration stage is completed.
+	// The file allows reproducing the deployment on another host.
+	RecordFile string
+
+	// Recorded represents the answers recorded if RecordFile is set.
+	Recorded *answers.Answers
+
+	// Rollback collects the actions compensating the deployment stages.
+	// The actions are unwound in case the deployment fails.
+	Rollback *Rollback
+
+	// EventLog, if set, receives the progress events of the build
+	// and the post-processing, one JSON object per line.
+	// The deployment fails in case the events cannot be written.
+	EventLog io.Writer
+
+	// DiffLog, if set, receives the unified diffs of the files
+	// edited by the rootfs customization (see content.CustomizeWithData).
+	DiffLog io.Writer
+
+	// BuildConcurrency limits the number of builders running at a time.
+	// Zero means the number of CPUs.
+	BuildConcurrency int
+
+	// SigningKey is a path to the local private key
+	// the images are signed by (see ImageBuilderData.SigningKey).
+	SigningKey string
+
+	// CacheDir is a path to the directory the base images
+	// are cached in (see ImageBuilderData.CacheDir).
+	CacheDir string
+
+	// Grow turns on growing the disks to the configured sizes
+	// on upgrade (see ImageBuilderData.Grow).
+	Grow bool
+
+	// Action is the lifecycle action applied to the appliance.
+	// A new appliance is installed by default.
+	Action Action
+
+	// Plan turns the plan mode on if set.
+	// The configuration stage runs as usual, then the builders and
+	// the post-processor write what they would do to Plan instead of doing it.
+	// The actions registered in Rollback by the configuration stage
+	// are unwound once the plan is written.
+	Plan io.Writer
 }
 
 // CommonConfig represents common configuration
@@ -26,9 +26,15 @@ type EnvDriver interface {
 	// Sets appliance to start on host boot.
 	SetAutostart(string) error
 
+	// Prevents appliance from starting on host boot.
+	UnsetAutostart(string) error
+
 	// Returns true if the given domain exists.
 	DomainExists(string) bool
 
+	// Returns paths to the images attached to the domain as disks.
+	DomainDisks(string) ([]string, error)
+
 	// Returns path to emulator(QEMU for example).
 	Emulator(arch string) (string, error)
 
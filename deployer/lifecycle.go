@@ -0,0 +1,50 @@
+package deployer
+
+import (
+	ssh "github.com/dorzheh/infra/comm/common"
+)
+
+// Action represents the lifecycle action applied to an appliance.
+type Action int
+
+const (
+	// ActionInstall deploys a new appliance.
+	ActionInstall Action = iota
+
+	// ActionRedeploy rebuilds the disks of an existing appliance.
+	// The appliance definition (name, networks and so forth) is kept.
+	ActionRedeploy
+
+	// ActionUpgrade reinstalls the application on the existing disks
+	// of an appliance (see RootfsFiller.InstallApp).
+	ActionUpgrade
+
+	// ActionRemove destroys and undefines an existing appliance
+	// and removes its disks.
+	ActionRemove
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionInstall:
+		return "install"
+	case ActionRedeploy:
+		return "redeploy"
+	case ActionUpgrade:
+		return "upgrade"
+	case ActionRemove:
+		return "remove"
+	}
+	return "unknown"
+}
+
+// LifecycleFlowCreator is the interface implemented by flows
+// able to process an existing appliance (see Action).
+type LifecycleFlowCreator interface {
+	FlowCreator
+
+	// Target returns the environment driver and the ssh configuration
+	// (nil for the local host) of the host the appliance is deployed on.
+	// Called once the configuration is created.
+	Target() (EnvDriver, *ssh.Config)
+}
@@ -0,0 +1,166 @@
+package deployer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dorzheh/deployer/builder/image"
+	"github.com/dorzheh/deployer/utils"
+	ssh "github.com/dorzheh/infra/comm/common"
+)
+
+// ArtifactMetadata represents integrity information
+// and the build details of an artifact.
+type ArtifactMetadata struct {
+	// SHA256 is the hex encoded digest of the artifact.
+	SHA256 string `json:"sha256"`
+
+	// Size of the artifact in bytes.
+	Size int64 `json:"size"`
+
+	// Format of the image (see image.StorageType).
+	Format string `json:"format,omitempty"`
+
+	// StorageConfig is the disk configuration the image is built by.
+	StorageConfig *image.Disk `json:"storage_config,omitempty"`
+
+	// Started and Finished are the builder timings.
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	// Signature is a path to the detached signature of the artifact
+	// (see SignArtifact).
+	Signature string `json:"signature,omitempty"`
+}
+
+// ManifestEntry represents an artifact listed by the manifest.
+type ManifestEntry struct {
+	Name     string            `json:"name"`
+	Path     string            `json:"path"`
+	Metadata *ArtifactMetadata `json:"metadata"`
+}
+
+// Manifest describes the artifacts created by a deployment.
+type Manifest struct {
+	Name      string           `json:"name"`
+	Artifacts []*ManifestEntry `json:"artifacts"`
+}
+
+// ArtifactDigest returns SHA-256 digest and size of the artifact
+// stored either locally or on the remote host (see sshconf).
+func ArtifactDigest(path string, sshconf *ssh.Config) (digest []byte, size int64, err error) {
+	run := utils.RunFunc(sshconf)
+	out, err := run("sha256sum " + path)
+	if err != nil {
+		return nil, 0, utils.FormatError(err)
+	}
+	if digest, err = hex.DecodeString(strings.Fields(out + " ")[0]); err != nil {
+		return nil, 0, utils.FormatError(fmt.Errorf("unexpected digest %s", out))
+	}
+	if out, err = run("stat -c %s " + path); err != nil {
+		return nil, 0, utils.FormatError(err)
+	}
+	if size, err = strconv.ParseInt(strings.TrimSpace(out), 10, 64); err != nil {
+		return nil, 0, utils.FormatError(err)
+	}
+	return digest, size, nil
+}
+
+// WriteManifest writes the JSON manifest describing the artifacts
+// carrying metadata alongside the first of them.
+// Returns the manifest artifact or nil if no artifact carries metadata.
+func WriteManifest(name string, artifacts []Artifact) (*CommonArtifact, error) {
+	m := &Manifest{Name: name}
+	var sshconf *ssh.Config
+	for _, a := range artifacts {
+		if a.GetMetadata() == nil {
+			continue
+		}
+		if len(m.Artifacts) == 0 {
+			if c, ok := a.(*CommonArtifact); ok {
+				sshconf = c.SshConfig
+			}
+		}
+		m.Artifacts = append(m.Artifacts, &ManifestEntry{a.GetName(), a.GetPath(), a.GetMetadata()})
+	}
+	if len(m.Artifacts) == 0 {
+		return nil, nil
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, utils.FormatError(err)
+	}
+	a := &CommonArtifact{
+		Name:      name + ".manifest.json",
+		Type:      ManifestArtifact,
+		SshConfig: sshconf,
+	}
+	a.Path = filepath.Join(filepath.Dir(m.Artifacts[0].Path), a.Name)
+	if err := writeFile(a.Path, data, sshconf); err != nil {
+		return nil, utils.FormatError(err)
+	}
+	return a, nil
+}
+
+// VerifyArtifact verifies the digest and the size of the artifact
+// against its metadata. The detached signature is verified as well
+// if the public key is provided (see VerifySignature).
+func VerifyArtifact(a Artifact, publicKeyFile string) error {
+	m := a.GetMetadata()
+	if m == nil {
+		return utils.FormatError(fmt.Errorf("%s: metadata not found", a.GetPath()))
+	}
+	var sshconf *ssh.Config
+	if c, ok := a.(*CommonArtifact); ok {
+		sshconf = c.SshConfig
+	}
+	digest, size, err := ArtifactDigest(a.GetPath(), sshconf)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	if hex.EncodeToString(digest) != m.SHA256 || size != m.Size {
+		return utils.FormatError(fmt.Errorf("%s: digest mismatch", a.GetPath()))
+	}
+	if publicKeyFile == "" {
+		return nil
+	}
+	if m.Signature == "" {
+		return utils.FormatError(fmt.Errorf("%s: signature not found", a.GetPath()))
+	}
+	out, err := utils.RunFunc(sshconf)("base64 -w0 " + m.Signature)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(out))
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	if err := VerifySignature(publicKeyFile, digest, sig); err != nil {
+		return utils.FormatError(fmt.Errorf("%s: %v", a.GetPath(), err))
+	}
+	return nil
+}
+
+// writeFile writes the data either locally or on the remote host.
+// The data is streamed to the remote host over the standard input
+func writeFile(path string, data []byte, sshconf *ssh.Config) error {
+	if sshconf == nil {
+		return ioutil.WriteFile(path, data, 0644)
+	}
+	run := utils.RunStreamFuncWithContext(context.Background(), sshconf)
+	// tee writes the file with the privileges of the command (see utils.RunFunc)
+	if out, err := run("tee "+path+" >/dev/null", bytes.NewReader(data), nil); err != nil {
+		return fmt.Errorf("%s [%v]", out, err)
+	}
+	return nil
+}
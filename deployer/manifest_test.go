@@ -0,0 +1,187 @@
+package deployer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeKeys writes PEM encoded private and public keys to the directory
+func writeKeys(t *testing.T, dir string, key crypto.Signer) (prvt, pub string) {
+	var block *pem.Block
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prvt = filepath.Join(dir, block.Type+".pem")
+	pub = prvt + ".pub"
+	if err := ioutil.WriteFile(prvt, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pub, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return prvt, pub
+}
+
+// testImage creates an image artifact carrying metadata
+func testImage(t *testing.T, dir string) *CommonArtifact {
+	path := filepath.Join(dir, "test.img")
+	data := []byte("image content")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(data)
+	return &CommonArtifact{
+		Name: "test.img",
+		Path: path,
+		Type: ImageArtifact,
+		Metadata: &ArtifactMetadata{
+			SHA256: hex.EncodeToString(digest[:]),
+			Size:   int64(len(data)),
+			Format: "raw",
+		},
+	}
+}
+
+func TestArtifactDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer_manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := testImage(t, dir)
+	digest, size, err := ArtifactDigest(a.Path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(digest) != a.Metadata.SHA256 || size != a.Metadata.Size {
+		t.Fatalf("unexpected digest %x, size %d", digest, size)
+	}
+	if err := VerifyArtifact(a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(a.Path, []byte("tampered image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyArtifact(a, ""); err == nil {
+		t.Fatal("expected digest mismatch")
+	}
+}
+
+func TestSignArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer_signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		prvt, pub := writeKeys(t, dir, key)
+		a := testImage(t, dir)
+		digest, _ := hex.DecodeString(a.Metadata.SHA256)
+		if a.Metadata.Signature, err = SignArtifact(a.Path, nil, prvt, digest); err != nil {
+			t.Fatal(err)
+		}
+		if a.Metadata.Signature != a.Path+".sig" {
+			t.Fatalf("unexpected signature path %s", a.Metadata.Signature)
+		}
+		if err := VerifyArtifact(a, pub); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifySignature(pub, make([]byte, sha256.Size), []byte("garbage")); err == nil {
+			t.Fatal("expected invalid signature")
+		}
+		if err := a.Destroy(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(a.Metadata.Signature); !os.IsNotExist(err) {
+			t.Fatalf("signature is not removed [%v]", err)
+		}
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer_manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	meta := &CommonArtifact{Name: "metadata", Path: filepath.Join(dir, "metadata"), Type: MetadataArtifact}
+	m, err := WriteManifest("test", []Artifact{meta})
+	if err != nil || m != nil {
+		t.Fatalf("unexpected manifest %v [%v]", m, err)
+	}
+
+	a := testImage(t, dir)
+	if m, err = WriteManifest("test", []Artifact{meta, a}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != ManifestArtifact || m.Path != filepath.Join(dir, "test.manifest.json") {
+		t.Fatalf("unexpected manifest artifact %+v", m)
+	}
+	data, err := ioutil.ReadFile(m.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Name != "test" || len(manifest.Artifacts) != 1 {
+		t.Fatalf("unexpected manifest %s", data)
+	}
+	if e := manifest.Artifacts[0]; e.Path != a.Path || e.Metadata.SHA256 != a.Metadata.SHA256 {
+		t.Fatalf("unexpected manifest entry %+v", e)
+	}
+}
+
+func TestWriteFileLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer_manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// exceeds the limit of a command line argument
+	data := bytes.Repeat([]byte("manifest\n"), 32*1024)
+	path := filepath.Join(dir, "test.manifest.json")
+	if err := writeFile(path, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if written, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(written, data) {
+		t.Fatalf("unexpected content of %d bytes [%v]", len(written), err)
+	}
+}
@@ -0,0 +1,75 @@
+package deployer
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dorzheh/deployer/utils"
+)
+
+// BuildPlanner is the interface implemented by builders
+// able to describe the build without running it (plan mode).
+type BuildPlanner interface {
+	// Plan writes the actions the builder would take and returns
+	// the artifact the builder would create.
+	Plan(w io.Writer) (Artifact, error)
+}
+
+// PostProcessPlanner is the interface implemented by post-processors
+// able to describe the post-processing without running it (plan mode).
+type PostProcessPlanner interface {
+	// PlanPostProcess writes the actions the post-processor
+	// would take for given artifacts.
+	PlanPostProcess(w io.Writer, artifacts []Artifact) error
+}
+
+// PlannedArtifact represents an artifact that would be created
+// by a builder. The artifact doesn't exist therefore the builder
+// provides its content (if any) in Data.
+type PlannedArtifact struct {
+	CommonArtifact
+
+	// Data represents the artifact content.
+	Data string
+}
+
+// Destroy does nothing since the artifact is never created.
+func (a *PlannedArtifact) Destroy() error {
+	return nil
+}
+
+// PlanBuild writes the build plan of every builder.
+// Returns a slice of planned artifacts.
+func PlanBuild(w io.Writer, builders []Builder) ([]Artifact, error) {
+	var artifacts []Artifact
+	for _, b := range builders {
+		fmt.Fprintf(w, "=== %s ===\n", b.Id())
+		p, ok := b.(BuildPlanner)
+		if !ok {
+			fmt.Fprintln(w, "plan is not supported by the builder")
+			continue
+		}
+		artifact, err := p.Plan(w)
+		if err != nil {
+			return nil, utils.FormatError(err)
+		}
+		if artifact != nil {
+			artifacts = append(artifacts, artifact)
+		}
+	}
+	return artifacts, nil
+}
+
+// PlanPostProcess writes the post-processing plan for given artifacts.
+func PlanPostProcess(w io.Writer, p PostProcessor, artifacts []Artifact) error {
+	fmt.Fprintln(w, "=== Post-processing ===")
+	pp, ok := p.(PostProcessPlanner)
+	if !ok {
+		fmt.Fprintln(w, "plan is not supported by the post-processor")
+		return nil
+	}
+	if err := pp.PlanPostProcess(w, artifacts); err != nil {
+		return utils.FormatError(err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package deployer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+type planBuilder struct {
+	id string
+}
+
+func (b *planBuilder) Id() string {
+	return b.id
+}
+
+func (b *planBuilder) Run(ctx context.Context) (Artifact, error) {
+	panic("Run must not be called in plan mode")
+}
+
+func (b *planBuilder) Plan(w io.Writer) (Artifact, error) {
+	io.WriteString(w, "plan of "+b.id+"\n")
+	return &PlannedArtifact{CommonArtifact: CommonArtifact{Name: b.id, Type: MetadataArtifact}}, nil
+}
+
+type runBuilder struct{}
+
+func (b *runBuilder) Id() string {
+	return "runBuilder"
+}
+
+func (b *runBuilder) Run(ctx context.Context) (Artifact, error) {
+	panic("Run must not be called in plan mode")
+}
+
+func TestPlanBuild(t *testing.T) {
+	buf := new(bytes.Buffer)
+	artifacts, err := PlanBuild(buf, []Builder{&planBuilder{"first"}, &runBuilder{}, &planBuilder{"second"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts) != 2 || artifacts[1].GetName() != "second" {
+		t.Fatalf("unexpected artifacts %v", artifacts)
+	}
+	if err := artifacts[0].Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"=== first ===\nplan of first\n", "=== runBuilder ===\nplan is not supported"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("%q not found in the plan:\n%s", s, buf.String())
+		}
+	}
+}
@@ -1,26 +1,22 @@
 package deployer
 
 import (
-	"github.com/dorzheh/deployer/utils"
+	"context"
+
+	"github.com/dorzheh/deployer/utils/progress"
 )
 
 // PostProcessProgress is responsible for representing a progress
 // during post-processing of appropriate artifact.
-func PostProcessProgress(c *CommonData, p PostProcessor, artifacts []Artifact) error {
-	if c.Ui == nil {
-		return p.PostProcess(artifacts)
-	}
-
-	errChan := make(chan error)
-	defer close(errChan)
-	go func() {
-		errChan <- p.PostProcess(artifacts)
-	}()
-
-	progressBarTitle := "Post-processing"
-	progressBarMsg := "\n" + c.VaName + " installation in progress.Please wait..."
-	if err := c.Ui.Progress(progressBarTitle, progressBarMsg, c.Ui.Pb.Sleep(), c.Ui.Pb.Step(), errChan); err != nil {
-		return utils.FormatError(err)
-	}
-	return nil
+// The post-processor reports its progress events under "PostProcessor" source.
+func PostProcessProgress(ctx context.Context, c *CommonData, p PostProcessor, artifacts []Artifact) error {
+	return trackProgress(ctx, c, "Post-processing", 1, func(ctx context.Context) error {
+		ctx = progress.WithSource(ctx, "PostProcessor")
+		if err := p.PostProcess(ctx, artifacts); err != nil {
+			progress.ReportError(ctx, err)
+			return err
+		}
+		progress.Report(ctx, progress.StageDone, 100)
+		return nil
+	})
 }
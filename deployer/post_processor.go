@@ -1,8 +1,12 @@
 package deployer
 
+import (
+	"context"
+)
+
 // PostProcessor is the interface that has to be
 // implemented in order to post-process appropriate artifact.
 type PostProcessor interface {
 	// Processes given artifacts
-	PostProcess([]Artifact) error
+	PostProcess(context.Context, []Artifact) error
 }
@@ -0,0 +1,72 @@
+package deployer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/progress"
+)
+
+// trackProgress runs fn and forwards the progress events emitted
+// by the given amount of sources to the UI and the event log.
+// The first error writing the event log is returned unless fn fails,
+// no events are written after the error.
+func trackProgress(ctx context.Context, c *CommonData, title string, sources int, fn func(context.Context) error) error {
+	events := make(chan *progress.Event, 100)
+	result := make(chan error, 1)
+	go func() {
+		result <- fn(progress.WithEvents(ctx, events))
+	}()
+
+	var uiEvents chan *progress.Event
+	uiDone := make(chan error, 1)
+	uiResult := make(chan error, 1)
+	if c.Ui != nil {
+		uiEvents = make(chan *progress.Event, 100)
+		go func() {
+			msg := "\n" + c.VaName + " installation in progress.Please wait..."
+			uiResult <- c.Ui.Progress(title, msg, uiEvents, uiDone)
+		}()
+	}
+
+	tracker := progress.NewTracker(sources)
+	var logErr error
+	forward := func(e *progress.Event) {
+		tracker.Update(e)
+		if c.EventLog != nil && logErr == nil {
+			logErr = json.NewEncoder(c.EventLog).Encode(e)
+		}
+		if uiEvents != nil {
+			// the event is dropped in case the UI is too slow
+			select {
+			case uiEvents <- e:
+			default:
+			}
+		}
+	}
+
+	for {
+		select {
+		case e := <-events:
+			forward(e)
+		case err := <-result:
+			// all the sources are done, forward the events left
+			for len(events) > 0 {
+				forward(<-events)
+			}
+			if err == nil && logErr != nil {
+				err = utils.FormatError(fmt.Errorf("writing the progress events: %v", logErr))
+			}
+			if c.Ui == nil {
+				return err
+			}
+			uiDone <- err
+			if err := <-uiResult; err != nil {
+				return utils.FormatError(err)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package deployer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/dorzheh/deployer/utils/progress"
+)
+
+type reportingBuilder struct{}
+
+func (b *reportingBuilder) Id() string {
+	return "reportingBuilder"
+}
+
+func (b *reportingBuilder) Run(ctx context.Context) (Artifact, error) {
+	progress.Report(ctx, progress.StageFillRootfs, 20)
+	return &CommonArtifact{Name: "reporting"}, nil
+}
+
+func TestBuildProgressEventLog(t *testing.T) {
+	log := new(bytes.Buffer)
+	// the builders run one by one so that the events are ordered
+	c := &CommonData{EventLog: log, BuildConcurrency: 1}
+	if _, err := BuildProgress(context.Background(), c, []Builder{new(reportingBuilder), new(reportingBuilder)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []*progress.Event
+	for _, line := range strings.Split(strings.TrimSpace(log.String()), "\n") {
+		e := new(progress.Event)
+		if err := json.Unmarshal([]byte(line), e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %d:\n%s", len(events), log.String())
+	}
+	// the builders share the ID
+	if events[0].Source != "reportingBuilder" || events[2].Source != "reportingBuilder-2" {
+		t.Fatalf("unexpected sources:\n%s", log.String())
+	}
+	if last := events[3]; last.Stage != progress.StageDone || last.Total != 100 {
+		t.Fatalf("unexpected last event %+v", last)
+	}
+}
+
+// failingWriter accepts the given amount of writes
+type failingWriter struct {
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.writes == 0 {
+		return 0, errors.New("no space left on device")
+	}
+	w.writes--
+	return len(p), nil
+}
+
+func TestBuildProgressEventLogError(t *testing.T) {
+	log := &failingWriter{writes: 1}
+	c := &CommonData{EventLog: log, BuildConcurrency: 1}
+	artifacts, err := BuildProgress(context.Background(), c, []Builder{new(reportingBuilder)})
+	if err == nil || !strings.Contains(err.Error(), "no space left on device") {
+		t.Fatalf("expected the event log error, got %v", err)
+	}
+	// the artifacts are returned so that they are rolled back
+	if len(artifacts) != 1 {
+		t.Fatalf("unexpected artifacts %v", artifacts)
+	}
+}
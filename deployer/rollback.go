@@ -0,0 +1,83 @@
+package deployer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Rollback collects compensating actions registered by the deployment stages.
+// In case the deployment fails the actions are unwound in reverse order.
+// A nil Rollback is valid and ignores the actions.
+type Rollback struct {
+	sync.Mutex
+	actions []*rollbackAction
+}
+
+type rollbackAction struct {
+	// description of the action
+	desc string
+
+	// the action
+	undo func() error
+}
+
+// Register adds a compensating action.
+// desc describes the action in the rollback report
+func (r *Rollback) Register(desc string, undo func() error) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.actions = append(r.actions, &rollbackAction{desc, undo})
+}
+
+// Unwind runs the registered actions in reverse order.
+// All the actions are run even though some of them fail.
+// Returns the rollback report.
+func (r *Rollback) Unwind() string {
+	if r == nil {
+		return ""
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	buf := new(bytes.Buffer)
+	for i := len(r.actions) - 1; i >= 0; i-- {
+		a := r.actions[i]
+		if err := a.undo(); err != nil {
+			fmt.Fprintf(buf, "%s: failed [%v]\n", a.desc, err)
+		} else {
+			fmt.Fprintf(buf, "%s: done\n", a.desc)
+		}
+	}
+	r.actions = nil
+	return buf.String()
+}
+
+// Discard drops the registered actions (the deployment succeeded)
+func (r *Rollback) Discard() {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.actions = nil
+}
+
+type rollbackKey struct{}
+
+// WithRollback returns a copy of the context carrying the rollback.
+// Builders and post-processors register compensating actions
+// against the rollback found in the context (see RollbackFromContext).
+func WithRollback(ctx context.Context, r *Rollback) context.Context {
+	return context.WithValue(ctx, rollbackKey{}, r)
+}
+
+// RollbackFromContext returns the rollback carried by the context or nil
+func RollbackFromContext(ctx context.Context) *Rollback {
+	r, _ := ctx.Value(rollbackKey{}).(*Rollback)
+	return r
+}
@@ -0,0 +1,66 @@
+package deployer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRollbackUnwind(t *testing.T) {
+	var order []string
+	r := new(Rollback)
+	r.Register("first", func() error {
+		order = append(order, "first")
+		return nil
+	})
+	r.Register("second", func() error {
+		order = append(order, "second")
+		return errors.New("oops")
+	})
+
+	report := r.Unwind()
+	if len(order) != 2 || order[0] != "second" || order[1] != "first" {
+		t.Fatalf("unexpected order %v", order)
+	}
+	if report != "second: failed [oops]\nfirst: done\n" {
+		t.Fatalf("unexpected report %q", report)
+	}
+	if r.Unwind() != "" {
+		t.Fatal("the actions are expected to be dropped")
+	}
+
+	r.Register("discarded", func() error {
+		t.Fatal("discarded action is called")
+		return nil
+	})
+	r.Discard()
+	r.Unwind()
+}
+
+func TestRollbackFromContext(t *testing.T) {
+	if r := RollbackFromContext(context.Background()); r != nil {
+		t.Fatal("expected nil")
+	}
+	// nil rollback ignores the actions
+	var nilRollback *Rollback
+	nilRollback.Register("nothing", nil)
+	if nilRollback.Unwind() != "" {
+		t.Fatal("expected empty report")
+	}
+
+	r := new(Rollback)
+	if RollbackFromContext(WithRollback(context.Background(), r)) != r {
+		t.Fatal("unexpected rollback")
+	}
+}
+
+func TestBuildReturnsSucceededArtifacts(t *testing.T) {
+	artifacts, err := Build(context.Background(), []Builder{&artifactBuilder{"done"}, new(failingBuilder)}, 0)
+	if err == nil || !strings.Contains(err.Error(), "build failed") {
+		t.Fatalf("expected the builder failure, got %v", err)
+	}
+	if len(artifacts) != 1 || artifacts[0].GetName() != "done" {
+		t.Fatalf("unexpected artifacts %v", artifacts)
+	}
+}
@@ -16,3 +16,30 @@ type RootfsFiller interface {
 	// when rootfs postprocessing is required
 	RunHooks(string) error
 }
+
+// CacheableFiller is implemented by fillers whose rootfs customization
+// depends on the given inputs only. The image customized by CustomizeRootfs
+// is cached as a base image and reused by builds having the same inputs
+// (see ImageBuilderData.CacheDir), only InstallApp and RunHooks are applied.
+type CacheableFiller interface {
+	RootfsFiller
+
+	// CacheInputs returns paths to the files and directories
+	// (archives, customization XMLs and so forth) CustomizeRootfs depends on.
+	CacheInputs() []string
+
+	// CacheData returns the data other than the inputs CustomizeRootfs
+	// depends on (the data the templates are rendered with and so forth)
+	// or nil. The data is hashed as JSON.
+	CacheData() interface{}
+}
+
+// ProgressFiller is implemented by fillers reporting the progress
+// of the rootfs customization.
+type ProgressFiller interface {
+	RootfsFiller
+
+	// CustomizeRootfsProgress is similar to CustomizeRootfs.
+	// report is called with the part (0-100) of the customization done.
+	CustomizeRootfsProgress(rootfs string, report func(part int)) error
+}
@@ -0,0 +1,102 @@
+package deployer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/dorzheh/deployer/utils"
+	ssh "github.com/dorzheh/infra/comm/common"
+)
+
+// SignArtifact signs SHA-256 digest of the artifact by the local
+// PEM encoded RSA or ECDSA private key and writes the detached signature
+// to <path>.sig alongside the artifact.
+// The signature is verified by VerifyArtifact or by
+// "openssl dgst -sha256 -verify <public key> -signature <path>.sig <path>".
+// Returns path to the signature.
+func SignArtifact(path string, sshconf *ssh.Config, privateKeyFile string, digest []byte) (string, error) {
+	sig, err := SignDigest(privateKeyFile, digest)
+	if err != nil {
+		return "", utils.FormatError(err)
+	}
+	sigPath := path + ".sig"
+	if err := writeFile(sigPath, sig, sshconf); err != nil {
+		return "", utils.FormatError(err)
+	}
+	return sigPath, nil
+}
+
+// SignDigest signs SHA-256 digest by the PEM encoded RSA (PKCS#1 v1.5)
+// or ECDSA (ASN.1) private key
+func SignDigest(privateKeyFile string, digest []byte) ([]byte, error) {
+	block, err := readPEM(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported private key", privateKeyFile)
+	}
+	return signer.Sign(rand.Reader, digest, crypto.SHA256)
+}
+
+// VerifySignature verifies the signature of SHA-256 digest
+// by the PEM encoded public key
+func VerifySignature(publicKeyFile string, digest, sig []byte) error {
+	block, err := readPEM(publicKeyFile)
+	if err != nil {
+		return err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig); err != nil {
+			return errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		var s struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &s); err != nil || !ecdsa.Verify(key, digest, s.R, s.S) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return fmt.Errorf("%s: unsupported public key", publicKeyFile)
+	}
+	return nil
+}
+
+// readPEM returns the first PEM block of the file
+func readPEM(file string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: PEM data not found", file)
+	}
+	return block, nil
+}
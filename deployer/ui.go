@@ -0,0 +1,99 @@
+package deployer
+
+import (
+	"time"
+
+	"github.com/dorzheh/deployer/utils/progress"
+)
+
+// Navigation errors returned by the UI widgets.
+// The values match the exit codes of the dialog utility
+// since the steps controller relies on them.
+const (
+	UiExit     = "exit status 1"
+	UiMoveBack = "exit status 2"
+	UiNext     = "exit status 3"
+)
+
+// Notification types accepted by UI.Output
+const (
+	UiSuccess      = "Success"
+	UiError        = "Failure"
+	UiWarning      = "Warning"
+	UiNotification = "Notification"
+	UiNone         = ""
+)
+
+// UI is implemented by user interface backends.
+//
+// The widget methods follow the dialog utility semantics:
+// the Set* methods configure the next widget only,
+// the help button is treated as "Back" (returns UiMoveBack error),
+// the extra button returns UiNext error and cancel returns UiExit error.
+type UI interface {
+	// SetTitle sets the title of the next widget
+	SetTitle(title string)
+
+	// SetSize sets height and width of the next widget
+	SetSize(height int, width int)
+
+	// SetLabel sets the text shown by the next widget
+	SetLabel(label string)
+
+	// SetOkLabel sets the label of the "OK" button
+	SetOkLabel(label string)
+
+	// SetExtraLabel enables the extra button and sets its label
+	SetExtraLabel(label string)
+
+	// HelpButton enables the help button
+	HelpButton(truefalse bool)
+
+	// SetHelpLabel sets the label of the help button
+	SetHelpLabel(label string)
+
+	// Msgbox shows a message
+	Msgbox(text string)
+
+	// Textbox shows the file content.
+	// Returns error if the content is not accepted
+	Textbox(filepath string) error
+
+	// Inputbox reads a string
+	Inputbox(value string) (string, error)
+
+	// Menu shows the tag/item pairs and returns the tag selected
+	Menu(menuHeight int, tagItem ...string) (string, error)
+
+	// Mixedform shows a form. Each field is represented by 9 values:
+	// label, y, x, item, y, x, field length, input length, type
+	// (0 - regular, 1 - hidden, 2 - read-only).
+	// Returns the field values
+	Mixedform(title string, insecure bool, tagItemStatus ...string) ([]string, error)
+
+	// Yesno asks a yes/no question
+	Yesno() bool
+
+	// Output shows a notification of a given type.
+	// Terminates the program in case of UiError notification
+	Output(ntype string, msgs ...string)
+
+	// Progress shows the progress reported by the events
+	// until the done channel is written
+	Progress(title, pbMsg string, events <-chan *progress.Event, done chan error) error
+
+	// Wait shows the message until the done channel is written or the timeout is reached
+	Wait(msg string, pause, timeOut time.Duration, done chan error) error
+
+	// GetPathToFileFromInput reads a path to an existing file
+	GetPathToFileFromInput(title, helpButtonLabel, extraButtonLabel string) (string, error)
+
+	// GetPathToDirFromInput reads a path to an existing directory
+	GetPathToDirFromInput(title, defaultDir, helpButtonLabel, extraButtonLabel string) (string, error)
+
+	// GetFromInput reads a non-empty string
+	GetFromInput(title, defaultInput, helpButtonLabel, extraButtonLabel string) (string, error)
+
+	// GetPasswordFromInput reads a password
+	GetPasswordFromInput(host, user, helpButtonLabel, extraButtonLabel string, confirm bool) (string, error)
+}
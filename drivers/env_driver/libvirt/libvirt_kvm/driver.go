@@ -1,6 +1,7 @@
 package libvirt_kvm
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"sync"
@@ -16,8 +17,14 @@ type Driver struct {
 }
 
 func NewDriver(config *ssh.Config) *Driver {
+	return NewDriverWithContext(context.Background(), config)
+}
+
+// NewDriverWithContext creates a driver which commands
+// are interrupted once the context is cancelled
+func NewDriverWithContext(ctx context.Context, config *ssh.Config) *Driver {
 	d := new(Driver)
-	d.Run = utils.RunFunc(config)
+	d.Run = utils.RunFuncWithContext(ctx, config)
 	return d
 }
 
@@ -75,6 +82,16 @@ func (d *Driver) SetAutostart(name string) error {
 	return nil
 }
 
+func (d *Driver) UnsetAutostart(name string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, err := d.Run("virsh autostart --disable " + name); err != nil {
+		return utils.FormatError(err)
+	}
+	return nil
+}
+
 func (d *Driver) DomainExists(name string) bool {
 	d.Lock()
 	defer d.Unlock()
@@ -85,6 +102,32 @@ func (d *Driver) DomainExists(name string) bool {
 	return true
 }
 
+// DomainDisks returns paths to the images attached to the domain as disks
+func (d *Driver) DomainDisks(name string) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	out, err := d.Run("virsh domblklist --details " + name)
+	if err != nil {
+		return nil, utils.FormatError(err)
+	}
+	return parseDomblklist(out), nil
+}
+
+// parseDomblklist looks for the file based disks
+// in the output of "virsh domblklist --details"
+func parseDomblklist(out string) []string {
+	var disks []string
+	for _, line := range strings.Split(out, "\n") {
+		// Type Device Target Source
+		f := strings.Fields(line)
+		if len(f) == 4 && f[0] == "file" && f[1] == "disk" {
+			disks = append(disks, f[3])
+		}
+	}
+	return disks
+}
+
 // Emulator returns appropriate path to QEMU emulator for a given architecture
 func (d *Driver) Emulator(arch string) (string, error) {
 	switch arch {
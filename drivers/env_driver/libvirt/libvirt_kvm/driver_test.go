@@ -37,3 +37,17 @@ func TestAllCPUsPinned(t *testing.T) {
 	}
 	fmt.Printf("AllCPUsPinned result : %v\n", pinned)
 }
+
+func TestParseDomblklist(t *testing.T) {
+	out := ` Type       Device     Target     Source
+------------------------------------------------
+ file       disk       vda        /var/lib/libvirt/images/va.qcow2
+ file       disk       vdb        /var/lib/libvirt/images/va_1.qcow2
+ file       cdrom      hda        -
+ block      disk       vdc        /dev/sdb
+`
+	disks := parseDomblklist(out)
+	if len(disks) != 2 || disks[0] != "/var/lib/libvirt/images/va.qcow2" || disks[1] != "/var/lib/libvirt/images/va_1.qcow2" {
+		t.Fatalf("unexpected disks %v", disks)
+	}
+}
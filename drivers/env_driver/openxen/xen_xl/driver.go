@@ -1,7 +1,9 @@
 package xen_xl
 
 import (
+	"context"
 	"fmt"
+	"regexp"
 	"strings"
 	"sync"
 
@@ -16,8 +18,14 @@ type Driver struct {
 }
 
 func NewDriver(config *ssh.Config) *Driver {
+	return NewDriverWithContext(context.Background(), config)
+}
+
+// NewDriverWithContext creates a driver which commands
+// are interrupted once the context is cancelled
+func NewDriverWithContext(ctx context.Context, config *ssh.Config) *Driver {
 	d := new(Driver)
-	d.Run = utils.RunFunc(config)
+	d.Run = utils.RunFuncWithContext(ctx, config)
 	return d
 }
 
@@ -29,10 +37,15 @@ func (d *Driver) DefineDomain(domainConfig string) error {
 	return nil
 }
 
+// StartDomain starts the domain given either by
+// path to the domain configuration or by name
 func (d *Driver) StartDomain(domainConfig string) error {
 	d.Lock()
 	defer d.Unlock()
 
+	if !strings.Contains(domainConfig, "/") {
+		domainConfig = configFile(domainConfig)
+	}
 	if _, err := d.Run("xl create " + domainConfig); err != nil {
 		return utils.FormatError(err)
 	}
@@ -49,7 +62,14 @@ func (d *Driver) DestroyDomain(name string) error {
 	return nil
 }
 
+// UndefineDomain removes the domain configuration
 func (d *Driver) UndefineDomain(name string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, err := d.Run(fmt.Sprintf("rm -f /etc/xen/auto/%s.cfg %s", name, configFile(name))); err != nil {
+		return utils.FormatError(err)
+	}
 	return nil
 }
 
@@ -63,16 +83,68 @@ func (d *Driver) SetAutostart(name string) error {
 	return nil
 }
 
+func (d *Driver) UnsetAutostart(name string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, err := d.Run(fmt.Sprintf("rm -f /etc/xen/auto/%s.cfg", name)); err != nil {
+		return utils.FormatError(err)
+	}
+	return nil
+}
+
+// DomainExists returns true if the domain is either running or configured
 func (d *Driver) DomainExists(name string) bool {
 	d.Lock()
 	defer d.Unlock()
 
-	if _, err := d.Run("xl list " + name); err != nil {
+	if _, err := d.Run(fmt.Sprintf("xl list %s || ls %s", name, configFile(name))); err != nil {
 		return false
 	}
 	return true
 }
 
+// DomainDisks returns paths to the images listed in the domain configuration
+func (d *Driver) DomainDisks(name string) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	out, err := d.Run("cat " + configFile(name))
+	if err != nil {
+		return nil, utils.FormatError(err)
+	}
+	return parseDisks(out), nil
+}
+
+// parseDisks looks for the file based disks in the "disk" entry
+// of the domain configuration, for example
+// disk = [ 'tap:qcow2:/var/lib/xen/va.qcow2,xvda,w','file:/var/lib/xen/va_1.raw,xvdb,w' ]
+func parseDisks(config string) []string {
+	m := diskEntry.FindStringSubmatch(config)
+	if m == nil {
+		return nil
+	}
+	var disks []string
+	for _, spec := range diskSpec.FindAllStringSubmatch(m[1], -1) {
+		target := strings.Split(spec[1], ",")[0]
+		switch {
+		case strings.HasPrefix(target, "file:"), strings.HasPrefix(target, "tap:"):
+			disks = append(disks, target[strings.LastIndex(target, ":")+1:])
+		}
+	}
+	return disks
+}
+
+var (
+	diskEntry = regexp.MustCompile(`(?m)^\s*disk\s*=\s*\[(.*)\]`)
+	diskSpec  = regexp.MustCompile(`'([^']*)'`)
+)
+
+// configFile returns path to the domain configuration
+func configFile(name string) string {
+	return "/etc/xen/" + name + ".cfg"
+}
+
 func (d *Driver) Emulator(arch string) (string, error) {
 	return "", nil
 }
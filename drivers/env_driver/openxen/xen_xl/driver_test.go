@@ -13,3 +13,17 @@ func TestVersion(t *testing.T) {
 	}
 	fmt.Printf("DEBUG: driver version => %s\n", v)
 }
+
+func TestParseDisks(t *testing.T) {
+	config := `name = 'va'
+memory = 4096
+disk = [ 'tap:qcow2:/var/lib/xen/va.qcow2,xvda,w','file:/var/lib/xen/va_1.raw,xvdb,w','phy:/dev/sdb,xvdc,w' ]
+`
+	disks := parseDisks(config)
+	if len(disks) != 2 || disks[0] != "/var/lib/xen/va.qcow2" || disks[1] != "/var/lib/xen/va_1.raw" {
+		t.Fatalf("unexpected disks %v", disks)
+	}
+	if disks := parseDisks("name = 'va'\n"); disks != nil {
+		t.Fatalf("unexpected disks %v", disks)
+	}
+}
@@ -6,6 +6,7 @@ package common
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -31,9 +32,21 @@ type rootfsFiller struct {
 	pathToApplArchive          string
 	pathToConfigDir            string
 	extractApplImage           bool
+
+	// the deployment data the templates are rendered with
+	templateData *content.TemplateData
+
+	// receives the diffs of the edited files
+	diffLog io.Writer
 }
 
 func (f *rootfsFiller) CustomizeRootfs(pathToRootfsMp string) error {
+	return f.CustomizeRootfsProgress(pathToRootfsMp, func(int) {})
+}
+
+// CustomizeRootfsProgress customizes the rootfs reporting the progress
+// (see deployer.ProgressFiller)
+func (f *rootfsFiller) CustomizeRootfsProgress(pathToRootfsMp string, report func(int)) error {
 	unsquashfs, err := exec.LookPath("unsquashfs")
 	if err != nil {
 		unsquashfs = filepath.Join(f.pathToKitDir, "install/x86_64/bin/unsquashfs")
@@ -51,6 +64,7 @@ func (f *rootfsFiller) CustomizeRootfs(pathToRootfsMp string) error {
 	if err := os.RemoveAll(path); err != nil {
 		return utils.FormatError(err)
 	}
+	report(60)
 	if f.pathToKernelModulesArchive != "" && f.pathToKernelArchive != "" {
 		errCh := make(chan error, 2)
 		defer close(errCh)
@@ -83,16 +97,18 @@ func (f *rootfsFiller) CustomizeRootfs(pathToRootfsMp string) error {
 			return utils.FormatError(err)
 		}
 	}
+	report(75)
 
 	pathToCommonDir := filepath.Join(f.pathToKitDir, "comp/env/common/config")
 	fd, err := os.Stat(pathToCommonDir)
 	if err == nil && fd.IsDir() {
-		if err := content.Customize(pathToRootfsMp, pathToCommonDir); err != nil {
+		if err := content.CustomizeWithData(pathToRootfsMp, pathToCommonDir, f.templateData, f.diffLog); err != nil {
 			return utils.FormatError(err)
 		}
 	}
+	report(90)
 	if f.pathToConfigDir != "" {
-		if err := content.Customize(pathToRootfsMp, f.pathToConfigDir); err != nil {
+		if err := content.CustomizeWithData(pathToRootfsMp, f.pathToConfigDir, f.templateData, f.diffLog); err != nil {
 			return utils.FormatError(err)
 		}
 	}
@@ -110,6 +126,24 @@ func (f *rootfsFiller) InstallApp(pathToRootfsMp string) error {
 	return nil
 }
 
+// CacheInputs returns the archives and the customization XMLs
+// CustomizeRootfs depends on (see deployer.CacheableFiller)
+func (f *rootfsFiller) CacheInputs() []string {
+	return []string{
+		f.pathToRootfsSquashfs,
+		f.pathToKernelArchive,
+		f.pathToKernelModulesArchive,
+		filepath.Join(f.pathToKitDir, "comp/env/common/config"),
+		f.pathToConfigDir,
+	}
+}
+
+// CacheData returns the deployment data the templates are rendered with
+// (see deployer.CacheableFiller)
+func (f *rootfsFiller) CacheData() interface{} {
+	return f.templateData
+}
+
 // RunHooks is responsible for executing hooks before the image is being cleaned up
 func (f *rootfsFiller) RunHooks(pathToRootfsMp string) error {
 	return nil
@@ -126,7 +160,7 @@ func extractApplImage(pathRootMp string) error {
 	return os.Chdir("/")
 }
 
-func ImageFiller(data *deployer.CommonData, configDir string) deployer.RootfsFiller {
+func ImageFiller(data *deployer.CommonData, configDir string, templateData *content.TemplateData) deployer.RootfsFiller {
 	return &rootfsFiller{
 		pathToKitDir:               data.RootDir,
 		pathToRootfsSquashfs:       filepath.Join(data.RootDir, "comp/rootfs.squashfs"),
@@ -135,5 +169,7 @@ func ImageFiller(data *deployer.CommonData, configDir string) deployer.RootfsFil
 		pathToApplArchive:          filepath.Join(data.RootDir, "comp/appl.tgz"),
 		pathToConfigDir:            filepath.Join(data.RootDir, configDir),
 		extractApplImage:           false,
+		templateData:               templateData,
+		diffLog:                    data.DiffLog,
 	}
 }
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 
+	deploy "github.com/dorzheh/deployer"
+	"github.com/dorzheh/deployer/config/answers"
+	"github.com/dorzheh/deployer/config/topology"
 	"github.com/dorzheh/deployer/deployer"
+	libvirtdriver "github.com/dorzheh/deployer/drivers/env_driver/libvirt/libvirt_kvm"
+	xendriver "github.com/dorzheh/deployer/drivers/env_driver/openxen/xen_xl"
 	libvirt_kvm "github.com/dorzheh/deployer/example/myproduct/env/libvirt/kvm"
 	"github.com/dorzheh/deployer/example/myproduct/env/openxen"
 	gui "github.com/dorzheh/deployer/ui"
 	"github.com/dorzheh/deployer/ui/dialog_ui"
+	"github.com/dorzheh/deployer/ui/terminal_ui"
+	ssh "github.com/dorzheh/infra/comm/common"
+	infrautils "github.com/dorzheh/infra/utils"
 	"github.com/dorzheh/infra/utils/archutils"
 )
 
@@ -19,6 +31,15 @@ const arch = "x86_64"
 var (
 	defaultProductName = ""
 	rootDir            = ""
+
+	// directory the base images are cached in (see deployer.CacheableFiller)
+	cacheDir = ""
+
+	// grow the disks to the sizes of the answers file on upgrade
+	grow = false
+
+	// receives the diffs of the files edited in the image
+	diffLog io.Writer
 )
 
 // Initialize the stuff before the main() is executed.
@@ -40,9 +61,78 @@ func init() {
 }
 
 func main() {
-	ui := dialog_ui.NewDialogUi()
-	ui.Shadow(false)
-	ui.SetCancelLabel("Exit")
+	answersFile := flag.String("answers", "", "path to the answers file (unattended deployment)")
+	term := flag.Bool("terminal", false, "line based user interface (serial console)")
+	recordFile := flag.String("record", "", "path to the answers file the configuration is recorded to")
+	planFile := flag.String("plan", "", "write the deployment plan to the file (\"-\" for stdout) instead of deploying")
+	eventsFile := flag.String("events", "", "write the progress events (JSON) to the file (\"-\" for stdout)")
+	diffFile := flag.String("diff", "", "write the unified diffs of the files edited in the image to the file (\"-\" for stdout)")
+	topologyFile := flag.String("topology", "", "path to the topology file (unattended deployment of several appliances)")
+	removeName := flag.String("remove", "", "remove the appliance (requires the answers file)")
+	redeployName := flag.String("redeploy", "", "rebuild the disks of the appliance (requires the answers file)")
+	upgradeName := flag.String("upgrade", "", "upgrade the application of the appliance (requires the answers file)")
+	flag.StringVar(&cacheDir, "cache", "", "directory the base images are cached in (incremental builds)")
+	flag.BoolVar(&grow, "grow", false, "grow the disks to the sizes of the answers file (with -upgrade)")
+	cleanup := flag.Bool("cleanup", false, "release the loop devices, mounts and temporary directories left behind by a killed deployment")
+	force := flag.Bool("force", false, "release the leftovers of other hosts as well (with -cleanup)")
+	flag.Parse()
+
+	plan, err := openOutput(*planFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	events, err := openOutput(*eventsFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	diff, err := openOutput(*diffFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if diff != nil {
+		diffLog = diff
+	}
+
+	if *cleanup {
+		os.Exit(cleanupStale(*answersFile, plan, *force))
+	}
+
+	action, name := deployer.ActionInstall, ""
+	switch {
+	case *removeName != "":
+		action, name = deployer.ActionRemove, *removeName
+	case *redeployName != "":
+		action, name = deployer.ActionRedeploy, *redeployName
+	case *upgradeName != "":
+		action, name = deployer.ActionUpgrade, *upgradeName
+	}
+	if action != deployer.ActionInstall {
+		if *answersFile == "" {
+			fmt.Fprintf(os.Stderr, "Error: the answers file is required to %s the appliance\n", action)
+			os.Exit(1)
+		}
+		os.Exit(lifecycle(action, name, *answersFile, plan, events))
+	}
+	if *topologyFile != "" {
+		os.Exit(unattendedTopology(*topologyFile, plan, events))
+	}
+	if *answersFile != "" {
+		os.Exit(unattended(*answersFile, plan, events))
+	}
+
+	var ui deployer.UI
+	if *term {
+		ui = terminal_ui.NewTerminalUi()
+	} else {
+		dui := dialog_ui.NewDialogUi()
+		dui.Shadow(false)
+		dui.SetCancelLabel("Exit")
+		ui = dui
+	}
 	gui.UiValidateUser(ui, 0)
 	gui.UiWelcomeMsg(ui, defaultProductName)
 	gui.UiEulaMsg(ui, filepath.Join(rootDir, ".EULA"))
@@ -53,13 +143,282 @@ func main() {
 		VaName:           defaultProductName,
 		Arch:             arch,
 		Ui:               ui,
+		RecordFile:       *recordFile,
+		CacheDir:         cacheDir,
+		DiffLog:          diffLog,
+	}
+	msg := data.VaName + " installation completed successfully"
+	if events != nil {
+		data.EventLog = events
+	}
+	if *planFile != "" {
+		data.Plan = plan
+		msg = data.VaName + " deployment plan is written to " + *planFile
 	}
 
 	if err := archutils.Extract(filepath.Join(rootDir, "comp/env.tgz"), filepath.Join(rootDir, "comp")); err != nil {
 		ui.Output(dialog_ui.Error, err.Error())
 	}
 
-	gui.UiDeploymentResult(ui, data.VaName+" installation completed successfully",
+	gui.UiDeploymentResult(ui, msg,
 		gui.UiSelectEnv(data, []string{"Libvirt(KVM)", "OpenXen"},
 			[]deployer.FlowCreator{new(libvirt_kvm.FlowCreator), new(openxen.FlowCreator)}))
 }
+
+// unattended runs the deployment without user interaction
+func unattended(answersFile string, plan, events *os.File) int {
+	if err := infrautils.ValidateUserID(0); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	a, err := parseAnswers(answersFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	data := &deployer.CommonData{
+		RootDir:          rootDir,
+		RootfsMp:         filepath.Join(rootDir, "rootfs_mnt"),
+		DefaultExportDir: rootDir,
+		VaName:           defaultProductName,
+		Arch:             arch,
+		Answers:          a,
+		CacheDir:         cacheDir,
+		DiffLog:          diffLog,
+	}
+	if plan != nil {
+		data.Plan = plan
+	}
+	if events != nil {
+		data.EventLog = events
+	}
+
+	if err := archutils.Extract(filepath.Join(rootDir, "comp/env.tgz"), filepath.Join(rootDir, "comp")); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	err = gui.UiSelectEnv(data, []string{"Libvirt(KVM)", "OpenXen"},
+		[]deployer.FlowCreator{new(libvirt_kvm.FlowCreator), new(openxen.FlowCreator)})
+	for _, w := range a.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if plan == nil {
+		fmt.Println(data.VaName + " installation completed successfully")
+	}
+	return 0
+}
+
+// unattendedTopology deploys the appliances described by the topology file
+// without user interaction
+func unattendedTopology(topologyFile string, plan, events *os.File) int {
+	if err := infrautils.ValidateUserID(0); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	t, err := topology.ParseFile(topologyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if t.Common == nil {
+		t.Common = new(answers.Answers)
+	}
+	if err := gui.AnswerSshPassword(terminal_ui.NewTerminalUi(), t.Common); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	var newFlow deploy.FlowFactory
+	switch t.Common.Environment {
+	case "", "Libvirt(KVM)":
+		newFlow = func(*topology.Appliance) (deployer.FlowCreator, error) {
+			return new(libvirt_kvm.FlowCreator), nil
+		}
+	case "OpenXen":
+		newFlow = func(*topology.Appliance) (deployer.FlowCreator, error) {
+			return new(openxen.FlowCreator), nil
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unexpected environment \"%s\"\n", t.Common.Environment)
+		return 1
+	}
+
+	data := &deployer.CommonData{
+		RootDir:          rootDir,
+		RootfsMp:         filepath.Join(rootDir, "rootfs_mnt"),
+		DefaultExportDir: rootDir,
+		VaName:           defaultProductName,
+		Arch:             arch,
+		Answers:          t.Common,
+		CacheDir:         cacheDir,
+		DiffLog:          diffLog,
+	}
+	if plan != nil {
+		data.Plan = plan
+	}
+	if events != nil {
+		data.EventLog = events
+	}
+
+	if err := archutils.Extract(filepath.Join(rootDir, "comp/env.tgz"), filepath.Join(rootDir, "comp")); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	err = deploy.DeployTopology(context.Background(), data, t, newFlow)
+	for _, w := range t.Common.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if plan == nil {
+		fmt.Println(data.VaName + " installation completed successfully")
+	}
+	return 0
+}
+
+// lifecycle applies the action to the existing appliance without user interaction
+func lifecycle(action deployer.Action, name, answersFile string, plan, events *os.File) int {
+	if err := infrautils.ValidateUserID(0); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	a, err := parseAnswers(answersFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	data := &deployer.CommonData{
+		RootDir:          rootDir,
+		RootfsMp:         filepath.Join(rootDir, "rootfs_mnt"),
+		DefaultExportDir: rootDir,
+		VaName:           name,
+		Arch:             arch,
+		Answers:          a,
+		CacheDir:         cacheDir,
+		DiffLog:          diffLog,
+		Grow:             grow,
+	}
+	if plan != nil {
+		data.Plan = plan
+	}
+	if events != nil {
+		data.EventLog = events
+	}
+
+	var flow deployer.LifecycleFlowCreator
+	var driver deployer.EnvDriver
+	var sshconf *ssh.Config
+	if a.RemoteMode {
+		if sshconf, err = a.Ssh.Config(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+	switch a.Environment {
+	case "", "Libvirt(KVM)":
+		flow = new(libvirt_kvm.FlowCreator)
+		driver = libvirtdriver.NewDriver(sshconf)
+	case "OpenXen":
+		flow = new(openxen.FlowCreator)
+		driver = xendriver.NewDriver(sshconf)
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unexpected environment \"%s\"\n", a.Environment)
+		return 1
+	}
+
+	if action != deployer.ActionRemove {
+		if err := archutils.Extract(filepath.Join(rootDir, "comp/env.tgz"), filepath.Join(rootDir, "comp")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	switch action {
+	case deployer.ActionRemove:
+		err = deploy.Remove(data, driver, sshconf, name)
+	case deployer.ActionRedeploy:
+		err = deploy.Redeploy(context.Background(), data, flow, name)
+	case deployer.ActionUpgrade:
+		err = deploy.Upgrade(context.Background(), data, flow, name)
+	}
+	for _, w := range a.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if plan == nil {
+		fmt.Printf("%s %s completed successfully\n", name, action)
+	}
+	return 0
+}
+
+// cleanupStale releases the leftovers of the killed deployments locally
+// and on the remote host of the answers file (if any)
+func cleanupStale(answersFile string, plan *os.File, force bool) int {
+	if err := infrautils.ValidateUserID(0); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	data := &deployer.CommonData{}
+	if plan != nil {
+		data.Plan = plan
+	}
+	var sshconf *ssh.Config
+	if answersFile != "" {
+		a, err := parseAnswers(answersFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		if a.RemoteMode {
+			if sshconf, err = a.Ssh.Config(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return 1
+			}
+		}
+	}
+	released, err := deploy.Cleanup(data, sshconf, force)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if plan == nil {
+		fmt.Printf("cleanup completed, %d journal(s) released\n", released)
+	}
+	return 0
+}
+
+// parseAnswers parses the answers file and asks the SSH password
+// the recorded answers lack (see answers.Ssh.AskPassword)
+func parseAnswers(answersFile string) (*answers.Answers, error) {
+	a, err := answers.ParseFile(answersFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := gui.AnswerSshPassword(terminal_ui.NewTerminalUi(), a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// openOutput opens the file the output (plan, events) is written to.
+// Returns nil if no path is given
+func openOutput(path string) (*os.File, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
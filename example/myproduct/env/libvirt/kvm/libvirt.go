@@ -15,6 +15,7 @@ import (
 	"github.com/dorzheh/deployer/deployer"
 	"github.com/dorzheh/deployer/example/myproduct/common"
 	libvirtpost "github.com/dorzheh/deployer/post_processor/libvirt/libvirt_kvm"
+	ssh "github.com/dorzheh/infra/comm/common"
 	"github.com/dorzheh/infra/comm/sshfs"
 )
 
@@ -60,14 +61,6 @@ func (c *FlowCreator) CreateConfig(d *deployer.CommonData) error {
 	if err := controller.RunSteps(); err != nil {
 		return err
 	}
-
-	d.Ui.Pb.SetSleep("10s")
-	d.Ui.Pb.SetStep(10)
-
-	if c.config.RemoteMode {
-		d.Ui.Pb.IncreaseSleep("5s")
-		d.Ui.Pb.DecreaseStep(4)
-	}
 	return nil
 }
 
@@ -84,13 +77,23 @@ func (c *FlowCreator) CreateBuilders(d *deployer.CommonData) (b []deployer.Build
 	util := &image.Utils{
 		Kpartx: filepath.Join(d.RootDir, "install", d.Arch, "bin/kpartx"),
 	}
+	var images []deployer.Builder
 	for _, disk := range c.config.StorageConfig.Configs[0].Disks {
 		imageData := &deployer.ImageBuilderData{
 			ImageConfig: disk,
 			RootfsMp:    d.RootfsMp,
-			Filler:      common.ImageFiller(d, mainConfig["config_dir"]),
+			Filler:      common.ImageFiller(d, mainConfig["config_dir"], c.config.TemplateData()),
+			Upgrade:     d.Action == deployer.ActionUpgrade,
+			Grow:        d.Grow,
+			SigningKey:  d.SigningKey,
+			CacheDir:    d.CacheDir,
 		}
-		b = append(b, &builder.ImageBuilder{imageData, sshfsConf, util})
+		var ib deployer.Builder = &builder.ImageBuilder{imageData, sshfsConf, util}
+		// the disks share the rootfs mount point
+		if len(images) > 0 {
+			ib = deployer.After(ib, images[len(images)-1])
+		}
+		images = append(images, ib)
 	}
 
 	metaData := &deployer.MetadataBuilderData{
@@ -99,13 +102,16 @@ func (c *FlowCreator) CreateBuilders(d *deployer.CommonData) (b []deployer.Build
 		UserData: c.config.Metadata,
 	}
 
-	b = append(b, &builder.MetadataBuilder{metaData, c.config.SshConfig})
+	// the metadata refers to the final image paths
+	b = append(images, deployer.After(&builder.MetadataBuilder{metaData, c.config.SshConfig}, images...))
 	return
 }
 
 func (c *FlowCreator) CreatePostProcessor(d *deployer.CommonData) (p deployer.PostProcessor, err error) {
-	d.Ui.Pb.SetSleep("1s")
-	d.Ui.Pb.SetStep(50)
 	p = libvirtpost.NewPostProcessor(c.config.SshConfig, false)
 	return
 }
+
+func (c *FlowCreator) Target() (deployer.EnvDriver, *ssh.Config) {
+	return c.config.EnvDriver, c.config.SshConfig
+}
@@ -0,0 +1,233 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/dorzheh/deployer/deployer"
+	"github.com/dorzheh/deployer/utils"
+	ssh "github.com/dorzheh/infra/comm/common"
+)
+
+// Remove removes an existing appliance.
+// The domain is destroyed and undefined and the images attached to the domain
+// are removed either locally or on the remote host (see sshconf).
+// In plan mode (see CommonData.Plan) the actions are only described.
+func Remove(c *deployer.CommonData, driver deployer.EnvDriver, sshconf *ssh.Config, name string) error {
+	c.Action = deployer.ActionRemove
+	if !driver.DomainExists(name) {
+		return utils.FormatError(fmt.Errorf("domain %s doesn't exist", name))
+	}
+	disks, err := driver.DomainDisks(name)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+
+	if c.Plan != nil {
+		fmt.Fprintf(c.Plan, "destroy domain %s\n", name)
+		fmt.Fprintf(c.Plan, "undefine domain %s\n", name)
+		for _, disk := range disks {
+			fmt.Fprintf(c.Plan, "remove %s\n", disk)
+		}
+		return nil
+	}
+
+	// the domain might be shut off already
+	driver.DestroyDomain(name)
+	if err := driver.UndefineDomain(name); err != nil {
+		return utils.FormatError(err)
+	}
+	if err := removeImages(disks, sshconf); err != nil {
+		return utils.FormatError(err)
+	}
+	return nil
+}
+
+// Redeploy rebuilds the disks of an existing appliance.
+// The domain definition (name, networks and so forth) is kept:
+// the domain is stopped, the images are moved aside and built again
+// by the flow builders, then the domain is started and the old images
+// are removed. The images must be attached to the domain.
+// In case of failure the old images are restored and the domain is started again.
+func Redeploy(ctx context.Context, c *deployer.CommonData, f deployer.LifecycleFlowCreator, name string) error {
+	return processExisting(ctx, c, f, name, deployer.ActionRedeploy)
+}
+
+// Upgrade reinstalls the application on the existing disks of an appliance
+// (see deployer.ImageBuilderData.Upgrade).
+// The domain is stopped during the upgrade and started once done.
+// The images must be attached to the domain.
+// In case of failure the domain is started again on the intact images
+// unless a RAW image is attached: the RAW images are upgraded in place,
+// therefore the domain is left stopped.
+func Upgrade(ctx context.Context, c *deployer.CommonData, f deployer.LifecycleFlowCreator, name string) error {
+	return processExisting(ctx, c, f, name, deployer.ActionUpgrade)
+}
+
+// processExisting applies either the redeploy or the upgrade action
+// to the existing appliance
+func processExisting(ctx context.Context, c *deployer.CommonData, f deployer.LifecycleFlowCreator, name string, action deployer.Action) (err error) {
+	c.Action = action
+	c.VaName = name
+	if c.Rollback == nil {
+		c.Rollback = new(deployer.Rollback)
+	}
+	defer unwindOnError(c, &err)
+
+	if err := f.CreateConfig(c); err != nil {
+		return utils.FormatError(err)
+	}
+	builders, err := f.CreateBuilders(c)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	driver, sshconf := f.Target()
+	images, err := domainImages(driver, c.VaName, builders)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+
+	if c.Plan != nil {
+		fmt.Fprintf(c.Plan, "destroy domain %s\n", c.VaName)
+		if action == deployer.ActionRedeploy {
+			for _, image := range images {
+				fmt.Fprintf(c.Plan, "mv %s %s\n", image, oldImage(image))
+			}
+		}
+		if _, err := deployer.PlanBuild(c.Plan, builders); err != nil {
+			return utils.FormatError(err)
+		}
+		fmt.Fprintf(c.Plan, "start domain %s\n", c.VaName)
+		if action == deployer.ActionRedeploy {
+			for _, image := range images {
+				fmt.Fprintf(c.Plan, "remove %s\n", oldImage(image))
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := cancelOnInterrupt(ctx)
+	defer cancel()
+	ctx = deployer.WithRollback(ctx, c.Rollback)
+
+	// the domain might be shut off already
+	driver.DestroyDomain(c.VaName)
+	if action == deployer.ActionRedeploy || !upgradedInPlace(images) {
+		domain := c.VaName
+		c.Rollback.Register("start domain "+domain, func() error {
+			return driver.StartDomain(domain)
+		})
+	}
+	if action == deployer.ActionRedeploy {
+		if err := moveImagesAside(c.Rollback, images, sshconf); err != nil {
+			return utils.FormatError(err)
+		}
+	}
+
+	artifacts, err := deployer.BuildProgress(ctx, c, builders)
+	// the domain definition is kept therefore the metadata is not needed
+	for _, a := range artifacts {
+		if a.GetType() == deployer.MetadataArtifact {
+			a.Destroy()
+		}
+	}
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	if err := writeManifest(c, artifacts); err != nil {
+		return utils.FormatError(err)
+	}
+	if err := driver.StartDomain(c.VaName); err != nil {
+		return utils.FormatError(err)
+	}
+	if action == deployer.ActionRedeploy {
+		// the new images are in use, the old ones are never restored
+		c.Rollback.Discard()
+		var old []string
+		for _, image := range images {
+			old = append(old, oldImage(image))
+		}
+		if err := removeImages(old, sshconf); err != nil {
+			return utils.FormatError(err)
+		}
+	}
+	return nil
+}
+
+// domainImages returns paths to the images the builders would create.
+// An error is returned if an image is not attached to the domain.
+func domainImages(driver deployer.EnvDriver, domain string, builders []deployer.Builder) ([]string, error) {
+	disks, err := driver.DomainDisks(domain)
+	if err != nil {
+		return nil, err
+	}
+	attached := make(map[string]bool)
+	for _, disk := range disks {
+		attached[disk] = true
+	}
+
+	planned, err := deployer.PlanBuild(ioutil.Discard, builders)
+	if err != nil {
+		return nil, err
+	}
+	var images []string
+	for _, a := range planned {
+		if a.GetType() != deployer.ImageArtifact {
+			continue
+		}
+		if !attached[a.GetPath()] {
+			return nil, fmt.Errorf("image %s is not attached to domain %s", a.GetPath(), domain)
+		}
+		images = append(images, a.GetPath())
+	}
+	return images, nil
+}
+
+// upgradedInPlace returns true if any of the images is RAW.
+// Other images are processed as temporary RAW copies
+// and replaced only once upgraded (see image.Open)
+func upgradedInPlace(images []string) bool {
+	for _, image := range images {
+		if strings.HasSuffix(image, ".raw") {
+			return true
+		}
+	}
+	return false
+}
+
+// oldImage returns path the image is moved aside to during redeployment
+func oldImage(image string) string {
+	return image + ".old"
+}
+
+// moveImagesAside moves the images aside either locally or on the remote host
+// and registers the actions restoring them
+func moveImagesAside(r *deployer.Rollback, images []string, sshconf *ssh.Config) error {
+	run := utils.RunFunc(sshconf)
+	for _, image := range images {
+		if out, err := run(fmt.Sprintf("mv -f %s %s", image, oldImage(image))); err != nil {
+			return fmt.Errorf("%s [%v]", out, err)
+		}
+		image := image
+		r.Register("restore "+image, func() error {
+			if out, err := run(fmt.Sprintf("mv -f %s %s", oldImage(image), image)); err != nil {
+				return fmt.Errorf("%s [%v]", out, err)
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// removeImages removes the images either locally or on the remote host
+func removeImages(images []string, sshconf *ssh.Config) error {
+	for _, image := range images {
+		a := &deployer.CommonArtifact{Path: image, SshConfig: sshconf}
+		if err := a.Destroy(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
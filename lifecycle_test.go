@@ -0,0 +1,199 @@
+package deployer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dorzheh/deployer/deployer"
+	ssh "github.com/dorzheh/infra/comm/common"
+)
+
+// fakeDriver records the domain operations
+type fakeDriver struct {
+	j     *journal
+	disks []string
+}
+
+func (d *fakeDriver) Id() string                           { return "fakeDriver" }
+func (d *fakeDriver) DefineDomain(string) error            { return nil }
+func (d *fakeDriver) SetAutostart(string) error            { return nil }
+func (d *fakeDriver) UnsetAutostart(string) error          { return nil }
+func (d *fakeDriver) DomainExists(string) bool             { return true }
+func (d *fakeDriver) Emulator(string) (string, error)      { return "", nil }
+func (d *fakeDriver) Version() (string, error)             { return "", nil }
+func (d *fakeDriver) MaxVCPUsPerGuest() int                { return 1 }
+func (d *fakeDriver) AllCPUsPinned() (bool, error)         { return true, nil }
+func (d *fakeDriver) DomainDisks(string) ([]string, error) { return d.disks, nil }
+
+func (d *fakeDriver) StartDomain(name string) error {
+	d.j.add("start %s", name)
+	return nil
+}
+
+func (d *fakeDriver) DestroyDomain(name string) error {
+	d.j.add("destroy %s", name)
+	return nil
+}
+
+func (d *fakeDriver) UndefineDomain(name string) error {
+	d.j.add("undefine %s", name)
+	return nil
+}
+
+// fakeLifecycleFlow builds a single image
+type fakeLifecycleFlow struct {
+	j      *journal
+	driver *fakeDriver
+	image  string
+	action deployer.Action
+
+	// the build fails if set
+	fail bool
+}
+
+func (f *fakeLifecycleFlow) CreateConfig(d *deployer.CommonData) error {
+	f.action = d.Action
+	return nil
+}
+
+func (f *fakeLifecycleFlow) CreateBuilders(d *deployer.CommonData) ([]deployer.Builder, error) {
+	return []deployer.Builder{&imageBuilder{f.j, f.image, f.fail}}, nil
+}
+
+func (f *fakeLifecycleFlow) CreatePostProcessor(d *deployer.CommonData) (deployer.PostProcessor, error) {
+	return nil, nil
+}
+
+func (f *fakeLifecycleFlow) Target() (deployer.EnvDriver, *ssh.Config) {
+	return f.driver, nil
+}
+
+type imageBuilder struct {
+	j    *journal
+	path string
+	fail bool
+}
+
+func (b *imageBuilder) Id() string {
+	return "imageBuilder"
+}
+
+func (b *imageBuilder) Run(ctx context.Context) (deployer.Artifact, error) {
+	b.j.add("build %s", b.path)
+	if b.fail {
+		return nil, errors.New("build failed")
+	}
+	return &deployer.CommonArtifact{Path: b.path, Type: deployer.ImageArtifact}, nil
+}
+
+func (b *imageBuilder) Plan(w io.Writer) (deployer.Artifact, error) {
+	return &deployer.PlannedArtifact{
+		CommonArtifact: deployer.CommonArtifact{Path: b.path, Type: deployer.ImageArtifact},
+	}, nil
+}
+
+func tempImage(t *testing.T) string {
+	f, err := ioutil.TempFile("", "deployer_image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return f.Name()
+}
+
+func TestRemove(t *testing.T) {
+	image := tempImage(t)
+	defer os.Remove(image)
+
+	j := new(journal)
+	driver := &fakeDriver{j, []string{image}}
+	if err := Remove(new(deployer.CommonData), driver, nil, "va"); err != nil {
+		t.Fatal(err)
+	}
+	if entries := strings.Join(j.entries, ","); entries != "destroy va,undefine va" {
+		t.Fatalf("unexpected actions %s", entries)
+	}
+	if _, err := os.Stat(image); !os.IsNotExist(err) {
+		t.Fatal("the image is not removed")
+	}
+}
+
+func TestRedeploy(t *testing.T) {
+	image := tempImage(t)
+	defer os.Remove(image)
+
+	j := new(journal)
+	f := &fakeLifecycleFlow{j: j, driver: &fakeDriver{j, []string{image}}, image: image}
+	if err := Redeploy(context.Background(), new(deployer.CommonData), f, "va"); err != nil {
+		t.Fatal(err)
+	}
+	if f.action != deployer.ActionRedeploy {
+		t.Fatalf("unexpected action %s", f.action)
+	}
+	if entries := strings.Join(j.entries, ","); entries != "destroy va,build "+image+",start va" {
+		t.Fatalf("unexpected actions %s", entries)
+	}
+	// the builder is fake therefore the removed image is not created again
+	if _, err := os.Stat(image); !os.IsNotExist(err) {
+		t.Fatal("the image is not removed before the build")
+	}
+	if _, err := os.Stat(image + ".old"); !os.IsNotExist(err) {
+		t.Fatal("the old image is not removed")
+	}
+}
+
+func TestRedeployFailure(t *testing.T) {
+	image := tempImage(t)
+	defer os.Remove(image)
+
+	j := new(journal)
+	f := &fakeLifecycleFlow{j: j, driver: &fakeDriver{j, []string{image}}, image: image, fail: true}
+	if err := Redeploy(context.Background(), new(deployer.CommonData), f, "va"); err == nil {
+		t.Fatal("build failed, expected error")
+	}
+	if entries := strings.Join(j.entries, ","); entries != "destroy va,build "+image+",start va" {
+		t.Fatalf("unexpected actions %s", entries)
+	}
+	// the domain is started on the old image
+	if _, err := os.Stat(image); err != nil {
+		t.Fatalf("the image is not restored [%v]", err)
+	}
+	if _, err := os.Stat(image + ".old"); !os.IsNotExist(err) {
+		t.Fatal("the old image is kept aside")
+	}
+}
+
+func TestUpgradeImageNotAttached(t *testing.T) {
+	j := new(journal)
+	f := &fakeLifecycleFlow{j: j, driver: &fakeDriver{j, []string{"/images/va.qcow2"}}, image: "/images/other.qcow2"}
+	err := Upgrade(context.Background(), new(deployer.CommonData), f, "va")
+	if err == nil || !strings.Contains(err.Error(), "is not attached to domain va") {
+		t.Fatalf("expected error, got %v", err)
+	}
+	if len(j.entries) != 0 {
+		t.Fatalf("unexpected actions %s", strings.Join(j.entries, ","))
+	}
+}
+
+func TestUpgradeFailure(t *testing.T) {
+	for image, expected := range map[string]string{
+		// the original image is kept therefore the domain is started again
+		"/images/va.qcow2": "destroy va,build /images/va.qcow2,start va",
+		// the image is upgraded in place
+		"/images/va.raw": "destroy va,build /images/va.raw",
+	} {
+		j := new(journal)
+		f := &fakeLifecycleFlow{j: j, driver: &fakeDriver{j, []string{image}}, image: image, fail: true}
+		if err := Upgrade(context.Background(), new(deployer.CommonData), f, "va"); err == nil {
+			t.Fatalf("%s: build failed, expected error", image)
+		}
+		if entries := strings.Join(j.entries, ","); entries != expected {
+			t.Fatalf("%s: unexpected actions %s", image, entries)
+		}
+	}
+}
@@ -1,53 +1,71 @@
 package libvirt_kvm
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"regexp"
 
 	"github.com/dorzheh/deployer/deployer"
 	"github.com/dorzheh/deployer/drivers/env_driver/libvirt/libvirt_kvm"
 	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/progress"
 	ssh "github.com/dorzheh/infra/comm/common"
 )
 
 type PostProcessor struct {
-	driver      *libvirt_kvm.Driver
+	sshconf     *ssh.Config
 	startDomain bool
 }
 
 func NewPostProcessor(sshconf *ssh.Config, startDomain bool) *PostProcessor {
 	p := new(PostProcessor)
-	p.driver = libvirt_kvm.NewDriver(sshconf)
+	p.sshconf = sshconf
 	p.startDomain = startDomain
 	return p
 }
 
-func (p *PostProcessor) PostProcess(artifacts []deployer.Artifact) error {
+func (p *PostProcessor) PostProcess(ctx context.Context, artifacts []deployer.Artifact) error {
+	driver := libvirt_kvm.NewDriverWithContext(ctx, p.sshconf)
+	// compensating actions are not bound to the context
+	undo := libvirt_kvm.NewDriver(p.sshconf)
+	rollback := deployer.RollbackFromContext(ctx)
 	for _, a := range artifacts {
 		switch a.(type) {
 		case *deployer.CommonArtifact:
 			if a.GetType() == deployer.MetadataArtifact {
-				if err := p.driver.DefineDomain(a.GetPath()); err != nil {
+				out, err := driver.Run("cat " + a.GetPath())
+				if err != nil {
 					return utils.FormatError(err)
 				}
 
-				out, err := p.driver.Run("cat " + a.GetPath())
+				domain, err := domainName(out)
 				if err != nil {
 					return utils.FormatError(err)
 				}
-
-				r, err := regexp.Compile(`<name>\s*(\S+)\s*</name>`)
-				if err != nil {
+				progress.Report(ctx, progress.StageDefine, 0)
+				if err := driver.DefineDomain(a.GetPath()); err != nil {
 					return utils.FormatError(err)
 				}
-
-				domain := r.FindStringSubmatch(out)[1]
-				if err := p.driver.SetAutostart(domain); err != nil {
+				rollback.Register("undefine domain "+domain, func() error {
+					return undo.UndefineDomain(domain)
+				})
+				progress.Report(ctx, progress.StageAutostart, 40)
+				if err := driver.SetAutostart(domain); err != nil {
 					return utils.FormatError(err)
 				}
+				rollback.Register("disable autostart of domain "+domain, func() error {
+					return undo.UnsetAutostart(domain)
+				})
 				if p.startDomain {
-					if err := p.driver.StartDomain(domain); err != nil {
+					progress.Report(ctx, progress.StageStartDomain, 70)
+					if err := driver.StartDomain(domain); err != nil {
 						return utils.FormatError(err)
 					}
+					rollback.Register("destroy domain "+domain, func() error {
+						return undo.DestroyDomain(domain)
+					})
 				}
 				if err := a.Destroy(); err != nil {
 					return utils.FormatError(err)
@@ -57,3 +75,35 @@ func (p *PostProcessor) PostProcess(artifacts []deployer.Artifact) error {
 	}
 	return nil
 }
+
+// PlanPostProcess writes the commands PostProcess would run
+func (p *PostProcessor) PlanPostProcess(w io.Writer, artifacts []deployer.Artifact) error {
+	for _, a := range artifacts {
+		if planned, ok := a.(*deployer.PlannedArtifact); ok && a.GetType() == deployer.MetadataArtifact {
+			domain, err := domainName(planned.Data)
+			if err != nil {
+				return utils.FormatError(err)
+			}
+			fmt.Fprintf(w, "virsh define %s\n", a.GetPath())
+			fmt.Fprintf(w, "virsh autostart %s\n", domain)
+			if p.startDomain {
+				fmt.Fprintf(w, "virsh start %s\n", domain)
+			}
+			fmt.Fprintf(w, "rm %s\n", a.GetPath())
+		}
+	}
+	return nil
+}
+
+// domainName looks for the domain name in the domain XML
+func domainName(data string) (string, error) {
+	r, err := regexp.Compile(`<name>\s*(\S+)\s*</name>`)
+	if err != nil {
+		return "", err
+	}
+	m := r.FindStringSubmatch(data)
+	if m == nil {
+		return "", errors.New("domain name not found")
+	}
+	return m[1], nil
+}
@@ -1,53 +1,73 @@
 package xen_xl
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"regexp"
 
 	"github.com/dorzheh/deployer/deployer"
 	"github.com/dorzheh/deployer/drivers/env_driver/openxen/xen_xl"
 	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/progress"
 	ssh "github.com/dorzheh/infra/comm/common"
 )
 
 type PostProcessor struct {
-	driver      *xen_xl.Driver
+	sshconf     *ssh.Config
 	startDomain bool
 }
 
 func NewPostProcessor(sshconf *ssh.Config, startDomain bool) *PostProcessor {
 	p := new(PostProcessor)
-	p.driver = xen_xl.NewDriver(sshconf)
+	p.sshconf = sshconf
 	p.startDomain = startDomain
 	return p
 }
 
-func (p *PostProcessor) PostProcess(artifacts []deployer.Artifact) error {
+func (p *PostProcessor) PostProcess(ctx context.Context, artifacts []deployer.Artifact) error {
+	driver := xen_xl.NewDriverWithContext(ctx, p.sshconf)
+	// compensating actions are not bound to the context
+	undo := xen_xl.NewDriver(p.sshconf)
+	rollback := deployer.RollbackFromContext(ctx)
 	for _, a := range artifacts {
 		switch a.(type) {
 		case *deployer.CommonArtifact:
 			if a.GetType() == deployer.MetadataArtifact {
-				out, err := p.driver.Run("cat " + a.GetPath())
+				out, err := driver.Run("cat " + a.GetPath())
 				if err != nil {
 					return utils.FormatError(err)
 				}
 
-				r, err := regexp.Compile(`\s*name\s*=\s*(\S+)`)
+				domain, err := domainName(out)
 				if err != nil {
 					return utils.FormatError(err)
 				}
-
-				domain := r.FindStringSubmatch(out)[1]
 				configFile := "/etc/xen/" + domain + ".cfg"
-				if _, err := p.driver.Run("mkdir -p /etc/xen/auto;cp " + a.GetPath() + " " + configFile); err != nil {
+				progress.Report(ctx, progress.StageDefine, 0)
+				if _, err := driver.Run("mkdir -p /etc/xen/auto;cp " + a.GetPath() + " " + configFile); err != nil {
 					return utils.FormatError(err)
 				}
-				if err := p.driver.SetAutostart(domain); err != nil {
+				rollback.Register("remove "+configFile, func() error {
+					_, err := undo.Run("rm -f " + configFile)
+					return err
+				})
+				progress.Report(ctx, progress.StageAutostart, 40)
+				if err := driver.SetAutostart(domain); err != nil {
 					return utils.FormatError(err)
 				}
+				rollback.Register("disable autostart of domain "+domain, func() error {
+					return undo.UnsetAutostart(domain)
+				})
 				if p.startDomain {
-					if err := p.driver.StartDomain(configFile); err != nil {
+					progress.Report(ctx, progress.StageStartDomain, 70)
+					if err := driver.StartDomain(configFile); err != nil {
 						return utils.FormatError(err)
 					}
+					rollback.Register("destroy domain "+domain, func() error {
+						return undo.DestroyDomain(domain)
+					})
 				}
 				if err := a.Destroy(); err != nil {
 					return utils.FormatError(err)
@@ -57,3 +77,36 @@ func (p *PostProcessor) PostProcess(artifacts []deployer.Artifact) error {
 	}
 	return nil
 }
+
+// PlanPostProcess writes the commands PostProcess would run
+func (p *PostProcessor) PlanPostProcess(w io.Writer, artifacts []deployer.Artifact) error {
+	for _, a := range artifacts {
+		if planned, ok := a.(*deployer.PlannedArtifact); ok && a.GetType() == deployer.MetadataArtifact {
+			domain, err := domainName(planned.Data)
+			if err != nil {
+				return utils.FormatError(err)
+			}
+			configFile := "/etc/xen/" + domain + ".cfg"
+			fmt.Fprintf(w, "mkdir -p /etc/xen/auto;cp %s %s\n", a.GetPath(), configFile)
+			fmt.Fprintf(w, "ln -fs %s /etc/xen/auto/%s.cfg\n", configFile, domain)
+			if p.startDomain {
+				fmt.Fprintf(w, "xl create %s\n", configFile)
+			}
+			fmt.Fprintf(w, "rm %s\n", a.GetPath())
+		}
+	}
+	return nil
+}
+
+// domainName looks for the domain name in the domain configuration
+func domainName(data string) (string, error) {
+	r, err := regexp.Compile(`\s*name\s*=\s*(\S+)`)
+	if err != nil {
+		return "", err
+	}
+	m := r.FindStringSubmatch(data)
+	if m == nil {
+		return "", errors.New("domain name not found")
+	}
+	return m[1], nil
+}
@@ -0,0 +1,183 @@
+package ova
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+
+	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/hwinfo/guest"
+)
+
+// instance ID of the first disk. CPU, memory and SCSI controller
+// items precede the disks and the network adapters
+const instanceFirstDevice = 4
+
+// ovfDisk represents a disk of the appliance
+type ovfDisk struct {
+	// file name inside the OVA (not escaped)
+	File string
+
+	// file size in bytes
+	Size int64
+
+	// virtual size in bytes
+	Capacity int64
+
+	// Unit is the disk address on the SCSI controller
+	Unit       int
+	Index      int
+	InstanceID int
+}
+
+// ovfNIC represents a network adapter connected to the network
+type ovfNIC struct {
+	Network    string
+	Index      int
+	InstanceID int
+}
+
+// ovfData is processed by the OVF template
+type ovfData struct {
+	Name     string
+	CPUs     int
+	RamMb    int
+	Disks    []*ovfDisk
+	Networks []string
+	NICs     []*ovfNIC
+}
+
+// escape returns the string escaped for XML
+func escape(s string) string {
+	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+// ovfDescriptor returns the OVF descriptor of the appliance.
+// The guest configuration provides CPUs, RAM and the network adapters.
+// An adapter is added for every NIC mapped to a network or,
+// if no NICs are mapped, for every network
+func ovfDescriptor(name string, config *guest.Config, disks []*ovfDisk) ([]byte, error) {
+	if config.CPUs < 1 || config.RamMb < 1 {
+		return nil, fmt.Errorf("invalid guest configuration: %d CPUs, %d MB RAM", config.CPUs, config.RamMb)
+	}
+	d := &ovfData{
+		Name:  escape(name),
+		CPUs:  config.CPUs,
+		RamMb: config.RamMb,
+		Disks: disks,
+	}
+	instance := instanceFirstDevice
+	for index, disk := range disks {
+		disk.Unit = index
+		disk.Index = index + 1
+		disk.InstanceID = instance
+		instance++
+	}
+
+	var networks []string
+	for _, net := range config.Networks {
+		networks = append(networks, net.Name)
+	}
+	for _, list := range config.NICLists {
+		for _, nic := range list {
+			d.NICs = append(d.NICs, &ovfNIC{Network: escape(nic.Network)})
+		}
+	}
+	if len(d.NICs) == 0 {
+		for _, net := range networks {
+			d.NICs = append(d.NICs, &ovfNIC{Network: escape(net)})
+		}
+	}
+	for _, net := range networks {
+		d.Networks = append(d.Networks, escape(net))
+	}
+	for index, nic := range d.NICs {
+		nic.Index = index + 1
+		nic.InstanceID = instance
+		instance++
+	}
+
+	data, err := utils.ProcessTemplate(TmpltOVF, d)
+	if err != nil {
+		return nil, utils.FormatError(err)
+	}
+	return data, nil
+}
+
+// TmpltOVF is the OVF 1.0 descriptor template
+var TmpltOVF = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData">
+  <References>{{range .Disks}}
+    <File ovf:href="{{.File}}" ovf:id="file{{.Index}}" ovf:size="{{.Size}}"/>{{end}}
+  </References>
+  <DiskSection>
+    <Info>Virtual disk information</Info>{{range .Disks}}
+    <Disk ovf:capacity="{{.Capacity}}" ovf:capacityAllocationUnits="byte" ovf:diskId="vmdisk{{.Index}}" ovf:fileRef="file{{.Index}}" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>{{end}}
+  </DiskSection>
+  <NetworkSection>
+    <Info>The list of logical networks</Info>{{range .Networks}}
+    <Network ovf:name="{{.}}">
+      <Description>The {{.}} network</Description>
+    </Network>{{end}}
+  </NetworkSection>
+  <VirtualSystem ovf:id="{{.Name}}">
+    <Info>A virtual machine</Info>
+    <Name>{{.Name}}</Name>
+    <OperatingSystemSection ovf:id="101">
+      <Info>The kind of installed guest operating system</Info>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>{{.Name}}</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>vmx-07</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:Description>Number of Virtual CPUs</rasd:Description>
+        <rasd:ElementName>{{.CPUs}} virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{.CPUs}}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:Description>Memory Size</rasd:Description>
+        <rasd:ElementName>{{.RamMb}}MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{.RamMb}}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:Description>SCSI Controller</rasd:Description>
+        <rasd:ElementName>SCSI controller 0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceSubType>lsilogic</rasd:ResourceSubType>
+        <rasd:ResourceType>6</rasd:ResourceType>
+      </Item>{{range .Disks}}
+      <Item>
+        <rasd:AddressOnParent>{{.Unit}}</rasd:AddressOnParent>
+        <rasd:ElementName>Hard disk {{.Index}}</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk{{.Index}}</rasd:HostResource>
+        <rasd:InstanceID>{{.InstanceID}}</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>{{end}}{{range .NICs}}
+      <Item>
+        <rasd:AddressOnParent>{{.Index}}</rasd:AddressOnParent>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Connection>{{.Network}}</rasd:Connection>
+        <rasd:ElementName>Network adapter {{.Index}}</rasd:ElementName>
+        <rasd:InstanceID>{{.InstanceID}}</rasd:InstanceID>
+        <rasd:ResourceSubType>VmxNet3</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>{{end}}
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`
@@ -0,0 +1,251 @@
+// Packages the image artifacts as OVA: OVF descriptor, manifest
+// and streamOptimized VMDK disks tarred together
+
+package ova
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dorzheh/deployer/deployer"
+	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/hwinfo/guest"
+	"github.com/dorzheh/deployer/utils/progress"
+)
+
+type PostProcessor struct {
+	// appliance name
+	name string
+
+	// directory the OVA is created in
+	dir string
+
+	// guest configuration (CPUs, RAM and NICs)
+	config *guest.Config
+}
+
+// NewPostProcessor gets the appliance name, the directory the OVA
+// is created in and the guest configuration described by the OVF.
+func NewPostProcessor(name, dir string, config *guest.Config) *PostProcessor {
+	p := new(PostProcessor)
+	p.name = name
+	p.dir = dir
+	p.config = config
+	return p
+}
+
+// Path returns path to the OVA
+func (p *PostProcessor) Path() string {
+	return filepath.Join(p.dir, p.name+".ova")
+}
+
+// PostProcess packages the image artifacts as OVA.
+// The images are converted to streamOptimized VMDK, the images themselves are kept.
+// Only local images are supported
+func (p *PostProcessor) PostProcess(ctx context.Context, artifacts []deployer.Artifact) error {
+	images, err := p.images(artifacts)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	progress.Report(ctx, progress.StagePackage, 0)
+
+	workdir, err := ioutil.TempDir(p.dir, ".ova")
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	run := utils.RunFuncWithContext(ctx, nil)
+	var disks []*ovfDisk
+	for index, image := range images {
+		disk := &ovfDisk{File: diskFile(index)}
+		path := filepath.Join(workdir, disk.File)
+		if out, err := run(vmdkCmd(image, path)); err != nil {
+			return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+		}
+		out, err := run("qemu-img info --output=json " + path)
+		if err != nil {
+			return utils.FormatError(fmt.Errorf("%s [%v]", out, err))
+		}
+		if disk.Capacity, err = virtualSize([]byte(out)); err != nil {
+			return utils.FormatError(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return utils.FormatError(err)
+		}
+		disk.Size = fi.Size()
+		disks = append(disks, disk)
+	}
+
+	progress.Report(ctx, progress.StagePackage, 70)
+	ovf, err := ovfDescriptor(p.name, p.config, disks)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	ovfFile := p.name + ".ovf"
+	if err := ioutil.WriteFile(filepath.Join(workdir, ovfFile), ovf, 0644); err != nil {
+		return utils.FormatError(err)
+	}
+	files := []string{ovfFile}
+	for _, disk := range disks {
+		files = append(files, disk.File)
+	}
+	mf, err := manifest(workdir, files)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	mfFile := p.name + ".mf"
+	if err := ioutil.WriteFile(filepath.Join(workdir, mfFile), mf, 0644); err != nil {
+		return utils.FormatError(err)
+	}
+
+	// the descriptor goes first, the manifest follows
+	files = append([]string{ovfFile, mfFile}, files[1:]...)
+	tmp := filepath.Join(workdir, filepath.Base(p.Path()))
+	if err := writeTar(tmp, workdir, files); err != nil {
+		return utils.FormatError(err)
+	}
+	if err := os.Rename(tmp, p.Path()); err != nil {
+		return utils.FormatError(err)
+	}
+	path := p.Path()
+	deployer.RollbackFromContext(ctx).Register("remove "+path, func() error {
+		return os.Remove(path)
+	})
+	return nil
+}
+
+// PlanPostProcess writes the commands PostProcess would run
+func (p *PostProcessor) PlanPostProcess(w io.Writer, artifacts []deployer.Artifact) error {
+	images, err := p.images(artifacts)
+	if err != nil {
+		return utils.FormatError(err)
+	}
+	files := []string{p.name + ".ovf", p.name + ".mf"}
+	for index, image := range images {
+		fmt.Fprintf(w, "%s\n", vmdkCmd(image, diskFile(index)))
+		files = append(files, diskFile(index))
+	}
+	fmt.Fprintf(w, "# write OVF descriptor %s (%d CPUs, %d MB RAM)\n", files[0], p.config.CPUs, p.config.RamMb)
+	fmt.Fprintf(w, "# write manifest %s (SHA256)\n", files[1])
+	fmt.Fprintf(w, "tar -cf %s", p.Path())
+	for _, f := range files {
+		fmt.Fprintf(w, " %s", f)
+	}
+	fmt.Fprintf(w, "\n")
+	return nil
+}
+
+// images returns paths to the image artifacts
+func (p *PostProcessor) images(artifacts []deployer.Artifact) ([]string, error) {
+	var images []string
+	for _, a := range artifacts {
+		if a.GetType() != deployer.ImageArtifact {
+			continue
+		}
+		if c, ok := a.(*deployer.CommonArtifact); ok && c.SshConfig != nil {
+			return nil, fmt.Errorf("%s: OVA packaging of remote images is not supported", a.GetPath())
+		}
+		images = append(images, a.GetPath())
+	}
+	if len(images) == 0 {
+		return nil, errors.New("no images to package")
+	}
+	return images, nil
+}
+
+// diskFile returns name of the VMDK inside the OVA
+func diskFile(index int) string {
+	return fmt.Sprintf("disk%d.vmdk", index+1)
+}
+
+func vmdkCmd(image, vmdk string) string {
+	return fmt.Sprintf("qemu-img convert -O vmdk -o subformat=streamOptimized %s %s", image, vmdk)
+}
+
+// virtualSize parses output of qemu-img info --output=json
+func virtualSize(info []byte) (int64, error) {
+	var i struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	if err := json.Unmarshal(info, &i); err != nil {
+		return 0, err
+	}
+	if i.VirtualSize == 0 {
+		return 0, errors.New("virtual size not found")
+	}
+	return i.VirtualSize, nil
+}
+
+// manifest returns SHA256 checksums of the files in the manifest format
+func manifest(dir string, files []string) ([]byte, error) {
+	var mf []byte
+	for _, name := range files {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		mf = append(mf, fmt.Sprintf("SHA256(%s)= %x\n", name, h.Sum(nil))...)
+	}
+	return mf, nil
+}
+
+// writeTar tars the files of the directory in the given order
+func writeTar(path, dir string, files []string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	for _, name := range files {
+		if err := addFile(tw, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// addFile adds the file to the archive
+func addFile(tw *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	// the build host owner is meaningless for the appliance
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.Uid, hdr.Gid = 0, 0
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,124 @@
+package ova
+
+import (
+	"archive/tar"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dorzheh/deployer/config/xmlinput"
+	"github.com/dorzheh/deployer/utils/hwinfo/guest"
+)
+
+func TestOVFDescriptor(t *testing.T) {
+	config := guest.NewConfig()
+	config.CPUs = 2
+	config.RamMb = 4096
+	config.Networks = []*xmlinput.Network{{Name: "Management"}, {Name: "R&D"}}
+	disks := []*ovfDisk{{File: "disk1.vmdk", Size: 100, Capacity: 1 << 30}, {File: "disk2.vmdk", Size: 10, Capacity: 1 << 20}}
+
+	data, err := ovfDescriptor("va<1>", config, disks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope struct {
+		Files []struct {
+			Href string `xml:"href,attr"`
+		} `xml:"References>File"`
+		Networks []struct {
+			Name string `xml:"name,attr"`
+		} `xml:"NetworkSection>Network"`
+		Name  string `xml:"VirtualSystem>Name"`
+		Items []struct {
+			InstanceID   int    `xml:"InstanceID"`
+			ResourceType int    `xml:"ResourceType"`
+			Quantity     int    `xml:"VirtualQuantity"`
+			Connection   string `xml:"Connection"`
+		} `xml:"VirtualSystem>VirtualHardwareSection>Item"`
+	}
+	if err := xml.Unmarshal(data, &envelope); err != nil {
+		t.Fatalf("%v:\n%s", err, data)
+	}
+	if envelope.Name != "va<1>" || len(envelope.Files) != 2 || envelope.Files[1].Href != "disk2.vmdk" {
+		t.Fatalf("unexpected descriptor:\n%s", data)
+	}
+	if len(envelope.Networks) != 2 || envelope.Networks[1].Name != "R&D" {
+		t.Fatalf("unexpected networks %v", envelope.Networks)
+	}
+	// CPU, memory, SCSI controller, 2 disks and a NIC per network
+	if len(envelope.Items) != 7 {
+		t.Fatalf("unexpected amount of items %d:\n%s", len(envelope.Items), data)
+	}
+	for index, item := range envelope.Items {
+		if item.InstanceID != index+1 {
+			t.Fatalf("unexpected instance ID %d of item %d", item.InstanceID, index)
+		}
+	}
+	if envelope.Items[0].Quantity != 2 || envelope.Items[1].Quantity != 4096 || envelope.Items[6].Connection != "R&D" {
+		t.Fatalf("unexpected hardware %+v", envelope.Items)
+	}
+
+	config.RamMb = 0
+	if _, err := ovfDescriptor("va", config, disks); err == nil {
+		t.Fatal("expected error for missing RAM")
+	}
+}
+
+func TestPackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer_ova")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := []string{"va.ovf", "disk1.vmdk"}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte("abc"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mf, err := manifest(dir, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if string(mf) != "SHA256(va.ovf)= "+sum+"\nSHA256(disk1.vmdk)= "+sum+"\n" {
+		t.Fatalf("unexpected manifest:\n%s", mf)
+	}
+
+	ova := filepath.Join(dir, "va.ova")
+	if err := writeTar(ova, dir, files); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(ova)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if strings.Join(names, ",") != "va.ovf,disk1.vmdk" {
+		t.Fatalf("unexpected archive content %v", names)
+	}
+}
+
+func TestVirtualSize(t *testing.T) {
+	size, err := virtualSize([]byte(`{"virtual-size": 1073741824, "filename": "disk1.vmdk", "format": "vmdk"}`))
+	if err != nil || size != 1<<30 {
+		t.Fatalf("unexpected size %d [%v]", size, err)
+	}
+}
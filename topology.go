@@ -0,0 +1,107 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dorzheh/deployer/config/topology"
+	"github.com/dorzheh/deployer/controller"
+	"github.com/dorzheh/deployer/deployer"
+	"github.com/dorzheh/deployer/utils"
+)
+
+// FlowFactory creates the flow deploying given appliance
+type FlowFactory func(*topology.Appliance) (deployer.FlowCreator, error)
+
+// deployedAppliance represents an appliance of the topology being deployed
+type deployedAppliance struct {
+	name      string
+	data      *deployer.CommonData
+	flow      deployer.FlowCreator
+	builders  []deployer.Builder
+	artifacts []deployer.Artifact
+}
+
+// DeployTopology deploys several cooperating appliances in a single run.
+// Every appliance is deployed by its own flow (see FlowFactory) configured
+// with the appliance answers (see topology package).
+// The flow consists of the following stages:
+// - every appliance is configured in the declared order
+// - the artifacts (images, domain definitions) of all the appliances are built
+// - every appliance is post-processed (defined and started) in the declared order
+// In case of failure the actions compensating the completed stages of all
+// the appliances are unwound in reverse order.
+func DeployTopology(ctx context.Context, c *deployer.CommonData, t *topology.Topology, newFlow FlowFactory) (err error) {
+	if c.Rollback == nil {
+		c.Rollback = new(deployer.Rollback)
+	}
+	defer unwindOnError(c, &err)
+
+	var appliances []*deployedAppliance
+	for _, a := range t.Appliances {
+		ap, err := configureAppliance(c, t, a, newFlow)
+		if err != nil {
+			return utils.FormatError(fmt.Errorf("appliance %s: %v", a.Name, err))
+		}
+		appliances = append(appliances, ap)
+	}
+
+	if c.Plan != nil {
+		for _, ap := range appliances {
+			fmt.Fprintf(c.Plan, "### appliance %s ###\n", ap.name)
+			if err := plan(ap.data, ap.flow, ap.builders); err != nil {
+				return utils.FormatError(fmt.Errorf("appliance %s: %v", ap.name, err))
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := cancelOnInterrupt(ctx)
+	defer cancel()
+	ctx = deployer.WithRollback(ctx, c.Rollback)
+
+	// the appliances are built one by one since the flows share the rootfs mount point
+	for _, ap := range appliances {
+		if ap.artifacts, err = build(ctx, ap.data, ap.builders); err != nil {
+			return utils.FormatError(fmt.Errorf("appliance %s: %v", ap.name, err))
+		}
+	}
+	for _, ap := range appliances {
+		if err := postProcess(ctx, ap.data, ap.flow, ap.artifacts); err != nil {
+			return utils.FormatError(fmt.Errorf("appliance %s: %v", ap.name, err))
+		}
+	}
+	return nil
+}
+
+// configureAppliance creates the configuration and the builders
+// of the appliance flow
+func configureAppliance(c *deployer.CommonData, t *topology.Topology, a *topology.Appliance, newFlow FlowFactory) (*deployedAppliance, error) {
+	f, err := newFlow(a)
+	if err != nil {
+		return nil, err
+	}
+
+	// the appliance shares the rollback, the event log and the plan
+	d := *c
+	d.VaName = a.Name
+	d.Answers = t.Answers(a)
+	d.RecordFile = ""
+	d.Recorded = nil
+
+	// the steps of the previous appliance are already done
+	controller.ResetSteps()
+	err = f.CreateConfig(&d)
+	if c.Answers != nil {
+		c.Answers.Warnings = append(c.Answers.Warnings, d.Answers.Warnings...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	builders, err := f.CreateBuilders(&d)
+	if err != nil {
+		return nil, err
+	}
+	return &deployedAppliance{name: a.Name, data: &d, flow: f, builders: builders}, nil
+}
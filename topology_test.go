@@ -0,0 +1,170 @@
+package deployer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dorzheh/deployer/config/answers"
+	"github.com/dorzheh/deployer/config/topology"
+	"github.com/dorzheh/deployer/deployer"
+)
+
+// journal records the stages of the fake flows
+type journal struct {
+	entries []string
+}
+
+func (j *journal) add(format string, args ...interface{}) {
+	j.entries = append(j.entries, fmt.Sprintf(format, args...))
+}
+
+type fakeFlow struct {
+	j        *journal
+	failPost bool
+}
+
+func (f *fakeFlow) CreateConfig(d *deployer.CommonData) error {
+	f.j.add("config %s bundle %s", d.VaName, d.Answers.Bundle)
+	return nil
+}
+
+func (f *fakeFlow) CreateBuilders(d *deployer.CommonData) ([]deployer.Builder, error) {
+	return []deployer.Builder{&fakeBuilder{f.j, d.VaName}}, nil
+}
+
+func (f *fakeFlow) CreatePostProcessor(d *deployer.CommonData) (deployer.PostProcessor, error) {
+	return &fakePostProcessor{f.j, d.VaName, f.failPost}, nil
+}
+
+type fakeBuilder struct {
+	j    *journal
+	name string
+}
+
+func (b *fakeBuilder) Id() string {
+	return "fakeBuilder"
+}
+
+func (b *fakeBuilder) Run(ctx context.Context) (deployer.Artifact, error) {
+	b.j.add("build %s", b.name)
+	return &fakeArtifact{deployer.CommonArtifact{Name: b.name}, b.j}, nil
+}
+
+type fakeArtifact struct {
+	deployer.CommonArtifact
+	j *journal
+}
+
+func (a *fakeArtifact) Destroy() error {
+	a.j.add("destroy %s", a.Name)
+	return nil
+}
+
+type fakePostProcessor struct {
+	j    *journal
+	name string
+	fail bool
+}
+
+func (p *fakePostProcessor) PostProcess(ctx context.Context, artifacts []deployer.Artifact) error {
+	if p.fail {
+		return errors.New("define failed")
+	}
+	p.j.add("start %s", artifacts[0].GetName())
+	return nil
+}
+
+func testTopology() *topology.Topology {
+	return &topology.Topology{
+		Common: &answers.Answers{Bundle: "Worker"},
+		Appliances: []*topology.Appliance{
+			{Name: "controller", Bundle: "Controller"},
+			{Name: "worker-1"},
+		},
+	}
+}
+
+func TestDeployTopology(t *testing.T) {
+	j := new(journal)
+	c := &deployer.CommonData{VaName: "myproduct"}
+	newFlow := func(a *topology.Appliance) (deployer.FlowCreator, error) {
+		return &fakeFlow{j: j}, nil
+	}
+	if err := DeployTopology(context.Background(), c, testTopology(), newFlow); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"config controller bundle Controller",
+		"config worker-1 bundle Worker",
+		"build controller",
+		"build worker-1",
+		"start controller",
+		"start worker-1",
+	}
+	if strings.Join(j.entries, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected flow:\n%s", strings.Join(j.entries, "\n"))
+	}
+	if c.VaName != "myproduct" {
+		t.Fatalf("common data is modified (%s)", c.VaName)
+	}
+}
+
+func TestDeployTopologyRollback(t *testing.T) {
+	j := new(journal)
+	c := new(deployer.CommonData)
+	newFlow := func(a *topology.Appliance) (deployer.FlowCreator, error) {
+		return &fakeFlow{j: j, failPost: a.Name == "worker-1"}, nil
+	}
+	err := DeployTopology(context.Background(), c, testTopology(), newFlow)
+	if err == nil || !strings.Contains(err.Error(), "appliance worker-1") {
+		t.Fatalf("expected the worker failure, got %v", err)
+	}
+
+	// artifacts of both the appliances are removed in reverse order
+	entries := strings.Join(j.entries[len(j.entries)-2:], "\n")
+	if entries != "destroy worker-1\ndestroy controller" {
+		t.Fatalf("unexpected rollback:\n%s", strings.Join(j.entries, "\n"))
+	}
+}
+
+// tempFileFlow creates a temporary file while configured
+type tempFileFlow struct {
+	fakeFlow
+	path string
+}
+
+func (f *tempFileFlow) CreateConfig(d *deployer.CommonData) error {
+	file, err := ioutil.TempFile("", "deployer_metadata")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	f.path = file.Name()
+	d.Rollback.Register("remove "+f.path, func() error {
+		return os.Remove(f.path)
+	})
+	return nil
+}
+
+func TestDeployPlanLeavesNothing(t *testing.T) {
+	j := new(journal)
+	f := &tempFileFlow{fakeFlow: fakeFlow{j: j}}
+	c := &deployer.CommonData{VaName: "va", Plan: new(bytes.Buffer)}
+	if err := Deploy(c, f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f.path); !os.IsNotExist(err) {
+		os.Remove(f.path)
+		t.Fatalf("%s is left behind by the plan", f.path)
+	}
+	if len(j.entries) != 0 {
+		t.Fatalf("unexpected actions %s", strings.Join(j.entries, ","))
+	}
+}
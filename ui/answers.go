@@ -0,0 +1,362 @@
+package ui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/dorzheh/deployer/builder/image"
+	"github.com/dorzheh/deployer/config"
+	"github.com/dorzheh/deployer/config/answers"
+	"github.com/dorzheh/deployer/config/xmlinput"
+	"github.com/dorzheh/deployer/deployer"
+	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/host_hwfilter"
+	"github.com/dorzheh/deployer/utils/hwinfo/guest"
+	"github.com/dorzheh/deployer/utils/hwinfo/host"
+	sshconf "github.com/dorzheh/infra/comm/common"
+)
+
+// The functions below are the unattended counterparts of the Ui* functions.
+// Instead of prompting the user they consume predefined answers
+// and return an error if the answers are not valid.
+
+// AnswerRemoteMode returns deployment mode
+func AnswerRemoteMode(a *answers.Answers) (bool, error) {
+	if a.RemoteMode {
+		if _, err := exec.LookPath("sshfs"); err != nil {
+			return false, errors.New("sshfs utility is not installed")
+		}
+	}
+	return a.RemoteMode, nil
+}
+
+// AnswerSshPassword asks the SSH password missing in the answers
+// (see answers.Ssh.AskPassword)
+func AnswerSshPassword(ui deployer.UI, a *answers.Answers) error {
+	if !a.RemoteMode || a.Ssh == nil || !a.Ssh.AskPassword || a.Ssh.Password != "" {
+		return nil
+	}
+	user := a.Ssh.User
+	if user == "" {
+		user = "root"
+	}
+	passwd, err := ui.GetPasswordFromInput(a.Ssh.Host, user, "", "", false)
+	if err != nil {
+		return err
+	}
+	if passwd == "" {
+		return errors.New("SSH password is empty")
+	}
+	a.Ssh.Password = passwd
+	return nil
+}
+
+// AnswerSshConfig returns remote session configuration
+// and verifies that SSH connection can be established
+func AnswerSshConfig(a *answers.Answers) (*sshconf.Config, error) {
+	if a.Ssh == nil {
+		return nil, errors.New("ssh configuration is missing")
+	}
+	cfg, err := a.Ssh.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := utils.RunFuncWithContext(ctx, cfg)("uname"); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("unable to establish SSH connection to %s: timeout was reached", cfg.Host)
+		}
+		return nil, fmt.Errorf("unable to establish SSH connection to %s: %v", cfg.Host, err)
+	}
+	return cfg, nil
+}
+
+// AnswerImagePath returns directory the appliance image will be installed on
+func AnswerImagePath(a *answers.Answers, defaultLocation string, remote bool) (string, error) {
+	location := a.ExportDir
+	if location == "" {
+		location = defaultLocation
+	}
+	if !remote {
+		stat, err := os.Stat(location)
+		if err != nil {
+			return "", err
+		}
+		if !stat.IsDir() {
+			return "", fmt.Errorf("%s is not a directory", location)
+		}
+	}
+	return location, nil
+}
+
+// AnswerApplianceName returns the virtual machine name
+func AnswerApplianceName(a *answers.Answers, defaultName string, driver deployer.EnvDriver) (string, error) {
+	name := a.Name
+	if name == "" {
+		name = defaultName
+	}
+	if name == "" {
+		return "", errors.New("virtual machine name is empty")
+	}
+	name = strings.Replace(name, ".", "-", -1)
+	if driver != nil && driver.DomainExists(name) {
+		return "", fmt.Errorf("domain %s already exists", name)
+	}
+	return name, nil
+}
+
+// AnswerWarning returns an error in case warnings are not accepted.
+// Otherwise the warning is kept by the answers for further reporting
+func AnswerWarning(a *answers.Answers, warningStr string) error {
+	if a.AcceptWarnings {
+		a.Warnings = append(a.Warnings, warningStr)
+		return nil
+	}
+	return errors.New(warningStr)
+}
+
+// AnswerNetworks maps the networks to the host NICs
+func AnswerNetworks(a *answers.Answers, data *xmlinput.XMLInputData, allowedNics host.NICList, gconf *guest.Config) error {
+	guestPciSlotCounter := data.GuestNic.PCI.FirstSlot
+
+	for _, net := range data.Networks.Configs {
+		anet := a.NetworkByName(net.Name)
+		if anet == nil || len(anet.NICs) == 0 {
+			if net.Optional {
+				continue
+			}
+			return fmt.Errorf("no interfaces selected for network \"%s\"", net.Name)
+		}
+
+		var modes []xmlinput.ConnectionMode
+		if len(net.UiModeBinding) == 0 {
+			for _, mode := range net.Modes {
+				modes = append(modes, mode.Type)
+			}
+		} else {
+			for _, mode := range net.UiModeBinding {
+				if mode.Appear == anet.ModeSelection {
+					modes = append(modes, mode.Type)
+				}
+			}
+			if len(modes) == 0 {
+				return fmt.Errorf("network \"%s\": unexpected interface type \"%s\"", net.Name, anet.ModeSelection)
+			}
+		}
+
+		retainedNics, err := host_hwfilter.NicsByType(allowedNics, modes)
+		if err != nil {
+			return utils.FormatError(err)
+		}
+
+		gnics := guest.NewNICList()
+		var disjuncNicVendor string
+		var disjuncNicModel string
+		for _, anic := range anet.NICs {
+			hnic, err := answerHostNic(a, retainedNics, anic)
+			if err != nil {
+				return fmt.Errorf("network \"%s\": %v", net.Name, err)
+			}
+			if _, _, err := gnics.NicByHostNicObj(hnic); err == nil {
+				return fmt.Errorf("network \"%s\": interface %s selected more than once", net.Name, answerNicString(anic))
+			}
+			if net.NicsDisjunction && (hnic.Type == host.NicTypePhys || hnic.Type == host.NicTypePhysVF) &&
+				(hnic.Vendor != disjuncNicVendor && hnic.Model != disjuncNicModel) {
+				if host_hwfilter.NicDisjunctionFound(hnic, data.HostNics.Allowed) && disjuncNicVendor != "" {
+					return fmt.Errorf("'%s' cannot be selected alongside '%s %s'", hnic.Desc, disjuncNicVendor, disjuncNicModel)
+				}
+				disjuncNicVendor = hnic.Vendor
+				disjuncNicModel = hnic.Model
+			}
+
+			gnic := guest.NewNIC()
+			gnic.Network = net.Name
+			gnic.PCIAddr.Domain = data.PCI.Domain
+			gnic.PCIAddr.Bus = data.PCI.Bus
+			gnic.PCIAddr.Slot = utils.IntToHexString(guestPciSlotCounter)
+			gnic.PCIAddr.Function = data.PCI.Function
+			gnic.HostNIC = hnic
+			gnics.Add(gnic)
+			guestPciSlotCounter++
+		}
+
+		gconf.Networks = append(gconf.Networks, net)
+		gconf.NICLists = append(gconf.NICLists, gnics)
+	}
+	return nil
+}
+
+// answerHostNic looks for the host NIC by PCI address and then by name.
+// Since the answers might be recorded on another host, a NIC found
+// by either PCI address or name only is reported as a warning
+func answerHostNic(a *answers.Answers, hnics host.NICList, anic *answers.NIC) (*host.NIC, error) {
+	if anic.PCIAddr != "" {
+		if i, err := hnics.IndexByPCI(anic.PCIAddr); err == nil {
+			hnic := hnics[i]
+			if anic.Name != "" && hnic.Name != anic.Name {
+				if err := AnswerWarning(a, fmt.Sprintf("interface %s (%s) is named %s on the host",
+					anic.PCIAddr, anic.Name, hnic.Name)); err != nil {
+					return nil, err
+				}
+			}
+			return hnic, nil
+		}
+	}
+	if anic.Name != "" {
+		if i, err := hnics.IndexByName(anic.Name); err == nil {
+			hnic := hnics[i]
+			if anic.PCIAddr != "" {
+				if err := AnswerWarning(a, fmt.Sprintf("interface %s not found, using %s (%s) instead",
+					anic.PCIAddr, hnic.Name, hnic.PCIAddr)); err != nil {
+					return nil, err
+				}
+			}
+			return hnic, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s not found or not eligible", answerNicString(anic))
+}
+
+func answerNicString(anic *answers.NIC) string {
+	switch {
+	case anic.PCIAddr != "" && anic.Name != "":
+		return fmt.Sprintf("%s (%s)", anic.Name, anic.PCIAddr)
+	case anic.PCIAddr != "":
+		return anic.PCIAddr
+	}
+	return anic.Name
+}
+
+// AnswerVmConfig sets amount of vCPUs, RAM and disks sizes
+func AnswerVmConfig(a *answers.Answers, driver deployer.HostinfoDriver, xidata *xmlinput.XMLInputData,
+	pathToMainImage string, sconf *image.Storage, conf *guest.Config) error {
+	if xidata.CPU.Configure {
+		selectedCpus := a.CPUs
+		if selectedCpus == 0 {
+			selectedCpus = xidata.CPU.Default
+		}
+		installedCpus, err := driver.CPUs()
+		if err != nil {
+			return utils.FormatError(err)
+		}
+		if err := verifyCpus(selectedCpus, xidata.CPU.Min, xidata.CPU.Max); err != nil {
+			return err
+		}
+		if selectedCpus > installedCpus {
+			if err := AnswerWarning(a, fmt.Sprintf("The host only has %d CPUs.Overcommitting vCPUs can reduce performance!", installedCpus)); err != nil {
+				return err
+			}
+		}
+		conf.CPUs = selectedCpus
+	} else if a.CPUs > 0 {
+		return errors.New("amount of vCPUs is not configurable")
+	} else if xidata.CPU.Default > 0 {
+		conf.CPUs = xidata.CPU.Default
+	}
+
+	if xidata.RAM.Configure {
+		selectedRamMb := a.RamMb
+		if selectedRamMb == 0 {
+			selectedRamMb = xidata.RAM.Default
+		}
+		installedRamMb, err := driver.RAMSize()
+		if err != nil {
+			return utils.FormatError(err)
+		}
+		maxRAM := xidata.RAM.Max
+		if maxRAM > installedRamMb || maxRAM == xmlinput.UnlimitedAlloc {
+			maxRAM = installedRamMb
+		}
+		if err := verifyRam(selectedRamMb, installedRamMb, xidata.RAM.Min, maxRAM); err != nil {
+			return err
+		}
+		conf.RamMb = selectedRamMb
+	} else if a.RamMb > 0 {
+		return errors.New("amount of RAM is not configurable")
+	} else if xidata.RAM.Default > 0 {
+		conf.RamMb = xidata.RAM.Default
+	}
+
+	if xidata.Disks.Configure {
+		disks := make([]int, 0)
+		if len(a.DisksMb) > 0 && len(a.DisksMb) != len(xidata.Disks.Configs) {
+			return fmt.Errorf("expected %d disks, got %d", len(xidata.Disks.Configs), len(a.DisksMb))
+		}
+		for i, disk := range xidata.Disks.Configs {
+			selectedDiskSizeMb := disk.Default
+			if len(a.DisksMb) > 0 {
+				selectedDiskSizeMb = a.DisksMb[i]
+			}
+			if err := verifyDisk(selectedDiskSizeMb, disk.Min, disk.Max); err != nil {
+				return err
+			}
+			disks = append(disks, selectedDiskSizeMb)
+		}
+		var err error
+		if conf.Storage, err = config.StorageConfig(pathToMainImage, a.StorageConfigIndex, sconf, disks); err != nil {
+			return err
+		}
+	} else if len(a.DisksMb) > 0 {
+		return errors.New("disks size is not configurable")
+	}
+	return nil
+}
+
+// AnswerNumaRam verifies that the NUMA nodes have enough free RAM
+func AnswerNumaRam(a *answers.Answers, driver deployer.HostinfoDriver, c *guest.Config, selectedRamInMb int) error {
+	warningStr, err := numaRamShortage(driver, c, selectedRamInMb)
+	if err != nil {
+		return err
+	}
+	if warningStr != "" {
+		return AnswerWarning(a, "Virtual machine configuration can not be optimized.\n"+warningStr)
+	}
+	return nil
+}
+
+// AnswerNUMATopology applies vCPU affinity.
+// Returns true if the topology has been changed
+func AnswerNUMATopology(a *answers.Answers, c *guest.Config, totalCpusOnHost int) (bool, error) {
+	if len(a.VCPUs) == 0 {
+		return false, nil
+	}
+
+	for _, v := range a.VCPUs {
+		if err := verifyRange(v.VNUMA, len(c.NUMAs)); err != nil {
+			return false, fmt.Errorf("vCPU %d: %v", v.ID, err)
+		}
+		if err := verifyRange(v.ID, c.CPUs); err != nil {
+			return false, fmt.Errorf("vCPU %d: %v", v.ID, err)
+		}
+		cpus, err := parseHostCpus(v.HostCPUs, totalCpusOnHost)
+		if err != nil {
+			return false, fmt.Errorf("vCPU %d: %v", v.ID, err)
+		}
+		// delete the old entry
+		for _, n := range c.NUMAs {
+			delete(n.CPUPin, v.ID)
+		}
+		c.NUMAs[v.VNUMA].CPUPin[v.ID] = cpus
+	}
+
+	seen := make(map[int]int)
+	for _, n := range c.NUMAs {
+		for vcpu, cpus := range n.CPUPin {
+			if len(cpus) != 1 {
+				continue
+			}
+			if other, ok := seen[cpus[0]]; ok {
+				return true, fmt.Errorf("CPU %d is assigned to more than one vCPU (%d and %d)", cpus[0], other, vcpu)
+			}
+			seen[cpus[0]] = vcpu
+		}
+	}
+	return true, nil
+}
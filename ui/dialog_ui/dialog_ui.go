@@ -7,71 +7,33 @@ import (
 	"os"
 	"time"
 
+	"github.com/dorzheh/deployer/deployer"
 	"github.com/dorzheh/deployer/utils"
+	"github.com/dorzheh/deployer/utils/progress"
 	. "github.com/dorzheh/go-dialog"
 )
 
 const (
-	DialogExit     = "exit status 1"
-	DialogMoveBack = "exit status 2"
-	DialogNext     = "exit status 3"
+	DialogExit     = deployer.UiExit
+	DialogMoveBack = deployer.UiMoveBack
+	DialogNext     = deployer.UiNext
 )
 
 const (
-	Success      = "Success"
-	Error        = "Failure"
-	Warning      = "Warning"
-	Notification = "Notification"
-	None         = ""
+	Success      = deployer.UiSuccess
+	Error        = deployer.UiError
+	Warning      = deployer.UiWarning
+	Notification = deployer.UiNotification
+	None         = deployer.UiNone
 )
 
-type Pb struct {
-	sleep time.Duration
-	step  int
-}
-
-func (p *Pb) SetSleep(s string) (err error) {
-	p.sleep, err = time.ParseDuration(s)
-	err = utils.FormatError(err)
-	return
-}
-
-func (p *Pb) SetStep(s int) {
-	p.step = s
-}
-
-func (p *Pb) Sleep() time.Duration {
-	return p.sleep
-}
-
-func (p *Pb) Step() int {
-	return p.step
-}
-
-func (p *Pb) IncreaseSleep(s string) error {
-	sleep, err := time.ParseDuration(s)
-	if err != nil {
-		return utils.FormatError(err)
-	}
-	p.sleep += sleep
-	return nil
-}
-
-func (p *Pb) IncreaseStep(s int) {
-	p.step += s
-}
-
-func (p *Pb) DecreaseStep(s int) {
-	p.step -= s
-}
-
+// DialogUi implements deployer.UI interface by means of the dialog utility
 type DialogUi struct {
 	*Dialog
-	Pb *Pb
 }
 
 func NewDialogUi() *DialogUi {
-	return &DialogUi{New(CONSOLE, 0), &Pb{0, 0}}
+	return &DialogUi{New(CONSOLE, 0)}
 }
 
 ///// Functions providing verification services /////
@@ -111,9 +73,10 @@ func (ui *DialogUi) Output(ntype string, msgs ...string) {
 // 	return ui.Progress(title, msg, duration, step, done)
 // }
 
-// Progress implements a progress bar
+// Progress implements a progress bar showing the overall percentage
+// and the stage reported by the events
 // Returns error or nil
-func (ui *DialogUi) Progress(title, pbMsg string, duration time.Duration, step int, done chan error) error {
+func (ui *DialogUi) Progress(title, pbMsg string, events <-chan *progress.Event, done chan error) error {
 	defaultWidth := 50
 	titleWidth := len(title) + 4
 	msgWidth := len(pbMsg) + 4
@@ -129,7 +92,7 @@ func (ui *DialogUi) Progress(title, pbMsg string, duration time.Duration, step i
 	ui.SetTitle(title)
 	ui.SetSize(8, newWidth)
 	pb := ui.Progressbar()
-	var interval int = 0
+	pb.Step(0, pbMsg)
 	for {
 		select {
 		// wait for result
@@ -146,15 +109,8 @@ func (ui *DialogUi) Progress(title, pbMsg string, duration time.Duration, step i
 			}
 			time.Sleep(finalSleep)
 			return nil
-		default:
-			if interval < 100 {
-				interval += step
-			}
-			if interval > 100 {
-				interval = 100
-			}
-			pb.Step(interval, pbMsg)
-			time.Sleep(duration)
+		case e := <-events:
+			pb.Step(e.Total, pbMsg+"\n"+e.String())
 		}
 	}
 	return nil
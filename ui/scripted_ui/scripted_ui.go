@@ -0,0 +1,295 @@
+// Scripted user interface replaying predefined replies.
+// Intended for unit testing of the deployment flows.
+//
+// Every interactive widget consumes the next reply:
+//  Menu                      - the tag
+//  Inputbox, GetFromInput,
+//  GetPathTo*FromInput,
+//  GetPasswordFromInput      - the value (empty keeps the default)
+//  Mixedform                 - one reply per editable field (empty keeps the default)
+//  Yesno                     - "y"/"yes" for true
+//  Textbox                   - empty to accept
+// The navigation replies (Back, Next and Cancel) are converted to appropriate
+// errors. Msgbox, Output, Progress and Wait do not consume replies.
+
+package scripted_ui
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dorzheh/deployer/deployer"
+	"github.com/dorzheh/deployer/utils/progress"
+)
+
+// Navigation replies
+const (
+	Back   = deployer.UiMoveBack
+	Next   = deployer.UiNext
+	Cancel = deployer.UiExit
+)
+
+// Exit is the value ScriptedUi panics with upon error notification
+// (deployer.UI implementations terminate the program in this case)
+type Exit struct {
+	Msg string
+}
+
+// Widget represents a widget shown by the flow
+type Widget struct {
+	// Widget type (menu, inputbox, mixedform and so forth)
+	Type string
+
+	// Title and label (text) of the widget
+	Title string
+	Label string
+
+	// Items of menu (tag/item pairs), mixedform (labels)
+	// and progress (events received)
+	Items []string
+
+	back bool
+	next bool
+}
+
+// ScriptedUi implements deployer.UI interface
+type ScriptedUi struct {
+	replies []string
+
+	title      string
+	label      string
+	helpButton bool
+	extraLabel string
+
+	// Widgets shown so far
+	Widgets []*Widget
+}
+
+// NewScriptedUi creates a user interface replaying given replies
+func NewScriptedUi(replies ...string) *ScriptedUi {
+	return &ScriptedUi{
+		replies: replies,
+	}
+}
+
+// Remaining returns amount of replies not consumed yet
+func (ui *ScriptedUi) Remaining() int {
+	return len(ui.replies)
+}
+
+// Last returns the last widget shown
+func (ui *ScriptedUi) Last() *Widget {
+	if len(ui.Widgets) == 0 {
+		return nil
+	}
+	return ui.Widgets[len(ui.Widgets)-1]
+}
+
+func (ui *ScriptedUi) SetTitle(title string) {
+	ui.title = title
+}
+
+func (ui *ScriptedUi) SetSize(height int, width int) {
+}
+
+func (ui *ScriptedUi) SetLabel(label string) {
+	ui.label = label
+}
+
+func (ui *ScriptedUi) SetOkLabel(label string) {
+}
+
+func (ui *ScriptedUi) SetExtraLabel(label string) {
+	ui.extraLabel = label
+}
+
+func (ui *ScriptedUi) HelpButton(truefalse bool) {
+	ui.helpButton = truefalse
+}
+
+func (ui *ScriptedUi) SetHelpLabel(label string) {
+}
+
+func (ui *ScriptedUi) Msgbox(text string) {
+	ui.show("msgbox", text)
+}
+
+func (ui *ScriptedUi) Textbox(filepath string) error {
+	_, err := ui.reply(ui.show("textbox", filepath))
+	return err
+}
+
+func (ui *ScriptedUi) Inputbox(value string) (string, error) {
+	input, err := ui.reply(ui.show("inputbox", ui.label))
+	if err != nil {
+		return "", err
+	}
+	if input == "" {
+		return value, nil
+	}
+	return input, nil
+}
+
+func (ui *ScriptedUi) Menu(menuHeight int, tagItem ...string) (string, error) {
+	w := ui.show("menu", ui.label)
+	w.Items = tagItem
+	tag, err := ui.reply(w)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < len(tagItem); i += 2 {
+		if tag == tagItem[i] {
+			return tag, nil
+		}
+	}
+	return "", fmt.Errorf("scripted ui: menu \"%s\" has no tag \"%s\"", w.Title, tag)
+}
+
+func (ui *ScriptedUi) Mixedform(title string, insecure bool, tagItemStatus ...string) ([]string, error) {
+	if len(tagItemStatus)%9 != 0 {
+		return nil, errors.New("scripted ui: each form field must be represented by 9 values")
+	}
+	w := ui.show("mixedform", title)
+	var result []string
+	for i := 0; i < len(tagItemStatus); i += 9 {
+		w.Items = append(w.Items, tagItemStatus[i])
+		item := tagItemStatus[i+3]
+		if tagItemStatus[i+8] == "2" {
+			result = append(result, item)
+			continue
+		}
+		input, err := ui.reply(w)
+		if err != nil {
+			return nil, err
+		}
+		if input == "" {
+			input = item
+		}
+		result = append(result, input)
+	}
+	return result, nil
+}
+
+func (ui *ScriptedUi) Yesno() bool {
+	input, err := ui.reply(ui.show("yesno", ui.label))
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(input) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// Output records the notification.
+// Panics with *Exit in case of error notification
+func (ui *ScriptedUi) Output(ntype string, msgs ...string) {
+	ui.SetTitle(ntype)
+	w := ui.show("output", strings.Join(msgs, "\n"))
+	if ntype == deployer.UiError {
+		panic(&Exit{w.Label})
+	}
+}
+
+// Progress records the events received as the widget items
+func (ui *ScriptedUi) Progress(title, pbMsg string, events <-chan *progress.Event, done chan error) error {
+	ui.SetTitle(title)
+	w := ui.show("progress", pbMsg)
+	for {
+		select {
+		case e := <-events:
+			w.Items = append(w.Items, e.String())
+		case result := <-done:
+			return result
+		}
+	}
+}
+
+func (ui *ScriptedUi) Wait(msg string, pause, timeOut time.Duration, done chan error) error {
+	ui.show("wait", msg)
+	if timeOut <= 0 {
+		return <-done
+	}
+	select {
+	case result := <-done:
+		return result
+	case <-time.After(timeOut):
+		return errors.New("Timeout was reached")
+	}
+}
+
+func (ui *ScriptedUi) GetPathToFileFromInput(title, helpButtonLabel, extraButtonLabel string) (string, error) {
+	return ui.getFromInput(title, "", helpButtonLabel, extraButtonLabel)
+}
+
+func (ui *ScriptedUi) GetPathToDirFromInput(title, defaultDir, helpButtonLabel, extraButtonLabel string) (string, error) {
+	return ui.getFromInput(title, defaultDir, helpButtonLabel, extraButtonLabel)
+}
+
+func (ui *ScriptedUi) GetFromInput(title, defaultInput, helpButtonLabel, extraButtonLabel string) (string, error) {
+	return ui.getFromInput(title, defaultInput, helpButtonLabel, extraButtonLabel)
+}
+
+func (ui *ScriptedUi) GetPasswordFromInput(host, user, helpButtonLabel, extraButtonLabel string, confirm bool) (string, error) {
+	return ui.getFromInput(fmt.Sprintf("\"%s\" password on the host %s", user, host), "", helpButtonLabel, extraButtonLabel)
+}
+
+func (ui *ScriptedUi) getFromInput(title, defaultInput, helpButtonLabel, extraButtonLabel string) (string, error) {
+	ui.SetTitle(title)
+	ui.HelpButton(helpButtonLabel != "")
+	ui.SetExtraLabel(extraButtonLabel)
+	input, err := ui.Inputbox(defaultInput)
+	if err != nil {
+		return "", err
+	}
+	if input == "" {
+		return "", fmt.Errorf("scripted ui: empty reply for \"%s\"", title)
+	}
+	return input, nil
+}
+
+// show records the widget and resets the widget state
+func (ui *ScriptedUi) show(wtype, label string) *Widget {
+	w := &Widget{
+		Type:  wtype,
+		Title: ui.title,
+		Label: label,
+		back:  ui.helpButton,
+		next:  ui.extraLabel != "",
+	}
+	ui.Widgets = append(ui.Widgets, w)
+	ui.title = ""
+	ui.label = ""
+	ui.helpButton = false
+	ui.extraLabel = ""
+	return w
+}
+
+// reply consumes the next reply.
+// Returns appropriate error in case of the navigation reply
+func (ui *ScriptedUi) reply(w *Widget) (string, error) {
+	if len(ui.replies) == 0 {
+		return "", fmt.Errorf("scripted ui: no reply left for %s \"%s\"", w.Type, w.Title)
+	}
+	r := ui.replies[0]
+	ui.replies = ui.replies[1:]
+
+	switch r {
+	case Cancel:
+		return "", errors.New(r)
+	case Back:
+		if !w.back {
+			return "", fmt.Errorf("scripted ui: %s \"%s\" has no back button", w.Type, w.Title)
+		}
+		return "", errors.New(r)
+	case Next:
+		if !w.next {
+			return "", fmt.Errorf("scripted ui: %s \"%s\" has no extra button", w.Type, w.Title)
+		}
+		return "", errors.New(r)
+	}
+	return r, nil
+}
@@ -0,0 +1,77 @@
+package scripted_ui
+
+import (
+	"testing"
+
+	"github.com/dorzheh/deployer/deployer"
+)
+
+var _ deployer.UI = (*ScriptedUi)(nil)
+
+func TestReplies(t *testing.T) {
+	ui := NewScriptedUi("2", "", "8", "y")
+
+	ui.SetTitle("Deployment Mode")
+	tag, err := ui.Menu(2, "1", "Local", "2", "Remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag != "2" {
+		t.Fatalf("expected 2, got %s", tag)
+	}
+	if ui.Last().Title != "Deployment Mode" {
+		t.Fatalf("unexpected title %s", ui.Last().Title)
+	}
+
+	res, err := ui.Mixedform("Virtual Machine configuration", false,
+		"CPUs: ", "1", "1", "4", "1", "10", "6", "0", "0",
+		"Max : ", "2", "1", "16", "2", "10", "6", "0", "2",
+		"RAM : ", "3", "1", "2", "3", "10", "6", "0", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 || res[0] != "4" || res[1] != "16" || res[2] != "8" {
+		t.Fatalf("unexpected form result %v", res)
+	}
+
+	if !ui.Yesno() {
+		t.Fatal("expected true")
+	}
+	if ui.Remaining() != 0 {
+		t.Fatalf("expected all the replies consumed, %d left", ui.Remaining())
+	}
+	if _, err := ui.Inputbox(""); err == nil {
+		t.Fatal("expected error since no reply is left")
+	}
+}
+
+func TestNavigation(t *testing.T) {
+	ui := NewScriptedUi(Back, Back, Next)
+
+	ui.HelpButton(true)
+	if _, err := ui.Menu(1, "1", "Local"); err == nil || err.Error() != deployer.UiMoveBack {
+		t.Fatalf("expected %s, got %v", deployer.UiMoveBack, err)
+	}
+	// the buttons are reset after every widget
+	if _, err := ui.Menu(1, "1", "Local"); err == nil || err.Error() == deployer.UiMoveBack {
+		t.Fatalf("unexpected %v", err)
+	}
+	if _, err := ui.GetFromInput("Name", "", "", "Next"); err == nil || err.Error() != deployer.UiNext {
+		t.Fatalf("expected %s, got %v", deployer.UiNext, err)
+	}
+}
+
+func TestOutputError(t *testing.T) {
+	ui := NewScriptedUi()
+	defer func() {
+		e, ok := recover().(*Exit)
+		if !ok {
+			t.Fatal("expected *Exit")
+		}
+		if e.Msg != "failure" {
+			t.Fatalf("unexpected message %s", e.Msg)
+		}
+	}()
+	ui.Output(deployer.UiWarning, "warning")
+	ui.Output(deployer.UiError, "failure")
+}
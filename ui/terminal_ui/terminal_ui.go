@@ -0,0 +1,486 @@
+// Line based user interface suitable for dumb terminals and serial consoles.
+//
+// Every widget prints its title and label followed by a prompt.
+// Pressing <Enter> is equivalent to the "OK" button (keeping the default value
+// if the widget provides one).
+// The following commands are accepted instead of a value:
+//  <  - the help button (treated as "Back" by deployer)
+//  >  - the extra button
+//  !  - cancel (exit)
+
+package terminal_ui
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dorzheh/deployer/deployer"
+	"github.com/dorzheh/deployer/utils/progress"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	cmdHelp   = "<"
+	cmdExtra  = ">"
+	cmdCancel = "!"
+)
+
+// TerminalUi implements deployer.UI interface
+type TerminalUi struct {
+	in   *bufio.Reader
+	inFd int
+	out  io.Writer
+
+	title      string
+	label      string
+	okLabel    string
+	extraLabel string
+	helpLabel  string
+	helpButton bool
+}
+
+// NewTerminalUi creates a user interface communicating
+// over the standard input and output
+func NewTerminalUi() *TerminalUi {
+	ui := NewTerminalUiWithIO(os.Stdin, os.Stdout)
+	ui.inFd = int(os.Stdin.Fd())
+	return ui
+}
+
+// NewTerminalUiWithIO creates a user interface communicating
+// over a given reader and writer
+func NewTerminalUiWithIO(in io.Reader, out io.Writer) *TerminalUi {
+	ui := &TerminalUi{
+		in:   bufio.NewReader(in),
+		inFd: -1,
+		out:  out,
+	}
+	ui.reset()
+	return ui
+}
+
+func (ui *TerminalUi) SetTitle(title string) {
+	ui.title = title
+}
+
+// SetSize is a no-op since the terminal layout is line based
+func (ui *TerminalUi) SetSize(height int, width int) {
+}
+
+func (ui *TerminalUi) SetLabel(label string) {
+	ui.label = label
+}
+
+func (ui *TerminalUi) SetOkLabel(label string) {
+	ui.okLabel = label
+}
+
+func (ui *TerminalUi) SetExtraLabel(label string) {
+	ui.extraLabel = label
+}
+
+func (ui *TerminalUi) HelpButton(truefalse bool) {
+	ui.helpButton = truefalse
+}
+
+func (ui *TerminalUi) SetHelpLabel(label string) {
+	ui.helpLabel = label
+}
+
+func (ui *TerminalUi) Msgbox(text string) {
+	b := ui.begin()
+	fmt.Fprintln(ui.out, strings.Trim(text, "\n"))
+	ui.acknowledge(b)
+}
+
+func (ui *TerminalUi) Textbox(filepath string) error {
+	buf, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		ui.reset()
+		return err
+	}
+	b := ui.begin()
+	fmt.Fprintln(ui.out, strings.TrimRight(string(buf), "\n"))
+	return ui.acknowledge(b)
+}
+
+func (ui *TerminalUi) Inputbox(value string) (string, error) {
+	b := ui.begin()
+	input, err := ui.readInput("Input", value, b)
+	if err != nil {
+		return "", err
+	}
+	if input == "" {
+		return value, nil
+	}
+	return input, nil
+}
+
+func (ui *TerminalUi) Menu(menuHeight int, tagItem ...string) (string, error) {
+	if len(tagItem)%2 != 0 {
+		ui.reset()
+		return "", errors.New("menu items must be represented by tag/item pairs")
+	}
+	b := ui.begin()
+	for i := 0; i < len(tagItem); i += 2 {
+		fmt.Fprintf(ui.out, "  %s) %s\n", tagItem[i], strings.TrimSpace(tagItem[i+1]))
+	}
+	for {
+		input, err := ui.readInput("Select", "", b)
+		if err != nil {
+			return "", err
+		}
+		for i := 0; i < len(tagItem); i += 2 {
+			if input == tagItem[i] {
+				return input, nil
+			}
+		}
+		fmt.Fprintf(ui.out, "Invalid selection \"%s\"\n", input)
+	}
+}
+
+func (ui *TerminalUi) Mixedform(title string, insecure bool, tagItemStatus ...string) ([]string, error) {
+	if len(tagItemStatus)%9 != 0 {
+		ui.reset()
+		return nil, errors.New("each form field must be represented by 9 values")
+	}
+	ui.label = title
+	b := ui.begin()
+
+	var result []string
+	for i := 0; i < len(tagItemStatus); i += 9 {
+		label := strings.TrimSpace(strings.TrimRight(tagItemStatus[i], ": "))
+		item := tagItemStatus[i+3]
+		switch tagItemStatus[i+8] {
+		case "2":
+			fmt.Fprintf(ui.out, "%s: %s\n", label, item)
+			result = append(result, item)
+			continue
+		case "1":
+			fmt.Fprintf(ui.out, "%s%s: ", label, b.hint())
+			input, err := ui.readPassword()
+			if err != nil {
+				return nil, err
+			}
+			if err := b.command(input); err != nil {
+				return nil, err
+			}
+			if input == "" {
+				input = item
+			}
+			result = append(result, input)
+			continue
+		}
+		input, err := ui.readInput(label, item, b)
+		if err != nil {
+			return nil, err
+		}
+		if input == "" {
+			input = item
+		}
+		result = append(result, input)
+	}
+	return result, nil
+}
+
+func (ui *TerminalUi) Yesno() bool {
+	ui.begin()
+	for {
+		fmt.Fprint(ui.out, "[y/n]: ")
+		input, err := ui.readLine()
+		if err != nil {
+			return false
+		}
+		switch strings.ToLower(input) {
+		case "y", "yes":
+			return true
+		case "n", "no", cmdCancel:
+			return false
+		}
+	}
+}
+
+// Output prints out appropriate message.
+// Terminates the program in case of error notification
+func (ui *TerminalUi) Output(ntype string, msgs ...string) {
+	ui.reset()
+	if ntype != deployer.UiNone {
+		fmt.Fprintf(ui.out, "\n%s:\n", ntype)
+	}
+	for _, msg := range msgs {
+		fmt.Fprintln(ui.out, msg)
+	}
+	if ntype == deployer.UiError {
+		os.Exit(1)
+	}
+	ui.acknowledge(&buttons{ok: "OK"})
+}
+
+// Progress prints out the percentage and the stage upon every event
+func (ui *TerminalUi) Progress(title, pbMsg string, events <-chan *progress.Event, done chan error) error {
+	ui.SetTitle(title)
+	ui.SetLabel(pbMsg)
+	ui.begin()
+
+	for {
+		select {
+		case result := <-done:
+			if result != nil {
+				return result
+			}
+			fmt.Fprintln(ui.out, "100% Done!")
+			return nil
+		case e := <-events:
+			fmt.Fprintf(ui.out, "%d%% %s\n", e.Total, e)
+		}
+	}
+}
+
+// Wait prints out the message and waits until the function is executed
+func (ui *TerminalUi) Wait(msg string, pause, timeOut time.Duration, done chan error) error {
+	ui.reset()
+	fmt.Fprintln(ui.out, msg)
+
+	var t <-chan time.Time
+	if timeOut > 0 {
+		t = time.After(timeOut)
+	}
+	select {
+	case result := <-done:
+		return result
+	case <-t:
+		return errors.New("Timeout was reached")
+	}
+}
+
+// GetPathToFileFromInput reads path to an existing file
+func (ui *TerminalUi) GetPathToFileFromInput(title, helpButtonLabel, extraButtonLabel string) (string, error) {
+	for {
+		ui.setButtons(title, helpButtonLabel, extraButtonLabel)
+		result, err := ui.Inputbox("")
+		if err != nil {
+			return result, err
+		}
+		if result != "" {
+			stat, err := os.Stat(result)
+			if err == nil && !stat.IsDir() {
+				return result, nil
+			}
+			fmt.Fprintf(ui.out, "%s is not a file\n", result)
+		}
+	}
+}
+
+// GetPathToDirFromInput reads path to an existing directory
+func (ui *TerminalUi) GetPathToDirFromInput(title, defaultDir, helpButtonLabel, extraButtonLabel string) (string, error) {
+	for {
+		ui.setButtons(title, helpButtonLabel, extraButtonLabel)
+		result, err := ui.Inputbox(defaultDir)
+		if err != nil {
+			return result, err
+		}
+		if result != "" {
+			stat, err := os.Stat(result)
+			if err == nil && stat.IsDir() {
+				return result, nil
+			}
+			fmt.Fprintf(ui.out, "%s is not a directory\n", result)
+		}
+	}
+}
+
+// GetFromInput reads a non-empty string
+func (ui *TerminalUi) GetFromInput(title, defaultInput, helpButtonLabel, extraButtonLabel string) (string, error) {
+	for {
+		ui.setButtons(title, helpButtonLabel, extraButtonLabel)
+		input, err := ui.Inputbox(defaultInput)
+		if err != nil {
+			return input, err
+		}
+		if input != "" {
+			return input, nil
+		}
+	}
+}
+
+// GetPasswordFromInput reads user password.
+// The password is not echoed if the input is a terminal
+func (ui *TerminalUi) GetPasswordFromInput(host, user, helpButtonLabel, extraButtonLabel string, confirm bool) (string, error) {
+	for {
+		ui.setButtons(fmt.Sprintf("\"%s\" password on the host %s", user, host), helpButtonLabel, extraButtonLabel)
+		passwd1, err := ui.passwordbox()
+		if err != nil {
+			return "", err
+		}
+		if passwd1 == "" {
+			continue
+		}
+		if !confirm {
+			return passwd1, nil
+		}
+
+		ui.setButtons("Password confirmation for user \""+user+"\"", "Back", extraButtonLabel)
+		passwd2, err := ui.passwordbox()
+		if err != nil {
+			if err.Error() == deployer.UiMoveBack {
+				continue
+			}
+			return "", err
+		}
+		if passwd1 == passwd2 {
+			return passwd1, nil
+		}
+		fmt.Fprintln(ui.out, "Passwords do not match")
+	}
+}
+
+func (ui *TerminalUi) setButtons(title, helpButtonLabel, extraButtonLabel string) {
+	ui.SetTitle(title)
+	if helpButtonLabel != "" {
+		ui.HelpButton(true)
+		ui.SetHelpLabel(helpButtonLabel)
+	}
+	if extraButtonLabel != "" {
+		ui.SetExtraLabel(extraButtonLabel)
+	}
+}
+
+func (ui *TerminalUi) passwordbox() (string, error) {
+	b := ui.begin()
+	fmt.Fprintf(ui.out, "Password%s: ", b.hint())
+	passwd, err := ui.readPassword()
+	if err != nil {
+		return "", err
+	}
+	if err := b.command(passwd); err != nil {
+		return "", err
+	}
+	return passwd, nil
+}
+
+// buttons represents the buttons of a widget
+type buttons struct {
+	ok string
+
+	// empty if appropriate button is disabled
+	help  string
+	extra string
+}
+
+// hint returns the list of the commands available for the widget
+func (b *buttons) hint() string {
+	var cmds []string
+	if b.help != "" {
+		cmds = append(cmds, cmdHelp+" "+b.help)
+	}
+	if b.extra != "" {
+		cmds = append(cmds, cmdExtra+" "+b.extra)
+	}
+	if len(cmds) == 0 {
+		return ""
+	}
+	cmds = append(cmds, cmdCancel+" Exit")
+	return " (" + strings.Join(cmds, ", ") + ")"
+}
+
+// command converts the input to appropriate navigation error
+func (b *buttons) command(input string) error {
+	switch {
+	case input == cmdCancel:
+		return errors.New(deployer.UiExit)
+	case input == cmdHelp && b.help != "":
+		return errors.New(deployer.UiMoveBack)
+	case input == cmdExtra && b.extra != "":
+		return errors.New(deployer.UiNext)
+	}
+	return nil
+}
+
+// begin prints out the title and the label of the current widget
+// and resets the widget state.
+// Returns the widget buttons
+func (ui *TerminalUi) begin() *buttons {
+	b := &buttons{
+		ok:    ui.okLabel,
+		extra: ui.extraLabel,
+	}
+	if ui.helpButton {
+		b.help = ui.helpLabel
+		if b.help == "" {
+			b.help = "Help"
+		}
+	}
+
+	fmt.Fprintln(ui.out)
+	if ui.title != "" {
+		fmt.Fprintf(ui.out, "=== %s ===\n", ui.title)
+	}
+	if label := strings.Trim(ui.label, "\n"); label != "" {
+		fmt.Fprintln(ui.out, label)
+	}
+	ui.reset()
+	return b
+}
+
+// acknowledge waits for <Enter> or a command
+func (ui *TerminalUi) acknowledge(b *buttons) error {
+	prompt := "Press <Enter> to continue"
+	if b.ok != "OK" || b.hint() != "" {
+		prompt = "<Enter> - " + b.ok
+	}
+	_, err := ui.readInput(prompt, "", b)
+	return err
+}
+
+// readInput prints out the prompt and reads a line.
+// Returns appropriate error if a command is received
+func (ui *TerminalUi) readInput(prompt, defaultValue string, b *buttons) (string, error) {
+	if defaultValue != "" {
+		prompt += " [" + defaultValue + "]"
+	}
+	fmt.Fprintf(ui.out, "%s%s: ", prompt, b.hint())
+	input, err := ui.readLine()
+	if err != nil {
+		return "", err
+	}
+	if err := b.command(input); err != nil {
+		return "", err
+	}
+	return input, nil
+}
+
+func (ui *TerminalUi) readLine() (string, error) {
+	line, err := ui.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		// treat closed input as cancel
+		return "", errors.New(deployer.UiExit)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (ui *TerminalUi) readPassword() (string, error) {
+	if ui.inFd < 0 || !terminal.IsTerminal(ui.inFd) {
+		return ui.readLine()
+	}
+	passwd, err := terminal.ReadPassword(ui.inFd)
+	fmt.Fprintln(ui.out)
+	if err != nil {
+		return "", errors.New(deployer.UiExit)
+	}
+	return string(passwd), nil
+}
+
+func (ui *TerminalUi) reset() {
+	ui.title = ""
+	ui.label = ""
+	ui.okLabel = "OK"
+	ui.extraLabel = ""
+	ui.helpButton = false
+	ui.helpLabel = ""
+}
@@ -0,0 +1,136 @@
+package terminal_ui
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dorzheh/deployer/deployer"
+	"github.com/dorzheh/deployer/utils/progress"
+)
+
+var _ deployer.UI = (*TerminalUi)(nil)
+
+func newTestUi(input ...string) (*TerminalUi, *bytes.Buffer) {
+	out := new(bytes.Buffer)
+	return NewTerminalUiWithIO(strings.NewReader(strings.Join(input, "\n")+"\n"), out), out
+}
+
+func TestMenu(t *testing.T) {
+	ui, out := newTestUi("3", "2")
+	ui.SetTitle("Deployment Mode")
+	res, err := ui.Menu(2, "1", "Local", "2", "Remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "2" {
+		t.Fatalf("expected 2, got %s", res)
+	}
+	if !strings.Contains(out.String(), "=== Deployment Mode ===") {
+		t.Fatalf("title is missing:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "Invalid selection \"3\"") {
+		t.Fatalf("expected invalid selection message:\n%s", out.String())
+	}
+}
+
+func TestMenuNavigation(t *testing.T) {
+	ui, _ := newTestUi("<", "<", ">", "!")
+	// no help button - "<" is treated as invalid selection
+	ui.SetExtraLabel("Next")
+	if _, err := ui.Menu(1, "1", "Local"); err == nil || err.Error() != deployer.UiNext {
+		t.Fatalf("expected %s, got %v", deployer.UiNext, err)
+	}
+
+	ui.HelpButton(true)
+	ui.SetHelpLabel("Back")
+	if _, err := ui.Menu(1, "1", "Local"); err == nil || err.Error() != deployer.UiExit {
+		t.Fatalf("expected %s, got %v", deployer.UiExit, err)
+	}
+
+	ui, _ = newTestUi("<")
+	ui.HelpButton(true)
+	if _, err := ui.Menu(1, "1", "Local"); err == nil || err.Error() != deployer.UiMoveBack {
+		t.Fatalf("expected %s, got %v", deployer.UiMoveBack, err)
+	}
+}
+
+func TestMixedform(t *testing.T) {
+	ui, out := newTestUi("10.0.0.1", "", "admin")
+	res, err := ui.Mixedform("Remote session configuration", false,
+		"IP      : ", "1", "1", "", "1", "10", "22", "0", "0",
+		"SSH Port: ", "2", "1", "22", "2", "10", "22", "0", "0",
+		"Version : ", "3", "1", "1.0", "3", "10", "22", "0", "2",
+		"Username: ", "4", "1", "root", "4", "10", "22", "0", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.1", "22", "1.0", "admin"}
+	if strings.Join(res, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+	if !strings.Contains(out.String(), "SSH Port [22]: ") {
+		t.Fatalf("default value is missing:\n%s", out.String())
+	}
+}
+
+func TestInputbox(t *testing.T) {
+	ui, _ := newTestUi("", "myvm")
+	res, err := ui.Inputbox("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "default" {
+		t.Fatalf("expected default, got %s", res)
+	}
+	if res, _ = ui.Inputbox("default"); res != "myvm" {
+		t.Fatalf("expected myvm, got %s", res)
+	}
+	// end of input
+	if _, err = ui.Inputbox(""); err == nil || err.Error() != deployer.UiExit {
+		t.Fatalf("expected %s, got %v", deployer.UiExit, err)
+	}
+}
+
+func TestYesno(t *testing.T) {
+	ui, _ := newTestUi("maybe", "y", "no")
+	if !ui.Yesno() {
+		t.Fatal("expected true")
+	}
+	if ui.Yesno() {
+		t.Fatal("expected false")
+	}
+}
+
+func TestGetPasswordFromInput(t *testing.T) {
+	ui, out := newTestUi("", "secret", "typo", "secret", "secret")
+	passwd, err := ui.GetPasswordFromInput("10.0.0.1", "root", "", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passwd != "secret" {
+		t.Fatalf("expected secret, got %s", passwd)
+	}
+	if !strings.Contains(out.String(), "Passwords do not match") {
+		t.Fatalf("expected mismatch message:\n%s", out.String())
+	}
+}
+
+func TestProgress(t *testing.T) {
+	ui, out := newTestUi()
+	events := make(chan *progress.Event)
+	done := make(chan error)
+	go func() {
+		events <- &progress.Event{Source: "LocalImageBuilder", Stage: progress.StageMkfs, Total: 10}
+		done <- nil
+	}()
+	if err := ui.Progress("Building artifacts", "Please wait...", events, done); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "10% LocalImageBuilder: create file systems\n") {
+		t.Fatalf("expected the event:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "100% Done!") {
+		t.Fatalf("expected completion message:\n%s", out.String())
+	}
+}
@@ -14,6 +14,7 @@ import (
 	main "github.com/dorzheh/deployer"
 	"github.com/dorzheh/deployer/builder/image"
 	"github.com/dorzheh/deployer/config"
+	"github.com/dorzheh/deployer/config/answers"
 	"github.com/dorzheh/deployer/config/xmlinput"
 	"github.com/dorzheh/deployer/deployer"
 	gui "github.com/dorzheh/deployer/ui/dialog_ui"
@@ -27,21 +28,21 @@ import (
 
 // UiValidateUser intended for validate the ID
 // of the user executing deployer binary
-func UiValidateUser(ui *gui.DialogUi, userId int) {
+func UiValidateUser(ui deployer.UI, userId int) {
 	if err := infrautils.ValidateUserID(userId); err != nil {
 		ui.Output(gui.Error, err.Error())
 	}
 }
 
 // UiWelcomeMsg prints out appropriate welcome message
-func UiWelcomeMsg(ui *gui.DialogUi, name string) {
+func UiWelcomeMsg(ui deployer.UI, name string) {
 	msg := "Welcome to the " + name + " deployment procedure!"
 	ui.SetSize(6, len(msg)+5)
 	ui.Msgbox(msg)
 }
 
 // UiEulaMsg prints out appropriate EULA message
-func UiEulaMsg(ui *gui.DialogUi, pathToEula string) {
+func UiEulaMsg(ui deployer.UI, pathToEula string) {
 	ui.SetOkLabel("Agree")
 	ui.SetExtraLabel("Disagree")
 	ui.SetTitle("End User License Agreement")
@@ -62,7 +63,18 @@ func UiSelectEnv(c *deployer.CommonData, envList []string, envs []deployer.FlowC
 
 	envsNum := len(envs)
 	dType := 0
-	if envsNum > 1 {
+	if envsNum > 1 && c.Answers != nil {
+		dType = -1
+		for i, env := range envList {
+			if env == c.Answers.Environment {
+				dType = i
+				break
+			}
+		}
+		if dType == -1 {
+			return utils.FormatError(fmt.Errorf("unexpected environment \"%s\"", c.Answers.Environment))
+		}
+	} else if envsNum > 1 {
 		c.Ui.SetTitle("Select environment")
 		c.Ui.SetSize(envsNum+7, 30)
 		resStr, err := c.Ui.Menu(envsNum, menuList[0:]...)
@@ -75,17 +87,20 @@ func UiSelectEnv(c *deployer.CommonData, envList []string, envs []deployer.FlowC
 		}
 		dType--
 	}
+	if c.RecordFile != "" {
+		c.Recorded = &answers.Answers{Environment: envList[dType]}
+	}
 	return main.Deploy(c, envs[dType])
 }
 
-func UiDeploymentResult(ui *gui.DialogUi, msg string, err error) {
+func UiDeploymentResult(ui deployer.UI, msg string, err error) {
 	if err != nil {
 		ui.Output(gui.Error, err.Error())
 	}
 	ui.Output(gui.Success, msg)
 }
 
-func UiApplianceName(ui *gui.DialogUi, defaultName string, driver deployer.EnvDriver) (string, error) {
+func UiApplianceName(ui deployer.UI, defaultName string, driver deployer.EnvDriver) (string, error) {
 	var name string
 	var err error
 
@@ -112,7 +127,7 @@ func UiApplianceName(ui *gui.DialogUi, defaultName string, driver deployer.EnvDr
 	return name, nil
 }
 
-func UiImagePath(ui *gui.DialogUi, defaultLocation string, remote bool) (string, error) {
+func UiImagePath(ui deployer.UI, defaultLocation string, remote bool) (string, error) {
 	if remote {
 		return ui.GetFromInput("Select directory on remote server to install the VA image on", defaultLocation, "Back", "")
 	}
@@ -132,7 +147,7 @@ func UiImagePath(ui *gui.DialogUi, defaultLocation string, remote bool) (string,
 	return location, nil
 }
 
-func UiRemoteMode(ui *gui.DialogUi) (bool, error) {
+func UiRemoteMode(ui deployer.UI) (bool, error) {
 	ui.SetTitle("Deployment Mode")
 	ui.SetSize(9, 28)
 	answer, err := ui.Menu(2, "1", "Local", "2", "Remote")
@@ -149,7 +164,7 @@ func UiRemoteMode(ui *gui.DialogUi) (bool, error) {
 	return true, nil
 }
 
-func UiSshConfig(ui *gui.DialogUi) (*sshconf.Config, error) {
+func UiSshConfig(ui deployer.UI) (*sshconf.Config, error) {
 	cfg := new(sshconf.Config)
 	cfg.Port = "22"
 	cfg.User = "root"
@@ -231,7 +246,7 @@ MainLoop:
 	return cfg, nil
 }
 
-func UiNetworks(ui *gui.DialogUi, data *xmlinput.XMLInputData, allowedNics host.NICList, gconf *guest.Config) error {
+func UiNetworks(ui deployer.UI, data *xmlinput.XMLInputData, allowedNics host.NICList, gconf *guest.Config) error {
 	guestPciSlotCounter := data.GuestNic.PCI.FirstSlot
 	lastGuestPciSlotCounter := guestPciSlotCounter
 	portCounter := 1
@@ -313,7 +328,7 @@ MainLoop:
 	return nil
 }
 
-func uiNicSelectMenu(ui *gui.DialogUi, data *xmlinput.XMLInputData, guestPortCounter *int,
+func uiNicSelectMenu(ui deployer.UI, data *xmlinput.XMLInputData, guestPortCounter *int,
 	guestPciSlotCounter *int, hnics host.NICList, net *xmlinput.Network, index int) (guest.NICList, error) {
 	list := make([]string, 0)
 	keeper := make(map[string]*host.NIC)
@@ -449,7 +464,7 @@ func uiNUMAIntToString(numaInt int) string {
 	return numaStr
 }
 
-func uiHeaderSelectNics(ui *gui.DialogUi) int {
+func uiHeaderSelectNics(ui deployer.UI) int {
 	str := " ___________________________________________________________________________________________________________________________"
 	width := len(str)
 	str += "\n|____________________________________________________HOST__________________________________________________________|___VM___|"
@@ -463,7 +478,7 @@ func uiHeaderSelectNics(ui *gui.DialogUi) int {
 	return width
 }
 
-func uiNetworkPolicySelector(ui *gui.DialogUi, net *xmlinput.Network) ([]xmlinput.ConnectionMode, error) {
+func uiNetworkPolicySelector(ui deployer.UI, net *xmlinput.Network) ([]xmlinput.ConnectionMode, error) {
 	matrix := make(map[string][]xmlinput.ConnectionMode)
 	for _, mode := range net.UiModeBinding {
 		if _, ok := matrix[mode.Appear]; !ok {
@@ -501,7 +516,7 @@ func uiNetworkPolicySelector(ui *gui.DialogUi, net *xmlinput.Network) ([]xmlinpu
 	return matrix[temp[resultInt]], nil
 }
 
-func UiGatherHWInfo(ui *gui.DialogUi, hidriver deployer.HostinfoDriver, remote bool) error {
+func UiGatherHWInfo(ui deployer.UI, hidriver deployer.HostinfoDriver, remote bool) error {
 	errCh := make(chan error)
 	defer close(errCh)
 	go func() {
@@ -517,7 +532,7 @@ func UiGatherHWInfo(ui *gui.DialogUi, hidriver deployer.HostinfoDriver, remote b
 	return ui.Wait(msg, time.Second*2, 0, errCh)
 }
 
-func UiVmConfig(ui *gui.DialogUi, driver deployer.HostinfoDriver, xidata *xmlinput.XMLInputData,
+func UiVmConfig(ui deployer.UI, driver deployer.HostinfoDriver, xidata *xmlinput.XMLInputData,
 	pathToMainImage string, sconf *image.Storage, conf *guest.Config) error {
 	var installedRamMb int
 	var maxRAM int
@@ -618,7 +633,7 @@ func UiVmConfig(ui *gui.DialogUi, driver deployer.HostinfoDriver, xidata *xmlinp
 					if uiDiskNotOK(ui, selectedDiskSizeMb, disk.Min, disk.Max) {
 						continue MainLoop
 					}
-					disks = append(disks, selectedDiskSizeMb*1024)
+					disks = append(disks, selectedDiskSizeMb)
 					resultIndex++
 				}
 				if conf.Storage, err = config.StorageConfig(pathToMainImage, 0, sconf, disks); err != nil {
@@ -631,20 +646,16 @@ func UiVmConfig(ui *gui.DialogUi, driver deployer.HostinfoDriver, xidata *xmlinp
 	return nil
 }
 
-func UiVCPUsOvercommit(ui *gui.DialogUi, installedCpus int) bool {
+func UiVCPUsOvercommit(ui deployer.UI, installedCpus int) bool {
 	ui.SetSize(8, 75)
 	ui.SetTitle(gui.Warning)
 	ui.SetLabel(fmt.Sprintf("\nThe host only has %d CPUs.Overcommitting vCPUs can reduce performance!\nWould you like to proceed?", installedCpus))
 	return ui.Yesno()
 }
 
-func uiCpuNotOK(ui *gui.DialogUi, selectedCpus, installedCpus, minCpus, maxCpus int) bool {
-	if selectedCpus < minCpus {
-		ui.Output(gui.Warning, fmt.Sprintf("Minimum vCPUs requirement is %d.", minCpus), "Press <OK> to return to menu.")
-		return true
-	}
-	if selectedCpus > maxCpus {
-		ui.Output(gui.Warning, fmt.Sprintf("Amount of vCPUs exceeds maximum supported vCPUs(%d).", maxCpus), "Press <OK> to return to menu.")
+func uiCpuNotOK(ui deployer.UI, selectedCpus, installedCpus, minCpus, maxCpus int) bool {
+	if err := verifyCpus(selectedCpus, minCpus, maxCpus); err != nil {
+		ui.Output(gui.Warning, err.Error(), "Press <OK> to return to menu.")
 		return true
 	}
 	if selectedCpus > installedCpus {
@@ -655,34 +666,61 @@ func uiCpuNotOK(ui *gui.DialogUi, selectedCpus, installedCpus, minCpus, maxCpus
 	return false
 }
 
-func uiRamNotOK(ui *gui.DialogUi, selectedRamInMb, installedRamMb, minRamInMb, maxRamInMb int) bool {
-	if selectedRamInMb > installedRamMb {
-		ui.Output(gui.Warning, "Required RAM exceeds host machine available memory.", "Press <OK> to return to menu.")
+func verifyCpus(selectedCpus, minCpus, maxCpus int) error {
+	if selectedCpus < minCpus {
+		return fmt.Errorf("Minimum vCPUs requirement is %d.", minCpus)
+	}
+	if selectedCpus > maxCpus {
+		return fmt.Errorf("Amount of vCPUs exceeds maximum supported vCPUs(%d).", maxCpus)
+	}
+	return nil
+}
+
+func uiRamNotOK(ui deployer.UI, selectedRamInMb, installedRamMb, minRamInMb, maxRamInMb int) bool {
+	if err := verifyRam(selectedRamInMb, installedRamMb, minRamInMb, maxRamInMb); err != nil {
+		ui.Output(gui.Warning, err.Error(), "Press <OK> to return to menu.")
 		return true
 	}
+	return false
+}
+
+func verifyRam(selectedRamInMb, installedRamMb, minRamInMb, maxRamInMb int) error {
+	if selectedRamInMb > installedRamMb {
+		return errors.New("Required RAM exceeds host machine available memory.")
+	}
 	if selectedRamInMb < minRamInMb {
-		ui.Output(gui.Warning, fmt.Sprintf("Minimum RAM requirement is %0.1fGB.", float64(minRamInMb)/1024), "Press <OK> to return to menu.")
-		return true
+		return fmt.Errorf("Minimum RAM requirement is %0.1fGB.", float64(minRamInMb)/1024)
 	}
 	if selectedRamInMb > maxRamInMb {
-		ui.Output(gui.Warning, fmt.Sprintf("Maximum RAM requirement is %0.1fGB.", float64(maxRamInMb)/1024), "Press <OK> to return to menu.")
-		return true
+		return fmt.Errorf("Maximum RAM requirement is %0.1fGB.", float64(maxRamInMb)/1024)
 	}
-	return false
+	return nil
 }
 
-func UiNumaRamNotOK(ui *gui.DialogUi, driver deployer.HostinfoDriver, c *guest.Config, selectedRamInMb int) (bool, error) {
-	// file, err := os.Create("/tmp/_setNUMATuneData.txt")
-	// defer file.Close()
+func UiNumaRamNotOK(ui deployer.UI, driver deployer.HostinfoDriver, c *guest.Config, selectedRamInMb int) (bool, error) {
+	warningStr, err := numaRamShortage(driver, c, selectedRamInMb)
+	if err != nil {
+		return true, err
+	}
+	if warningStr != "" {
+		ui.SetTitle(gui.Warning)
+		ui.SetSize(10, 80)
+		ui.SetLabel("Virtual machine configuration can not be optimized.\n" + warningStr + "\n\nDo you want to continue?")
+		return ui.Yesno(), nil
+	}
+	return true, nil
+}
 
+// numaRamShortage verifies that NUMA nodes the physical NICs are bound to
+// have enough free RAM.
+// Returns a warning message if RAM is insufficient
+func numaRamShortage(driver deployer.HostinfoDriver, c *guest.Config, selectedRamInMb int) (string, error) {
 	numas, err := driver.NUMAInfo()
 	if err != nil {
-		return true, utils.FormatError(err)
+		return "", utils.FormatError(err)
 	}
 	NumaForCheck := make([]int, 0)
-	// file.WriteString("uiNumaRamNotOK\n")
 	for _, n := range c.NUMAs {
-		// file.WriteString("c.NUMAs\n")
 		for _, nic := range n.NICs {
 			if nic.HostNIC.Type == host.NicTypePhys || nic.HostNIC.Type == host.NicTypePhysVF {
 				isAdd := true
@@ -693,12 +731,10 @@ func UiNumaRamNotOK(ui *gui.DialogUi, driver deployer.HostinfoDriver, c *guest.C
 				}
 				if isAdd {
 					NumaForCheck = append(NumaForCheck, nic.HostNIC.NUMANode)
-					// file.WriteString("NumaForCheck: [" + strconv.Itoa(nic.HostNIC.NUMANode) + "]\n")
 				}
 			}
 		}
 	}
-	// selectedRamInMb = 1
 	var requiredMemory float64
 	var freeRam float64
 	numberOfNumas := len(NumaForCheck)
@@ -708,45 +744,41 @@ func UiNumaRamNotOK(ui *gui.DialogUi, driver deployer.HostinfoDriver, c *guest.C
 	requiredMemoryMB := selectedRamInMb / numberOfNumas
 	requiredMemory = float64(selectedRamInMb / numberOfNumas)
 	requiredMemoryStr := strconv.FormatFloat((requiredMemory / 1024), 'f', 1, 64)
-	// file.WriteString("requiredMemoryStr: " + requiredMemoryStr + " selectedRamInMb:" + strconv.Itoa(selectedRamInMb) + " \n")
 	for _, node := range numas {
 		for _, CellID := range NumaForCheck {
-			// file.WriteString("CellID: " + strconv.Itoa(CellID) + " node.CellID: " + strconv.Itoa(node.CellID) + "\n")
 			if node.CellID != CellID {
 				continue
 			}
 			numafreeRamMb := node.FreeRAM / 1024
-
-			// file.WriteString("requiredMemoryMB: " + strconv.Itoa(requiredMemoryMB) + " node.FreeRAM:" + strconv.Itoa(numafreeRamMb) + " \n")
-			// numafreeRamMb = 0
 			if numafreeRamMb < requiredMemoryMB {
 				freeRam = float64(node.FreeRAM / (1024 * 1024))
 				freeRamStr := strconv.FormatFloat(freeRam, 'f', 1, 64)
-				ui.SetTitle(gui.Warning)
-				ui.SetSize(10, 80)
-				ui.SetLabel("Virtual machine configuration can not be optimized.\n" + requiredMemoryStr + " GB RAM are required on NUMA " + strconv.Itoa(node.CellID) + " but just " + freeRamStr + "Gb are available\n\nDo you want to continue?")
-				return ui.Yesno(), nil
+				return requiredMemoryStr + " GB RAM are required on NUMA " + strconv.Itoa(node.CellID) + " but just " + freeRamStr + "Gb are available", nil
 			}
 		}
 	}
+	return "", nil
+}
 
-	return true, nil
-
+func uiDiskNotOK(ui deployer.UI, selectedDiskInMb, minDiskInMb, maxDiskInMb int) bool {
+	if err := verifyDisk(selectedDiskInMb, minDiskInMb, maxDiskInMb); err != nil {
+		ui.Output(gui.Warning, err.Error(), "Press <OK> to return to menu.")
+		return true
+	}
+	return false
 }
 
-func uiDiskNotOK(ui *gui.DialogUi, selectedDiskInMb, minDiskInMb, maxDiskInMb int) bool {
+func verifyDisk(selectedDiskInMb, minDiskInMb, maxDiskInMb int) error {
 	if selectedDiskInMb < minDiskInMb {
-		ui.Output(gui.Warning, fmt.Sprintf("Minimum disk size requirement is %dGB.", minDiskInMb/1024), "Press <OK> to return to menu.")
-		return true
+		return fmt.Errorf("Minimum disk size requirement is %dGB.", minDiskInMb/1024)
 	}
 	if selectedDiskInMb > maxDiskInMb {
-		ui.Output(gui.Warning, fmt.Sprintf("Maximum disk size requirement is %dGB.", maxDiskInMb/1024), "Press <OK> to return to menu.")
-		return true
+		return fmt.Errorf("Maximum disk size requirement is %dGB.", maxDiskInMb/1024)
 	}
-	return false
+	return nil
 }
 
-func uiNUMATopologyHeader(ui *gui.DialogUi, c *guest.Config) string {
+func uiNUMATopologyHeader(ui deployer.UI, c *guest.Config) string {
 	ui.HelpButton(true)
 	ui.SetHelpLabel("Back")
 	ui.SetTitle("VA NUMA Configuration")
@@ -773,7 +805,7 @@ func uiNUMATopologyHeader(ui *gui.DialogUi, c *guest.Config) string {
 	return hdr
 }
 
-func uiShowNumaTopologyHelpMsg(ui *gui.DialogUi) {
+func uiShowNumaTopologyHelpMsg(ui deployer.UI) {
 	msg := "CPU Pinning Help\n"
 	msg += "----------------\n\n"
 	msg += "Example 1 : one to one pinning\n\n"
@@ -809,14 +841,14 @@ func uiShowNumaTopologyHelpMsg(ui *gui.DialogUi) {
 	ui.Msgbox(msg)
 }
 
-func UiWarningOnOptimizationFailure(ui *gui.DialogUi, warningStr string) bool {
+func UiWarningOnOptimizationFailure(ui deployer.UI, warningStr string) bool {
 	ui.SetTitle(gui.Warning)
 	ui.SetSize(10, 80)
 	ui.SetLabel("Virtual machine configuration can not be optimized.\n" + warningStr + "\n\nDo you want to continue?")
 	return ui.Yesno()
 }
 
-func UiNUMATopology(ui *gui.DialogUi, c *guest.Config, d deployer.EnvDriver, totalCpusOnHost int) (bool, error) {
+func UiNUMATopology(ui deployer.UI, c *guest.Config, d deployer.EnvDriver, totalCpusOnHost int) (bool, error) {
 	var list []string
 
 	// file, err := os.Create("/tmp/UiNUMATopology.txt")
@@ -915,7 +947,6 @@ MainLoop:
 			return isChanged, err
 		}
 
-	InternalLoop:
 		for {
 			// file.WriteString("[UiNUMATopology] InternalLoop: \n")
 
@@ -1054,46 +1085,10 @@ MainLoop:
 				continue
 			}
 
-			hostCpus := r[1]
-			cpus := make([]int, 0)
-			if strings.Contains(hostCpus, ",") {
-				for _, e := range strings.Split(hostCpus, ",") {
-					if strings.Contains(e, "-") {
-						cpus, err = splitByHypen(e, totalCpusOnHost)
-						if err != nil {
-							ui.Output(gui.Warning, err.Error(), "Press <OK> to return to menu.")
-							continue InternalLoop
-						}
-					} else {
-						cpu, err := strconv.Atoi(e)
-						if err != nil {
-							ui.Output(gui.Warning, "Illegal input \""+e+"\"", "Press <OK> to return to menu.")
-							continue InternalLoop
-						}
-						if err := verifyRange(cpu, totalCpusOnHost); err != nil {
-							ui.Output(gui.Warning, err.Error(), "Press <OK> to return to menu.")
-							continue InternalLoop
-						}
-						cpus = append(cpus, cpu)
-					}
-				}
-			} else if strings.Contains(hostCpus, "-") {
-				cpus, err = splitByHypen(hostCpus, totalCpusOnHost)
-				if err != nil {
-					ui.Output(gui.Warning, err.Error(), "Press <OK> to return to menu.")
-					continue
-				}
-			} else {
-				cpu, err := strconv.Atoi(hostCpus)
-				if err != nil {
-					ui.Output(gui.Warning, "Illegal input \""+hostCpus+"\"", "Press <OK> to return to menu.")
-					continue
-				}
-				if err := verifyRange(cpu, totalCpusOnHost); err != nil {
-					ui.Output(gui.Warning, err.Error(), "Press <OK> to return to menu.")
-					continue
-				}
-				cpus = append(cpus, cpu)
+			cpus, err := parseHostCpus(r[1], totalCpusOnHost)
+			if err != nil {
+				ui.Output(gui.Warning, err.Error(), "Press <OK> to return to menu.")
+				continue
 			}
 
 			// delete the old entry
@@ -1129,6 +1124,32 @@ MainLoop:
 	return isChanged, nil
 }
 
+// parseHostCpus converts host CPU(s) representation (for example "0-3,8")
+// to a slice of CPU numbers
+func parseHostCpus(hostCpus string, totalCpusOnHost int) ([]int, error) {
+	cpus := make([]int, 0)
+	for _, e := range strings.Split(hostCpus, ",") {
+		e = strings.TrimSpace(e)
+		if strings.Contains(e, "-") {
+			rangeCpus, err := splitByHypen(e, totalCpusOnHost)
+			if err != nil {
+				return nil, err
+			}
+			cpus = append(cpus, rangeCpus...)
+		} else {
+			cpu, err := strconv.Atoi(e)
+			if err != nil {
+				return nil, errors.New("Illegal input \"" + e + "\"")
+			}
+			if err := verifyRange(cpu, totalCpusOnHost); err != nil {
+				return nil, err
+			}
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
 func splitByHypen(e string, totalCpusOnHost int) ([]int, error) {
 	cpus := make([]int, 0)
 
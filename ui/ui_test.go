@@ -0,0 +1,104 @@
+package ui
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dorzheh/deployer/config/answers"
+	"github.com/dorzheh/deployer/ui/scripted_ui"
+	"github.com/dorzheh/deployer/utils/hwinfo/host"
+)
+
+func TestUiImagePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ui := scripted_ui.NewScriptedUi("/nonexistent", dir)
+	location, err := UiImagePath(ui, "/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location != dir {
+		t.Fatalf("expected %s, got %s", dir, location)
+	}
+
+	ui = scripted_ui.NewScriptedUi(scripted_ui.Back)
+	if _, err := UiImagePath(ui, "/", false); err == nil || err.Error() != scripted_ui.Back {
+		t.Fatalf("expected %s, got %v", scripted_ui.Back, err)
+	}
+}
+
+func TestUiVCPUsOvercommit(t *testing.T) {
+	ui := scripted_ui.NewScriptedUi("n", "y")
+	if UiVCPUsOvercommit(ui, 2) {
+		t.Fatal("expected false")
+	}
+	if !UiVCPUsOvercommit(ui, 2) {
+		t.Fatal("expected true")
+	}
+	if ui.Last().Type != "yesno" {
+		t.Fatalf("expected yesno widget, got %s", ui.Last().Type)
+	}
+}
+
+func TestAnswerHostNic(t *testing.T) {
+	hnics := host.NICList{
+		{Name: "eth0", PCIAddr: "0000:03:00.0", Type: host.NicTypePhys},
+		{Name: "eth1", PCIAddr: "0000:03:00.1", Type: host.NicTypePhys},
+	}
+
+	a := &answers.Answers{}
+	hnic, err := answerHostNic(a, hnics, &answers.NIC{Name: "eth1", PCIAddr: "0000:03:00.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hnic != hnics[1] {
+		t.Fatalf("unexpected NIC %v", hnic)
+	}
+
+	// renamed interface
+	if _, err := answerHostNic(a, hnics, &answers.NIC{Name: "ens3", PCIAddr: "0000:03:00.0"}); err == nil {
+		t.Fatal("expected mismatch error")
+	}
+	a.AcceptWarnings = true
+	if hnic, err = answerHostNic(a, hnics, &answers.NIC{Name: "ens3", PCIAddr: "0000:03:00.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if hnic != hnics[0] {
+		t.Fatalf("unexpected NIC %v", hnic)
+	}
+
+	// PCI address not found, resolved by name
+	if hnic, err = answerHostNic(a, hnics, &answers.NIC{Name: "eth1", PCIAddr: "0000:04:00.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if hnic != hnics[1] {
+		t.Fatalf("unexpected NIC %v", hnic)
+	}
+	if len(a.Warnings) != 2 {
+		t.Fatalf("expected 2 warnings, got %v", a.Warnings)
+	}
+
+	if _, err := answerHostNic(a, hnics, &answers.NIC{Name: "eth5", PCIAddr: "0000:05:00.0"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestAnswerSshPassword(t *testing.T) {
+	a := &answers.Answers{RemoteMode: true, Ssh: &answers.Ssh{Host: "10.0.0.1", AskPassword: true}}
+	ui := scripted_ui.NewScriptedUi("secret")
+	if err := AnswerSshPassword(ui, a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Ssh.Password != "secret" {
+		t.Fatalf("unexpected password %q", a.Ssh.Password)
+	}
+	// the password is asked once
+	if err := AnswerSshPassword(ui, a); err != nil {
+		t.Fatal(err)
+	}
+}
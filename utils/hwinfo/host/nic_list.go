@@ -35,7 +35,7 @@ func (list NICList) IndexByPCI(pciaddr string) (int, error) {
 	f := func(i int) bool {
 		return list[i].PCIAddr >= pciaddr
 	}
-	if i := sort.Search(len(list), f); list[i].PCIAddr == pciaddr {
+	if i := sort.Search(len(list), f); i < len(list) && list[i].PCIAddr == pciaddr {
 		return i, nil
 	}
 	return -1, utils.FormatError(fmt.Errorf("index for PCIAddr %s not found", pciaddr))
@@ -46,7 +46,7 @@ func (list NICList) IndexByName(name string) (int, error) {
 	f := func(i int) bool {
 		return list[i].Name >= name
 	}
-	if i := sort.Search(len(list), f); list[i].Name == name {
+	if i := sort.Search(len(list), f); i < len(list) && list[i].Name == name {
 		return i, nil
 	}
 	return -1, utils.FormatError(fmt.Errorf("index for Name %s not found", name))
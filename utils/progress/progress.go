@@ -0,0 +1,137 @@
+// Progress events emitted by builders and post-processors
+
+package progress
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Stage represents a step of the build or the post-processing
+type Stage string
+
+const (
+	StageCreate      Stage = "create image"
+	StageGrow        Stage = "grow image"
+	StagePartition   Stage = "partition"
+	StageMkfs        Stage = "create file systems"
+	StageFillRootfs  Stage = "customize rootfs"
+	StageInstallApp  Stage = "install application"
+	StageBootloader  Stage = "install bootloader"
+	StageHooks       Stage = "run hooks"
+	StageConvert     Stage = "convert image"
+	StageMetadata    Stage = "write metadata"
+	StageDefine      Stage = "define domain"
+	StageAutostart   Stage = "set autostart"
+	StageStartDomain Stage = "start domain"
+	StagePackage     Stage = "package appliance"
+	StageDone        Stage = "done"
+	StageFailed      Stage = "failed"
+)
+
+// Event is emitted once a source (builder or post-processor) enters a stage
+type Event struct {
+	Time time.Time `json:"time"`
+
+	// Source is the ID of the builder or the post-processor
+	Source string `json:"source"`
+
+	Stage Stage `json:"stage"`
+
+	// Percent represents the progress of the source.
+	// Every stage starts at a fixed percentage, the long running stages
+	// (rootfs customization, image conversion) report their progress
+	// up to the percentage the next stage starts at
+	Percent int `json:"percent"`
+
+	// Total represents the overall progress of all the sources (see Tracker)
+	Total int `json:"total"`
+
+	// Error is set for StageFailed
+	Error string `json:"error,omitempty"`
+}
+
+func (e *Event) String() string {
+	if e.Source == "" {
+		return string(e.Stage)
+	}
+	return e.Source + ": " + string(e.Stage)
+}
+
+type eventsKey struct{}
+
+type sourceKey struct{}
+
+// WithEvents returns a copy of the context the events are reported to.
+func WithEvents(ctx context.Context, events chan<- *Event) context.Context {
+	return context.WithValue(ctx, eventsKey{}, events)
+}
+
+// WithSource returns a copy of the context setting the source of the events.
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// Report emits an event in case the context carries the events channel
+func Report(ctx context.Context, stage Stage, percent int) {
+	report(ctx, &Event{Stage: stage, Percent: percent})
+}
+
+// Scale returns the percentage the given part (0-100) of a stage
+// reported between from and to corresponds to
+func Scale(from, to, part int) int {
+	if part < 0 {
+		part = 0
+	} else if part > 100 {
+		part = 100
+	}
+	return from + (to-from)*part/100
+}
+
+// ReportError emits StageFailed event
+func ReportError(ctx context.Context, err error) {
+	report(ctx, &Event{Stage: StageFailed, Error: err.Error()})
+}
+
+func report(ctx context.Context, e *Event) {
+	events, ok := ctx.Value(eventsKey{}).(chan<- *Event)
+	if !ok {
+		return
+	}
+	e.Time = time.Now()
+	e.Source, _ = ctx.Value(sourceKey{}).(string)
+	events <- e
+}
+
+// Tracker calculates the overall progress of a given amount of sources
+type Tracker struct {
+	sync.Mutex
+	sources  int
+	percents map[string]int
+}
+
+func NewTracker(sources int) *Tracker {
+	if sources < 1 {
+		sources = 1
+	}
+	return &Tracker{sources: sources, percents: make(map[string]int)}
+}
+
+// Update records the source progress and sets the overall progress of the event
+func (t *Tracker) Update(e *Event) {
+	t.Lock()
+	defer t.Unlock()
+
+	if e.Stage != StageFailed {
+		t.percents[e.Source] = e.Percent
+	}
+	sum := 0
+	for _, p := range t.percents {
+		sum += p
+	}
+	e.Total = sum / t.sources
+	if e.Total > 100 {
+		e.Total = 100
+	}
+}
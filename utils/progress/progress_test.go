@@ -0,0 +1,47 @@
+package progress
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	// no events channel
+	Report(context.Background(), StageCreate, 0)
+
+	events := make(chan *Event, 2)
+	ctx := WithSource(WithEvents(context.Background(), events), "LocalImageBuilder")
+	Report(ctx, StageMkfs, 10)
+	ReportError(ctx, errors.New("mkfs failed"))
+
+	e := <-events
+	if e.Source != "LocalImageBuilder" || e.Stage != StageMkfs || e.Percent != 10 || e.Time.IsZero() {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if e.String() != "LocalImageBuilder: create file systems" {
+		t.Fatalf("unexpected event string %s", e)
+	}
+	if e = <-events; e.Stage != StageFailed || e.Error != "mkfs failed" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tr := NewTracker(2)
+	for _, c := range []struct {
+		e     *Event
+		total int
+	}{
+		{&Event{Source: "a", Stage: StageMkfs, Percent: 10}, 5},
+		{&Event{Source: "b", Stage: StageMetadata, Percent: 0}, 5},
+		{&Event{Source: "a", Stage: StageDone, Percent: 100}, 50},
+		{&Event{Source: "b", Stage: StageFailed}, 50},
+		{&Event{Source: "b", Stage: StageDone, Percent: 100}, 100},
+	} {
+		tr.Update(c.e)
+		if c.e.Total != c.total {
+			t.Fatalf("expected total %d for %+v, got %d", c.total, c.e, c.e.Total)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os/exec"
 	"strings"
 
@@ -13,29 +15,68 @@ import (
 // RunFunc is a generic solution for running appropriate commands
 // on local or remote host
 func RunFunc(config *sshconf.Config) func(string) (string, error) {
+	return RunFuncWithContext(context.Background(), config)
+}
+
+// RunFuncWithContext is similar to RunFunc.
+// Once the context is cancelled the running command is interrupted
+// (local process is killed, remote connection is closed)
+// and no further commands are executed.
+func RunFuncWithContext(ctx context.Context, config *sshconf.Config) func(string) (string, error) {
+	run := RunStreamFuncWithContext(ctx, config)
+	return func(command string) (string, error) {
+		return run(command, nil, nil)
+	}
+}
+
+// RunStreamFuncWithContext is similar to RunFuncWithContext.
+// The command reads its standard input from stdin and its standard output
+// is copied to stdout while the command runs. Both might be nil.
+func RunStreamFuncWithContext(ctx context.Context, config *sshconf.Config) func(string, io.Reader, io.Writer) (string, error) {
 	if config == nil {
-		return func(command string) (string, error) {
+		return func(command string, stdin io.Reader, out io.Writer) (string, error) {
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
 			var stderr bytes.Buffer
 			var stdout bytes.Buffer
-			c := exec.Command("/bin/bash", "-c", command)
+			c := exec.CommandContext(ctx, "/bin/bash", "-c", command)
+			c.Stdin = stdin
 			c.Stderr = &stderr
-			c.Stdout = &stdout
+			c.Stdout = teeWriter(&stdout, out)
 			if err := c.Start(); err != nil {
 				return "", FormatError(err)
 			}
 			if err := c.Wait(); err != nil {
+				if ctx.Err() != nil {
+					return "", fmt.Errorf("executing %s  : %s", command, ctx.Err())
+				}
 				return "", fmt.Errorf("executing %s  : %s [%s]", command, stderr.String(), err)
 			}
 			return strings.TrimSpace(stdout.String()), nil
 		}
 	}
-	return func(command string) (string, error) {
+	return func(command string, stdin io.Reader, out io.Writer) (string, error) {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
 		c, err := ssh.NewSshConn(config)
 		if err != nil {
 			return "", FormatError(err)
 		}
 		defer c.ConnClose()
 
+		// close the connection once the context is cancelled
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.ConnClose()
+			case <-done:
+			}
+		}()
+
 		var cmd string
 		if strings.TrimSpace(config.User) == "root" {
 			cmd = command
@@ -44,10 +85,30 @@ func RunFunc(config *sshconf.Config) func(string) (string, error) {
 			cmd = "sudo " + command
 		}
 
-		outstr, errstr, err := c.Run(cmd)
+		session, err := c.Client.NewSession()
 		if err != nil {
-			return "", fmt.Errorf("executing %s : %s [%s]", cmd, errstr, err)
+			return "", FormatError(err)
+		}
+		defer session.Close()
+		var stderr bytes.Buffer
+		var stdout bytes.Buffer
+		session.Stdin = stdin
+		session.Stderr = &stderr
+		session.Stdout = teeWriter(&stdout, out)
+		if err := session.Run(cmd); err != nil {
+			if ctx.Err() != nil {
+				return "", fmt.Errorf("executing %s : %s", cmd, ctx.Err())
+			}
+			return "", fmt.Errorf("executing %s : %s [%s]", cmd, stderr.String(), err)
 		}
-		return strings.TrimSpace(outstr), nil
+		return strings.TrimSpace(stdout.String()), nil
+	}
+}
+
+// teeWriter returns the writer copying to out as well unless out is nil
+func teeWriter(w io.Writer, out io.Writer) io.Writer {
+	if out == nil {
+		return w
 	}
+	return io.MultiWriter(w, out)
 }
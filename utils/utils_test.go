@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"context"
 	"log"
 	"testing"
+	"time"
 )
 
 var str = `
@@ -30,3 +32,20 @@ func TestProcessTemplate(t *testing.T) {
 	}
 	log.Printf("DEBUG: %s\n", out)
 }
+
+func TestRunFuncWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	run := RunFuncWithContext(ctx, nil)
+	start := time.Now()
+	if _, err := run("sleep 10"); err == nil {
+		t.Fatal("expected error")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("the command is not interrupted")
+	}
+	if _, err := run("true"); err == nil {
+		t.Fatal("expected error since the context is cancelled")
+	}
+}